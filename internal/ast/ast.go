@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/TheAlchemistKE/helios/internal/token"
 	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -26,6 +27,89 @@ type Expression interface {
 	expressionNode()
 }
 
+// TokenOf returns the token a node was parsed from, which carries the
+// node's source position. Nodes without a token of their own return the
+// zero Token.
+func TokenOf(node Node) token.Token {
+	switch n := node.(type) {
+	case *Identifier:
+		return n.Token
+	case *LetStatement:
+		return n.Token
+	case *ReturnStatement:
+		return n.Token
+	case *ExpressionStatement:
+		return n.Token
+	case *IntegerLiteral:
+		return n.Token
+	case *FloatLiteral:
+		return n.Token
+	case *PrefixExpression:
+		return n.Token
+	case *InfixExpression:
+		return n.Token
+	case *Boolean:
+		return n.Token
+	case *IfExpression:
+		return n.Token
+	case *BlockStatement:
+		return n.Token
+	case *FunctionLiteral:
+		return n.Token
+	case *FunctionStatement:
+		return n.Token
+	case *CallExpression:
+		return n.Token
+	case *StringLiteral:
+		return n.Token
+	case *ArrayLiteral:
+		return n.Token
+	case *IndexExpression:
+		return n.Token
+	case *MemberExpression:
+		return n.Token
+	case *HashLiteral:
+		return n.Token
+	case *ForExpression:
+		return n.Token
+	case *Assignment:
+		return n.Token
+	case *NullLiteral:
+		return n.Token
+	case *TernaryExpression:
+		return n.Token
+	case *WhileExpression:
+		return n.Token
+	case *TypeExpression:
+		return n.Token
+	case *TryCatchExpression:
+		return n.Token
+	case *EnumStatement:
+		return n.Token
+	case *MatchExpression:
+		return n.Token
+	case *WildcardPattern:
+		return n.Token
+	case *BindingPattern:
+		return n.Token
+	case *VariantPattern:
+		return n.Token
+	case *LiteralPattern:
+		return n.Token
+	case *ArrayPattern:
+		return n.Token
+	case *HashPattern:
+		return n.Token
+	case *DefaultPattern:
+		return n.Token
+	case *ImportStatement:
+		return n.Token
+	case *ExportStatement:
+		return n.Token
+	}
+	return token.Token{}
+}
+
 // Program represents the root node of every AST our parser produces
 type Program struct {
 	Statements []Statement
@@ -61,11 +145,15 @@ func (i *Identifier) expressionNode()      {}
 func (i *Identifier) TokenLiteral() string { return i.Token.Literal }
 func (i *Identifier) String() string       { return i.Value }
 
-// LetStatement represents a let statement in the AST
+// LetStatement represents a let statement in the AST. Destructuring lets
+// such as `let [a, b] = xs;` set Pattern instead of Name. Type is the
+// annotation of `let x: int = 1;`, nil if there is none.
 type LetStatement struct {
-	Token token.Token // the token.LET token
-	Name  *Identifier
-	Value Expression
+	Token   token.Token // the token.LET token
+	Name    *Identifier
+	Type    *TypeExpression
+	Pattern Pattern
+	Value   Expression
 }
 
 func (ls *LetStatement) statementNode()       {}
@@ -74,7 +162,14 @@ func (ls *LetStatement) String() string {
 	var out bytes.Buffer
 
 	out.WriteString(ls.TokenLiteral() + " ")
-	out.WriteString(ls.Name.String())
+	if ls.Pattern != nil {
+		out.WriteString(ls.Pattern.String())
+	} else {
+		out.WriteString(ls.Name.String())
+	}
+	if ls.Type != nil {
+		out.WriteString(": " + ls.Type.String())
+	}
 	out.WriteString(" = ")
 
 	if ls.Value != nil {
@@ -236,24 +331,49 @@ func (bs *BlockStatement) String() string {
 	return out.String()
 }
 
-// FunctionLiteral represents a function literal
+// FunctionLiteral represents a function literal. Defaults runs parallel to
+// Parameters and holds nil for parameters without a default value; Types
+// does the same for annotations such as `n: int`. Variadic is the trailing
+// `...name` parameter, if any. Name is the name the function is bound to by
+// a let statement or declaration, empty for anonymous functions.
 type FunctionLiteral struct {
 	Token      token.Token // The 'fn' token
+	Name       string
 	Parameters []*Identifier
+	Types      []*TypeExpression
+	Defaults   []Expression
+	Variadic   *Identifier
 	Body       *BlockStatement
 }
 
 func (fl *FunctionLiteral) expressionNode()      {}
 func (fl *FunctionLiteral) TokenLiteral() string { return fl.Token.Literal }
-func (fl *FunctionLiteral) String() string {
+func (fl *FunctionLiteral) String() string       { return fl.format("") }
+
+// format renders the function, placing name between `fn` and the parameter
+// list when it is not empty.
+func (fl *FunctionLiteral) format(name string) string {
 	var out bytes.Buffer
 
 	params := []string{}
-	for _, p := range fl.Parameters {
-		params = append(params, p.String())
+	for i, p := range fl.Parameters {
+		param := p.String()
+		if i < len(fl.Types) && fl.Types[i] != nil {
+			param += ": " + fl.Types[i].String()
+		}
+		if i < len(fl.Defaults) && fl.Defaults[i] != nil {
+			param += " = " + fl.Defaults[i].String()
+		}
+		params = append(params, param)
+	}
+	if fl.Variadic != nil {
+		params = append(params, "..."+fl.Variadic.String())
 	}
 
 	out.WriteString(fl.TokenLiteral())
+	if name != "" {
+		out.WriteString(" " + name)
+	}
 	out.WriteString("(")
 	out.WriteString(strings.Join(params, ", "))
 	out.WriteString(") ")
@@ -268,11 +388,26 @@ func (fl *FunctionLiteral) String() string {
 	return out.String()
 }
 
+// FunctionStatement represents a named function declaration such as
+// `fn add(a, b) { a + b }`, which binds Function to Name in the current scope.
+type FunctionStatement struct {
+	Token    token.Token // The 'fn' token
+	Name     *Identifier
+	Function *FunctionLiteral
+}
+
+func (fs *FunctionStatement) statementNode()       {}
+func (fs *FunctionStatement) TokenLiteral() string { return fs.Token.Literal }
+func (fs *FunctionStatement) String() string {
+	return fs.Function.format(fs.Name.String())
+}
+
 // CallExpression represents a function call
 type CallExpression struct {
-	Token     token.Token // The '(' token
-	Function  Expression  // Identifier or FunctionLiteral
-	Arguments []Expression
+	Token            token.Token // The '(' token
+	Function         Expression  // Identifier or FunctionLiteral
+	Arguments        []Expression
+	KeywordArguments []*KeywordArgument
 }
 
 func (ce *CallExpression) expressionNode()      {}
@@ -284,6 +419,9 @@ func (ce *CallExpression) String() string {
 	for _, a := range ce.Arguments {
 		args = append(args, a.String())
 	}
+	for _, ka := range ce.KeywordArguments {
+		args = append(args, ka.String())
+	}
 
 	out.WriteString(ce.Function.String())
 	out.WriteString("(")
@@ -293,6 +431,16 @@ func (ce *CallExpression) String() string {
 	return out.String()
 }
 
+// KeywordArgument represents a `name: value` argument at a call site
+type KeywordArgument struct {
+	Name  *Identifier
+	Value Expression
+}
+
+func (ka *KeywordArgument) String() string {
+	return ka.Name.String() + ": " + ka.Value.String()
+}
+
 // StringLiteral represents a string literal
 type StringLiteral struct {
 	Token token.Token
@@ -347,6 +495,19 @@ func (ie *IndexExpression) String() string {
 	return out.String()
 }
 
+// MemberExpression represents access to a named member, as in `math.add`
+type MemberExpression struct {
+	Token    token.Token // The . token
+	Object   Expression
+	Property *Identifier
+}
+
+func (me *MemberExpression) expressionNode()      {}
+func (me *MemberExpression) TokenLiteral() string { return me.Token.Literal }
+func (me *MemberExpression) String() string {
+	return me.Object.String() + "." + me.Property.String()
+}
+
 // HashLiteral represents a hash literal
 type HashLiteral struct {
 	Token token.Token // the '{' token
@@ -518,3 +679,250 @@ func (tce *TryCatchExpression) String() string {
 
 	return out.String()
 }
+
+// EnumStatement represents an enum declaration such as
+// `enum Shape { Circle(r), Rect(w, h) }`
+type EnumStatement struct {
+	Token    token.Token // the 'enum' token
+	Name     *Identifier
+	Variants []*EnumVariant
+}
+
+func (es *EnumStatement) statementNode()       {}
+func (es *EnumStatement) TokenLiteral() string { return es.Token.Literal }
+func (es *EnumStatement) String() string {
+	var out bytes.Buffer
+
+	variants := []string{}
+	for _, v := range es.Variants {
+		variants = append(variants, v.String())
+	}
+
+	out.WriteString("enum ")
+	out.WriteString(es.Name.String())
+	out.WriteString(" { ")
+	out.WriteString(strings.Join(variants, ", "))
+	out.WriteString(" }")
+
+	return out.String()
+}
+
+// EnumVariant represents a single case of an enum declaration
+type EnumVariant struct {
+	Name   *Identifier
+	Fields []*Identifier
+}
+
+func (ev *EnumVariant) String() string {
+	if len(ev.Fields) == 0 {
+		return ev.Name.String()
+	}
+
+	fields := []string{}
+	for _, f := range ev.Fields {
+		fields = append(fields, f.String())
+	}
+
+	return ev.Name.String() + "(" + strings.Join(fields, ", ") + ")"
+}
+
+// MatchExpression represents a match expression
+type MatchExpression struct {
+	Token   token.Token // the 'match' token
+	Subject Expression
+	Arms    []*MatchArm
+}
+
+func (me *MatchExpression) expressionNode()      {}
+func (me *MatchExpression) TokenLiteral() string { return me.Token.Literal }
+func (me *MatchExpression) String() string {
+	var out bytes.Buffer
+
+	arms := []string{}
+	for _, a := range me.Arms {
+		arms = append(arms, a.String())
+	}
+
+	out.WriteString("match ")
+	out.WriteString(me.Subject.String())
+	out.WriteString(" { ")
+	out.WriteString(strings.Join(arms, ", "))
+	out.WriteString(" }")
+
+	return out.String()
+}
+
+// MatchArm represents a single `pattern if guard => body` arm of a match
+// expression. Guard is nil when the arm has no guard.
+type MatchArm struct {
+	Token   token.Token // the '=>' token
+	Pattern Pattern
+	Guard   Expression
+	Body    *BlockStatement
+}
+
+func (ma *MatchArm) String() string {
+	if ma.Guard != nil {
+		return ma.Pattern.String() + " if " + ma.Guard.String() + " => " + ma.Body.String()
+	}
+	return ma.Pattern.String() + " => " + ma.Body.String()
+}
+
+// Pattern represents a pattern in a match arm
+type Pattern interface {
+	Node
+	patternNode()
+}
+
+// WildcardPattern matches any value without binding it
+type WildcardPattern struct {
+	Token token.Token // the '_' token
+}
+
+func (wp *WildcardPattern) patternNode()         {}
+func (wp *WildcardPattern) TokenLiteral() string { return wp.Token.Literal }
+func (wp *WildcardPattern) String() string       { return "_" }
+
+// BindingPattern matches any value and binds it to Name. When Name refers
+// to a variant without fields it matches that variant instead.
+type BindingPattern struct {
+	Token token.Token
+	Name  *Identifier
+}
+
+func (bp *BindingPattern) patternNode()         {}
+func (bp *BindingPattern) TokenLiteral() string { return bp.Token.Literal }
+func (bp *BindingPattern) String() string       { return bp.Name.String() }
+
+// VariantPattern matches an enum variant and destructures its fields.
+// Module is set for a variant of an imported enum, whose Fields are nil when
+// it is named without parentheses.
+type VariantPattern struct {
+	Token  token.Token
+	Module *Identifier
+	Name   *Identifier
+	Fields []Pattern
+}
+
+func (vp *VariantPattern) patternNode()         {}
+func (vp *VariantPattern) TokenLiteral() string { return vp.Token.Literal }
+func (vp *VariantPattern) String() string {
+	fields := []string{}
+	for _, f := range vp.Fields {
+		fields = append(fields, f.String())
+	}
+
+	name := vp.Name.String()
+	if vp.Module != nil {
+		name = vp.Module.String() + "." + name
+		if vp.Fields == nil {
+			return name
+		}
+	}
+
+	return name + "(" + strings.Join(fields, ", ") + ")"
+}
+
+// LiteralPattern matches values equal to a literal
+type LiteralPattern struct {
+	Token token.Token
+	Value Expression
+}
+
+func (lp *LiteralPattern) patternNode()         {}
+func (lp *LiteralPattern) TokenLiteral() string { return lp.Token.Literal }
+func (lp *LiteralPattern) String() string       { return lp.Value.String() }
+
+// ArrayPattern matches arrays element by element. Rest, when present, is
+// bound to the elements left over after Elements and lets the pattern match
+// longer arrays.
+type ArrayPattern struct {
+	Token    token.Token // the '[' token
+	Elements []Pattern
+	Rest     Pattern
+}
+
+func (ap *ArrayPattern) patternNode()         {}
+func (ap *ArrayPattern) TokenLiteral() string { return ap.Token.Literal }
+func (ap *ArrayPattern) String() string {
+	elements := []string{}
+	for _, el := range ap.Elements {
+		elements = append(elements, el.String())
+	}
+
+	if ap.Rest != nil {
+		if _, ok := ap.Rest.(*WildcardPattern); ok {
+			elements = append(elements, "..")
+		} else {
+			elements = append(elements, ".."+ap.Rest.String())
+		}
+	}
+
+	return "[" + strings.Join(elements, ", ") + "]"
+}
+
+// HashPattern matches hashes that contain every key in Pairs
+type HashPattern struct {
+	Token token.Token // the '{' token
+	Pairs []*HashPatternPair
+}
+
+// HashPatternPair pairs a literal key with the pattern its value must match
+type HashPatternPair struct {
+	Key   Expression
+	Value Pattern
+}
+
+func (hp *HashPattern) patternNode()         {}
+func (hp *HashPattern) TokenLiteral() string { return hp.Token.Literal }
+func (hp *HashPattern) String() string {
+	pairs := []string{}
+	for _, pair := range hp.Pairs {
+		pairs = append(pairs, pair.Key.String()+": "+pair.Value.String())
+	}
+
+	return "{" + strings.Join(pairs, ", ") + "}"
+}
+
+// DefaultPattern matches Pattern against the value it is applied to, or
+// against Default when that value is missing or null
+type DefaultPattern struct {
+	Token   token.Token // the '=' token
+	Pattern Pattern
+	Default Expression
+}
+
+func (dp *DefaultPattern) patternNode()         {}
+func (dp *DefaultPattern) TokenLiteral() string { return dp.Token.Literal }
+func (dp *DefaultPattern) String() string {
+	return dp.Pattern.String() + " = " + dp.Default.String()
+}
+
+// ImportStatement represents `import "path/to/mod"` or `import name "path"`.
+// Name is nil when the binding is derived from the last element of Path.
+type ImportStatement struct {
+	Token token.Token // The 'import' token
+	Name  *Identifier
+	Path  string
+}
+
+func (is *ImportStatement) statementNode()       {}
+func (is *ImportStatement) TokenLiteral() string { return is.Token.Literal }
+func (is *ImportStatement) String() string {
+	if is.Name != nil {
+		return is.TokenLiteral() + " " + is.Name.String() + " " + strconv.Quote(is.Path)
+	}
+	return is.TokenLiteral() + " " + strconv.Quote(is.Path)
+}
+
+// ExportStatement marks a let or fn declaration as visible to importers
+type ExportStatement struct {
+	Token     token.Token // The 'export' token
+	Statement Statement
+}
+
+func (es *ExportStatement) statementNode()       {}
+func (es *ExportStatement) TokenLiteral() string { return es.Token.Literal }
+func (es *ExportStatement) String() string {
+	return es.TokenLiteral() + " " + es.Statement.String()
+}
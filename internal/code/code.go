@@ -34,9 +34,11 @@ const (
 	OpMinus // Unary minus
 	OpBang  // Logical NOT
 
-	// Jumps for control flow
+	// Jumps for control flow. OpJumpSupplied jumps if the argument in a
+	// parameter's local slot was passed, skipping the code of its default.
 	OpJumpNotTruthy
 	OpJump
+	OpJumpSupplied
 
 	// Null value
 	OpNull
@@ -60,6 +62,68 @@ const (
 	OpReturn
 	OpClosure
 	OpCurrentClosure
+	OpCallKeywords
+	OpSetFree
+
+	// OpTailCall is an OpCall whose result is returned straight away. A
+	// closure called this way takes over the caller's frame.
+	// OpTailCallKeywords is the same for an OpCallKeywords.
+	OpTailCall
+	OpTailCallKeywords
+
+	// Pattern matching
+	OpMatchVariant
+	OpMatchArray
+	OpMatchHash
+	OpSlice
+	OpFail
+
+	// OpWide prefixes an instruction whose operands are twice their usual
+	// width, for indices and jump targets that do not fit the narrow form
+	OpWide
+
+	// Superinstructions do the work of a common sequence of instructions
+	// in one dispatch, see the compiler's fuse pass. A jump's target is
+	// always its last operand.
+
+	// OpGetLocalPair is OpGetLocal a, OpGetLocal b
+	OpGetLocalPair
+	// OpLocalAddConstant is OpGetLocal, OpConstant, OpAdd
+	OpLocalAddConstant
+	// OpLocalSubConstant is OpGetLocal, OpConstant, OpSub
+	OpLocalSubConstant
+	// OpJumpNotGreater is OpGreaterThan, OpJumpNotTruthy
+	OpJumpNotGreater
+	// OpJumpNotEqual is OpEqual, OpJumpNotTruthy
+	OpJumpNotEqual
+	// OpJumpLocalsNotGreater is OpGetLocal a, OpGetLocal b, OpGreaterThan,
+	// OpJumpNotTruthy
+	OpJumpLocalsNotGreater
+	// OpReturnLocal is OpGetLocal, OpReturnValue
+	OpReturnLocal
+
+	// The Int operations are for operands the compiler has proven to be
+	// integers. They skip the type dispatch of the generic forms.
+	OpAddInt
+	OpSubInt
+	OpMulInt
+	OpDivInt
+	OpGreaterThanInt
+	OpEqualInt
+	OpNotEqualInt
+
+	// OpCheckType fails unless the value on top of the stack has the type
+	// of an annotation, an index into object.Annotations. OpCheckLocal
+	// checks a local instead.
+	OpCheckType
+	OpCheckLocal
+
+	// OpGetCallerLocal and OpGetCallerFree load a local or free variable of
+	// the function that defined the running closure, from its frame below
+	// the closure's own. The compiler only emits them in closures that
+	// never escape that function, see object.CompiledFunction.ReadsCaller.
+	OpGetCallerLocal
+	OpGetCallerFree
 )
 
 // Definition holds info about an opcode and its operands
@@ -85,6 +149,7 @@ var definitions = map[Opcode]*Definition{
 	OpBang:           {"OpBang", []int{}},
 	OpJumpNotTruthy:  {"OpJumpNotTruthy", []int{2}},
 	OpJump:           {"OpJump", []int{2}},
+	OpJumpSupplied:   {"OpJumpSupplied", []int{1, 2}},
 	OpNull:           {"OpNull", []int{}},
 	OpGetGlobal:      {"OpGetGlobal", []int{2}},
 	OpSetGlobal:      {"OpSetGlobal", []int{2}},
@@ -100,6 +165,63 @@ var definitions = map[Opcode]*Definition{
 	OpClosure:        {"OpClosure", []int{2, 1}},
 	OpGetFree:        {"OpGetFree", []int{1}},
 	OpCurrentClosure: {"OpCurrentClosure", []int{}},
+	OpCallKeywords:   {"OpCallKeywords", []int{1, 2}},
+	OpSetFree:        {"OpSetFree", []int{1}},
+	OpTailCall:       {"OpTailCall", []int{1}},
+	OpMatchVariant:   {"OpMatchVariant", []int{2}},
+	OpMatchArray:     {"OpMatchArray", []int{2, 2, 1}},
+	OpMatchHash:      {"OpMatchHash", []int{2}},
+	OpSlice:          {"OpSlice", []int{2}},
+	OpFail:           {"OpFail", []int{2}},
+	OpWide:           {"OpWide", []int{}},
+
+	OpGetLocalPair:         {"OpGetLocalPair", []int{1, 1}},
+	OpLocalAddConstant:     {"OpLocalAddConstant", []int{1, 2}},
+	OpLocalSubConstant:     {"OpLocalSubConstant", []int{1, 2}},
+	OpJumpNotGreater:       {"OpJumpNotGreater", []int{2}},
+	OpJumpNotEqual:         {"OpJumpNotEqual", []int{2}},
+	OpJumpLocalsNotGreater: {"OpJumpLocalsNotGreater", []int{1, 1, 2}},
+	OpReturnLocal:          {"OpReturnLocal", []int{1}},
+
+	OpAddInt:         {"OpAddInt", []int{}},
+	OpSubInt:         {"OpSubInt", []int{}},
+	OpMulInt:         {"OpMulInt", []int{}},
+	OpDivInt:         {"OpDivInt", []int{}},
+	OpGreaterThanInt: {"OpGreaterThanInt", []int{}},
+	OpEqualInt:       {"OpEqualInt", []int{}},
+	OpNotEqualInt:    {"OpNotEqualInt", []int{}},
+	OpCheckType:      {"OpCheckType", []int{1}},
+	OpCheckLocal:     {"OpCheckLocal", []int{1, 1}},
+	OpGetCallerLocal: {"OpGetCallerLocal", []int{1}},
+	OpGetCallerFree:  {"OpGetCallerFree", []int{1}},
+
+	OpTailCallKeywords: {"OpTailCallKeywords", []int{1, 2}},
+}
+
+// wideDefinitions holds the widened form of every opcode that has operands
+var wideDefinitions = map[Opcode]*Definition{}
+
+func init() {
+	for op, def := range definitions {
+		if len(def.OperandWidths) == 0 {
+			continue
+		}
+
+		widths := make([]int, len(def.OperandWidths))
+		for i, w := range def.OperandWidths {
+			widths[i] = w * 2
+		}
+		wideDefinitions[op] = &Definition{"OpWide " + def.Name, widths}
+	}
+}
+
+// Width returns the number of operand bytes following the opcode
+func (def *Definition) Width() int {
+	width := 0
+	for _, w := range def.OperandWidths {
+		width += w
+	}
+	return width
 }
 
 // Lookup finds a Definition for an Opcode
@@ -111,22 +233,72 @@ func Lookup(op byte) (*Definition, error) {
 	return def, nil
 }
 
-// Make creates a new bytecode instruction
+// LookupWide finds the widened Definition of an Opcode, as used after an
+// OpWide prefix
+func LookupWide(op byte) (*Definition, error) {
+	def, ok := wideDefinitions[Opcode(op)]
+	if !ok {
+		return nil, fmt.Errorf("opcode %d cannot be widened", op)
+	}
+	return def, nil
+}
+
+// Decode looks up the instruction at the start of ins. An OpWide prefix is
+// resolved to the opcode it prefixes and that opcode's widened Definition;
+// prefix is the length of the prefix, 0 or 1.
+func Decode(ins Instructions) (op Opcode, def *Definition, prefix int, err error) {
+	if Opcode(ins[0]) != OpWide {
+		def, err = Lookup(ins[0])
+		return Opcode(ins[0]), def, 0, err
+	}
+
+	if len(ins) < 2 {
+		return OpWide, nil, 1, fmt.Errorf("truncated OpWide")
+	}
+	def, err = LookupWide(ins[1])
+	return Opcode(ins[1]), def, 1, err
+}
+
+// Fits reports whether the operands can be encoded in def's operand widths
+func (def *Definition) Fits(operands ...int) bool {
+	for i, o := range operands {
+		if o < 0 || o >= 1<<(8*def.OperandWidths[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Make creates a new bytecode instruction. It panics if an operand does not
+// fit its width, see MakeWide.
 func Make(op Opcode, operands ...int) []byte {
 	def, ok := definitions[op]
 	if !ok {
 		return []byte{}
 	}
 
-	instructionLen := 1
-	for _, w := range def.OperandWidths {
-		instructionLen += w
+	return makeInstruction([]byte{byte(op)}, def, operands)
+}
+
+// MakeWide creates an OpWide-prefixed instruction, whose operands are twice
+// their usual width
+func MakeWide(op Opcode, operands ...int) []byte {
+	def, ok := wideDefinitions[op]
+	if !ok {
+		return []byte{}
+	}
+
+	return makeInstruction([]byte{byte(OpWide), byte(op)}, def, operands)
+}
+
+func makeInstruction(instruction []byte, def *Definition, operands []int) []byte {
+	if !def.Fits(operands...) {
+		panic(fmt.Sprintf("operands %v do not fit %s", operands, def.Name))
 	}
 
-	instruction := make([]byte, instructionLen)
-	instruction[0] = byte(op)
+	offset := len(instruction)
+	instruction = append(instruction, make([]byte, def.Width())...)
 
-	offset := 1
 	for i, o := range operands {
 		width := def.OperandWidths[i]
 		switch width {
@@ -134,6 +306,8 @@ func Make(op Opcode, operands ...int) []byte {
 			instruction[offset] = byte(o)
 		case 2:
 			binary.BigEndian.PutUint16(instruction[offset:], uint16(o))
+		case 4:
+			binary.BigEndian.PutUint32(instruction[offset:], uint32(o))
 		}
 		offset += width
 	}
@@ -146,6 +320,11 @@ func ReadUint16(ins []byte) uint16 {
 	return binary.BigEndian.Uint16(ins)
 }
 
+// ReadUint32 reads a uint32 from the given bytes
+func ReadUint32(ins []byte) uint32 {
+	return binary.BigEndian.Uint32(ins)
+}
+
 // ReadUint8 reads a uint8 from the given bytes
 func ReadUint8(ins []byte) uint8 {
 	return uint8(ins[0])
@@ -162,6 +341,8 @@ func ReadOperands(def *Definition, ins Instructions) ([]int, int) {
 			operands[i] = int(ReadUint8(ins[offset:]))
 		case 2:
 			operands[i] = int(ReadUint16(ins[offset:]))
+		case 4:
+			operands[i] = int(ReadUint32(ins[offset:]))
 		}
 		offset += width
 	}
@@ -175,17 +356,23 @@ func (ins Instructions) String() string {
 
 	i := 0
 	for i < len(ins) {
-		def, err := Lookup(ins[i])
+		_, def, prefix, err := Decode(ins[i:])
 		if err != nil {
-			fmt.Fprintf(&out, "ERROR: %s\n", err)
+			fmt.Fprintf(&out, "%04d ERROR: %s\n", i, err)
+			i++
 			continue
 		}
 
-		operands, read := ReadOperands(def, ins[i+1:])
+		if i+prefix+1+def.Width() > len(ins) {
+			fmt.Fprintf(&out, "%04d ERROR: truncated %s\n", i, def.Name)
+			break
+		}
+
+		operands, read := ReadOperands(def, ins[i+prefix+1:])
 
 		fmt.Fprintf(&out, "%04d %s\n", i, ins.fmtInstruction(def, operands))
 
-		i += 1 + read
+		i += prefix + 1 + read
 	}
 
 	return out.String()
@@ -206,6 +393,8 @@ func (ins Instructions) fmtInstruction(def *Definition, operands []int) string {
 		return fmt.Sprintf("%s %d", def.Name, operands[0])
 	case 2:
 		return fmt.Sprintf("%s %d %d", def.Name, operands[0], operands[1])
+	case 3:
+		return fmt.Sprintf("%s %d %d %d", def.Name, operands[0], operands[1], operands[2])
 	}
 
 	return fmt.Sprintf("ERROR: unhandled operandCount for %s\n", def.Name)
@@ -12,6 +12,7 @@ func TestMake(t *testing.T) {
 		{OpConstant, []int{65534}, []byte{byte(OpConstant), 255, 254}},
 		{OpGetLocal, []int{255}, []byte{byte(OpGetLocal), 255}},
 		{OpClosure, []int{65534, 255}, []byte{byte(OpClosure), 255, 254, 255}},
+		{OpMatchArray, []int{2, 1, 1}, []byte{byte(OpMatchArray), 0, 2, 0, 1, 1}},
 	}
 
 	for _, tt := range tests {
@@ -31,6 +32,83 @@ func TestMake(t *testing.T) {
 	}
 }
 
+func TestMakeWide(t *testing.T) {
+	tests := []struct {
+		op       Opcode
+		operands []int
+		expected []byte
+	}{
+		{OpConstant, []int{65536}, []byte{byte(OpWide), byte(OpConstant), 0, 1, 0, 0}},
+		{OpGetLocal, []int{256}, []byte{byte(OpWide), byte(OpGetLocal), 1, 0}},
+		{OpClosure, []int{70000, 300}, []byte{byte(OpWide), byte(OpClosure), 0, 1, 17, 112, 1, 44}},
+	}
+
+	for _, tt := range tests {
+		instruction := MakeWide(tt.op, tt.operands...)
+
+		if string(instruction) != string(tt.expected) {
+			t.Errorf("wrong instruction. want=%v, got=%v", tt.expected, instruction)
+		}
+
+		op, def, prefix, err := Decode(instruction)
+		if err != nil {
+			t.Fatalf("decode error: %s", err)
+		}
+		if op != tt.op || prefix != 1 {
+			t.Errorf("wrong decode. want=%d prefix 1, got=%d prefix %d", tt.op, op, prefix)
+		}
+
+		operands, n := ReadOperands(def, instruction[2:])
+		if n != len(instruction)-2 {
+			t.Errorf("wrong number of bytes read. want=%d, got=%d", len(instruction)-2, n)
+		}
+		for i, want := range tt.operands {
+			if operands[i] != want {
+				t.Errorf("operand wrong. want=%d, got=%d", want, operands[i])
+			}
+		}
+	}
+}
+
+func TestMakeRegister(t *testing.T) {
+	tests := []struct {
+		op       RegisterOpcode
+		operands []int
+		expected []byte
+	}{
+		{RegAdd, []int{1, 2, RKConstant | 3}, []byte{byte(RegAdd), 0, 1, 0, 2, 128, 3}},
+		{RegReturnNull, []int{}, []byte{byte(RegReturnNull)}},
+		{RegClosure, []int{0, 300, 4, 2}, []byte{byte(RegClosure), 0, 0, 1, 44, 0, 4, 0, 2}},
+	}
+
+	for _, tt := range tests {
+		instruction := MakeRegister(tt.op, tt.operands...)
+
+		if string(instruction) != string(tt.expected) {
+			t.Errorf("wrong instruction. want=%v, got=%v", tt.expected, instruction)
+		}
+	}
+}
+
+func TestMakeOverflow(t *testing.T) {
+	def, _ := Lookup(byte(OpConstant))
+	if def.Fits(65536) || !def.Fits(65535) {
+		t.Errorf("wrong narrow OpConstant limit")
+	}
+
+	wide, _ := LookupWide(byte(OpGetLocal))
+	if wide.Fits(65536) || !wide.Fits(65535) {
+		t.Errorf("wrong wide OpGetLocal limit")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Make truncated an operand instead of panicking")
+		}
+	}()
+	Make(OpGetLocal, 256)
+}
+
 func TestInstructionsString(t *testing.T) {
 	instructions := []Instructions{
 		Make(OpAdd),
@@ -38,6 +116,7 @@ func TestInstructionsString(t *testing.T) {
 		Make(OpConstant, 2),
 		Make(OpConstant, 65535),
 		Make(OpClosure, 65535, 255),
+		Make(OpMatchArray, 2, 1, 1),
 	}
 
 	expected := `0000 OpAdd
@@ -45,6 +124,7 @@ func TestInstructionsString(t *testing.T) {
 0003 OpConstant 2
 0006 OpConstant 65535
 0009 OpClosure 65535 255
+0013 OpMatchArray 2 1 1
 `
 
 	concatted := Instructions{}
@@ -58,6 +138,25 @@ func TestInstructionsString(t *testing.T) {
 	}
 }
 
+func TestInstructionsStringMalformed(t *testing.T) {
+	ins := Instructions{byte(OpTrue), 255, byte(OpPop), byte(OpWide), byte(OpPop)}
+	ins = append(ins, MakeWide(OpGetLocal, 300)...)
+	ins = append(ins, Make(OpConstant, 1)[:2]...)
+
+	expected := `0000 OpTrue
+0001 ERROR: opcode 255 undefined
+0002 OpPop
+0003 ERROR: opcode 5 cannot be widened
+0004 OpPop
+0005 OpWide OpGetLocal 300
+0009 ERROR: truncated OpConstant
+`
+
+	if ins.String() != expected {
+		t.Errorf("instructions wrongly formatted.\nwant=%q\ngot=%q", expected, ins.String())
+	}
+}
+
 func TestReadOperands(t *testing.T) {
 	tests := []struct {
 		op        Opcode
@@ -89,3 +188,45 @@ func TestReadOperands(t *testing.T) {
 		}
 	}
 }
+
+func TestPositionTable(t *testing.T) {
+	table := PositionTable{}
+	table.Add(0, Position{Line: 1, Column: 1})
+	table.Add(3, Position{Line: 1, Column: 1})
+	table.Add(4, Position{})
+	table.Add(6, Position{File: "lib.helios", Line: 2, Column: 5})
+	table.Add(6, Position{File: "lib.helios", Line: 2, Column: 9})
+	table.Add(9, Position{Line: 3, Column: 1})
+	table.Add(12, Position{Line: 4, Column: 2})
+
+	if len(table.Entries) != 4 || len(table.Files) != 2 {
+		t.Fatalf("table not compact. got=%+v", table)
+	}
+
+	table.Truncate(12)
+
+	tests := []struct {
+		offset   int
+		expected string
+		ok       bool
+	}{
+		{0, "1:1", true},
+		{5, "1:1", true},
+		{6, "lib.helios:2:9", true},
+		{8, "lib.helios:2:9", true},
+		{9, "3:1", true},
+		{14, "3:1", true},
+	}
+
+	for _, tt := range tests {
+		pos, ok := table.Lookup(tt.offset)
+		if ok != tt.ok || pos.String() != tt.expected {
+			t.Errorf("Lookup(%d) wrong. want=%s, got=%s", tt.offset, tt.expected, pos)
+		}
+	}
+
+	empty := PositionTable{}
+	if _, ok := empty.Lookup(0); ok {
+		t.Errorf("empty table found a position")
+	}
+}
@@ -0,0 +1,97 @@
+package code
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Position is a location in Helios source. Line and Column are 1-based and
+// File is empty for source that was not read from a file.
+type Position struct {
+	File   string
+	Line   int
+	Column int
+}
+
+func (p Position) String() string {
+	if p.File == "" {
+		return fmt.Sprintf("%d:%d", p.Line, p.Column)
+	}
+	return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Column)
+}
+
+// PositionTable maps instruction offsets to the source positions they were
+// compiled from. Each entry covers the instructions from its Offset up to
+// the next entry's, so a run of instructions compiled from the same position
+// takes a single entry.
+type PositionTable struct {
+	Files   []string
+	Entries []PositionEntry
+}
+
+// PositionEntry starts a range of instructions. File indexes the table's
+// Files.
+type PositionEntry struct {
+	Offset int
+	File   int
+	Line   int
+	Column int
+}
+
+// Add records that the instruction at offset was compiled from pos. Offsets
+// must not decrease. Positions with no line are ignored, leaving the
+// instruction in the range of the one before it.
+func (t *PositionTable) Add(offset int, pos Position) {
+	if pos.Line == 0 {
+		return
+	}
+
+	file := -1
+	for i, f := range t.Files {
+		if f == pos.File {
+			file = i
+			break
+		}
+	}
+	if file == -1 {
+		file = len(t.Files)
+		t.Files = append(t.Files, pos.File)
+	}
+
+	entry := PositionEntry{Offset: offset, File: file, Line: pos.Line, Column: pos.Column}
+
+	if n := len(t.Entries); n > 0 {
+		last := t.Entries[n-1]
+		if last.File == file && last.Line == pos.Line && last.Column == pos.Column {
+			return
+		}
+		if last.Offset == offset {
+			t.Entries[n-1] = entry
+			return
+		}
+	}
+
+	t.Entries = append(t.Entries, entry)
+}
+
+// Truncate forgets the positions of instructions at or after offset, for
+// when instructions are removed from the end of a stream.
+func (t *PositionTable) Truncate(offset int) {
+	i := sort.Search(len(t.Entries), func(i int) bool {
+		return t.Entries[i].Offset >= offset
+	})
+	t.Entries = t.Entries[:i]
+}
+
+// Lookup returns the source position of the instruction at offset
+func (t *PositionTable) Lookup(offset int) (Position, bool) {
+	i := sort.Search(len(t.Entries), func(i int) bool {
+		return t.Entries[i].Offset > offset
+	})
+	if i == 0 {
+		return Position{}, false
+	}
+
+	entry := t.Entries[i-1]
+	return Position{File: t.Files[entry.File], Line: entry.Line, Column: entry.Column}, true
+}
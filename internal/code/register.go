@@ -0,0 +1,127 @@
+package code
+
+import "fmt"
+
+// RegisterOpcode is an operation of the register instruction set, an
+// alternative to the stack instruction set selected by the compiler's
+// backend option. Operands name registers, the slots of a frame, instead
+// of the top of a stack, so an operation reads its operands and stores its
+// result without separate loads and stores.
+//
+// Every operand is two bytes. A is the register an operation stores its
+// result in. Operands marked RK are a register, or a constant if RKConstant
+// is set. Calls, arrays, hashes and closures take their operands from a
+// window of consecutive registers starting at B.
+type RegisterOpcode byte
+
+const (
+	// RegLoadConst A K loads constant K
+	RegLoadConst RegisterOpcode = iota
+	RegLoadTrue
+	RegLoadFalse
+	RegLoadNull
+	// RegMove A B copies register B
+	RegMove
+
+	// RegGetGlobal A G loads global G, RegSetGlobal G B stores RK B in it
+	RegGetGlobal
+	RegSetGlobal
+	RegGetBuiltin
+	RegGetFree
+	RegCurrentClosure
+
+	// Binary operations are A B C, computing RK B op RK C
+	RegAdd
+	RegSub
+	RegMul
+	RegDiv
+	RegGreaterThan
+	RegEqual
+	RegNotEqual
+	// Unary operations are A B, computing op RK B
+	RegMinus
+	RegBang
+	// RegIndex A B C indexes RK B by RK C
+	RegIndex
+
+	// RegArray A B N builds an array of the N registers from B
+	RegArray
+	// RegHash A B N builds a hash of N registers from B, keys and values
+	// alternating
+	RegHash
+	// RegClosure A K B N makes a closure of constant K over N registers
+	// from B
+	RegClosure
+
+	// RegCall A B N calls register B with the N registers after it and
+	// stores the result in A
+	RegCall
+	// RegTailCall B N is a RegCall whose result is returned straight away
+	RegTailCall
+	// RegReturn B returns RK B
+	RegReturn
+	RegReturnNull
+
+	RegJump
+	// RegJumpNotTruthy B T jumps to T unless RK B is truthy
+	RegJumpNotTruthy
+
+	// RegPop B sets the program's result to RK B
+	RegPop
+)
+
+// RKConstant marks an RK operand that is a constant index
+const RKConstant = 0x8000
+
+var registerDefinitions = map[RegisterOpcode]*Definition{
+	RegLoadConst:      {"RegLoadConst", []int{2, 2}},
+	RegLoadTrue:       {"RegLoadTrue", []int{2}},
+	RegLoadFalse:      {"RegLoadFalse", []int{2}},
+	RegLoadNull:       {"RegLoadNull", []int{2}},
+	RegMove:           {"RegMove", []int{2, 2}},
+	RegGetGlobal:      {"RegGetGlobal", []int{2, 2}},
+	RegSetGlobal:      {"RegSetGlobal", []int{2, 2}},
+	RegGetBuiltin:     {"RegGetBuiltin", []int{2, 2}},
+	RegGetFree:        {"RegGetFree", []int{2, 2}},
+	RegCurrentClosure: {"RegCurrentClosure", []int{2}},
+	RegAdd:            {"RegAdd", []int{2, 2, 2}},
+	RegSub:            {"RegSub", []int{2, 2, 2}},
+	RegMul:            {"RegMul", []int{2, 2, 2}},
+	RegDiv:            {"RegDiv", []int{2, 2, 2}},
+	RegGreaterThan:    {"RegGreaterThan", []int{2, 2, 2}},
+	RegEqual:          {"RegEqual", []int{2, 2, 2}},
+	RegNotEqual:       {"RegNotEqual", []int{2, 2, 2}},
+	RegMinus:          {"RegMinus", []int{2, 2}},
+	RegBang:           {"RegBang", []int{2, 2}},
+	RegIndex:          {"RegIndex", []int{2, 2, 2}},
+	RegArray:          {"RegArray", []int{2, 2, 2}},
+	RegHash:           {"RegHash", []int{2, 2, 2}},
+	RegClosure:        {"RegClosure", []int{2, 2, 2, 2}},
+	RegCall:           {"RegCall", []int{2, 2, 2}},
+	RegTailCall:       {"RegTailCall", []int{2, 2}},
+	RegReturn:         {"RegReturn", []int{2}},
+	RegReturnNull:     {"RegReturnNull", []int{}},
+	RegJump:           {"RegJump", []int{2}},
+	RegJumpNotTruthy:  {"RegJumpNotTruthy", []int{2, 2}},
+	RegPop:            {"RegPop", []int{2}},
+}
+
+// LookupRegister finds the Definition of a RegisterOpcode
+func LookupRegister(op byte) (*Definition, error) {
+	def, ok := registerDefinitions[RegisterOpcode(op)]
+	if !ok {
+		return nil, fmt.Errorf("register opcode %d undefined", op)
+	}
+	return def, nil
+}
+
+// MakeRegister creates a register instruction. It panics if an operand does
+// not fit in two bytes.
+func MakeRegister(op RegisterOpcode, operands ...int) []byte {
+	def, ok := registerDefinitions[op]
+	if !ok {
+		return []byte{}
+	}
+
+	return makeInstruction([]byte{byte(op)}, def, operands)
+}
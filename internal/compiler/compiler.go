@@ -5,13 +5,29 @@ import (
 	"github.com/TheAlchemistKE/helios/internal/ast"
 	"github.com/TheAlchemistKE/helios/internal/code"
 	"github.com/TheAlchemistKE/helios/internal/object"
+	"math"
+	"slices"
 	"sort"
 )
 
 type CompilationScope struct {
 	instructions        code.Instructions
+	positions           code.PositionTable
 	lastInstruction     EmittedInstruction
 	previousInstruction EmittedInstruction
+
+	// farJumps maps the offset of each jump whose target did not fit its
+	// operand to that target. Such jumps are widened by scopeCode.
+	farJumps map[int]int
+
+	// bindings are the variables declared in a function and discardable the
+	// code of its pure expression statements whose value is ignored, see
+	// deadCode
+	bindings    []binding
+	discardable []span
+
+	// tails are the calls in tail position of the function, see tailCalls
+	tails map[*ast.CallExpression]bool
 }
 
 type EmittedInstruction struct {
@@ -20,16 +36,70 @@ type EmittedInstruction struct {
 }
 
 type Compiler struct {
-	constants   []object.Object
-	symbolTable *SymbolTable
+	constants []object.Object
+	// constantIndex maps the value of each Integer, Float and String
+	// constant to its index, so that equal literals share one constant
+	constantIndex map[constantKey]int
+	symbolTable   *SymbolTable
 
 	scopes     []CompilationScope
 	scopeIndex int
+
+	variants  map[string]*variantInfo
+	enums     map[string][]string
+	warnings  []string
+	tempCount int
+
+	// defaults maps each default pattern being compiled to the temp its
+	// value is kept in between a pattern's test and its bindings
+	defaults map[*ast.DefaultPattern]Symbol
+
+	// position is the source position of the node being compiled
+	position code.Position
+
+	resolver    Resolver
+	path        string
+	loading     []string
+	exports     []string
+	modules     []*module
+	moduleIndex map[string]int
+
+	options Options
+
+	// inlinable holds the functions whose calls can be replaced by their
+	// body, and inlining is set while such a body is compiled
+	inlinable map[inlineKey]*inlineFunction
+	inlining  bool
+
+	// readsCaller holds the closures found not to escape the function
+	// defining them, see nonEscaping
+	readsCaller map[*ast.FunctionLiteral]bool
+
+	// registerCode is set once the main program is compiled to register
+	// code, which uses mainRegisters registers
+	registerCode  bool
+	mainRegisters int
+
+	// err is the first error found while emitting, such as an operand too
+	// large to encode. It is returned once the program is compiled.
+	err error
 }
 
+// GlobalsSize is the most global slots a program may use, across every
+// module and every compilation sharing its symbol table. The VM's globals
+// store has this many slots.
+const GlobalsSize = 65536
+
 type Bytecode struct {
 	Instructions code.Instructions
 	Constants    []object.Object
+	// MaxStackDepth is the deepest the main program's stack gets, or for
+	// register code the number of registers it uses
+	MaxStackDepth int
+	Positions     code.PositionTable
+	// Backend is the instruction set of the main program and every
+	// function in Constants
+	Backend Backend
 }
 
 func New() *Compiler {
@@ -48,10 +118,15 @@ func New() *Compiler {
 	}
 
 	return &Compiler{
-		constants:   []object.Object{},
-		symbolTable: symbolTable,
-		scopes:      []CompilationScope{mainScope},
-		scopeIndex:  0,
+		constants:     []object.Object{},
+		constantIndex: map[constantKey]int{},
+		symbolTable:   symbolTable,
+		scopes:        []CompilationScope{mainScope},
+		scopeIndex:    0,
+		variants:      map[string]*variantInfo{},
+		enums:         map[string][]string{},
+		defaults:      map[*ast.DefaultPattern]Symbol{},
+		moduleIndex:   map[string]int{},
 	}
 }
 
@@ -59,17 +134,40 @@ func NewWithState(s *SymbolTable, constants []object.Object) *Compiler {
 	compiler := New()
 	compiler.symbolTable = s
 	compiler.constants = constants
+	for i, c := range constants {
+		if key, ok := keyOf(c); ok {
+			if _, seen := compiler.constantIndex[key]; !seen {
+				compiler.constantIndex[key] = i
+			}
+		}
+	}
 	return compiler
 }
 
 func (c *Compiler) Compile(node ast.Node) error {
+	defer c.enterNode(node)()
+
 	switch node := node.(type) {
 	case *ast.Program:
-		for _, s := range node.Statements {
-			err := c.Compile(s)
-			if err != nil {
-				return err
-			}
+		err := c.compileProgram(node)
+		if err != nil {
+			return err
+		}
+		if globals := *c.symbolTable.globals; globals > GlobalsSize {
+			return fmt.Errorf("program too large: %d globals exceed the limit of %d",
+				globals, GlobalsSize)
+		}
+
+	case *ast.ImportStatement:
+		return fmt.Errorf("import %q must be at the top level of a module", node.Path)
+
+	case *ast.ExportStatement:
+		return fmt.Errorf("export must be at the top level of a module: %s", node.Statement)
+
+	case *ast.MemberExpression:
+		err := c.compileMember(node)
+		if err != nil {
+			return err
 		}
 
 	case *ast.ExpressionStatement:
@@ -80,6 +178,10 @@ func (c *Compiler) Compile(node ast.Node) error {
 		c.emit(code.OpPop)
 
 	case *ast.PrefixExpression:
+		if simplified := c.simplify(node); simplified != node {
+			return c.Compile(simplified)
+		}
+
 		err := c.Compile(node.Right)
 		if err != nil {
 			return err
@@ -95,6 +197,12 @@ func (c *Compiler) Compile(node ast.Node) error {
 		}
 
 	case *ast.InfixExpression:
+		if simplified := c.simplify(node); simplified != node {
+			return c.Compile(simplified)
+		}
+
+		integers := c.integers(node)
+
 		// Special case for comparison operators
 		if node.Operator == "<" {
 			err := c.Compile(node.Right)
@@ -105,7 +213,7 @@ func (c *Compiler) Compile(node ast.Node) error {
 			if err != nil {
 				return err
 			}
-			c.emit(code.OpGreaterThan)
+			c.emitOperator(code.OpGreaterThan, integers)
 			return nil
 		}
 
@@ -121,24 +229,37 @@ func (c *Compiler) Compile(node ast.Node) error {
 
 		switch node.Operator {
 		case "+":
-			c.emit(code.OpAdd)
+			c.emitOperator(code.OpAdd, integers)
 		case "-":
-			c.emit(code.OpSub)
+			c.emitOperator(code.OpSub, integers)
 		case "*":
-			c.emit(code.OpMul)
+			c.emitOperator(code.OpMul, integers)
 		case "/":
-			c.emit(code.OpDiv)
+			c.emitOperator(code.OpDiv, integers)
 		case ">":
-			c.emit(code.OpGreaterThan)
+			c.emitOperator(code.OpGreaterThan, integers)
 		case "==":
-			c.emit(code.OpEqual)
+			c.emitOperator(code.OpEqual, integers)
 		case "!=":
-			c.emit(code.OpNotEqual)
+			c.emitOperator(code.OpNotEqual, integers)
 		default:
 			return fmt.Errorf("unknown operator %s", node.Operator)
 		}
 
 	case *ast.IfExpression:
+		if truthy, ok := literalTruthiness(c.simplify(node.Condition)); ok && c.options.FoldConstants {
+			// The condition is constant, only the branch taken is compiled
+			switch {
+			case truthy:
+				return c.compileBlockValue(node.Consequence)
+			case node.Alternative != nil:
+				return c.compileBlockValue(node.Alternative)
+			default:
+				c.emit(code.OpNull)
+				return nil
+			}
+		}
+
 		err := c.Compile(node.Condition)
 		if err != nil {
 			return err
@@ -147,15 +268,11 @@ func (c *Compiler) Compile(node ast.Node) error {
 		// Emit an `OpJumpNotTruthy` with a bogus value
 		jumpNotTruthyPos := c.emit(code.OpJumpNotTruthy, 9999)
 
-		err = c.Compile(node.Consequence)
+		err = c.compileBlockValue(node.Consequence)
 		if err != nil {
 			return err
 		}
 
-		if c.lastInstructionIs(code.OpPop) {
-			c.removeLastPop()
-		}
-
 		// Emit an `OpJump` with a bogus value
 		jumpPos := c.emit(code.OpJump, 9999)
 
@@ -165,38 +282,67 @@ func (c *Compiler) Compile(node ast.Node) error {
 		if node.Alternative == nil {
 			c.emit(code.OpNull)
 		} else {
-			err := c.Compile(node.Alternative)
+			err := c.compileBlockValue(node.Alternative)
 			if err != nil {
 				return err
 			}
-
-			if c.lastInstructionIs(code.OpPop) {
-				c.removeLastPop()
-			}
 		}
 
 		afterAlternativePos := len(c.currentInstructions())
 		c.changeOperand(jumpPos, afterAlternativePos)
 
 	case *ast.BlockStatement:
-		for _, s := range node.Statements {
-			err := c.Compile(s)
+		err := c.compileStatements(node.Statements)
+		if err != nil {
+			return err
+		}
+
+	case *ast.LetStatement:
+		if node.Pattern != nil {
+			err := c.compileLetPattern(node)
 			if err != nil {
 				return err
 			}
+			break
 		}
 
-	case *ast.LetStatement:
-		symbol := c.symbolTable.Define(node.Name.Value)
+		// The name comes into scope after its value, which therefore
+		// refers to any outer binding of it. A function literal refers to
+		// itself by its own name.
+		start := len(c.currentInstructions())
 		err := c.Compile(node.Value)
 		if err != nil {
 			return err
 		}
 
-		if symbol.Scope == GlobalScope {
-			c.emit(code.OpSetGlobal, symbol.Index)
-		} else {
-			c.emit(code.OpSetLocal, symbol.Index)
+		typ, checked := c.staticType(node.Value), false
+		if node.Type != nil {
+			typ, checked, err = c.compileLetType(node, typ)
+			if err != nil {
+				return err
+			}
+		}
+
+		symbol := c.symbolTable.Define(node.Name.Value)
+		c.storeSymbol(symbol)
+		c.symbolTable.setType(symbol, typ)
+
+		if c.options.Inline {
+			c.registerInline(symbol, node)
+		}
+
+		c.addBinding(node.Name, symbol, span{start, len(c.currentInstructions())}, isPure(node.Value) && !checked)
+
+	case *ast.EnumStatement:
+		err := c.compileEnum(node)
+		if err != nil {
+			return err
+		}
+
+	case *ast.MatchExpression:
+		err := c.compileMatch(node)
+		if err != nil {
+			return err
 		}
 
 	case *ast.Identifier:
@@ -216,6 +362,12 @@ func (c *Compiler) Compile(node ast.Node) error {
 			c.emit(code.OpGetFree, symbol.Index)
 		case FunctionScope:
 			c.emit(code.OpCurrentClosure)
+		case CallerLocalScope:
+			c.emit(code.OpGetCallerLocal, symbol.Index)
+		case CallerFreeScope:
+			c.emit(code.OpGetCallerFree, symbol.Index)
+		case ModuleScope:
+			c.compileModuleValue(c.modules[symbol.Index])
 		}
 
 	case *ast.StringLiteral:
@@ -252,50 +404,28 @@ func (c *Compiler) Compile(node ast.Node) error {
 		}
 		c.emit(code.OpHash, len(node.Pairs)*2)
 
-		// In compiler.go, modify the Compile method for *ast.FunctionLiteral:
 	case *ast.FunctionLiteral:
-		c.enterScope()
-
-		// Define the function name first if it exists
-		if node.TokenLiteral() != "fn" {
-			c.symbolTable.DefineFunctionName(node.TokenLiteral())
-		}
-
-		for _, p := range node.Parameters {
-			c.symbolTable.Define(p.Value)
-		}
-
-		err := c.Compile(node.Body)
+		_, err := c.compileFunctionLiteral(node)
 		if err != nil {
 			return err
 		}
 
-		if !c.lastInstructionIs(code.OpReturnValue) {
-			if c.lastInstructionIs(code.OpPop) {
-				c.replaceLastPopWithReturn()
-			} else {
-				c.emit(code.OpReturn)
-			}
+	case *ast.FunctionStatement:
+		symbol := c.symbolTable.Define(node.Name.Value)
+		start := len(c.currentInstructions())
+		_, err := c.compileFunctionLiteral(node.Function)
+		if err != nil {
+			return err
 		}
 
-		freeSymbols := c.symbolTable.FreeSymbols
-		numLocals := c.symbolTable.numDefinitions
-		instructions := c.leaveScope()
+		c.storeSymbol(symbol)
+		c.addBinding(node.Name, symbol, span{start, len(c.currentInstructions())}, true)
 
-		for _, s := range freeSymbols {
-			c.loadSymbol(s)
-		}
-
-		compiledFn := &object.CompiledFunction{
-			Instructions:  instructions,
-			NumLocals:     numLocals,
-			NumParameters: len(node.Parameters),
+	case *ast.ReturnStatement:
+		if c.scopeIndex == 0 {
+			return fmt.Errorf("return outside a function")
 		}
 
-		fnIndex := c.addConstant(compiledFn)
-		c.emit(code.OpClosure, fnIndex, len(freeSymbols))
-
-	case *ast.ReturnStatement:
 		err := c.Compile(node.ReturnValue)
 		if err != nil {
 			return err
@@ -304,6 +434,10 @@ func (c *Compiler) Compile(node ast.Node) error {
 		c.emit(code.OpReturnValue)
 
 	case *ast.CallExpression:
+		if inlined, err := c.compileInlineCall(node); inlined || err != nil {
+			return err
+		}
+
 		err := c.Compile(node.Function)
 		if err != nil {
 			return err
@@ -316,12 +450,46 @@ func (c *Compiler) Compile(node ast.Node) error {
 			}
 		}
 
-		c.emit(code.OpCall, len(node.Arguments))
+		// An inlined body is not in tail position of the function it is
+		// inlined into
+		tail := c.scopes[c.scopeIndex].tails[node] && !c.inlining
+
+		if len(node.KeywordArguments) == 0 {
+			if tail {
+				c.emit(code.OpTailCall, len(node.Arguments))
+			} else {
+				c.emit(code.OpCall, len(node.Arguments))
+			}
+			break
+		}
+
+		names := []object.Object{}
+		for _, ka := range node.KeywordArguments {
+			err := c.Compile(ka.Value)
+			if err != nil {
+				return err
+			}
+			names = append(names, &object.String{Value: ka.Name.Value})
+		}
+
+		namesIndex := c.addConstant(&object.Array{Elements: names})
+		if tail {
+			c.emit(code.OpTailCallKeywords, len(node.Arguments), namesIndex)
+		} else {
+			c.emit(code.OpCallKeywords, len(node.Arguments), namesIndex)
+		}
 
 	case *ast.IntegerLiteral:
 		integer := &object.Integer{Value: node.Value}
 		c.emit(code.OpConstant, c.addConstant(integer))
 
+	case *ast.FloatLiteral:
+		float := &object.Float{Value: node.Value}
+		c.emit(code.OpConstant, c.addConstant(float))
+
+	case *ast.NullLiteral:
+		c.emit(code.OpNull)
+
 	case *ast.Boolean:
 		if node.Value {
 			c.emit(code.OpTrue)
@@ -346,10 +514,33 @@ func (c *Compiler) Compile(node ast.Node) error {
 	return nil
 }
 
+// Warnings returns the non-fatal diagnostics collected during compilation
+func (c *Compiler) Warnings() []string {
+	return c.warnings
+}
+
 func (c *Compiler) Bytecode() *Bytecode {
+	if c.registerCode {
+		main := c.scopes[0]
+		return &Bytecode{
+			Instructions:  main.instructions,
+			Constants:     c.constants,
+			MaxStackDepth: c.mainRegisters,
+			Positions:     main.positions,
+			Backend:       RegisterBackend,
+		}
+	}
+
+	instructions, positions := c.scopeCode()
+	constants := c.constants
+	if c.options.EliminateDeadCode {
+		instructions, constants = pruneConstants(instructions, constants)
+	}
 	return &Bytecode{
-		Instructions: c.currentInstructions(),
-		Constants:    c.constants,
+		Instructions:  instructions,
+		Constants:     constants,
+		MaxStackDepth: maxStackDepth(instructions, constants),
+		Positions:     positions,
 	}
 }
 
@@ -376,13 +567,93 @@ func (c *Compiler) currentInstructions() code.Instructions {
 	return c.scopes[c.scopeIndex].instructions
 }
 
+// scopeCode returns the finished instructions and position table of the
+// current scope. Jumps whose targets overflowed their operand are widened,
+// and dead code elimination and the peephole optimiser run if they are
+// enabled.
+func (c *Compiler) scopeCode() (code.Instructions, code.PositionTable) {
+	scope := c.scopes[c.scopeIndex]
+	if len(scope.farJumps) == 0 && !c.options.Peephole && !c.options.EliminateDeadCode &&
+		!c.options.Superinstructions {
+		return scope.instructions, scope.positions
+	}
+
+	list := decodeEditable(scope.instructions, scope.positions, scope.farJumps)
+	if c.options.EliminateDeadCode {
+		list = removeSpans(list, c.deadCode())
+	}
+
+	// Each pass can leave work for the other: removing unreachable code
+	// leaves jumps to the next instruction, and resolving a constant
+	// condition leaves a branch that is never taken
+	for size := -1; size != len(list); {
+		size = len(list)
+		if c.options.EliminateDeadCode {
+			list = removeUnreachable(list)
+		}
+		if c.options.Peephole {
+			list = peephole(list, c.scopeIndex == 0)
+		}
+	}
+	if c.options.Superinstructions {
+		list = fuse(list)
+	}
+	return encodeEditable(list)
+}
+
+// enterNode makes node's position the source position of the instructions
+// emitted until the returned function restores the previous one. Nodes
+// without a position keep the enclosing node's.
+func (c *Compiler) enterNode(node ast.Node) func() {
+	tok := ast.TokenOf(node)
+	if tok.Line == 0 {
+		return func() {}
+	}
+
+	saved := c.position
+	c.position = code.Position{File: c.path, Line: tok.Line, Column: tok.Column}
+	return func() { c.position = saved }
+}
+
 func (c *Compiler) emit(op code.Opcode, operands ...int) int {
-	ins := code.Make(op, operands...)
+	ins := c.makeInstruction(op, operands)
 	pos := c.addInstruction(ins)
+	c.scopes[c.scopeIndex].positions.Add(pos, c.position)
 	c.setLastInstruction(op, pos)
 	return pos
 }
 
+// makeInstruction encodes an instruction, with an OpWide prefix if an
+// operand does not fit its usual width. Operands too large even for that are
+// recorded as an error rather than truncated.
+func (c *Compiler) makeInstruction(op code.Opcode, operands []int) []byte {
+	def, _ := code.Lookup(byte(op))
+	if def.Fits(operands...) {
+		return code.Make(op, operands...)
+	}
+
+	wide, err := code.LookupWide(byte(op))
+	if err == nil && wide.Fits(operands...) {
+		return code.MakeWide(op, operands...)
+	}
+
+	for i, o := range operands {
+		limit := 1<<(8*wide.OperandWidths[i]) - 1
+		if o > limit {
+			c.fail(fmt.Errorf("program too large: %s operand %d exceeds the limit of %d",
+				def.Name, o, limit))
+			break
+		}
+	}
+	return code.Make(op, make([]int, len(operands))...)
+}
+
+func (c *Compiler) fail(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+}
+
 func (c *Compiler) addInstruction(ins []byte) int {
 	posNewIns := len(c.currentInstructions())
 	updatedInstructions := append(c.currentInstructions(), ins...)
@@ -390,11 +661,46 @@ func (c *Compiler) addInstruction(ins []byte) int {
 	return posNewIns
 }
 
+// addConstant adds obj to the constant pool and returns its index. Integer,
+// Float and String constants are deduplicated by value, and strings are
+// interned.
 func (c *Compiler) addConstant(obj object.Object) int {
+	key, ok := keyOf(obj)
+	if ok {
+		if index, seen := c.constantIndex[key]; seen {
+			return index
+		}
+		if s, isString := obj.(*object.String); isString {
+			obj = object.Intern(s.Value)
+		}
+		c.constantIndex[key] = len(c.constants)
+	}
+
 	c.constants = append(c.constants, obj)
 	return len(c.constants) - 1
 }
 
+// constantKey identifies a constant by its type and value
+type constantKey struct {
+	kind  object.ObjectType
+	value uint64
+	str   string
+}
+
+// keyOf returns the key of a constant that can be deduplicated. Floats are
+// keyed by their bits, so 0.0 and -0.0 stay distinct.
+func keyOf(obj object.Object) (constantKey, bool) {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		return constantKey{kind: obj.Type(), value: uint64(obj.Value)}, true
+	case *object.Float:
+		return constantKey{kind: obj.Type(), value: math.Float64bits(obj.Value)}, true
+	case *object.String:
+		return constantKey{kind: obj.Type(), str: obj.Value}, true
+	}
+	return constantKey{}, false
+}
+
 func (c *Compiler) setLastInstruction(op code.Opcode, pos int) {
 	previous := c.scopes[c.scopeIndex].lastInstruction
 	last := EmittedInstruction{Opcode: op, Position: pos}
@@ -415,6 +721,7 @@ func (c *Compiler) removeLastPop() {
 	old := c.currentInstructions()
 	new := old[:last.Position]
 	c.scopes[c.scopeIndex].instructions = new
+	c.scopes[c.scopeIndex].positions.Truncate(last.Position)
 	c.scopes[c.scopeIndex].lastInstruction = previous
 }
 
@@ -425,9 +732,23 @@ func (c *Compiler) replaceInstruction(pos int, newInstruction []byte) {
 	}
 }
 
+// changeOperand patches the target of the jump at opPos. A target too far
+// for the jump's operand is recorded and the jump widened by scopeCode.
 func (c *Compiler) changeOperand(opPos int, operand int) {
 	op := code.Opcode(c.currentInstructions()[opPos])
-	newInstruction := code.Make(op, operand)
+	def, _ := code.Lookup(byte(op))
+	operands, _ := code.ReadOperands(def, c.currentInstructions()[opPos+1:])
+	operands[len(operands)-1] = operand
+	if !def.Fits(operands...) {
+		scope := &c.scopes[c.scopeIndex]
+		if scope.farJumps == nil {
+			scope.farJumps = map[int]int{}
+		}
+		scope.farJumps[opPos] = operand
+		operands[len(operands)-1] = 0
+	}
+
+	newInstruction := code.Make(op, operands...)
 	c.replaceInstruction(opPos, newInstruction)
 }
 
@@ -437,6 +758,75 @@ func (c *Compiler) replaceLastPopWithReturn() {
 	c.scopes[c.scopeIndex].lastInstruction.Opcode = code.OpReturnValue
 }
 
+// tailCalls returns the calls in tail position of a function body, whose
+// result the function returns unchanged: the value of a return statement
+// and of the body's last expression, and within either the last
+// expression of each branch of an if and each arm of a match. Returns are
+// found in the blocks of any if or match reached from the body's
+// statements.
+func tailCalls(body *ast.BlockStatement) map[*ast.CallExpression]bool {
+	tails := map[*ast.CallExpression]bool{}
+
+	var block func(b *ast.BlockStatement, tail bool)
+	value := func(e ast.Expression, tail bool) {
+		switch e := e.(type) {
+		case *ast.CallExpression:
+			if tail {
+				tails[e] = true
+			}
+		case *ast.IfExpression:
+			block(e.Consequence, tail)
+			block(e.Alternative, tail)
+		case *ast.MatchExpression:
+			for _, arm := range e.Arms {
+				block(arm.Body, tail)
+			}
+		}
+	}
+	block = func(b *ast.BlockStatement, tail bool) {
+		if b == nil {
+			return
+		}
+		for i, s := range b.Statements {
+			switch s := s.(type) {
+			case *ast.ReturnStatement:
+				value(s.ReturnValue, true)
+			case *ast.ExpressionStatement:
+				value(s.Expression, tail && i == len(b.Statements)-1)
+			case *ast.LetStatement:
+				value(s.Value, false)
+			}
+		}
+	}
+
+	block(body, true)
+	return tails
+}
+
+// markTailCall turns ins into an OpTailCall if it is an OpCall directly
+// followed by an OpReturnValue, which returns the call's result unchanged.
+// Code generated from SSA form finds its tail calls this way. A return at
+// the top level ends the program, so its calls are left alone.
+func (c *Compiler) markTailCall(ins EmittedInstruction) {
+	if c.scopeIndex == 0 || ins.Opcode != code.OpCall {
+		return
+	}
+
+	instructions := c.currentInstructions()
+	_, def, prefix, err := code.Decode(instructions[ins.Position:])
+	if err != nil {
+		return
+	}
+	_, read := code.ReadOperands(def, instructions[ins.Position+prefix+1:])
+
+	end := ins.Position + prefix + 1 + read
+	if end < len(instructions) && code.Opcode(instructions[end]) != code.OpReturnValue {
+		return
+	}
+
+	instructions[ins.Position+prefix] = byte(code.OpTailCall)
+}
+
 // In compiler.go, update loadSymbol:
 func (c *Compiler) loadSymbol(s Symbol) {
 	switch s.Scope {
@@ -450,5 +840,315 @@ func (c *Compiler) loadSymbol(s Symbol) {
 		c.emit(code.OpGetFree, s.Index)
 	case FunctionScope:
 		c.emit(code.OpCurrentClosure)
+	case CallerLocalScope:
+		c.emit(code.OpGetCallerLocal, s.Index)
+	case CallerFreeScope:
+		c.emit(code.OpGetCallerFree, s.Index)
+	}
+}
+
+// compileFunctionLiteral compiles fn into a closure on the stack and returns
+// the symbols it captured, in the order of the closure's free variables.
+func (c *Compiler) compileFunctionLiteral(node *ast.FunctionLiteral) ([]Symbol, error) {
+	c.enterScope()
+	c.symbolTable.readsCaller = c.readsCaller[node]
+	c.scopes[c.scopeIndex].tails = tailCalls(node.Body)
+
+	if c.options.EscapeAnalysis {
+		for _, literal := range nonEscaping(node) {
+			if c.readsCaller == nil {
+				c.readsCaller = map[*ast.FunctionLiteral]bool{}
+			}
+			c.readsCaller[literal] = true
+		}
+	}
+
+	if node.Name != "" {
+		c.symbolTable.DefineFunctionName(node.Name)
+	}
+
+	params := []string{}
+	for i, p := range node.Parameters {
+		if slices.Contains(params, p.Value) {
+			return nil, fmt.Errorf("duplicate parameter %s", p.Value)
+		}
+		symbol := c.symbolTable.Define(p.Value)
+		if i < len(node.Types) && node.Types[i] != nil {
+			index, err := annotation(node.Types[i])
+			if err != nil {
+				return nil, err
+			}
+			c.symbolTable.setType(symbol, object.Annotations[index].Type)
+		}
+		params = append(params, p.Value)
+	}
+	if node.Variadic != nil {
+		if slices.Contains(params, node.Variadic.Value) {
+			return nil, fmt.Errorf("duplicate parameter %s", node.Variadic.Value)
+		}
+		c.symbolTable.Define(node.Variadic.Value)
+	}
+
+	numDefaults, err := c.compileParameterDefaults(node)
+	if err != nil {
+		return nil, err
+	}
+	err = c.compileParameterTypes(node)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.Compile(node.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if !c.lastInstructionIs(code.OpReturnValue) {
+		if c.lastInstructionIs(code.OpPop) {
+			c.replaceLastPopWithReturn()
+		} else {
+			c.emit(code.OpReturn)
+		}
+	}
+
+	c.warnUnused()
+
+	freeSymbols := c.symbolTable.FreeSymbols
+	numLocals := c.symbolTable.numDefinitions
+	readsCaller := c.symbolTable.usesCaller
+	instructions, positions := c.scopeCode()
+	c.leaveScope()
+
+	for _, s := range freeSymbols {
+		c.loadSymbol(s)
+	}
+
+	compiledFn := &object.CompiledFunction{
+		Name:          node.Name,
+		Instructions:  instructions,
+		NumLocals:     numLocals,
+		NumParameters: len(node.Parameters),
+		NumDefaults:   numDefaults,
+		Variadic:      node.Variadic != nil,
+		Parameters:    params,
+		MaxStackDepth: maxStackDepth(instructions, c.constants),
+		Positions:     positions,
+		ReadsCaller:   readsCaller,
 	}
+
+	fnIndex := c.addConstant(compiledFn)
+	c.emit(code.OpClosure, fnIndex, len(freeSymbols))
+
+	return freeSymbols, nil
+}
+
+// functionDeclaration describes a statement that binds a function to a name,
+// either `fn name() {}` or `let name = fn() {}`.
+type functionDeclaration struct {
+	name *ast.Identifier
+	fn   *ast.FunctionLiteral
+}
+
+func declaredFunction(s ast.Statement) (functionDeclaration, bool) {
+	switch s := s.(type) {
+	case *ast.FunctionStatement:
+		return functionDeclaration{s.Name, s.Function}, true
+	case *ast.LetStatement:
+		if fn, ok := s.Value.(*ast.FunctionLiteral); ok && s.Pattern == nil && s.Type == nil {
+			return functionDeclaration{s.Name, fn}, true
+		}
+	}
+	return functionDeclaration{}, false
+}
+
+// compileStatements compiles a list of statements. Runs of adjacent function
+// declarations are compiled together so that they can refer to each other.
+// Statements after one that always returns are reported, and dropped when
+// dead code is eliminated.
+func (c *Compiler) compileStatements(stmts []ast.Statement) error {
+	if end := reachableEnd(stmts); end < len(stmts) {
+		c.warn(stmts[end], "unreachable code")
+		if c.options.EliminateDeadCode {
+			stmts = stmts[:end]
+		}
+	}
+
+	for i := 0; i < len(stmts); {
+		group := []functionDeclaration{}
+		for _, s := range stmts[i:] {
+			decl, ok := declaredFunction(s)
+			if !ok {
+				break
+			}
+			group = append(group, decl)
+		}
+
+		if len(group) < 2 {
+			start := len(c.currentInstructions())
+			err := c.Compile(stmts[i])
+			if err != nil {
+				return err
+			}
+
+			// The value of the last statement is the value of the block,
+			// and at the top level every value popped can be the result
+			if c.scopeIndex > 0 && i < len(stmts)-1 && isDiscardable(stmts[i]) {
+				scope := &c.scopes[c.scopeIndex]
+				scope.discardable = append(scope.discardable, span{start, len(c.currentInstructions())})
+			}
+			i++
+			continue
+		}
+
+		err := c.compileFunctionGroup(group)
+		if err != nil {
+			return err
+		}
+		i += len(group)
+	}
+
+	return nil
+}
+
+// compileFunctionGroup compiles mutually recursive function declarations.
+// Every name is defined before any body is compiled. A closure that captured
+// a sibling declared after it holds null in that free variable, so once all
+// closures exist the variable is patched with OpSetFree.
+func (c *Compiler) compileFunctionGroup(group []functionDeclaration) error {
+	symbols := make([]Symbol, len(group))
+	for i, decl := range group {
+		symbols[i] = c.symbolTable.Define(decl.name.Value)
+	}
+
+	captured := make([][]Symbol, len(group))
+	spans := make([]span, len(group))
+	for i, decl := range group {
+		spans[i].start = len(c.currentInstructions())
+		free, err := c.compileFunctionLiteral(decl.fn)
+		if err != nil {
+			return err
+		}
+
+		c.storeSymbol(symbols[i])
+		captured[i] = free
+		spans[i].end = len(c.currentInstructions())
+	}
+
+	// A closure that is patched is loaded by the patch, so its code stays
+	// even if its variable is never read
+	patched := make([]bool, len(group))
+	for i, free := range captured {
+		for freeIndex, s := range free {
+			for _, sibling := range symbols[i+1:] {
+				if s.Scope != sibling.Scope || s.Index != sibling.Index {
+					continue
+				}
+
+				c.loadSymbol(symbols[i])
+				c.loadSymbol(sibling)
+				c.emit(code.OpSetFree, freeIndex)
+				patched[i] = true
+			}
+		}
+	}
+
+	for i, decl := range group {
+		c.addBinding(decl.name, symbols[i], spans[i], !patched[i])
+	}
+
+	return nil
+}
+
+// compileBlockValue compiles a block whose last expression is its value,
+// such as a branch of an if. A block that does not end in an expression
+// evaluates to null.
+func (c *Compiler) compileBlockValue(block *ast.BlockStatement) error {
+	start := len(c.currentInstructions())
+
+	err := c.Compile(block)
+	if err != nil {
+		return err
+	}
+
+	if len(c.currentInstructions()) > start && c.lastInstructionIs(code.OpPop) {
+		c.removeLastPop()
+	} else {
+		c.emit(code.OpNull)
+	}
+	return nil
+}
+
+// simplify folds constant subexpressions of expr if the compiler's options
+// ask for it, see simplify
+func (c *Compiler) simplify(expr ast.Expression) ast.Expression {
+	if !c.options.FoldConstants {
+		return expr
+	}
+	return simplify(expr)
+}
+
+// compileParameterDefaults emits the function prologue that gives omitted
+// parameters their default values. It returns the number of parameters
+// that have a default.
+func (c *Compiler) compileParameterDefaults(node *ast.FunctionLiteral) (int, error) {
+	numDefaults := 0
+
+	for i, def := range node.Defaults {
+		if def == nil {
+			continue
+		}
+		numDefaults++
+
+		symbol, _ := c.symbolTable.Resolve(node.Parameters[i].Value)
+		jumpPos := c.emit(code.OpJumpSupplied, symbol.Index, 9999)
+
+		// A default sees only the parameters before it, which are
+		// already bound when it runs
+		later := []string{}
+		for _, p := range node.Parameters[i:] {
+			later = append(later, p.Value)
+		}
+		if node.Variadic != nil {
+			later = append(later, node.Variadic.Value)
+		}
+		c.symbolTable.hide(later)
+		err := c.Compile(def)
+		c.symbolTable.hide(nil)
+		if err != nil {
+			return 0, fmt.Errorf("default of parameter %s: %w", node.Parameters[i].Value, err)
+		}
+		c.storeSymbol(symbol)
+
+		c.changeOperand(jumpPos, len(c.currentInstructions()))
+	}
+
+	return numDefaults, nil
+}
+
+func (c *Compiler) storeSymbol(s Symbol) {
+	if s.Scope == GlobalScope {
+		c.emit(code.OpSetGlobal, s.Index)
+	} else {
+		c.emit(code.OpSetLocal, s.Index)
+	}
+}
+
+// defineTemp defines a compiler-generated variable whose name cannot clash
+// with an identifier in the source program. It reuses the slot of a temp
+// released in the same scope if there is one.
+func (c *Compiler) defineTemp() Symbol {
+	if n := len(c.symbolTable.temps); n > 0 {
+		temp := c.symbolTable.temps[n-1]
+		c.symbolTable.temps = c.symbolTable.temps[:n-1]
+		return temp
+	}
+
+	c.tempCount++
+	return c.symbolTable.Define(fmt.Sprintf("$tmp%d", c.tempCount))
+}
+
+// releaseTemp makes the slot of temp, which is no longer read, free for
+// another temp in the same scope
+func (c *Compiler) releaseTemp(temp Symbol) {
+	c.symbolTable.temps = append(c.symbolTable.temps, temp)
 }
@@ -2,6 +2,11 @@ package compiler
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
 
 	"github.com/TheAlchemistKE/helios/internal/ast"
@@ -15,6 +20,7 @@ type compilerTestCase struct {
 	input                string
 	expectedConstants    []interface{}
 	expectedInstructions []code.Instructions
+	options              Options
 }
 
 func TestIntegerArithmetic(t *testing.T) {
@@ -362,373 +368,2305 @@ func TestHashLiterals(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
-func TestIndexExpressions(t *testing.T) {
+func TestConstantDeduplication(t *testing.T) {
 	tests := []compilerTestCase{
 		{
-			input:             "[1, 2, 3][1 + 1]",
-			expectedConstants: []interface{}{1, 2, 3, 1, 1},
+			input:             `"id"; 1; 2.5; "id"; 1; 2.5; "ID"`,
+			expectedConstants: []interface{}{"id", 1, &object.Float{Value: 2.5}, "ID"},
 			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
 				code.Make(code.OpConstant, 1),
+				code.Make(code.OpPop),
 				code.Make(code.OpConstant, 2),
-				code.Make(code.OpArray, 3),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpPop),
 				code.Make(code.OpConstant, 3),
-				code.Make(code.OpConstant, 4),
-				code.Make(code.OpAdd),
-				code.Make(code.OpIndex),
 				code.Make(code.OpPop),
 			},
 		},
 		{
-			input:             "{1: 2}[2 - 1]",
-			expectedConstants: []interface{}{1, 2, 2, 1},
+			// An integer and a float of the same value are different constants
+			input:             "1; 1.0",
+			expectedConstants: []interface{}{1, &object.Float{Value: 1}},
 			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
 				code.Make(code.OpConstant, 1),
-				code.Make(code.OpHash, 2),
-				code.Make(code.OpConstant, 2),
-				code.Make(code.OpConstant, 3),
-				code.Make(code.OpSub),
-				code.Make(code.OpIndex),
 				code.Make(code.OpPop),
 			},
 		},
 	}
 
 	runCompilerTests(t, tests)
+
+	// Constants from an earlier compilation are reused, as in the REPL
+	first := New()
+	first.Compile(parse(`"id"`))
+	second := NewWithState(first.symbolTable, first.Bytecode().Constants)
+	second.Compile(parse(`"id"`))
+	if len(second.Bytecode().Constants) != 1 {
+		t.Errorf("wrong number of constants. want=1, got=%d", len(second.Bytecode().Constants))
+	}
 }
 
-func TestFunctions(t *testing.T) {
+func TestConstantFolding(t *testing.T) {
+	fold := Options{FoldConstants: true}
+
 	tests := []compilerTestCase{
 		{
-			input: "fn() { return 5 + 10 }",
-			expectedConstants: []interface{}{5, 10, []code.Instructions{
+			input:             "2 * 60 * 60",
+			expectedConstants: []interface{}{2, 60},
+			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 0),
 				code.Make(code.OpConstant, 1),
-				code.Make(code.OpAdd),
-				code.Make(code.OpReturnValue),
-			}},
+				code.Make(code.OpMul),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpMul),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "2 * 60 * 60",
+			expectedConstants: []interface{}{7200},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpConstant, 0),
 				code.Make(code.OpPop),
 			},
+			options: fold,
 		},
 		{
-			input: "fn() { 5 + 10 }",
-			expectedConstants: []interface{}{5, 10, []code.Instructions{
+			input:             `-(1 + 2.5); "a" + "b"; 3 < 4; !null; 1 == 1.0`,
+			expectedConstants: []interface{}{&object.Float{Value: -3.5}, "ab"},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpPop),
+				code.Make(code.OpTrue),
+				code.Make(code.OpPop),
+				code.Make(code.OpTrue),
+				code.Make(code.OpPop),
+				code.Make(code.OpTrue),
+				code.Make(code.OpPop),
+			},
+			options: fold,
+		},
+		{
+			// Errors are left for run time
+			input:             `1 / 0; "a" + 1`,
+			expectedConstants: []interface{}{1, 0, "a"},
+			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 0),
 				code.Make(code.OpConstant, 1),
+				code.Make(code.OpDiv),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpConstant, 0),
 				code.Make(code.OpAdd),
-				code.Make(code.OpReturnValue),
-			}},
+				code.Make(code.OpPop),
+			},
+			options: fold,
+		},
+		{
+			input:             "let x = 5; (x - 2 * 1) * 1; x * 1; x + 0",
+			expectedConstants: []interface{}{5, 2, 1, 0},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpSub),
+				code.Make(code.OpPop),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpMul),
+				code.Make(code.OpPop),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 3),
+				code.Make(code.OpAdd),
 				code.Make(code.OpPop),
 			},
+			options: fold,
 		},
 		{
-			input: "fn() { 1; 2 }",
-			expectedConstants: []interface{}{1, 2, []code.Instructions{
+			input:             "if (1 > 2) { 10 } else { 20 }; if (!false) { 30 }; if (null) { 40 }",
+			expectedConstants: []interface{}{20, 30},
+			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 0),
 				code.Make(code.OpPop),
 				code.Make(code.OpConstant, 1),
-				code.Make(code.OpReturnValue),
-			}},
-			expectedInstructions: []code.Instructions{
-				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+				code.Make(code.OpNull),
 				code.Make(code.OpPop),
 			},
+			options: fold,
 		},
 	}
 
 	runCompilerTests(t, tests)
 }
 
-func TestFunctionCalls(t *testing.T) {
+func TestPeephole(t *testing.T) {
+	peephole := Options{Peephole: true}
+
 	tests := []compilerTestCase{
 		{
-			input: "fn() { 24 }();",
-			expectedConstants: []interface{}{24, []code.Instructions{
+			// The inner if's jumps land on the OpJump past the outer
+			// alternative, so they go straight to its target
+			input:             "let x = true; if (x) { if (x) { 1 } else { 2 } } else { 3 }",
+			expectedConstants: []interface{}{1, 2, 3},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpTrue),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpJumpNotTruthy, 28),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpJumpNotTruthy, 22),
 				code.Make(code.OpConstant, 0),
-				code.Make(code.OpReturnValue),
-			}},
+				code.Make(code.OpJump, 31),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpJump, 31),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpPop),
+			},
+			options: peephole,
+		},
+		{
+			// In a function they return straight away instead
+			input: "fn(x) { if (x) { if (x) { 1 } else { 2 } } else { 3 } }",
+			expectedConstants: []interface{}{
+				1, 2, 3,
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpJumpNotTruthy, 18),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpJumpNotTruthy, 14),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpReturnValue),
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpReturnValue),
+					code.Make(code.OpConstant, 2),
+					code.Make(code.OpReturnValue),
+				},
+			},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpClosure, 1, 0),
-				code.Make(code.OpCall, 0),
+				code.Make(code.OpClosure, 3, 0),
 				code.Make(code.OpPop),
 			},
+			options: peephole,
 		},
 		{
-			input: `
-let noArg = fn() { 24 };
-noArg();
-`,
-			expectedConstants: []interface{}{24, []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpReturnValue),
-			}},
+			// A call in the consequence becomes a tail call once its jump
+			// to the return is replaced by the return
+			input: "fn(f) { if (f) { f(1) } else { f(2) } }",
+			expectedConstants: []interface{}{
+				1, 2,
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpJumpNotTruthy, 13),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpTailCall, 1),
+					code.Make(code.OpReturnValue),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpTailCall, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpClosure, 1, 0),
-				code.Make(code.OpSetGlobal, 0),
-				code.Make(code.OpGetGlobal, 0),
-				code.Make(code.OpCall, 0),
+				code.Make(code.OpClosure, 2, 0),
 				code.Make(code.OpPop),
 			},
+			options: peephole,
 		},
 		{
-			input: `
-let oneArg = fn(a) { a };
-oneArg(1);
-`,
-			expectedConstants: []interface{}{[]code.Instructions{
-				code.Make(code.OpGetLocal, 0),
-				code.Make(code.OpReturnValue),
-			}, 1},
+			input: "fn() { 1; 2 }",
+			expectedConstants: []interface{}{
+				1, 2,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpClosure, 0, 0),
-				code.Make(code.OpSetGlobal, 0),
-				code.Make(code.OpGetGlobal, 0),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpCall, 1),
+				code.Make(code.OpClosure, 2, 0),
 				code.Make(code.OpPop),
 			},
+			options: peephole,
 		},
 		{
-			input: `
-let manyArg = fn(a, b, c) { a; b; c };
-manyArg(1, 2, 3);
-`,
-			expectedConstants: []interface{}{[]code.Instructions{
-				code.Make(code.OpGetLocal, 0),
+			// The last value popped is the program's result, so top-level
+			// pops stay
+			input:             "if (true) { 10 }; 3333",
+			expectedConstants: []interface{}{10, 3333},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpJump, 7),
+				code.Make(code.OpNull),
 				code.Make(code.OpPop),
-				code.Make(code.OpGetLocal, 1),
+				code.Make(code.OpConstant, 1),
 				code.Make(code.OpPop),
-				code.Make(code.OpGetLocal, 2),
-				code.Make(code.OpReturnValue),
-			}, 1, 2, 3},
+			},
+			options: peephole,
+		},
+		{
+			input:             "let a = 1; if (false) { 5 } else { 6 }",
+			expectedConstants: []interface{}{1, 5, 6},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpClosure, 0, 0),
+				code.Make(code.OpConstant, 0),
 				code.Make(code.OpSetGlobal, 0),
-				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpJump, 15),
 				code.Make(code.OpConstant, 1),
+				code.Make(code.OpJump, 18),
 				code.Make(code.OpConstant, 2),
-				code.Make(code.OpConstant, 3),
-				code.Make(code.OpCall, 3),
+				code.Make(code.OpPop),
+			},
+			options: peephole,
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestTailCalls(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: "fn(f) { return f(1); }",
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpTailCall, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// Both branches end the function, whether or not a jump
+			// separates their call from the return
+			input: "fn(f) { if (f) { f(1) } else { f(2) } }",
+			expectedConstants: []interface{}{
+				1, 2,
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpJumpNotTruthy, 15),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpTailCall, 1),
+					code.Make(code.OpJump, 22),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpTailCall, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// The call's result is stored rather than returned
+			input: "fn(f) { let x = f(1); x }",
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpCall, 1),
+					code.Make(code.OpSetLocal, 1),
+					code.Make(code.OpGetLocal, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: "fn(f) { f(1, n: 2) }",
+			expectedConstants: []interface{}{
+				1, 2, []interface{}{"n"},
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpTailCallKeywords, 1, 2),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 3, 0),
 				code.Make(code.OpPop),
 			},
 		},
+		{
+			input: "fn(f) { f(1) + 1 }",
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpCall, 1),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpAdd),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: "let f = fn() { 1 }; f()",
+			expectedConstants: []interface{}{1, []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpReturnValue),
+			}},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpCall, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestSuperinstructions(t *testing.T) {
+	fused := Options{Superinstructions: true}
+
+	tests := []compilerTestCase{
+		{
+			input: "fn(a, b) { if (a > b) { a + 1 } else { b - 1 } }",
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpJumpLocalsNotGreater, 0, 1, 12),
+					code.Make(code.OpLocalAddConstant, 0, 0),
+					code.Make(code.OpJump, 16),
+					code.Make(code.OpLocalSubConstant, 1, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+			options: fused,
+		},
+		{
+			// The peephole optimiser's returns are fused too
+			input: "fn(n) { if (n == 0) { n } else { 2 } }",
+			expectedConstants: []interface{}{
+				0, 2,
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpJumpNotEqual, 10),
+					code.Make(code.OpReturnLocal, 0),
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+			options: Options{Peephole: true, Superinstructions: true},
+		},
+		{
+			// The then branch jumps to the OpConstant, so it is not fused
+			// with the else branch's OpGetLocal
+			input: "fn(a, b) { (if (a) { a } else { b }) + 1 }",
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpJumpNotTruthy, 10),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpJump, 12),
+					code.Make(code.OpGetLocal, 1),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpAdd),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+			options: fused,
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestSpecialiseIntegers(t *testing.T) {
+	specialised := Options{SpecialiseIntegers: true}
+
+	tests := []compilerTestCase{
+		{
+			input: "fn(a: int, b: int) { if (a < b) { a * b } else { a - 1 } }",
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpCheckLocal, 0, 0),
+					code.Make(code.OpCheckLocal, 1, 0),
+					code.Make(code.OpGetLocal, 1),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpGreaterThanInt),
+					code.Make(code.OpJumpNotTruthy, 22),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpGetLocal, 1),
+					code.Make(code.OpMulInt),
+					code.Make(code.OpJump, 28),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSubInt),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+			options: specialised,
+		},
+		{
+			// Unannotated variables have the type of the value they are
+			// bound to
+			input:             "let x = 2; let y = x * 3; y > x",
+			expectedConstants: []interface{}{2, 3},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpMulInt),
+				code.Make(code.OpSetGlobal, 1),
+				code.Make(code.OpGetGlobal, 1),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpGreaterThanInt),
+				code.Make(code.OpPop),
+			},
+			options: specialised,
+		},
+		{
+			// An annotated let is checked unless its value's type is known
+			input: "fn(a) { let n: int = a; let m: int = n + 1; a + m }",
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpCheckType, 0),
+					code.Make(code.OpSetLocal, 1),
+					code.Make(code.OpGetLocal, 1),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpAddInt),
+					code.Make(code.OpSetLocal, 2),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpGetLocal, 2),
+					code.Make(code.OpAdd),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+			options: specialised,
+		},
+		{
+			input:             "let x = 1; x + 1.5",
+			expectedConstants: []interface{}{1, 1.5},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpAdd),
+				code.Make(code.OpPop),
+			},
+			options: specialised,
+		},
+		{
+			// Annotations are checked even when nothing is specialised
+			input: "fn(a: int) { a + 1 }",
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpCheckLocal, 0, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpAdd),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestTypeAnnotationErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`let x: int = "a";`, "type mismatch: x is annotated int, got STRING"},
+		{`let x: float = 1;`, "type mismatch: x is annotated float, got INTEGER"},
+		{`let x = 1; let y: string = x * 2;`, "type mismatch: y is annotated string, got INTEGER"},
+		{`fn(a: number) { a }`, "unknown type number"},
+		{`let x: number = 1;`, "unknown type number"},
+	}
+
+	for _, tt := range tests {
+		compiler := New()
+		err := compiler.Compile(parse(tt.input))
+		if err == nil {
+			t.Fatalf("expected compiler error %q", tt.expected)
+		}
+
+		if err.Error() != tt.expected {
+			t.Errorf("wrong compiler error. want=%q, got=%q", tt.expected, err)
+		}
+	}
+}
+
+func TestEscapeAnalysis(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: "fn(k) { let add = fn(x) { x + k }; add(1) }",
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpGetCallerLocal, 0),
+					code.Make(code.OpAdd),
+					code.Make(code.OpReturnValue),
+				},
+				1,
+				[]code.Instructions{
+					code.Make(code.OpClosure, 0, 0),
+					code.Make(code.OpSetLocal, 1),
+					code.Make(code.OpGetLocal, 1),
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpTailCall, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+			options: Options{EscapeAnalysis: true},
+		},
+		{
+			// Returned, the closure escapes and captures k
+			input: "fn(k) { let add = fn(x) { x + k }; add }",
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpGetFree, 0),
+					code.Make(code.OpAdd),
+					code.Make(code.OpReturnValue),
+				},
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpClosure, 0, 1),
+					code.Make(code.OpSetLocal, 1),
+					code.Make(code.OpGetLocal, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+			options: Options{EscapeAnalysis: true},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestNonEscaping(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string
+	}{
+		{"fn(k) { let f = fn(x) { x + k }; f(1) + f(2) }", []string{"f"}},
+		{"fn(k) { fn f(x) { x + k } f(k: 1) }", []string{"f"}},
+		{"fn(k) { let f = fn(x) { x + k }; if (k) { f(1) } else { [f(2)] } }", []string{"f"}},
+		// Returned, stored or passed on, a closure escapes
+		{"fn(k) { let f = fn(x) { x + k }; f }", []string{}},
+		{"fn(k) { let f = fn(x) { x + k }; [f] }", []string{}},
+		{"fn(k, g) { let f = fn(x) { x + k }; g(f) }", []string{}},
+		// So does one called by another closure, which may run elsewhere
+		{"fn(k) { let f = fn(x) { x + k }; let g = fn() { f(1) }; g() }", []string{"g"}},
+		{"fn(k) { let f = fn(x) { f(x) }; f(1) }", []string{}},
+		// Names bound more than once are left alone
+		{"fn(f) { let f = fn(x) { x }; f(1) }", []string{}},
+		{"fn(k) { let f = fn(x) { x }; match k { f => f } }", []string{}},
+	}
+
+	for _, tt := range tests {
+		program := parse(tt.input)
+		fn := program.Statements[0].(*ast.ExpressionStatement).Expression.(*ast.FunctionLiteral)
+
+		names := []string{}
+		for _, literal := range nonEscaping(fn) {
+			names = append(names, literal.Name)
+		}
+		sort.Strings(names)
+
+		if !reflect.DeepEqual(names, tt.expected) {
+			t.Errorf("%q: want=%v, got=%v", tt.input, tt.expected, names)
+		}
+	}
+}
+
+func TestSSA(t *testing.T) {
+	ssa := Options{SSA: true}
+
+	tests := []compilerTestCase{
+		{
+			input:             `let x = 2 * 3; if (x > 5) { "big" } else { "small" }`,
+			expectedConstants: []interface{}{6, 5, "big", "small"},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpConstant, 0),
+				// 0003
+				code.Make(code.OpSetGlobal, 0),
+				// 0006
+				code.Make(code.OpGetGlobal, 0),
+				// 0009
+				code.Make(code.OpConstant, 1),
+				// 0012
+				code.Make(code.OpGreaterThan),
+				// 0013
+				code.Make(code.OpJumpNotTruthy, 22),
+				// 0016
+				code.Make(code.OpConstant, 2),
+				// 0019
+				code.Make(code.OpJump, 25),
+				// 0022
+				code.Make(code.OpConstant, 3),
+				// 0025
+				code.Make(code.OpPop),
+			},
+			options: ssa,
+		},
+		{
+			// Copies are propagated, so the variables need no slots
+			input: "fn(a) { let b = a; let c = b; c + 1 }",
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpAdd),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+			options: ssa,
+		},
+		{
+			// A value used after a call that follows it is kept in a slot
+			input: "fn(a) { let n = len(a); [first(a), n] }",
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpGetBuiltin, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpCall, 1),
+					code.Make(code.OpSetLocal, 1),
+					code.Make(code.OpGetBuiltin, 1),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpCall, 1),
+					code.Make(code.OpGetLocal, 1),
+					code.Make(code.OpArray, 2),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 0, 0),
+				code.Make(code.OpPop),
+			},
+			options: ssa,
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestSSAFallback(t *testing.T) {
+	modules := MapResolver{"shapes": "export enum Shape { Circle(r) }"}
+
+	tests := []struct {
+		input    string
+		options  Options
+		warnings []string
+	}{
+		{
+			input:    "let x = 1; x + 2",
+			options:  Options{SSA: true},
+			warnings: []string{},
+		},
+		{
+			input:    "match 1 { _ => 2 }",
+			options:  Options{SSA: true},
+			warnings: []string{"not supported by the IR: MatchExpression, compiled without the IR"},
+		},
+		{
+			input:    "let f = fn(a, b = 1) { a }; f(1)",
+			options:  Options{SSA: true, Backend: RegisterBackend},
+			warnings: []string{"not supported by the IR: default parameters, compiled without the IR"},
+		},
+		{
+			input:   `import "shapes"; shapes.Circle(1)`,
+			options: Options{SSA: true},
+			warnings: []string{
+				"not supported by the IR: ImportStatement, compiled without the IR",
+				"shapes: not supported by the IR: ExportStatement, compiled without the IR",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		compiler := NewWithResolverOptions(modules, "", tt.options)
+		err := compiler.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		warnings := compiler.Warnings()
+		if len(warnings) != len(tt.warnings) {
+			t.Fatalf("%q: wrong number of warnings. want=%q, got=%q", tt.input, tt.warnings, warnings)
+		}
+
+		for i, want := range tt.warnings {
+			if warnings[i] != want {
+				t.Errorf("wrong warning. want=%q, got=%q", want, warnings[i])
+			}
+		}
+	}
+}
+
+func TestInlining(t *testing.T) {
+	inline := Options{Inline: true}
+
+	tests := []compilerTestCase{
+		{
+			input: "let sq = fn(x) { x * x }; sq(3) + sq(4)",
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpMul),
+					code.Make(code.OpReturnValue),
+				},
+				3, 4,
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 0, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpSetGlobal, 1),
+				code.Make(code.OpGetGlobal, 1),
+				code.Make(code.OpGetGlobal, 1),
+				code.Make(code.OpMul),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpSetGlobal, 2),
+				code.Make(code.OpGetGlobal, 2),
+				code.Make(code.OpGetGlobal, 2),
+				code.Make(code.OpMul),
+				code.Make(code.OpAdd),
+				code.Make(code.OpPop),
+			},
+			options: inline,
+		},
+		{
+			// The arguments go to new locals of the caller, and g still
+			// means the global it meant where f was defined
+			input: "let g = 10; let f = fn(x, y) { x - y + g }; fn() { let g = 1; f(2, g) }",
+			expectedConstants: []interface{}{
+				10,
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpGetLocal, 1),
+					code.Make(code.OpSub),
+					code.Make(code.OpGetGlobal, 0),
+					code.Make(code.OpAdd),
+					code.Make(code.OpReturnValue),
+				},
+				1, 2,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 2),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpConstant, 3),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpSetLocal, 2),
+					code.Make(code.OpSetLocal, 1),
+					code.Make(code.OpGetLocal, 1),
+					code.Make(code.OpGetLocal, 2),
+					code.Make(code.OpSub),
+					code.Make(code.OpGetGlobal, 0),
+					code.Make(code.OpAdd),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpSetGlobal, 1),
+				code.Make(code.OpClosure, 4, 0),
+				code.Make(code.OpPop),
+			},
+			options: inline,
+		},
+		{
+			input: "let f = fn(x) { f(x) }; f(1)",
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpCurrentClosure),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpTailCall, 1),
+					code.Make(code.OpReturnValue),
+				},
+				1,
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 0, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpCall, 1),
+				code.Make(code.OpPop),
+			},
+			options: inline,
+		},
+		{
+			input: "let sq = fn(x) { x * x }; sq(3)",
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpMul),
+					code.Make(code.OpReturnValue),
+				},
+				3,
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 0, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpCall, 1),
+				code.Make(code.OpPop),
+			},
+			options: Options{Inline: true, InlineThreshold: 5},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestDeadCode(t *testing.T) {
+	dce := Options{EliminateDeadCode: true}
+
+	tests := []compilerTestCase{
+		{
+			input: "fn(x) { let a = 1; let _b = fn() { x }; let c = x + 1; 5; x; return a; 99 }",
+			// The constants of the dropped code are pruned
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSetLocal, 1),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpAdd),
+					code.Make(code.OpSetLocal, 3),
+					code.Make(code.OpGetLocal, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+			options: dce,
+		},
+		{
+			input: "let f = fn(x) { let unused = fn() { 7 }; fn helper() { 8 } x }; 9",
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpReturnValue),
+				},
+				9,
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 0, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpPop),
+			},
+			options: dce,
+		},
+		{
+			input: "fn(x) { if (x) { return 1 } else { return 2 }; x }",
+			expectedConstants: []interface{}{
+				1, 2,
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpJumpNotTruthy, 9),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpReturnValue),
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+			options: dce,
+		},
+		{
+			input:             "if (true) { 10 }; 3333",
+			expectedConstants: []interface{}{10, 3333},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpPop),
+			},
+			options: Options{EliminateDeadCode: true, Peephole: true},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestDeadCodeWarnings(t *testing.T) {
+	tests := []struct {
+		input    string
+		warnings []string
+	}{
+		{
+			input: `fn(x) {
+  return x;
+  x + 1;
+}`,
+			warnings: []string{"3:3: unreachable code"},
+		},
+		{
+			input:    "fn(x) { if (x) { return 1 } else { return 2 }; 3 }",
+			warnings: []string{"1:48: unreachable code"},
+		},
+		{
+			input:    "fn(x) { if (x) { return 1 }; 2 }",
+			warnings: []string{},
+		},
+		{
+			input:    "fn() { let a = 1; let b = 2; let _c = 3; b }",
+			warnings: []string{"1:12: unused variable a"},
+		},
+		{
+			input:    "fn() { let a = 1; fn() { a } }",
+			warnings: []string{},
+		},
+		{
+			input:    "fn(x) { fn helper() { 1 } let [a, b] = x; match x { [c, d] => c }; b }",
+			warnings: []string{"1:12: unused variable helper", "1:32: unused variable a", "1:57: unused variable d"},
+		},
+		{
+			input:    "fn() { let f = fn() { 1 }; let g = fn() { 2 }; g() }",
+			warnings: []string{"1:12: unused variable f"},
+		},
+		{
+			// Top-level variables can be read by code compiled later
+			input:    "let a = 1;",
+			warnings: []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		for _, opts := range []Options{{}, {EliminateDeadCode: true}} {
+			compiler := NewWithOptions(opts)
+			err := compiler.Compile(parse(tt.input))
+			if err != nil {
+				t.Fatalf("compiler error: %s", err)
+			}
+
+			warnings := compiler.Warnings()
+			if len(warnings) != len(tt.warnings) {
+				t.Fatalf("wrong number of warnings for %q. want=%q, got=%q", tt.input, tt.warnings, warnings)
+			}
+			for i, want := range tt.warnings {
+				if warnings[i] != want {
+					t.Errorf("wrong warning. want=%q, got=%q", want, warnings[i])
+				}
+			}
+		}
+	}
+}
+
+func TestPeepholePositions(t *testing.T) {
+	input := `let a = 1;
+if (false) { 5 } else { 6 }`
+
+	compiler := NewWithOptions(Options{Peephole: true})
+	err := compiler.Compile(parse(input))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	bytecode := compiler.Bytecode()
+	for offset, want := range map[int]string{0: "1:9", 3: "1:1", 6: "2:1", 9: "2:14", 15: "2:25", 18: "2:1"} {
+		pos, ok := bytecode.Positions.Lookup(offset)
+		if !ok || pos.String() != want {
+			t.Errorf("wrong position at %04d. want=%s, got=%s", offset, want, pos)
+		}
+	}
+}
+
+func TestIndexExpressions(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "[1, 2, 3][1 + 1]",
+			expectedConstants: []interface{}{1, 2, 3},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpArray, 3),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpAdd),
+				code.Make(code.OpIndex),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "{1: 2}[2 - 1]",
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpHash, 2),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSub),
+				code.Make(code.OpIndex),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestFunctions(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: "fn() { return 5 + 10 }",
+			expectedConstants: []interface{}{5, 10, []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpAdd),
+				code.Make(code.OpReturnValue),
+			}},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: "fn() { 5 + 10 }",
+			expectedConstants: []interface{}{5, 10, []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpAdd),
+				code.Make(code.OpReturnValue),
+			}},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: "fn() { 1; 2 }",
+			expectedConstants: []interface{}{1, 2, []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpReturnValue),
+			}},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestFunctionCalls(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: "fn() { 24 }();",
+			expectedConstants: []interface{}{24, []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpReturnValue),
+			}},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpCall, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `
+let noArg = fn() { 24 };
+noArg();
+`,
+			expectedConstants: []interface{}{24, []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpReturnValue),
+			}},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpCall, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `
+let oneArg = fn(a) { a };
+oneArg(1);
+`,
+			expectedConstants: []interface{}{[]code.Instructions{
+				code.Make(code.OpGetLocal, 0),
+				code.Make(code.OpReturnValue),
+			}, 1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 0, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpCall, 1),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `
+let manyArg = fn(a, b, c) { a; b; c };
+manyArg(1, 2, 3);
+`,
+			expectedConstants: []interface{}{[]code.Instructions{
+				code.Make(code.OpGetLocal, 0),
+				code.Make(code.OpPop),
+				code.Make(code.OpGetLocal, 1),
+				code.Make(code.OpPop),
+				code.Make(code.OpGetLocal, 2),
+				code.Make(code.OpReturnValue),
+			}, 1, 2, 3},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 0, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpConstant, 3),
+				code.Make(code.OpCall, 3),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestFunctionParameters(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: "fn(a, b = 2) { a + b }",
+			expectedConstants: []interface{}{2, []code.Instructions{
+				// 0000
+				code.Make(code.OpJumpSupplied, 1, 9),
+				// 0004
+				code.Make(code.OpConstant, 0),
+				// 0007
+				code.Make(code.OpSetLocal, 1),
+				// 0009
+				code.Make(code.OpGetLocal, 0),
+				// 0011
+				code.Make(code.OpGetLocal, 1),
+				// 0013
+				code.Make(code.OpAdd),
+				// 0014
+				code.Make(code.OpReturnValue),
+			}},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: "let f = fn(a) { a }; f(a: 1);",
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpReturnValue),
+				},
+				1,
+				&object.Array{Elements: []object.Object{&object.String{Value: "a"}}},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 0, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpCallKeywords, 0, 2),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+
+	program := parse("fn(a, b = 2, ...rest) { a }")
+	compiler := New()
+	err := compiler.Compile(program)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	fn := compiler.Bytecode().Constants[1].(*object.CompiledFunction)
+	if fn.NumParameters != 2 || fn.NumDefaults != 1 || !fn.Variadic || fn.NumLocals != 3 {
+		t.Errorf("wrong function signature. got=%+v", fn)
+	}
+
+	errors := []struct {
+		input    string
+		expected string
+	}{
+		{"fn(a = b, b = 1) { a }", "default of parameter a: undefined variable b"},
+		{"let b = 1; fn(a = b, b = 2) { a }", "default of parameter a: undefined variable b"},
+		{"fn(a = fn() { a }) { a }", "default of parameter a: undefined variable a"},
+		{"fn(a, b = a, ...rest) { rest }", ""},
+		{"fn(a, b = rest, ...rest) { a }", "default of parameter b: undefined variable rest"},
+		{"fn(a, a) { a }", "duplicate parameter a"},
+		{"fn(a, ...a) { a }", "duplicate parameter a"},
+	}
+
+	for _, tt := range errors {
+		compiler := New()
+		err := compiler.Compile(parse(tt.input))
+		if tt.expected == "" {
+			if err != nil {
+				t.Errorf("%s: compiler error: %s", tt.input, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != tt.expected {
+			t.Errorf("%s: want error %q, got %v", tt.input, tt.expected, err)
+		}
+	}
+}
+
+func TestLetStatementScopes(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `
+let num = 55;
+fn() { num }
+`,
+			expectedConstants: []interface{}{55, []code.Instructions{
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpReturnValue),
+			}},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `
+fn() {
+let num = 55;
+num
+}
+`,
+			expectedConstants: []interface{}{55, []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetLocal, 0),
+				code.Make(code.OpGetLocal, 0),
+				code.Make(code.OpReturnValue),
+			}},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `
+fn() {
+let a = 55;
+let b = 77;
+a + b
+}
+`,
+			expectedConstants: []interface{}{55, 77, []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetLocal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpSetLocal, 1),
+				code.Make(code.OpGetLocal, 0),
+				code.Make(code.OpGetLocal, 1),
+				code.Make(code.OpAdd),
+				code.Make(code.OpReturnValue),
+			}},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestLetValueScope(t *testing.T) {
+	inputs := []string{
+		"let x = x + 1; x",
+		"let x = -x; x",
+		"let f = fn() { let y = y + 1; y }; f()",
+	}
+
+	for _, input := range inputs {
+		compiler := New()
+		err := compiler.Compile(parse(input))
+		if err == nil || !strings.HasPrefix(err.Error(), "undefined variable") {
+			t.Errorf("%q: expected undefined variable, got %v", input, err)
+		}
+	}
+}
+
+func TestBuiltins(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `
+len([]);
+push([], 1);
+`,
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpGetBuiltin, 0),
+				code.Make(code.OpArray, 0),
+				code.Make(code.OpCall, 1),
+				code.Make(code.OpPop),
+				code.Make(code.OpGetBuiltin, 4),
+				code.Make(code.OpArray, 0),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpCall, 2),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: "fn() { len([]) }",
+			expectedConstants: []interface{}{[]code.Instructions{
+				code.Make(code.OpGetBuiltin, 0),
+				code.Make(code.OpArray, 0),
+				code.Make(code.OpTailCall, 1),
+				code.Make(code.OpReturnValue),
+			}},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 0, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestRecursiveFunctions(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `
+let countDown = fn(x) { countDown(x - 1); };
+countDown(1);
+`,
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpCurrentClosure),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSub),
+					code.Make(code.OpTailCall, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpCall, 1),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `
+let wrapper = fn() {
+    let countDown = fn(x) { countDown(x - 1); };
+    countDown(1);
+};
+wrapper();
+`,
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpCurrentClosure),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSub),
+					code.Make(code.OpTailCall, 1),
+					code.Make(code.OpReturnValue),
+				},
+				[]code.Instructions{
+					code.Make(code.OpClosure, 1, 0),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpTailCall, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpCall, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `
+fn() {
+    fn even(n) { odd(n) }
+    fn odd(n) { even(n) }
+}
+`,
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpGetFree, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpTailCall, 1),
+					code.Make(code.OpReturnValue),
+				},
+				[]code.Instructions{
+					code.Make(code.OpGetFree, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpTailCall, 1),
+					code.Make(code.OpReturnValue),
+				},
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 1),
+					code.Make(code.OpClosure, 0, 1),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpClosure, 1, 1),
+					code.Make(code.OpSetLocal, 1),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpGetLocal, 1),
+					code.Make(code.OpSetFree, 0),
+					code.Make(code.OpReturn),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestClosures(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `
+fn(a) {
+fn(b) { a + b };
+}
+`,
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpGetFree, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpAdd),
+					code.Make(code.OpReturnValue),
+				},
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpClosure, 0, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `
+fn(a) {
+fn(b) {
+fn(c) { a + b + c };
+};
+};
+`,
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpGetFree, 0),
+					code.Make(code.OpGetFree, 1),
+					code.Make(code.OpAdd),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpAdd),
+					code.Make(code.OpReturnValue),
+				},
+				[]code.Instructions{
+					code.Make(code.OpGetFree, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpClosure, 0, 2),
+					code.Make(code.OpReturnValue),
+				},
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpClosure, 1, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestEnums(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `
+enum Shape { Circle(r), Empty }
+match Empty { Circle(r) => r, Empty => 0 }
+`,
+			expectedConstants: []interface{}{
+				&object.VariantConstructor{Enum: "Shape", Name: "Circle", Arity: 1},
+				&object.Variant{Enum: "Shape", Name: "Empty"},
+				0,
+			},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpConstant, 0),
+				// 0003
+				code.Make(code.OpSetGlobal, 0),
+				// 0006
+				code.Make(code.OpConstant, 1),
+				// 0009
+				code.Make(code.OpSetGlobal, 1),
+				// 0012
+				code.Make(code.OpGetGlobal, 1),
+				// 0015
+				code.Make(code.OpSetGlobal, 2),
+				// 0018
+				code.Make(code.OpGetGlobal, 2),
+				// 0021
+				code.Make(code.OpMatchVariant, 0),
+				// 0024
+				code.Make(code.OpJumpNotTruthy, 43),
+				// 0027
+				code.Make(code.OpGetGlobal, 2),
+				// 0030
+				code.Make(code.OpConstant, 2),
+				// 0033
+				code.Make(code.OpIndex),
+				// 0034
+				code.Make(code.OpSetGlobal, 3),
+				// 0037
+				code.Make(code.OpGetGlobal, 3),
+				// 0040
+				code.Make(code.OpJump, 59),
+				// 0043
+				code.Make(code.OpGetGlobal, 2),
+				// 0046
+				code.Make(code.OpMatchVariant, 1),
+				// 0049
+				code.Make(code.OpJumpNotTruthy, 58),
+				// 0052
+				code.Make(code.OpConstant, 2),
+				// 0055
+				code.Make(code.OpJump, 59),
+				// 0058
+				code.Make(code.OpNull),
+				// 0059
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestMatchPatterns(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "match [1] { [x, ..rest] if x > 0 => x }",
+			expectedConstants: []interface{}{1, 0},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpConstant, 0),
+				// 0003
+				code.Make(code.OpArray, 1),
+				// 0006
+				code.Make(code.OpSetGlobal, 0),
+				// 0009
+				code.Make(code.OpGetGlobal, 0),
+				// 0012
+				code.Make(code.OpMatchArray, 1, 0, 1),
+				// 0018
+				code.Make(code.OpJumpNotTruthy, 56),
+				// 0021
+				code.Make(code.OpGetGlobal, 0),
+				// 0024
+				code.Make(code.OpConstant, 1),
+				// 0027
+				code.Make(code.OpIndex),
+				// 0028
+				code.Make(code.OpSetGlobal, 1),
+				// 0031
+				code.Make(code.OpGetGlobal, 0),
+				// 0034
+				code.Make(code.OpSlice, 1),
+				// 0037
+				code.Make(code.OpSetGlobal, 2),
+				// 0040
+				code.Make(code.OpGetGlobal, 1),
+				// 0043
+				code.Make(code.OpConstant, 1),
+				// 0046
+				code.Make(code.OpGreaterThan),
+				// 0047
+				code.Make(code.OpJumpNotTruthy, 56),
+				// 0050
+				code.Make(code.OpGetGlobal, 1),
+				// 0053
+				code.Make(code.OpJump, 57),
+				// 0056
+				code.Make(code.OpNull),
+				// 0057
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             `match {"a": 1} { {a} => a }`,
+			expectedConstants: []interface{}{"a", 1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpHash, 2),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpMatchHash, 1),
+				code.Make(code.OpJumpNotTruthy, 40),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpIndex),
+				code.Make(code.OpSetGlobal, 1),
+				code.Make(code.OpGetGlobal, 1),
+				code.Make(code.OpJump, 41),
+				code.Make(code.OpNull),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestDestructuringLet(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: "let [a, b] = [1, 2];",
+			expectedConstants: []interface{}{
+				1, 2, "value does not match pattern [a, b]", 0,
+			},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpConstant, 0),
+				// 0003
+				code.Make(code.OpConstant, 1),
+				// 0006
+				code.Make(code.OpArray, 2),
+				// 0009
+				code.Make(code.OpSetGlobal, 0),
+				// 0012
+				code.Make(code.OpGetGlobal, 0),
+				// 0015
+				code.Make(code.OpMatchArray, 2, 0, 0),
+				// 0021
+				code.Make(code.OpJumpNotTruthy, 27),
+				// 0024
+				code.Make(code.OpJump, 30),
+				// 0027
+				code.Make(code.OpFail, 2),
+				// 0030
+				code.Make(code.OpGetGlobal, 0),
+				// 0033
+				code.Make(code.OpConstant, 3),
+				// 0036
+				code.Make(code.OpIndex),
+				// 0037
+				code.Make(code.OpSetGlobal, 1),
+				// 0040
+				code.Make(code.OpGetGlobal, 0),
+				// 0043
+				code.Make(code.OpConstant, 0),
+				// 0046
+				code.Make(code.OpIndex),
+				// 0047
+				code.Make(code.OpSetGlobal, 2),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestDefaultsEvaluatedOnce(t *testing.T) {
+	inputs := []string{
+		"let f = fn() { [1, 2] }; let [[b, c] = f()] = []; c",
+		`let f = fn() { {"x": 1, "y": 2} }; let {p: {x, y} = f()} = {}; y`,
+		"let f = fn() { [1, 2] }; match [] { [[b, c] = f()] => c }",
+	}
+
+	for _, input := range inputs {
+		compiler := New()
+		err := compiler.Compile(parse(input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		main := compiler.Bytecode().Instructions.String()
+		if calls := strings.Count(main, "OpCall"); calls != 1 {
+			t.Errorf("%q: default compiled %d times, want once", input, calls)
+		}
+	}
+}
+
+func TestMatchExhaustiveness(t *testing.T) {
+	tests := []struct {
+		input    string
+		warnings []string
+	}{
+		{
+			input:    "enum Shape { Circle(r), Rect(w, h) } match Circle(1) { Circle(r) => r }",
+			warnings: []string{"non-exhaustive match on Shape: missing Rect"},
+		},
+		{
+			input:    "enum Shape { Circle(r), Rect(w, h) } match Circle(1) { Circle(0) => 0, Rect(w, h) => w }",
+			warnings: []string{"non-exhaustive match on Shape: missing Circle"},
+		},
+		{
+			input:    "enum Shape { Circle(r), Rect(w, h) } match Circle(1) { Circle(r) if r > 1 => r, Rect(w, h) => w }",
+			warnings: []string{"non-exhaustive match on Shape: missing Circle"},
+		},
+		{
+			input:    "enum Shape { Circle(r), Rect(w, h) } match Circle(1) { Circle(r) => r, Rect(w, h) => w }",
+			warnings: []string{},
+		},
+		{
+			input:    "enum Shape { Circle(r), Rect(w, h) } match Circle(1) { Circle(r) => r, _ => 0 }",
+			warnings: []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		compiler := New()
+		err := compiler.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		warnings := compiler.Warnings()
+		if len(warnings) != len(tt.warnings) {
+			t.Fatalf("wrong number of warnings. want=%q, got=%q", tt.warnings, warnings)
+		}
+
+		for i, want := range tt.warnings {
+			if warnings[i] != want {
+				t.Errorf("wrong warning. want=%q, got=%q", want, warnings[i])
+			}
+		}
+	}
+}
+
+func TestReturnOutsideFunction(t *testing.T) {
+	compiler := New()
+	err := compiler.Compile(parse("if (true) { return 1; }"))
+	if err == nil || err.Error() != "return outside a function" {
+		t.Errorf("expected a return outside a function to fail, got %v", err)
+	}
+}
+
+func TestMatchScopes(t *testing.T) {
+	compiler := New()
+	err := compiler.Compile(parse("match 1 { x => x }; match 2 { [y] => y }; let [z] = [3]; x"))
+	if err == nil || err.Error() != "undefined variable x" {
+		t.Errorf("arm binding in scope after the match, got %v", err)
+	}
+
+	// The temps holding the subjects share one slot, next to the slots of
+	// x, y and z
+	compiler = New()
+	err = compiler.Compile(parse("match 1 { x => x }; match 2 { [y] => y }; let [z] = [3];"))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	if globals := *compiler.symbolTable.globals; globals != 4 {
+		t.Errorf("wrong number of globals. want=4, got=%d", globals)
+	}
+}
+
+func TestMatchErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{
+			input:    "match 1 { Circle(r) => r }",
+			expected: "undefined variant Circle",
+		},
+		{
+			input:    "enum Shape { Rect(w, h) } match 1 { Rect(w) => w }",
+			expected: "variant Rect has 2 fields, got=1",
+		},
+		{
+			input:    "enum A { P(v) } enum B { P(v, w) }",
+			expected: "variant P of enum B is already defined by enum A",
+		},
+		{
+			input:    "enum A { P, P(v) }",
+			expected: "duplicate variant P in enum A",
+		},
+		{
+			input:    "enum A { P(x, y, x) }",
+			expected: "duplicate field x in variant P",
+		},
+	}
+
+	for _, tt := range tests {
+		compiler := New()
+		err := compiler.Compile(parse(tt.input))
+		if err == nil {
+			t.Fatalf("expected compiler error %q", tt.expected)
+		}
+
+		if err.Error() != tt.expected {
+			t.Errorf("wrong compiler error. want=%q, got=%q", tt.expected, err)
+		}
+	}
+}
+
+// Helper functions
+
+func TestMaxStackDepth(t *testing.T) {
+	tests := []struct {
+		input    string
+		main     int
+		function int
+	}{
+		{"1 + 2", 2, -1},
+		{"[1, 2, 3]; 4", 3, -1},
+		{"let x = {1: 2, 3: 4}", 4, -1},
+		{"fn(a, b) { a + b * 2 }", 1, 3},
+		{"let f = fn(a, b, c) { a }; f(1, 2, 3)", 4, 1},
+		{"fn(a) { if (a) { [a, a] } else { a } }", 1, 2},
+		{"fn(a) { fn(b) { a + b } }", 1, 1},
+	}
+
+	for _, tt := range tests {
+		compiler := New()
+		err := compiler.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		bytecode := compiler.Bytecode()
+		if bytecode.MaxStackDepth != tt.main {
+			t.Errorf("%q: wrong main stack depth. want=%d, got=%d",
+				tt.input, tt.main, bytecode.MaxStackDepth)
+		}
+
+		if tt.function < 0 {
+			continue
+		}
+
+		var fn *object.CompiledFunction
+		for _, c := range bytecode.Constants {
+			if f, ok := c.(*object.CompiledFunction); ok {
+				fn = f
+			}
+		}
+		if fn.MaxStackDepth != tt.function {
+			t.Errorf("%q: wrong function stack depth. want=%d, got=%d",
+				tt.input, tt.function, fn.MaxStackDepth)
+		}
 	}
-
-	runCompilerTests(t, tests)
 }
 
-func TestLetStatementScopes(t *testing.T) {
-	tests := []compilerTestCase{
+func TestWideOperands(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []code.Instructions
+	}{
 		{
-			input: `
-let num = 55;
-fn() { num }
-`,
-			expectedConstants: []interface{}{55, []code.Instructions{
-				code.Make(code.OpGetGlobal, 0),
-				code.Make(code.OpReturnValue),
-			}},
-			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpSetGlobal, 0),
-				code.Make(code.OpClosure, 1, 0),
-				code.Make(code.OpPop),
+			// Every element is a separate constant, so the last ones
+			// need an index wider than 16 bits
+			sequence("[", ", ", "]", 70000, func(i int) string { return fmt.Sprint(i) }),
+			[]code.Instructions{
+				code.Make(code.OpConstant, 65535),
+				code.MakeWide(code.OpConstant, 65536),
+				code.MakeWide(code.OpArray, 70000),
 			},
 		},
 		{
-			input: `
-fn() {
-let num = 55;
-num
-}
-`,
-			expectedConstants: []interface{}{55, []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpSetLocal, 0),
-				code.Make(code.OpGetLocal, 0),
-				code.Make(code.OpReturnValue),
-			}},
-			expectedInstructions: []code.Instructions{
-				code.Make(code.OpClosure, 1, 0),
-				code.Make(code.OpPop),
+			sequence("fn() { ", " ", " v"+letters(299)+" }", 300, func(i int) string { return "let v" + letters(i) + " = 0;" }),
+			[]code.Instructions{
+				code.Make(code.OpSetLocal, 255),
+				code.MakeWide(code.OpSetLocal, 256),
+				code.MakeWide(code.OpGetLocal, 299),
 			},
 		},
 		{
-			input: `
-fn() {
-let a = 55;
-let b = 77;
-a + b
-}
-`,
-			expectedConstants: []interface{}{55, 77, []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpSetLocal, 0),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpSetLocal, 1),
-				code.Make(code.OpGetLocal, 0),
-				code.Make(code.OpGetLocal, 1),
-				code.Make(code.OpAdd),
-				code.Make(code.OpReturnValue),
-			}},
-			expectedInstructions: []code.Instructions{
-				code.Make(code.OpClosure, 2, 0),
-				code.Make(code.OpPop),
+			// The consequence is longer than a 16-bit jump can skip
+			sequence("if (len([]) == 0) { [", ", ", "] } else { 1 }", 25000, func(i int) string { return fmt.Sprint(i) }),
+			[]code.Instructions{
+				append(code.MakeWide(code.OpJumpNotTruthy, 75026), code.Make(code.OpConstant, 0)...),
+				code.MakeWide(code.OpJump, 75029),
 			},
 		},
 	}
 
-	runCompilerTests(t, tests)
+	for i, tt := range tests {
+		compiler := New()
+		err := compiler.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("test %d: compiler error: %s", i, err)
+		}
+
+		bytecode := compiler.Bytecode()
+		ins := string(bytecode.Instructions)
+		for _, c := range bytecode.Constants {
+			if fn, ok := c.(*object.CompiledFunction); ok {
+				ins += string(fn.Instructions)
+			}
+		}
+
+		for _, want := range tt.expected {
+			if !strings.Contains(ins, string(want)) {
+				t.Errorf("test %d: instructions do not contain %q", i, want)
+			}
+		}
+
+		for _, violation := range Verify(bytecode) {
+			t.Errorf("test %d: verifier: %s", i, violation)
+		}
+	}
 }
 
-func TestBuiltins(t *testing.T) {
-	tests := []compilerTestCase{
-		{
-			input: `
-len([]);
-push([], 1);
-`,
-			expectedConstants: []interface{}{1},
-			expectedInstructions: []code.Instructions{
-				code.Make(code.OpGetBuiltin, 0),
-				code.Make(code.OpArray, 0),
-				code.Make(code.OpCall, 1),
-				code.Make(code.OpPop),
-				code.Make(code.OpGetBuiltin, 5),
-				code.Make(code.OpArray, 0),
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpCall, 2),
-				code.Make(code.OpPop),
-			},
-		},
-		{
-			input: "fn() { len([]) }",
-			expectedConstants: []interface{}{[]code.Instructions{
-				code.Make(code.OpGetBuiltin, 0),
-				code.Make(code.OpArray, 0),
-				code.Make(code.OpCall, 1),
-				code.Make(code.OpReturnValue),
-			}},
-			expectedInstructions: []code.Instructions{
-				code.Make(code.OpClosure, 0, 0),
-				code.Make(code.OpPop),
-			},
-		},
+func TestOperandLimits(t *testing.T) {
+	input := sequence("let f = fn() { 1 }; f(", ", ", ")", 70000, func(int) string { return "0" })
+
+	compiler := New()
+	err := compiler.Compile(parse(input))
+	if err == nil {
+		t.Fatalf("expected compiler error")
 	}
 
-	runCompilerTests(t, tests)
+	expected := "program too large: OpCall operand 70000 exceeds the limit of 65535"
+	if err.Error() != expected {
+		t.Errorf("wrong compiler error: want=%q, got=%q", expected, err)
+	}
 }
 
-func TestRecursiveFunctions(t *testing.T) {
-	tests := []compilerTestCase{
-		{
-			input: `
-let countDown = fn(x) { countDown(x - 1); };
-countDown(1);
-`,
-			expectedConstants: []interface{}{
-				1,
-				[]code.Instructions{
-					code.Make(code.OpCurrentClosure),
-					code.Make(code.OpGetLocal, 0),
-					code.Make(code.OpConstant, 0),
-					code.Make(code.OpSub),
-					code.Make(code.OpCall, 1),
-					code.Make(code.OpReturnValue),
-				},
-				1,
-			},
-			expectedInstructions: []code.Instructions{
-				code.Make(code.OpClosure, 1, 0),
-				code.Make(code.OpSetGlobal, 0),
-				code.Make(code.OpGetGlobal, 0),
-				code.Make(code.OpConstant, 2),
-				code.Make(code.OpCall, 1),
-				code.Make(code.OpPop),
-			},
+func TestPositions(t *testing.T) {
+	input := `let x = 1;
+let f = fn(a) {
+  a / x
+};
+f(2) +
+  x`
+
+	compiler := New()
+	err := compiler.Compile(parse(input))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	bytecode := compiler.Bytecode()
+	fn := bytecode.Constants[1].(*object.CompiledFunction)
+
+	tests := []struct {
+		positions *code.PositionTable
+		ins       code.Instructions
+		op        code.Opcode
+		expected  string
+	}{
+		{&bytecode.Positions, bytecode.Instructions, code.OpSetGlobal, "1:1"},
+		{&bytecode.Positions, bytecode.Instructions, code.OpClosure, "2:9"},
+		{&bytecode.Positions, bytecode.Instructions, code.OpCall, "5:2"},
+		{&bytecode.Positions, bytecode.Instructions, code.OpAdd, "5:6"},
+		{&bytecode.Positions, bytecode.Instructions, code.OpPop, "5:1"},
+		{&fn.Positions, fn.Instructions, code.OpGetLocal, "3:3"},
+		{&fn.Positions, fn.Instructions, code.OpGetGlobal, "3:7"},
+		{&fn.Positions, fn.Instructions, code.OpDiv, "3:5"},
+	}
+
+	for _, tt := range tests {
+		offset := -1
+		for i := 0; i < len(tt.ins); {
+			def, _ := code.Lookup(tt.ins[i])
+			if code.Opcode(tt.ins[i]) == tt.op {
+				offset = i
+				break
+			}
+			_, read := code.ReadOperands(def, tt.ins[i+1:])
+			i += 1 + read
+		}
+		if offset == -1 {
+			t.Fatalf("opcode %d not found", tt.op)
+		}
+
+		pos, ok := tt.positions.Lookup(offset)
+		if !ok || pos.String() != tt.expected {
+			t.Errorf("wrong position for %d at %04d. want=%s, got=%s", tt.op, offset, tt.expected, pos)
+		}
+	}
+
+	modules := MapResolver{"lib": "export let y = 1 + 2;"}
+	compiler = NewWithResolver(modules, "main.helios")
+	err = compiler.Compile(parse(`import "lib"; lib.y`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	bytecode = compiler.Bytecode()
+	for offset, want := range map[int]string{0: "lib:1:16", 7: "lib:1:8", 10: "main.helios:1:18", 13: "main.helios:1:15"} {
+		pos, _ := bytecode.Positions.Lookup(offset)
+		if pos.String() != want {
+			t.Errorf("wrong position at %04d. want=%s, got=%s", offset, want, pos)
+		}
+	}
+}
+
+func TestImports(t *testing.T) {
+	modules := MapResolver{
+		"lib/math": "export fn add(a, b) { a + b } let secret = 1;",
+	}
+
+	program := parse(`import "lib/math"; import m "lib/math"; math.add(1, 2); m.add`)
+	compiler := NewWithResolver(modules, "")
+	err := compiler.Compile(program)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	bytecode := compiler.Bytecode()
+
+	expectedInstructions := []code.Instructions{
+		code.Make(code.OpClosure, 0, 0),
+		code.Make(code.OpSetGlobal, 0),
+		code.Make(code.OpConstant, 1),
+		code.Make(code.OpSetGlobal, 1),
+		code.Make(code.OpGetGlobal, 0),
+		code.Make(code.OpConstant, 1),
+		code.Make(code.OpConstant, 2),
+		code.Make(code.OpCall, 2),
+		code.Make(code.OpPop),
+		code.Make(code.OpGetGlobal, 0),
+		code.Make(code.OpPop),
+	}
+
+	err = testInstructions(expectedInstructions, bytecode.Instructions)
+	if err != nil {
+		t.Fatalf("testInstructions failed: %s", err)
+	}
+
+	expectedConstants := []interface{}{
+		[]code.Instructions{
+			code.Make(code.OpGetLocal, 0),
+			code.Make(code.OpGetLocal, 1),
+			code.Make(code.OpAdd),
+			code.Make(code.OpReturnValue),
 		},
+		1,
+		2,
 	}
 
-	runCompilerTests(t, tests)
+	err = testConstants(expectedConstants, bytecode.Constants)
+	if err != nil {
+		t.Fatalf("testConstants failed: %s", err)
+	}
 }
 
-func TestClosures(t *testing.T) {
-	tests := []compilerTestCase{
-		{
-			input: `
-fn(a) {
-fn(b) { a + b };
+func TestImportErrors(t *testing.T) {
+	modules := MapResolver{
+		"a":      `import "b"; export let x = 1;`,
+		"b":      `import "c";`,
+		"c":      `import "a";`,
+		"math":   "export let pi = 3; let secret = 1;",
+		"broken": "let = 1;",
+		"inner":  `let f = fn() { import "math" };`,
+		"shapes": "export enum Shape { Circle(r), Empty } enum Hidden { Secret }",
+	}
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`import "a"`, "c: circular import: a -> b -> c -> a"},
+		{`import "math"; math.secret`, "module math has no export secret"},
+		{`import "missing"`, `cannot import "missing": module "missing" not found`},
+		{`import "broken"`, "parse errors in module broken: expected next token to be IDENT, got = instead; no prefix parse function for = found"},
+		{`import "inner"`, `inner: import "math" must be at the top level of a module`},
+		{`import "shapes"; match 1 { shapes.Square(s) => s }`, "module shapes has no variant Square"},
+		{`import "shapes"; match 1 { shapes.Secret => 0 }`, "module shapes has no variant Secret"},
+		{`import "shapes"; match 1 { shapes.Circle => 0 }`, "variant Circle has 1 fields, got=0"},
+		{`let m = 1; match 1 { m.Circle(r) => r }`, "m is not a module"},
+		{`import "shapes"; match 1 { Circle(r) => r }`, "undefined variant Circle"},
+	}
+
+	for _, tt := range tests {
+		compiler := NewWithResolver(modules, "")
+		err := compiler.Compile(parse(tt.input))
+		if err == nil {
+			t.Fatalf("expected compiler error for %q", tt.input)
+		}
+
+		if err.Error() != tt.expected {
+			t.Errorf("wrong compiler error: want=%q, got=%q", tt.expected, err)
+		}
+	}
 }
-`,
-			expectedConstants: []interface{}{
-				[]code.Instructions{
-					code.Make(code.OpGetFree, 0),
-					code.Make(code.OpGetLocal, 0),
-					code.Make(code.OpAdd),
-					code.Make(code.OpReturnValue),
-				},
-				[]code.Instructions{
-					code.Make(code.OpGetLocal, 0),
-					code.Make(code.OpClosure, 0, 1),
-					code.Make(code.OpReturnValue),
-				},
-			},
-			expectedInstructions: []code.Instructions{
-				code.Make(code.OpClosure, 1, 0),
-				code.Make(code.OpPop),
-			},
-		},
-		{
-			input: `
-fn(a) {
-fn(b) {
-fn(c) { a + b + c };
-};
-};
-`,
-			expectedConstants: []interface{}{
-				[]code.Instructions{
-					code.Make(code.OpGetFree, 0),
-					code.Make(code.OpGetFree, 1),
-					code.Make(code.OpAdd),
-					code.Make(code.OpGetLocal, 0),
-					code.Make(code.OpAdd),
-					code.Make(code.OpReturnValue),
-				},
-				[]code.Instructions{
-					code.Make(code.OpGetFree, 0),
-					code.Make(code.OpGetLocal, 0),
-					code.Make(code.OpClosure, 0, 2),
-					code.Make(code.OpReturnValue),
-				},
-				[]code.Instructions{
-					code.Make(code.OpGetLocal, 0),
-					code.Make(code.OpClosure, 1, 1),
-					code.Make(code.OpReturnValue),
-				},
-			},
-			expectedInstructions: []code.Instructions{
-				code.Make(code.OpClosure, 2, 0),
-				code.Make(code.OpPop),
-			},
-		},
+
+func TestImportedEnumExhaustiveness(t *testing.T) {
+	modules := MapResolver{"shapes": "export enum Shape { Circle(r), Rect(w, h), Empty }"}
+
+	compiler := NewWithResolver(modules, "")
+	err := compiler.Compile(parse(`import "shapes"; match 1 { shapes.Circle(r) => r, shapes.Empty => 0 }`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
 	}
 
-	runCompilerTests(t, tests)
+	warnings := compiler.Warnings()
+	if len(warnings) != 1 || warnings[0] != "non-exhaustive match on Shape: missing Rect" {
+		t.Errorf("wrong warnings: %q", warnings)
+	}
 }
 
-// Helper functions
+func TestFileResolver(t *testing.T) {
+	root := t.TempDir()
+	err := os.MkdirAll(filepath.Join(root, "lib"), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(root, "lib", "math.helios"), []byte(`import "./util"; export let pi = util.three;`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(root, "lib", "util.helios"), []byte(`export let three = 3;`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compiler := NewWithResolver(&FileResolver{Root: root}, "")
+	err = compiler.Compile(parse(`import "lib/math"; math.pi`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	if len(compiler.modules) != 2 {
+		t.Errorf("expected 2 modules, got %d", len(compiler.modules))
+	}
+
+	// The main program is recognised when a module imports it back, under
+	// the path the resolver gives it rather than the one it was given as
+	err = os.WriteFile(filepath.Join(root, "lib", "cycle.helios"), []byte(`import "../main";`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	main := filepath.Join(root, "lib") + filepath.FromSlash("/../main.helios")
+	compiler = NewWithResolverOptions(&FileResolver{Root: root}, main, Options{Peephole: true})
+	err = compiler.Compile(parse(`import "./lib/cycle";`))
+
+	canonical := filepath.Join(root, "main.helios")
+	cycle := filepath.Join(root, "lib", "cycle.helios")
+	want := fmt.Sprintf("circular import: %s -> %s -> %s", canonical, cycle, canonical)
+	if err == nil || !strings.HasSuffix(err.Error(), want) {
+		t.Errorf("expected %q, got %v", want, err)
+
+	}
+}
 
 func runCompilerTests(t *testing.T, tests []compilerTestCase) {
 	t.Helper()
 	for _, tt := range tests {
 		program := parse(tt.input)
-		compiler := New()
+		compiler := NewWithOptions(tt.options)
 		err := compiler.Compile(program)
 		if err != nil {
 			t.Fatalf("compiler error: %s", err)
@@ -748,6 +2686,24 @@ func runCompilerTests(t *testing.T, tests []compilerTestCase) {
 	}
 }
 
+// sequence joins n generated items between a prefix and a suffix
+func sequence(prefix, sep, suffix string, n int, item func(int) string) string {
+	items := make([]string, n)
+	for i := range items {
+		items[i] = item(i)
+	}
+	return prefix + strings.Join(items, sep) + suffix
+}
+
+// letters spells i in base 26 with the letters a to z, to name variables
+func letters(i int) string {
+	name := string(rune('a' + i%26))
+	if i >= 26 {
+		name = letters(i/26-1) + name
+	}
+	return name
+}
+
 func parse(input string) *ast.Program {
 	l := lexer.New(input)
 	p := parser.New(l)
@@ -812,6 +2768,11 @@ func testConstants(
 			if err != nil {
 				return fmt.Errorf("constant %d - testInstructions failed: %s", i, err)
 			}
+		case object.Object:
+			if constant.Inspect() != actual[i].Inspect() {
+				return fmt.Errorf("constant %d - wrong object. got=%s, want=%s",
+					i, actual[i].Inspect(), constant.Inspect())
+			}
 		}
 	}
 
@@ -0,0 +1,271 @@
+package compiler
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/TheAlchemistKE/helios/internal/ast"
+	"github.com/TheAlchemistKE/helios/internal/code"
+	"github.com/TheAlchemistKE/helios/internal/object"
+)
+
+// span is a range of instruction offsets in the code of a scope
+type span struct {
+	start, end int
+}
+
+// binding is a variable declared in a function by a let, a function
+// declaration or a pattern, kept until the function is compiled to find out
+// whether it was ever read. Only the code of pure bindings can be dropped.
+type binding struct {
+	name   *ast.Identifier
+	symbol Symbol
+	code   span
+	pure   bool
+}
+
+// reachableEnd returns the number of statements of a block that can run: a
+// statement after one that always returns never does
+func reachableEnd(stmts []ast.Statement) int {
+	for i, s := range stmts {
+		if terminates(s) {
+			return i + 1
+		}
+	}
+	return len(stmts)
+}
+
+// terminates reports whether s always returns from the function, either
+// directly or through both branches of an if
+func terminates(s ast.Statement) bool {
+	switch s := s.(type) {
+	case *ast.ReturnStatement:
+		return true
+	case *ast.ExpressionStatement:
+		if node, ok := s.Expression.(*ast.IfExpression); ok && node.Alternative != nil {
+			return blockTerminates(node.Consequence) && blockTerminates(node.Alternative)
+		}
+	}
+	return false
+}
+
+func blockTerminates(block *ast.BlockStatement) bool {
+	for _, s := range block.Statements {
+		if terminates(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// isPure reports whether evaluating expr has no effect and cannot fail, so
+// its code can be dropped when its value is not used
+func isPure(expr ast.Expression) bool {
+	switch expr := expr.(type) {
+	case *ast.IntegerLiteral, *ast.FloatLiteral, *ast.StringLiteral, *ast.Boolean,
+		*ast.NullLiteral, *ast.Identifier, *ast.FunctionLiteral:
+		return true
+	case *ast.ArrayLiteral:
+		for _, el := range expr.Elements {
+			if !isPure(el) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// isDiscardable reports whether s is an expression statement whose code can
+// be dropped if its value is not the value of its block
+func isDiscardable(s ast.Statement) bool {
+	stmt, ok := s.(*ast.ExpressionStatement)
+	return ok && isPure(stmt.Expression)
+}
+
+// warn records a warning about node, prefixed with its source position
+func (c *Compiler) warn(node ast.Node, format string, args ...interface{}) {
+	tok := ast.TokenOf(node)
+	pos := code.Position{File: c.path, Line: tok.Line, Column: tok.Column}
+	c.warnings = append(c.warnings, pos.String()+": "+fmt.Sprintf(format, args...))
+}
+
+// addBinding records the binding of a local variable to the value computed
+// by the given code
+func (c *Compiler) addBinding(name *ast.Identifier, symbol Symbol, code span, pure bool) {
+	if symbol.Scope != LocalScope {
+		return
+	}
+	scope := &c.scopes[c.scopeIndex]
+	scope.bindings = append(scope.bindings, binding{name: name, symbol: symbol, code: code, pure: pure})
+}
+
+// unusedBindings returns the bindings of the current scope whose variable is
+// never read
+func (c *Compiler) unusedBindings() []binding {
+	unused := []binding{}
+	for _, b := range c.scopes[c.scopeIndex].bindings {
+		if !c.symbolTable.used[b.symbol.Index] {
+			unused = append(unused, b)
+		}
+	}
+	return unused
+}
+
+// warnUnused records a warning for each variable of the current scope that
+// is never read. Names starting with an underscore are meant to be unused.
+func (c *Compiler) warnUnused() {
+	for _, b := range c.unusedBindings() {
+		if !strings.HasPrefix(b.name.Value, "_") {
+			c.warn(b.name, "unused variable %s", b.name.Value)
+		}
+	}
+}
+
+// deadCode returns the code of the current scope that has no effect: pure
+// expression statements whose value is ignored and pure bindings that are
+// never read
+func (c *Compiler) deadCode() []span {
+	dead := append([]span{}, c.scopes[c.scopeIndex].discardable...)
+	for _, b := range c.unusedBindings() {
+		if b.pure {
+			dead = append(dead, b.code)
+		}
+	}
+	return dead
+}
+
+// removeSpans removes the instructions decoded from the given spans
+func removeSpans(list []editable, spans []span) []editable {
+	if len(spans) == 0 {
+		return list
+	}
+
+	deleted := make([]bool, len(list))
+	for i, e := range list {
+		for _, s := range spans {
+			if s.start <= e.offset && e.offset < s.end {
+				deleted[i] = true
+			}
+		}
+	}
+	return compact(list, deleted)
+}
+
+// removeUnreachable removes the instructions that no path from the first one
+// reaches
+func removeUnreachable(list []editable) []editable {
+	reached := make([]bool, len(list))
+
+	work := []int{0}
+	for len(work) > 0 {
+		i := work[len(work)-1]
+		work = work[:len(work)-1]
+		if i >= len(list) || reached[i] {
+			continue
+		}
+		reached[i] = true
+
+		op := list[i].op
+		switch {
+		case op == code.OpJump:
+			work = append(work, list[i].target)
+		case isConditionalJump(op):
+			work = append(work, i+1, list[i].target)
+		case op == code.OpReturnValue, op == code.OpReturn, op == code.OpReturnLocal, op == code.OpFail:
+		default:
+			work = append(work, i+1)
+		}
+	}
+
+	deleted := make([]bool, len(list))
+	for i := range list {
+		deleted[i] = !reached[i]
+	}
+	return compact(list, deleted)
+}
+
+// constantOperand returns which operand of op is a constant index, or -1 if
+// none is
+func constantOperand(op code.Opcode) int {
+	switch op {
+	case code.OpConstant, code.OpClosure, code.OpMatchVariant, code.OpFail:
+		return 0
+	case code.OpCallKeywords, code.OpTailCallKeywords, code.OpLocalAddConstant, code.OpLocalSubConstant:
+		return 1
+	}
+	return -1
+}
+
+// eachConstant calls f with the offset, decoded form and constant operand of
+// every instruction in ins that refers to a constant
+func eachConstant(ins code.Instructions, f func(offset int, op code.Opcode, prefix int, operands []int, index int)) {
+	for i := 0; i < len(ins); {
+		op, def, prefix, _ := code.Decode(ins[i:])
+		operands, read := code.ReadOperands(def, ins[i+prefix+1:])
+		if n := constantOperand(op); n >= 0 {
+			f(i, op, prefix, operands, n)
+		}
+		i += prefix + 1 + read
+	}
+}
+
+// pruneConstants drops the constants that neither main nor a function it
+// can create refers to, such as the functions of bindings removed as dead
+// code, and renumbers the references to the rest. Functions whose code
+// changes are copied, so the compiler's own pool is left as it was.
+func pruneConstants(main code.Instructions, constants []object.Object) (code.Instructions, []object.Object) {
+	used := make([]bool, len(constants))
+	work := []code.Instructions{main}
+	for len(work) > 0 {
+		ins := work[len(work)-1]
+		work = work[:len(work)-1]
+
+		eachConstant(ins, func(_ int, _ code.Opcode, _ int, operands []int, n int) {
+			index := operands[n]
+			if index >= len(constants) || used[index] {
+				return
+			}
+			used[index] = true
+			if fn, ok := constants[index].(*object.CompiledFunction); ok {
+				work = append(work, fn.Instructions)
+			}
+		})
+	}
+
+	renumbered := make([]int, len(constants))
+	pruned := []object.Object{}
+	for i, c := range constants {
+		if used[i] {
+			renumbered[i] = len(pruned)
+			pruned = append(pruned, c)
+		}
+	}
+	if len(pruned) == len(constants) {
+		return main, constants
+	}
+
+	// Renumbering never widens an operand, so every instruction keeps its
+	// size and jump targets and positions stay valid
+	rewrite := func(ins code.Instructions) code.Instructions {
+		out := append(code.Instructions{}, ins...)
+		eachConstant(ins, func(offset int, op code.Opcode, prefix int, operands []int, n int) {
+			operands[n] = renumbered[operands[n]]
+			if prefix == 0 {
+				copy(out[offset:], code.Make(op, operands...))
+			} else {
+				copy(out[offset:], code.MakeWide(op, operands...))
+			}
+		})
+		return out
+	}
+
+	for i, c := range pruned {
+		if fn, ok := c.(*object.CompiledFunction); ok {
+			copied := *fn
+			copied.Instructions = rewrite(fn.Instructions)
+			pruned[i] = &copied
+		}
+	}
+	return rewrite(main), pruned
+}
@@ -0,0 +1,321 @@
+package compiler
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/TheAlchemistKE/helios/internal/code"
+	"github.com/TheAlchemistKE/helios/internal/object"
+)
+
+// Disassemble renders the main program followed by every compiled function
+// in the constant pool. Jump targets get labels, and operands that refer to
+// constants, builtins, locals or keyword names are annotated with what they
+// refer to. Bytes that do not decode are reported in place. Register code
+// names registers r0, r1, ... and constants k0, k1, ...
+func (b *Bytecode) Disassemble() string {
+	var out bytes.Buffer
+
+	listing := disassemble
+	if b.Backend == RegisterBackend {
+		listing = disassembleRegisters
+	}
+
+	out.WriteString("main:\n")
+	listing(&out, b.Instructions, b.Constants, nil)
+
+	for i, c := range b.Constants {
+		fn, ok := c.(*object.CompiledFunction)
+		if !ok {
+			continue
+		}
+
+		fmt.Fprintf(&out, "\n%s:\n", describeFunction(i, fn))
+		listing(&out, fn.Instructions, b.Constants, fn)
+	}
+
+	return out.String()
+}
+
+// describeFunction returns the header of a function's listing, such as
+// `fn 3 add(a, b = ?, ...) locals=3 stack=2`
+func describeFunction(index int, fn *object.CompiledFunction) string {
+	params := []string{}
+	for i, p := range fn.Parameters {
+		if i >= fn.NumParameters-fn.NumDefaults {
+			p += " = ?"
+		}
+		params = append(params, p)
+	}
+	if fn.Variadic {
+		params = append(params, "...")
+	}
+
+	name := fn.Name
+	if name == "" {
+		name = "<anonymous>"
+	}
+
+	return fmt.Sprintf("fn %d %s(%s) locals=%d stack=%d",
+		index, name, strings.Join(params, ", "), fn.NumLocals, fn.MaxStackDepth)
+}
+
+func disassemble(out *bytes.Buffer, ins code.Instructions, constants []object.Object, fn *object.CompiledFunction) {
+	labels := jumpLabels(ins)
+
+	for i := 0; i < len(ins); {
+		if label, ok := labels[i]; ok {
+			fmt.Fprintf(out, "%s:\n", label)
+		}
+
+		op, def, prefix, err := code.Decode(ins[i:])
+		if err != nil {
+			if prefix == 0 {
+				fmt.Fprintf(out, "  %04d  ERROR: unknown opcode %d\n", i, ins[i])
+			} else {
+				fmt.Fprintf(out, "  %04d  ERROR: %s\n", i, err)
+			}
+			i++
+			continue
+		}
+
+		if i+prefix+1+def.Width() > len(ins) {
+			fmt.Fprintf(out, "  %04d  ERROR: truncated %s\n", i, def.Name)
+			return
+		}
+
+		operands, read := code.ReadOperands(def, ins[i+prefix+1:])
+		text, comment := formatInstruction(op, def, operands, labels, constants, fn)
+		if comment != "" {
+			text = fmt.Sprintf("%-24s ; %s", text, comment)
+		}
+		fmt.Fprintf(out, "  %04d  %s\n", i, text)
+
+		i += prefix + 1 + read
+	}
+
+	if label, ok := labels[len(ins)]; ok {
+		fmt.Fprintf(out, "%s:\n", label)
+	}
+}
+
+// jumpLabels names every jump target L1, L2, ... in offset order
+func jumpLabels(ins code.Instructions) map[int]string {
+	targets := []int{}
+	seen := map[int]bool{}
+
+	for i := 0; i < len(ins); {
+		op, def, prefix, err := code.Decode(ins[i:])
+		if err != nil {
+			i++
+			continue
+		}
+		if i+prefix+1+def.Width() > len(ins) {
+			break
+		}
+
+		operands, read := code.ReadOperands(def, ins[i+prefix+1:])
+		if isJump(op) {
+			target := operands[len(operands)-1]
+			if !seen[target] {
+				seen[target] = true
+				targets = append(targets, target)
+			}
+		}
+
+		i += prefix + 1 + read
+	}
+
+	sort.Ints(targets)
+	labels := map[int]string{}
+	for i, t := range targets {
+		labels[t] = fmt.Sprintf("L%d", i+1)
+	}
+	return labels
+}
+
+func formatInstruction(
+	op code.Opcode,
+	def *code.Definition,
+	operands []int,
+	labels map[int]string,
+	constants []object.Object,
+	fn *object.CompiledFunction,
+) (string, string) {
+	parts := []string{def.Name}
+	for _, o := range operands {
+		parts = append(parts, strconv.Itoa(o))
+	}
+
+	if isJump(op) {
+		parts[len(parts)-1] = labels[operands[len(operands)-1]]
+		if op == code.OpJumpSupplied && fn != nil && operands[0] < len(fn.Parameters) {
+			return strings.Join(parts, " "), fn.Parameters[operands[0]]
+		}
+		return strings.Join(parts, " "), ""
+	}
+
+	switch op {
+	case code.OpConstant, code.OpClosure, code.OpMatchVariant, code.OpFail:
+		return strings.Join(parts, " "), describeConstant(constants, operands[0])
+
+	case code.OpLocalAddConstant, code.OpLocalSubConstant:
+		return strings.Join(parts, " "), describeConstant(constants, operands[1])
+
+	case code.OpCallKeywords, code.OpTailCallKeywords:
+		return strings.Join(parts, " "), describeConstant(constants, operands[1])
+
+	case code.OpCheckType:
+		if operands[0] < len(object.Annotations) {
+			return strings.Join(parts, " "), object.Annotations[operands[0]].Name
+		}
+
+	case code.OpCheckLocal:
+		if fn != nil && operands[0] < len(fn.Parameters) && operands[1] < len(object.Annotations) {
+			return strings.Join(parts, " "), fn.Parameters[operands[0]] + ": " + object.Annotations[operands[1]].Name
+		}
+
+	case code.OpGetBuiltin:
+		if operands[0] < len(object.Builtins) {
+			return strings.Join(parts, " "), object.Builtins[operands[0]].Name
+		}
+
+	case code.OpGetLocal, code.OpSetLocal:
+		if fn != nil && operands[0] < len(fn.Parameters) {
+			return strings.Join(parts, " "), fn.Parameters[operands[0]]
+		}
+	}
+
+	return strings.Join(parts, " "), ""
+}
+
+func describeConstant(constants []object.Object, index int) string {
+	if index >= len(constants) {
+		return "constant out of range"
+	}
+
+	switch c := constants[index].(type) {
+	case *object.String:
+		return strconv.Quote(c.Value)
+	case *object.CompiledFunction:
+		if c.Name == "" {
+			return fmt.Sprintf("fn %d", index)
+		}
+		return fmt.Sprintf("fn %d %s", index, c.Name)
+	default:
+		return c.Inspect()
+	}
+}
+
+func disassembleRegisters(out *bytes.Buffer, ins code.Instructions, constants []object.Object, fn *object.CompiledFunction) {
+	labels := registerJumpLabels(ins)
+
+	for i := 0; i < len(ins); {
+		if label, ok := labels[i]; ok {
+			fmt.Fprintf(out, "%s:\n", label)
+		}
+
+		def, err := code.LookupRegister(ins[i])
+		if err != nil {
+			fmt.Fprintf(out, "  %04d  ERROR: unknown opcode %d\n", i, ins[i])
+			i++
+			continue
+		}
+		if i+1+def.Width() > len(ins) {
+			fmt.Fprintf(out, "  %04d  ERROR: truncated %s\n", i, def.Name)
+			return
+		}
+
+		operands, read := code.ReadOperands(def, ins[i+1:])
+		text, comment := formatRegisterInstruction(code.RegisterOpcode(ins[i]), def, operands, labels, constants)
+		if comment != "" {
+			text = fmt.Sprintf("%-24s ; %s", text, comment)
+		}
+		fmt.Fprintf(out, "  %04d  %s\n", i, text)
+
+		i += 1 + read
+	}
+
+	if label, ok := labels[len(ins)]; ok {
+		fmt.Fprintf(out, "%s:\n", label)
+	}
+}
+
+// registerJumpLabels names every jump target of register code L1, L2, ...
+// in offset order
+func registerJumpLabels(ins code.Instructions) map[int]string {
+	targets := []int{}
+	seen := map[int]bool{}
+
+	for i := 0; i < len(ins); {
+		def, err := code.LookupRegister(ins[i])
+		if err != nil {
+			i++
+			continue
+		}
+		if i+1+def.Width() > len(ins) {
+			break
+		}
+
+		operands, read := code.ReadOperands(def, ins[i+1:])
+		kinds := registerOperands[code.RegisterOpcode(ins[i])]
+		for j, o := range operands {
+			if kinds[j] == 't' && !seen[o] {
+				seen[o] = true
+				targets = append(targets, o)
+			}
+		}
+
+		i += 1 + read
+	}
+
+	sort.Ints(targets)
+	labels := map[int]string{}
+	for i, t := range targets {
+		labels[t] = fmt.Sprintf("L%d", i+1)
+	}
+	return labels
+}
+
+func formatRegisterInstruction(
+	op code.RegisterOpcode,
+	def *code.Definition,
+	operands []int,
+	labels map[int]string,
+	constants []object.Object,
+) (string, string) {
+	parts := []string{def.Name}
+	comments := []string{}
+	kinds := registerOperands[op]
+
+	for i, o := range operands {
+		switch kinds[i] {
+		case 'r', 'w':
+			parts = append(parts, fmt.Sprintf("r%d", o))
+		case 'k':
+			if o&code.RKConstant == 0 {
+				parts = append(parts, fmt.Sprintf("r%d", o))
+				break
+			}
+			o &^= code.RKConstant
+			fallthrough
+		case 'c':
+			parts = append(parts, fmt.Sprintf("k%d", o))
+			comments = append(comments, describeConstant(constants, o))
+		case 't':
+			parts = append(parts, labels[o])
+		case 'b':
+			parts = append(parts, strconv.Itoa(o))
+			if o < len(object.Builtins) {
+				comments = append(comments, object.Builtins[o].Name)
+			}
+		default:
+			parts = append(parts, strconv.Itoa(o))
+		}
+	}
+
+	return strings.Join(parts, " "), strings.Join(comments, ", ")
+}
@@ -0,0 +1,117 @@
+package compiler
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/TheAlchemistKE/helios/internal/code"
+)
+
+func TestDisassemble(t *testing.T) {
+	input := `let add = fn(a, b = 2) { a + b };
+if (len("ab") > 1) { add(1, b: 3) } else { "no" };`
+
+	expected := `main:
+  0000  OpClosure 1 0            ; fn 1 add
+  0004  OpSetGlobal 0
+  0007  OpGetBuiltin 0           ; len
+  0009  OpConstant 2             ; "ab"
+  0012  OpCall 1
+  0014  OpConstant 3             ; 1
+  0017  OpGreaterThan
+  0018  OpJumpNotTruthy L1
+  0021  OpGetGlobal 0
+  0024  OpConstant 3             ; 1
+  0027  OpConstant 4             ; 3
+  0030  OpCallKeywords 1 5       ; [b]
+  0034  OpJump L2
+L1:
+  0037  OpConstant 6             ; "no"
+L2:
+  0040  OpPop
+
+fn 1 add(a, b = ?) locals=2 stack=2:
+  0000  OpJumpSupplied 1 L1      ; b
+  0004  OpConstant 0             ; 2
+  0007  OpSetLocal 1             ; b
+L1:
+  0009  OpGetLocal 0             ; a
+  0011  OpGetLocal 1             ; b
+  0013  OpAdd
+  0014  OpReturnValue
+`
+
+	compiler := New()
+	err := compiler.Compile(parse(input))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	actual := compiler.Bytecode().Disassemble()
+	if actual != expected {
+		t.Errorf("wrong disassembly.\nwant=\n%s\ngot=\n%s", expected, actual)
+	}
+}
+
+func TestDisassembleRegisters(t *testing.T) {
+	input := `let sum = fn(n, acc) { if (n == 0) { acc } else { sum(n - 1, acc + n) } };
+sum(10, 0);`
+
+	expected := `main:
+  0000  RegClosure r0 k2 r2 0    ; fn 2 sum
+  0009  RegSetGlobal 0 r0
+  0014  RegGetGlobal r0 0
+  0019  RegMove r2 r0
+  0024  RegLoadConst r3 k3       ; 10
+  0029  RegLoadConst r4 k0       ; 0
+  0034  RegCall r1 r2 2
+  0041  RegPop r1
+
+fn 2 sum(n, acc) locals=10 stack=0:
+  0000  RegCurrentClosure r2
+  0003  RegEqual r3 r0 k0        ; 0
+  0010  RegJumpNotTruthy r3 L1
+  0015  RegMove r3 r1
+  0020  RegJump L2
+L1:
+  0023  RegSub r4 r0 k1          ; 1
+  0030  RegAdd r5 r1 r0
+  0037  RegMove r7 r2
+  0042  RegMove r8 r4
+  0047  RegMove r9 r5
+  0052  RegTailCall r7 2
+L2:
+  0057  RegReturn r3
+`
+
+	compiler := NewWithOptions(Options{Backend: RegisterBackend})
+	err := compiler.Compile(parse(input))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	actual := compiler.Bytecode().Disassemble()
+	if actual != expected {
+		t.Errorf("wrong disassembly.\nwant=\n%s\ngot=\n%s", expected, actual)
+	}
+}
+
+func TestDisassembleMalformed(t *testing.T) {
+	bytecode := &Bytecode{
+		Instructions: append(code.Instructions{255}, code.Make(code.OpConstant, 0)[:2]...),
+	}
+
+	expected := `main:
+  0000  ERROR: unknown opcode 255
+  0001  ERROR: truncated OpConstant
+`
+
+	actual := bytecode.Disassemble()
+	if actual != expected {
+		t.Errorf("wrong disassembly.\nwant=\n%s\ngot=\n%s", expected, actual)
+	}
+
+	if strings.Count(actual, "\n") != 3 {
+		t.Errorf("disassembly should stop after truncated operands, got=\n%s", actual)
+	}
+}
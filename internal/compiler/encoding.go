@@ -0,0 +1,454 @@
+package compiler
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+
+	"github.com/TheAlchemistKE/helios/internal/code"
+	"github.com/TheAlchemistKE/helios/internal/object"
+)
+
+// Serialized bytecode (.hbc files) is laid out as
+//
+//	magic    "HBC\x00"
+//	version  uint16, big endian
+//	backend  byte, the instruction set: 0 stack, 1 register
+//	main     instructions
+//	depth    uvarint, the main program's maximum stack depth or registers
+//	lines    the main program's position table
+//	count    uvarint, followed by that many constants
+//	checksum uint32, big endian CRC-32 (IEEE) of everything before it
+//
+// Instructions are a uvarint length followed by the raw bytes, strings are
+// encoded the same way. A position table is its file names followed by its
+// entries, each a delta from the previous entry's offset, a file index, a
+// line and a column. Each constant starts with a tag byte naming its type.
+const (
+	BytecodeMagic     = "HBC\x00"
+	BytecodeVersion   = 10
+	BytecodeExtension = ".hbc"
+)
+
+const (
+	tagInteger byte = iota + 1
+	tagFloat
+	tagString
+	tagCompiledFunction
+	tagArray
+	tagVariant
+	tagVariantConstructor
+)
+
+// maxConstantDepth is how deeply arrays and variants may nest within a
+// constant, which bounds the recursion of decoding one
+const maxConstantDepth = 64
+
+// The flags byte of a compiled function
+const (
+	flagVariadic byte = 1 << iota
+	flagReadsCaller
+)
+
+var (
+	ErrNotBytecode      = errors.New("not a Helios bytecode file")
+	ErrChecksumMismatch = errors.New("bytecode checksum mismatch")
+	ErrTruncated        = errors.New("truncated bytecode")
+)
+
+// MarshalBinary encodes the bytecode in the .hbc format
+func (b *Bytecode) MarshalBinary() ([]byte, error) {
+	out := []byte(BytecodeMagic)
+	out = binary.BigEndian.AppendUint16(out, BytecodeVersion)
+	out = append(out, byte(b.Backend))
+	out = appendBytes(out, b.Instructions)
+	out = binary.AppendUvarint(out, uint64(b.MaxStackDepth))
+	out = appendPositions(out, b.Positions)
+
+	out = binary.AppendUvarint(out, uint64(len(b.Constants)))
+	for _, c := range b.Constants {
+		var err error
+		out, err = appendConstant(out, c, 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(out)), nil
+}
+
+// UnmarshalBinary decodes bytecode produced by MarshalBinary
+func (b *Bytecode) UnmarshalBinary(data []byte) error {
+	header := len(BytecodeMagic) + 2
+	if len(data) < header || string(data[:len(BytecodeMagic)]) != BytecodeMagic {
+		return ErrNotBytecode
+	}
+
+	version := binary.BigEndian.Uint16(data[len(BytecodeMagic):])
+	if version != BytecodeVersion {
+		return fmt.Errorf("unsupported bytecode version %d, want %d", version, BytecodeVersion)
+	}
+
+	if len(data) < header+4 {
+		return ErrTruncated
+	}
+	body, sum := data[:len(data)-4], binary.BigEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return ErrChecksumMismatch
+	}
+
+	d := &decoder{data: body, pos: header}
+	backend := Backend(d.byte())
+	if d.err == nil && backend != StackBackend && backend != RegisterBackend {
+		return fmt.Errorf("unknown backend %d", backend)
+	}
+	instructions := code.Instructions(d.bytes())
+	maxStackDepth := d.int("MaxStackDepth")
+	positions := d.positions()
+
+	count := d.length()
+	constants := make([]object.Object, 0, count)
+	for i := 0; i < count && d.err == nil; i++ {
+		constants = append(constants, d.constant())
+	}
+
+	if d.err == nil && d.pos != len(d.data) {
+		d.err = fmt.Errorf("%d trailing bytes after constants", len(d.data)-d.pos)
+	}
+	if d.err != nil {
+		return d.err
+	}
+
+	b.Instructions = instructions
+	b.Constants = constants
+	b.MaxStackDepth = maxStackDepth
+	b.Positions = positions
+	b.Backend = backend
+	return nil
+}
+
+// WriteBytecode writes b to w in the .hbc format
+func WriteBytecode(w io.Writer, b *Bytecode) error {
+	data, err := b.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(data)
+	return err
+}
+
+// ReadBytecode reads bytecode in the .hbc format from r
+func ReadBytecode(r io.Reader) (*Bytecode, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Bytecode{}
+	err = b.UnmarshalBinary(data)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func appendBytes(out []byte, b []byte) []byte {
+	out = binary.AppendUvarint(out, uint64(len(b)))
+	return append(out, b...)
+}
+
+func appendString(out []byte, s string) []byte {
+	out = binary.AppendUvarint(out, uint64(len(s)))
+	return append(out, s...)
+}
+
+func appendPositions(out []byte, t code.PositionTable) []byte {
+	out = binary.AppendUvarint(out, uint64(len(t.Files)))
+	for _, f := range t.Files {
+		out = appendString(out, f)
+	}
+
+	out = binary.AppendUvarint(out, uint64(len(t.Entries)))
+	offset := 0
+	for _, e := range t.Entries {
+		out = binary.AppendUvarint(out, uint64(e.Offset-offset))
+		out = binary.AppendUvarint(out, uint64(e.File))
+		out = binary.AppendUvarint(out, uint64(e.Line))
+		out = binary.AppendUvarint(out, uint64(e.Column))
+		offset = e.Offset
+	}
+
+	return out
+}
+
+// appendConstant encodes obj, which is nested in depth arrays and variants
+func appendConstant(out []byte, obj object.Object, depth int) ([]byte, error) {
+	if depth == maxConstantDepth {
+		return nil, fmt.Errorf("cannot encode constant nested deeper than %d", maxConstantDepth)
+	}
+
+	switch obj := obj.(type) {
+	case *object.Integer:
+		out = append(out, tagInteger)
+		out = binary.AppendVarint(out, obj.Value)
+
+	case *object.Float:
+		out = append(out, tagFloat)
+		out = binary.BigEndian.AppendUint64(out, math.Float64bits(obj.Value))
+
+	case *object.String:
+		out = append(out, tagString)
+		out = appendString(out, obj.Value)
+
+	case *object.CompiledFunction:
+		out = append(out, tagCompiledFunction)
+		out = appendString(out, obj.Name)
+		out = appendBytes(out, obj.Instructions)
+		out = binary.AppendUvarint(out, uint64(obj.NumLocals))
+		out = binary.AppendUvarint(out, uint64(obj.NumParameters))
+		out = binary.AppendUvarint(out, uint64(obj.NumDefaults))
+		var flags byte
+		if obj.Variadic {
+			flags |= flagVariadic
+		}
+		if obj.ReadsCaller {
+			flags |= flagReadsCaller
+		}
+		out = append(out, flags)
+		out = binary.AppendUvarint(out, uint64(len(obj.Parameters)))
+		for _, p := range obj.Parameters {
+			out = appendString(out, p)
+		}
+		out = binary.AppendUvarint(out, uint64(obj.MaxStackDepth))
+		out = appendPositions(out, obj.Positions)
+
+	case *object.Array:
+		out = append(out, tagArray)
+		out = binary.AppendUvarint(out, uint64(len(obj.Elements)))
+		for _, el := range obj.Elements {
+			var err error
+			out, err = appendConstant(out, el, depth+1)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+	case *object.Variant:
+		out = append(out, tagVariant)
+		out = appendString(out, obj.Enum)
+		out = appendString(out, obj.Name)
+		out = binary.AppendUvarint(out, uint64(len(obj.Fields)))
+		for _, f := range obj.Fields {
+			var err error
+			out, err = appendConstant(out, f, depth+1)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+	case *object.VariantConstructor:
+		out = append(out, tagVariantConstructor)
+		out = appendString(out, obj.Enum)
+		out = appendString(out, obj.Name)
+		out = binary.AppendUvarint(out, uint64(obj.Arity))
+
+	default:
+		return nil, fmt.Errorf("cannot encode constant of type %s", obj.Type())
+	}
+
+	return out, nil
+}
+
+// decoder reads the body of an .hbc file. The first error is kept in err and
+// every later read returns a zero value, so callers check err once at the end.
+type decoder struct {
+	data []byte
+	pos  int
+	err  error
+
+	// depth is how many arrays and variants the constant being read is in
+	depth int
+}
+
+func (d *decoder) fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+}
+
+func (d *decoder) byte() byte {
+	if d.err != nil {
+		return 0
+	}
+	if d.pos >= len(d.data) {
+		d.fail(ErrTruncated)
+		return 0
+	}
+	b := d.data[d.pos]
+	d.pos++
+	return b
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.data[d.pos:])
+	if n <= 0 {
+		d.fail(ErrTruncated)
+		return 0
+	}
+	d.pos += n
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.data[d.pos:])
+	if n <= 0 {
+		d.fail(ErrTruncated)
+		return 0
+	}
+	d.pos += n
+	return v
+}
+
+// int reads a uvarint that the decoded value stores as an int. Anything
+// above math.MaxInt32 is rejected, as no count or index in valid bytecode
+// gets that large and converting it could make it negative.
+func (d *decoder) int(what string) int {
+	n := d.uvarint()
+	if n > math.MaxInt32 {
+		d.fail(fmt.Errorf("%s %d out of range", what, n))
+		return 0
+	}
+	return int(n)
+}
+
+// length reads a count or size, which can never exceed the remaining input
+func (d *decoder) length() int {
+	n := d.uvarint()
+	if n > uint64(len(d.data)-d.pos) {
+		d.fail(ErrTruncated)
+		return 0
+	}
+	return int(n)
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.length()
+	if d.err != nil {
+		return nil
+	}
+	b := make([]byte, n)
+	copy(b, d.data[d.pos:])
+	d.pos += n
+	return b
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes())
+}
+
+func (d *decoder) positions() code.PositionTable {
+	t := code.PositionTable{}
+
+	count := d.length()
+	for i := 0; i < count && d.err == nil; i++ {
+		t.Files = append(t.Files, d.string())
+	}
+
+	count = d.length()
+	offset := 0
+	for i := 0; i < count && d.err == nil; i++ {
+		e := code.PositionEntry{
+			Offset: offset + d.int("position offset"),
+			File:   d.int("position file"),
+			Line:   d.int("position line"),
+			Column: d.int("position column"),
+		}
+		if e.File >= len(t.Files) {
+			d.fail(fmt.Errorf("position entry refers to file %d of %d", e.File, len(t.Files)))
+		}
+		t.Entries = append(t.Entries, e)
+		offset = e.Offset
+	}
+
+	return t
+}
+
+func (d *decoder) constant() object.Object {
+	if d.depth == maxConstantDepth {
+		d.fail(fmt.Errorf("constant nested deeper than %d at offset %d", maxConstantDepth, d.pos))
+		return nil
+	}
+	d.depth++
+	defer func() { d.depth-- }()
+
+	switch tag := d.byte(); tag {
+	case tagInteger:
+		return &object.Integer{Value: d.varint()}
+
+	case tagFloat:
+		if len(d.data)-d.pos < 8 {
+			d.fail(ErrTruncated)
+			return nil
+		}
+		bits := binary.BigEndian.Uint64(d.data[d.pos:])
+		d.pos += 8
+		return &object.Float{Value: math.Float64frombits(bits)}
+
+	case tagString:
+		return object.Intern(d.string())
+
+	case tagCompiledFunction:
+		fn := &object.CompiledFunction{
+			Name:          d.string(),
+			Instructions:  d.bytes(),
+			NumLocals:     d.int("NumLocals"),
+			NumParameters: d.int("NumParameters"),
+			NumDefaults:   d.int("NumDefaults"),
+		}
+		flags := d.byte()
+		fn.Variadic = flags&flagVariadic != 0
+		fn.ReadsCaller = flags&flagReadsCaller != 0
+		count := d.length()
+		for i := 0; i < count && d.err == nil; i++ {
+			fn.Parameters = append(fn.Parameters, d.string())
+		}
+		fn.MaxStackDepth = d.int("MaxStackDepth")
+		fn.Positions = d.positions()
+		return fn
+
+	case tagArray:
+		count := d.length()
+		elements := make([]object.Object, 0, count)
+		for i := 0; i < count && d.err == nil; i++ {
+			elements = append(elements, d.constant())
+		}
+		return &object.Array{Elements: elements}
+
+	case tagVariant:
+		v := &object.Variant{Enum: d.string(), Name: d.string()}
+		count := d.length()
+		for i := 0; i < count && d.err == nil; i++ {
+			v.Fields = append(v.Fields, d.constant())
+		}
+		return v
+
+	case tagVariantConstructor:
+		return &object.VariantConstructor{Enum: d.string(), Name: d.string(), Arity: d.int("Arity")}
+
+	default:
+		if d.err == nil {
+			d.fail(fmt.Errorf("unknown constant tag %d at offset %d", tag, d.pos-1))
+		}
+		return nil
+	}
+}
@@ -0,0 +1,261 @@
+package compiler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/TheAlchemistKE/helios/internal/code"
+	"github.com/TheAlchemistKE/helios/internal/object"
+)
+
+func TestBytecodeRoundTrip(t *testing.T) {
+	input := `
+enum Shape { Circle(r), Empty }
+let scale = 2.5;
+let greet = fn(name, greeting = "hi", ...rest) { greeting + name };
+let area = fn(s) { match s { Circle(r) => r * r, Empty => 0 } };
+greet(greeting: "hello ", name: "there");
+area(Circle(-3));
+`
+
+	compiler := New()
+	err := compiler.Compile(parse(input))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	original := compiler.Bytecode()
+
+	var buf bytes.Buffer
+	err = WriteBytecode(&buf, original)
+	if err != nil {
+		t.Fatalf("encode error: %s", err)
+	}
+
+	if !strings.HasPrefix(buf.String(), BytecodeMagic) {
+		t.Fatalf("missing magic header")
+	}
+
+	decoded, err := ReadBytecode(&buf)
+	if err != nil {
+		t.Fatalf("decode error: %s", err)
+	}
+
+	err = testInstructions(
+		[]code.Instructions{original.Instructions}, decoded.Instructions)
+	if err != nil {
+		t.Fatalf("instructions differ: %s", err)
+	}
+
+	if decoded.MaxStackDepth != original.MaxStackDepth {
+		t.Errorf("wrong max stack depth. want=%d, got=%d",
+			original.MaxStackDepth, decoded.MaxStackDepth)
+	}
+
+	if !reflect.DeepEqual(decoded.Positions, original.Positions) {
+		t.Errorf("wrong positions. want=%v, got=%v", original.Positions, decoded.Positions)
+	}
+
+	if len(decoded.Constants) != len(original.Constants) {
+		t.Fatalf("wrong number of constants. want=%d, got=%d",
+			len(original.Constants), len(decoded.Constants))
+	}
+
+	for i, want := range original.Constants {
+		got := decoded.Constants[i]
+		if got.Type() != want.Type() {
+			t.Fatalf("constant %d has wrong type. want=%s, got=%s", i, want.Type(), got.Type())
+		}
+
+		wantFn, ok := want.(*object.CompiledFunction)
+		if !ok {
+			if got.Inspect() != want.Inspect() {
+				t.Errorf("constant %d differs. want=%s, got=%s", i, want.Inspect(), got.Inspect())
+			}
+			continue
+		}
+		gotFn := got.(*object.CompiledFunction)
+		if gotFn.Name != wantFn.Name ||
+			gotFn.Instructions.String() != wantFn.Instructions.String() ||
+			gotFn.NumLocals != wantFn.NumLocals ||
+			gotFn.NumParameters != wantFn.NumParameters ||
+			gotFn.NumDefaults != wantFn.NumDefaults ||
+			gotFn.Variadic != wantFn.Variadic ||
+			gotFn.MaxStackDepth != wantFn.MaxStackDepth ||
+			!reflect.DeepEqual(gotFn.Positions, wantFn.Positions) ||
+			strings.Join(gotFn.Parameters, ",") != strings.Join(wantFn.Parameters, ",") {
+			t.Errorf("function constant %d differs. want=%+v, got=%+v", i, wantFn, gotFn)
+		}
+	}
+}
+
+func TestRegisterBytecodeRoundTrip(t *testing.T) {
+	compiler := NewWithOptions(Options{Backend: RegisterBackend})
+	err := compiler.Compile(parse(`let fib = fn(n) { if (n < 2) { n } else { fib(n - 1) + fib(n - 2) } }; fib(10)`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	original := compiler.Bytecode()
+
+	data, err := original.MarshalBinary()
+	if err != nil {
+		t.Fatalf("encode error: %s", err)
+	}
+	decoded := &Bytecode{}
+	err = decoded.UnmarshalBinary(data)
+	if err != nil {
+		t.Fatalf("decode error: %s", err)
+	}
+
+	if decoded.Backend != RegisterBackend {
+		t.Errorf("wrong backend. want=%s, got=%s", RegisterBackend, decoded.Backend)
+	}
+	if decoded.Disassemble() != original.Disassemble() {
+		t.Errorf("disassembly differs. want=\n%s\ngot=\n%s", original.Disassemble(), decoded.Disassemble())
+	}
+}
+
+func TestBytecodeDecodeErrors(t *testing.T) {
+	compiler := New()
+	err := compiler.Compile(parse(`let s = "abc"; 1 + 2`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	valid, err := compiler.Bytecode().MarshalBinary()
+	if err != nil {
+		t.Fatalf("encode error: %s", err)
+	}
+
+	corrupt := func(i int) []byte {
+		data := append([]byte{}, valid...)
+		data[i] ^= 0xff
+		return data
+	}
+
+	tests := []struct {
+		name     string
+		data     []byte
+		expected string
+	}{
+		{"empty", nil, ErrNotBytecode.Error()},
+		{"bad magic", corrupt(0), ErrNotBytecode.Error()},
+		{"bad version", corrupt(5), "unsupported bytecode version 245, want 10"},
+		{"bad checksum", corrupt(len(valid) - 1), ErrChecksumMismatch.Error()},
+		{"flipped payload", corrupt(8), ErrChecksumMismatch.Error()},
+		{"truncated", valid[:len(valid)-6], ErrChecksumMismatch.Error()},
+	}
+
+	for _, tt := range tests {
+		err := (&Bytecode{}).UnmarshalBinary(tt.data)
+		if err == nil || err.Error() != tt.expected {
+			t.Errorf("%s: want error %q, got %v", tt.name, tt.expected, err)
+		}
+	}
+
+	// A well-formed file whose body is cut short is reported as truncated
+	// rather than misread, even with a matching checksum.
+	short := &Bytecode{Constants: []object.Object{&object.String{Value: "abc"}}}
+	data, _ := short.MarshalBinary()
+	body := data[:len(data)-6]
+	body = binary.BigEndian.AppendUint32(body, crc32.ChecksumIEEE(body))
+	err = (&Bytecode{}).UnmarshalBinary(body)
+	if !errors.Is(err, ErrTruncated) {
+		t.Errorf("want ErrTruncated, got %v", err)
+	}
+
+	_, err = (&Bytecode{Constants: []object.Object{&object.Hash{}}}).MarshalBinary()
+	if err == nil || err.Error() != "cannot encode constant of type HASH" {
+		t.Errorf("unexpected encode error: %v", err)
+	}
+
+	// Arrays nest up to maxConstantDepth deep in a constant
+	nested := func(depth int) object.Object {
+		var obj object.Object = &object.Array{}
+		for i := 1; i < depth; i++ {
+			obj = &object.Array{Elements: []object.Object{obj}}
+		}
+		return obj
+	}
+
+	data, err = (&Bytecode{Constants: []object.Object{nested(maxConstantDepth)}}).MarshalBinary()
+	if err != nil {
+		t.Fatalf("encode error: %s", err)
+	}
+	err = (&Bytecode{}).UnmarshalBinary(data)
+	if err != nil {
+		t.Errorf("decode error: %s", err)
+	}
+
+	_, err = (&Bytecode{Constants: []object.Object{nested(maxConstantDepth + 1)}}).MarshalBinary()
+	if err == nil || err.Error() != "cannot encode constant nested deeper than 64" {
+		t.Errorf("unexpected encode error: %v", err)
+	}
+
+	// A file with a deeper constant is rejected rather than recursed into
+	data, _ = (&Bytecode{}).MarshalBinary()
+	body = append([]byte{}, data[:len(data)-5]...)
+	body = append(body, 1)
+	for i := 0; i < maxConstantDepth; i++ {
+		body = append(body, tagArray, 1)
+	}
+	body = append(body, tagArray, 0)
+	body = binary.BigEndian.AppendUint32(body, crc32.ChecksumIEEE(body))
+	err = (&Bytecode{}).UnmarshalBinary(body)
+	expected := fmt.Sprintf("constant nested deeper than 64 at offset %d", len(body)-6)
+	if err == nil || err.Error() != expected {
+		t.Errorf("want error %q, got %v", expected, err)
+	}
+}
+
+func TestBytecodeDecodeRanges(t *testing.T) {
+	// Negative values encode as uvarints of 2^63 or more, which would turn
+	// negative again if converted to an int unchecked
+	position := func(e code.PositionEntry) code.PositionTable {
+		return code.PositionTable{Files: []string{"main.helios"}, Entries: []code.PositionEntry{e}}
+	}
+	fn := func(numLocals, numParameters, numDefaults, maxStackDepth int) *Bytecode {
+		return &Bytecode{Constants: []object.Object{&object.CompiledFunction{
+			NumLocals:     numLocals,
+			NumParameters: numParameters,
+			NumDefaults:   numDefaults,
+			MaxStackDepth: maxStackDepth,
+		}}}
+	}
+
+	tests := []struct {
+		name     string
+		bytecode *Bytecode
+		expected string
+	}{
+		{"MaxStackDepth", &Bytecode{MaxStackDepth: -1}, "MaxStackDepth 18446744073709551615 out of range"},
+		{"large MaxStackDepth", &Bytecode{MaxStackDepth: math.MaxInt32 + 1}, "MaxStackDepth 2147483648 out of range"},
+		{"position offset", &Bytecode{Positions: position(code.PositionEntry{Offset: -1})}, "position offset 18446744073709551615 out of range"},
+		{"position file", &Bytecode{Positions: position(code.PositionEntry{File: math.MinInt64})}, "position file 9223372036854775808 out of range"},
+		{"position line", &Bytecode{Positions: position(code.PositionEntry{Line: -1})}, "position line 18446744073709551615 out of range"},
+		{"position column", &Bytecode{Positions: position(code.PositionEntry{Column: -1})}, "position column 18446744073709551615 out of range"},
+		{"NumLocals", fn(-1, 0, 0, 0), "NumLocals 18446744073709551615 out of range"},
+		{"NumParameters", fn(0, -1, 0, 0), "NumParameters 18446744073709551615 out of range"},
+		{"NumDefaults", fn(0, 0, -1, 0), "NumDefaults 18446744073709551615 out of range"},
+		{"function MaxStackDepth", fn(0, 0, 0, -1), "MaxStackDepth 18446744073709551615 out of range"},
+		{"Arity", &Bytecode{Constants: []object.Object{&object.VariantConstructor{Arity: -1}}}, "Arity 18446744073709551615 out of range"},
+	}
+
+	for _, tt := range tests {
+		data, err := tt.bytecode.MarshalBinary()
+		if err != nil {
+			t.Fatalf("%s: encode error: %s", tt.name, err)
+		}
+
+		err = (&Bytecode{}).UnmarshalBinary(data)
+		if err == nil || err.Error() != tt.expected {
+			t.Errorf("%s: want error %q, got %v", tt.name, tt.expected, err)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package compiler
+
+import "github.com/TheAlchemistKE/helios/internal/ast"
+
+// escapes finds the closures of a function that never escape it. A function
+// literal bound to a name by a let or a declaration in the function's body
+// does not escape if every use of that name is a call, made by the function
+// itself rather than by a closure within it, and the name is bound nowhere
+// else in the body. The closure then only ever runs directly on top of the
+// function's frame, so it can read the function's variables from there
+// instead of capturing them, see SymbolTable.readsCaller.
+type escapes struct {
+	literals map[string]*ast.FunctionLiteral
+	bindings map[string]int
+	escaped  map[string]bool
+	// unknown is set if the body holds a node the analysis does not know,
+	// in which case every closure is assumed to escape
+	unknown bool
+}
+
+// nonEscaping returns the closures of fn that never escape it
+func nonEscaping(fn *ast.FunctionLiteral) []*ast.FunctionLiteral {
+	e := &escapes{
+		literals: map[string]*ast.FunctionLiteral{},
+		bindings: map[string]int{},
+		escaped:  map[string]bool{},
+	}
+
+	for _, p := range fn.Parameters {
+		e.bindings[p.Value]++
+	}
+	if fn.Variadic != nil {
+		e.bindings[fn.Variadic.Value]++
+	}
+	for _, def := range fn.Defaults {
+		if def != nil {
+			e.walk(def, false)
+		}
+	}
+	e.walk(fn.Body, false)
+
+	if e.unknown {
+		return nil
+	}
+
+	literals := []*ast.FunctionLiteral{}
+	for name, literal := range e.literals {
+		if e.bindings[name] == 1 && !e.escaped[name] {
+			literals = append(literals, literal)
+		}
+	}
+	return literals
+}
+
+// walk records the bindings and uses of names in node. nested is set within
+// a function literal, where every use is an escape.
+func (e *escapes) walk(node ast.Node, nested bool) {
+	switch node := node.(type) {
+	case nil:
+
+	case *ast.BlockStatement:
+		for _, s := range node.Statements {
+			e.walk(s, nested)
+		}
+
+	case *ast.ExpressionStatement:
+		e.walk(node.Expression, nested)
+
+	case *ast.ReturnStatement:
+		e.walk(node.ReturnValue, nested)
+
+	case *ast.LetStatement:
+		if node.Pattern != nil {
+			e.pattern(node.Pattern, nested)
+		} else {
+			e.bind(node.Name.Value, node.Value, nested)
+		}
+		e.walk(node.Value, nested)
+
+	case *ast.FunctionStatement:
+		e.bind(node.Name.Value, node.Function, nested)
+		e.walk(node.Function, nested)
+
+	case *ast.FunctionLiteral:
+		for _, def := range node.Defaults {
+			if def != nil {
+				e.walk(def, true)
+			}
+		}
+		e.walk(node.Body, true)
+
+	case *ast.Identifier:
+		e.escaped[node.Value] = true
+
+	case *ast.CallExpression:
+		if _, ok := node.Function.(*ast.Identifier); !ok || nested {
+			e.walk(node.Function, nested)
+		}
+		for _, a := range node.Arguments {
+			e.walk(a, nested)
+		}
+		for _, ka := range node.KeywordArguments {
+			e.walk(ka.Value, nested)
+		}
+
+	case *ast.IntegerLiteral, *ast.FloatLiteral, *ast.StringLiteral, *ast.Boolean, *ast.NullLiteral:
+
+	case *ast.EnumStatement:
+		e.bindings[node.Name.Value]++
+		for _, v := range node.Variants {
+			e.bindings[v.Name.Value]++
+		}
+
+	case *ast.PrefixExpression:
+		e.walk(node.Right, nested)
+
+	case *ast.InfixExpression:
+		e.walk(node.Left, nested)
+		e.walk(node.Right, nested)
+
+	case *ast.IfExpression:
+		e.walk(node.Condition, nested)
+		e.walk(node.Consequence, nested)
+		if node.Alternative != nil {
+			e.walk(node.Alternative, nested)
+		}
+
+	case *ast.ArrayLiteral:
+		for _, el := range node.Elements {
+			e.walk(el, nested)
+		}
+
+	case *ast.HashLiteral:
+		for k, v := range node.Pairs {
+			e.walk(k, nested)
+			e.walk(v, nested)
+		}
+
+	case *ast.IndexExpression:
+		e.walk(node.Left, nested)
+		e.walk(node.Index, nested)
+
+	case *ast.MemberExpression:
+		e.walk(node.Object, nested)
+
+	case *ast.MatchExpression:
+		e.walk(node.Subject, nested)
+		for _, arm := range node.Arms {
+			e.pattern(arm.Pattern, nested)
+			e.walk(arm.Guard, nested)
+			e.walk(arm.Body, nested)
+		}
+
+	default:
+		e.unknown = true
+	}
+}
+
+// bind records a binding of name to value
+func (e *escapes) bind(name string, value ast.Expression, nested bool) {
+	e.bindings[name]++
+	if literal, ok := value.(*ast.FunctionLiteral); ok && !nested {
+		e.literals[name] = literal
+	}
+}
+
+// pattern records the names a pattern binds, and the uses in its literals
+// and defaults
+func (e *escapes) pattern(p ast.Pattern, nested bool) {
+	switch p := p.(type) {
+	case nil, *ast.WildcardPattern:
+
+	case *ast.BindingPattern:
+		e.bindings[p.Name.Value]++
+
+	case *ast.VariantPattern:
+		e.escaped[p.Name.Value] = true
+		for _, f := range p.Fields {
+			e.pattern(f, nested)
+		}
+
+	case *ast.LiteralPattern:
+		e.walk(p.Value, nested)
+
+	case *ast.ArrayPattern:
+		for _, el := range p.Elements {
+			e.pattern(el, nested)
+		}
+		e.pattern(p.Rest, nested)
+
+	case *ast.HashPattern:
+		for _, pair := range p.Pairs {
+			e.walk(pair.Key, nested)
+			e.pattern(pair.Value, nested)
+		}
+
+	case *ast.DefaultPattern:
+		e.pattern(p.Pattern, nested)
+		e.walk(p.Default, nested)
+
+	default:
+		e.unknown = true
+	}
+}
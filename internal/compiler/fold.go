@@ -0,0 +1,295 @@
+package compiler
+
+import (
+	"strconv"
+
+	"github.com/TheAlchemistKE/helios/internal/ast"
+	"github.com/TheAlchemistKE/helios/internal/token"
+)
+
+// Options selects the optimisations the compiler performs. The zero value
+// compiles every expression exactly as written.
+type Options struct {
+	// FoldConstants evaluates operators on literals at compile time,
+	// simplifies algebraic identities and drops the branch of an if whose
+	// condition is a literal.
+	FoldConstants bool
+
+	// Peephole rewrites wasteful instruction sequences in each function
+	// once it is compiled and threads chains of jumps, see peephole
+	Peephole bool
+
+	// EliminateDeadCode drops statements after a return, instructions no
+	// path reaches, pure expressions, let bindings and function
+	// declarations in functions whose value is never used, and the
+	// constants only the dropped code referred to
+	EliminateDeadCode bool
+
+	// Inline replaces calls to small functions bound with let by their
+	// body, see registerInline. InlineThreshold is the size in bytes of
+	// the largest function inlined, DefaultInlineThreshold if zero.
+	Inline          bool
+	InlineThreshold int
+
+	// Superinstructions replaces common sequences of instructions by
+	// fused opcodes once each function is compiled, see fuse
+	Superinstructions bool
+
+	// SpecialiseIntegers compiles operators whose operands are known to
+	// be integers, see staticType, to their Int forms
+	SpecialiseIntegers bool
+
+	// EscapeAnalysis compiles closures that never escape the function
+	// defining them to read its variables from its frame instead of
+	// capturing them, see nonEscaping
+	EscapeAnalysis bool
+
+	// SSA compiles programs through the IR, whose passes propagate
+	// constants and copies and remove dead code, see compileSSA. Programs
+	// the IR cannot express, see ir.ErrUnsupported, are compiled directly
+	// and a warning says why.
+	SSA bool
+
+	// Backend selects the instruction set. RegisterBackend compiles
+	// programs through the IR to register code, see compileRegisters;
+	// programs the IR cannot express are compiled to stack code, with a
+	// warning.
+	Backend Backend
+}
+
+// NewWithOptions creates a compiler that applies the optimisations in opts
+func NewWithOptions(opts Options) *Compiler {
+	compiler := New()
+	compiler.options = opts
+	return compiler
+}
+
+// simplify returns expr with every operator on literals replaced by its
+// result. It folds exactly what the VM would compute and leaves anything that
+// would fail at run time, such as a division by zero or adding a string to a
+// number, in place so the error still happens. expr itself is returned if
+// nothing changed.
+func simplify(expr ast.Expression) ast.Expression {
+	switch node := expr.(type) {
+	case *ast.PrefixExpression:
+		right := simplify(node.Right)
+		if folded, ok := foldPrefix(node, right); ok {
+			return folded
+		}
+		if right != node.Right {
+			return &ast.PrefixExpression{Token: node.Token, Operator: node.Operator, Right: right}
+		}
+
+	case *ast.InfixExpression:
+		left, right := simplify(node.Left), simplify(node.Right)
+		if folded, ok := foldInfix(node, left, right); ok {
+			return folded
+		}
+		if identity, ok := simplifyIdentity(node.Operator, left, right); ok {
+			return identity
+		}
+		if left != node.Left || right != node.Right {
+			return &ast.InfixExpression{Token: node.Token, Left: left, Operator: node.Operator, Right: right}
+		}
+	}
+
+	return expr
+}
+
+func foldPrefix(node *ast.PrefixExpression, right ast.Expression) (ast.Expression, bool) {
+	switch node.Operator {
+	case "-":
+		switch right := right.(type) {
+		case *ast.IntegerLiteral:
+			return integerLiteral(node.Token, -right.Value), true
+		case *ast.FloatLiteral:
+			return floatLiteral(node.Token, -right.Value), true
+		}
+
+	case "!":
+		if truthy, ok := literalTruthiness(right); ok {
+			return booleanLiteral(node.Token, !truthy), true
+		}
+	}
+
+	return nil, false
+}
+
+func foldInfix(node *ast.InfixExpression, left, right ast.Expression) (ast.Expression, bool) {
+	tok := node.Token
+
+	switch l := left.(type) {
+	case *ast.IntegerLiteral:
+		if r, ok := right.(*ast.IntegerLiteral); ok {
+			return foldIntegers(tok, node.Operator, l.Value, r.Value)
+		}
+		if r, ok := right.(*ast.FloatLiteral); ok {
+			return foldFloats(tok, node.Operator, float64(l.Value), r.Value)
+		}
+
+	case *ast.FloatLiteral:
+		if r, ok := right.(*ast.IntegerLiteral); ok {
+			return foldFloats(tok, node.Operator, l.Value, float64(r.Value))
+		}
+		if r, ok := right.(*ast.FloatLiteral); ok {
+			return foldFloats(tok, node.Operator, l.Value, r.Value)
+		}
+
+	case *ast.StringLiteral:
+		if r, ok := right.(*ast.StringLiteral); ok {
+			return foldStrings(tok, node.Operator, l.Value, r.Value)
+		}
+
+	case *ast.Boolean:
+		if r, ok := right.(*ast.Boolean); ok {
+			return foldEquality(tok, node.Operator, l.Value == r.Value)
+		}
+
+	case *ast.NullLiteral:
+		if _, ok := right.(*ast.NullLiteral); ok {
+			return foldEquality(tok, node.Operator, true)
+		}
+	}
+
+	return nil, false
+}
+
+func foldIntegers(tok token.Token, operator string, l, r int64) (ast.Expression, bool) {
+	switch operator {
+	case "+":
+		return integerLiteral(tok, l+r), true
+	case "-":
+		return integerLiteral(tok, l-r), true
+	case "*":
+		return integerLiteral(tok, l*r), true
+	case "/":
+		if r == 0 {
+			return nil, false
+		}
+		return integerLiteral(tok, l/r), true
+	case ">":
+		return booleanLiteral(tok, l > r), true
+	case "<":
+		return booleanLiteral(tok, l < r), true
+	}
+	return foldEquality(tok, operator, l == r)
+}
+
+func foldFloats(tok token.Token, operator string, l, r float64) (ast.Expression, bool) {
+	switch operator {
+	case "+":
+		return floatLiteral(tok, l+r), true
+	case "-":
+		return floatLiteral(tok, l-r), true
+	case "*":
+		return floatLiteral(tok, l*r), true
+	case "/":
+		if r == 0 {
+			return nil, false
+		}
+		return floatLiteral(tok, l/r), true
+	case ">":
+		return booleanLiteral(tok, l > r), true
+	case "<":
+		return booleanLiteral(tok, l < r), true
+	}
+	return foldEquality(tok, operator, l == r)
+}
+
+func foldStrings(tok token.Token, operator string, l, r string) (ast.Expression, bool) {
+	switch operator {
+	case "+":
+		return &ast.StringLiteral{Token: token.Token{Type: token.STRING, Literal: l + r,
+			Line: tok.Line, Column: tok.Column}, Value: l + r}, true
+	case ">":
+		return booleanLiteral(tok, l > r), true
+	case "<":
+		return booleanLiteral(tok, l < r), true
+	}
+	return foldEquality(tok, operator, l == r)
+}
+
+func foldEquality(tok token.Token, operator string, equal bool) (ast.Expression, bool) {
+	switch operator {
+	case "==":
+		return booleanLiteral(tok, equal), true
+	case "!=":
+		return booleanLiteral(tok, !equal), true
+	}
+	return nil, false
+}
+
+// simplifyIdentity removes multiplication and division by one and
+// subtraction of zero. These only hold for numbers, so they are applied only
+// when the other operand is an arithmetic expression, which either yields a
+// number or fails by itself. x + 0 is left alone: for x = -0.0 it is 0.0.
+func simplifyIdentity(operator string, left, right ast.Expression) (ast.Expression, bool) {
+	switch operator {
+	case "*":
+		if isIntegerLiteral(right, 1) && isArithmetic(left) {
+			return left, true
+		}
+		if isIntegerLiteral(left, 1) && isArithmetic(right) {
+			return right, true
+		}
+	case "/":
+		if isIntegerLiteral(right, 1) && isArithmetic(left) {
+			return left, true
+		}
+	case "-":
+		if isIntegerLiteral(right, 0) && isArithmetic(left) {
+			return left, true
+		}
+	}
+	return nil, false
+}
+
+func isIntegerLiteral(expr ast.Expression, value int64) bool {
+	integer, ok := expr.(*ast.IntegerLiteral)
+	return ok && integer.Value == value
+}
+
+// isArithmetic reports whether expr produces a number whenever it succeeds
+func isArithmetic(expr ast.Expression) bool {
+	switch expr := expr.(type) {
+	case *ast.IntegerLiteral, *ast.FloatLiteral:
+		return true
+	case *ast.PrefixExpression:
+		return expr.Operator == "-"
+	case *ast.InfixExpression:
+		return expr.Operator == "-" || expr.Operator == "*" || expr.Operator == "/"
+	}
+	return false
+}
+
+// literalTruthiness reports whether a literal is truthy, following the VM's
+// isTruthy: only false and null are falsy
+func literalTruthiness(expr ast.Expression) (bool, bool) {
+	switch expr := expr.(type) {
+	case *ast.Boolean:
+		return expr.Value, true
+	case *ast.NullLiteral:
+		return false, true
+	case *ast.IntegerLiteral, *ast.FloatLiteral, *ast.StringLiteral:
+		return true, true
+	}
+	return false, false
+}
+
+func integerLiteral(tok token.Token, value int64) *ast.IntegerLiteral {
+	return &ast.IntegerLiteral{Token: token.Token{Type: token.INT,
+		Literal: strconv.FormatInt(value, 10), Line: tok.Line, Column: tok.Column}, Value: value}
+}
+
+func floatLiteral(tok token.Token, value float64) *ast.FloatLiteral {
+	return &ast.FloatLiteral{Token: token.Token{Type: token.FLOAT,
+		Literal: strconv.FormatFloat(value, 'g', -1, 64), Line: tok.Line, Column: tok.Column}, Value: value}
+}
+
+func booleanLiteral(tok token.Token, value bool) *ast.Boolean {
+	t := token.Token{Type: token.FALSE, Literal: "false", Line: tok.Line, Column: tok.Column}
+	if value {
+		t.Type, t.Literal = token.TRUE, "true"
+	}
+	return &ast.Boolean{Token: t, Value: value}
+}
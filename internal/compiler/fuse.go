@@ -0,0 +1,83 @@
+package compiler
+
+import "github.com/TheAlchemistKE/helios/internal/code"
+
+// superinstructions are the sequences fuse replaces, longest first. The
+// operands of a superinstruction are those of its sequence, in order.
+var superinstructions = []struct {
+	sequence []code.Opcode
+	fused    code.Opcode
+}{
+	{[]code.Opcode{code.OpGetLocal, code.OpGetLocal, code.OpGreaterThan, code.OpJumpNotTruthy}, code.OpJumpLocalsNotGreater},
+	{[]code.Opcode{code.OpGetLocal, code.OpConstant, code.OpAdd}, code.OpLocalAddConstant},
+	{[]code.Opcode{code.OpGetLocal, code.OpConstant, code.OpSub}, code.OpLocalSubConstant},
+	{[]code.Opcode{code.OpGreaterThan, code.OpJumpNotTruthy}, code.OpJumpNotGreater},
+	{[]code.Opcode{code.OpEqual, code.OpJumpNotTruthy}, code.OpJumpNotEqual},
+	{[]code.Opcode{code.OpGetLocal, code.OpReturnValue}, code.OpReturnLocal},
+	{[]code.Opcode{code.OpGetLocal, code.OpGetLocal}, code.OpGetLocalPair},
+}
+
+// fuse replaces common sequences of instructions by a superinstruction that
+// does the same in one dispatch. Like peephole, it never merges an
+// instruction that something jumps to with the ones before it. A
+// superinstruction takes the position of the last instruction of its
+// sequence that is not a jump, the one that can fail.
+func fuse(list []editable) []editable {
+	targeted := map[int]bool{}
+	for _, e := range list {
+		if isJump(e.op) {
+			targeted[e.target] = true
+		}
+	}
+
+	deleted := make([]bool, len(list))
+	for i := 0; i < len(list); i++ {
+		for _, s := range superinstructions {
+			n := len(s.sequence)
+			if !matches(list, i, s.sequence, targeted) {
+				continue
+			}
+
+			fused := editable{op: s.fused, target: list[i+n-1].target, offset: list[i].offset}
+			for j := i; j < i+n; j++ {
+				fused.operands = append(fused.operands, list[j].operands...)
+				if !isJump(list[j].op) && list[j].hasPos {
+					fused.position, fused.hasPos = list[j].position, true
+				}
+			}
+			// Locals too large for the narrow form are left alone. Jump
+			// targets are only known once the code is encoded.
+			operands := fused.operands
+			if isJump(s.fused) {
+				operands = operands[:len(operands)-1]
+			}
+			def, _ := code.Lookup(byte(s.fused))
+			if !def.Fits(operands...) {
+				continue
+			}
+
+			list[i] = fused
+			for j := i + 1; j < i+n; j++ {
+				deleted[j] = true
+			}
+			i += n - 1
+			break
+		}
+	}
+
+	return compact(list, deleted)
+}
+
+// matches reports whether list holds sequence from i, with no jump into
+// the middle of it
+func matches(list []editable, i int, sequence []code.Opcode, targeted map[int]bool) bool {
+	if i+len(sequence) > len(list) {
+		return false
+	}
+	for j, op := range sequence {
+		if list[i+j].op != op || j > 0 && targeted[i+j] {
+			return false
+		}
+	}
+	return true
+}
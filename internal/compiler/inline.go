@@ -0,0 +1,218 @@
+package compiler
+
+import (
+	"github.com/TheAlchemistKE/helios/internal/ast"
+	"github.com/TheAlchemistKE/helios/internal/object"
+)
+
+// DefaultInlineThreshold is the largest function, in bytes of instructions,
+// inlined when Options.InlineThreshold is zero
+const DefaultInlineThreshold = 32
+
+// inlineFunction is a function literal bound with let whose calls can be
+// replaced by its body. names holds what each name in the body other than
+// the parameters meant where the function was defined.
+type inlineFunction struct {
+	literal *ast.FunctionLiteral
+	names   map[string]Symbol
+}
+
+// inlineKey identifies the variable a function is bound to. Local slots are
+// only unique within their function's symbol table.
+type inlineKey struct {
+	table *SymbolTable
+	scope SymbolScope
+	index int
+}
+
+func (c *Compiler) inlineKey(s Symbol) inlineKey {
+	key := inlineKey{scope: s.Scope, index: s.Index}
+	if s.Scope == LocalScope {
+		key.table = c.symbolTable
+	}
+	return key
+}
+
+func (c *Compiler) inlineThreshold() int {
+	if c.options.InlineThreshold > 0 {
+		return c.options.InlineThreshold
+	}
+	return DefaultInlineThreshold
+}
+
+// registerInline records the function literal just compiled for symbol as
+// inlinable if it is small and its body is a plain expression over its
+// parameters, globals and builtins. Functions that call themselves, define
+// variables or functions, return early or check the types of their
+// arguments are never inlined.
+func (c *Compiler) registerInline(symbol Symbol, node *ast.LetStatement) {
+	literal, ok := node.Value.(*ast.FunctionLiteral)
+	if !ok || literal.Variadic != nil || literal.Types != nil {
+		return
+	}
+	for _, def := range literal.Defaults {
+		if def != nil {
+			return
+		}
+	}
+
+	// compileFunctionLiteral adds the function as the last constant
+	fn, ok := c.constants[len(c.constants)-1].(*object.CompiledFunction)
+	if !ok || len(fn.Instructions) > c.inlineThreshold() {
+		return
+	}
+
+	params := map[string]bool{}
+	for _, p := range literal.Parameters {
+		params[p.Value] = true
+	}
+
+	names := map[string]Symbol{}
+	if !c.inlineNames(literal.Body, node.Name.Value, params, names) {
+		return
+	}
+
+	if c.inlinable == nil {
+		c.inlinable = map[inlineKey]*inlineFunction{}
+	}
+	c.inlinable[c.inlineKey(symbol)] = &inlineFunction{literal: literal, names: names}
+}
+
+// inlineNames resolves every name in node that is not a parameter into
+// names. It reports false if node cannot be inlined.
+func (c *Compiler) inlineNames(node ast.Node, self string, params map[string]bool, names map[string]Symbol) bool {
+	resolve := func(nodes ...ast.Node) bool {
+		for _, n := range nodes {
+			if !c.inlineNames(n, self, params, names) {
+				return false
+			}
+		}
+		return true
+	}
+
+	switch node := node.(type) {
+	case *ast.BlockStatement:
+		for _, s := range node.Statements {
+			stmt, ok := s.(*ast.ExpressionStatement)
+			if !ok || !resolve(stmt.Expression) {
+				return false
+			}
+		}
+		return true
+
+	case *ast.Identifier:
+		if params[node.Value] {
+			return true
+		}
+		if node.Value == self {
+			return false
+		}
+		symbol, ok := c.symbolTable.Resolve(node.Value)
+		if !ok || (symbol.Scope != GlobalScope && symbol.Scope != BuiltinScope) {
+			return false
+		}
+		names[node.Value] = symbol
+		return true
+
+	case *ast.IntegerLiteral, *ast.FloatLiteral, *ast.StringLiteral, *ast.Boolean, *ast.NullLiteral:
+		return true
+
+	case *ast.PrefixExpression:
+		return resolve(node.Right)
+
+	case *ast.InfixExpression:
+		return resolve(node.Left, node.Right)
+
+	case *ast.IfExpression:
+		if node.Alternative != nil && !resolve(node.Alternative) {
+			return false
+		}
+		return resolve(node.Condition, node.Consequence)
+
+	case *ast.CallExpression:
+		if len(node.KeywordArguments) > 0 || !resolve(node.Function) {
+			return false
+		}
+		for _, a := range node.Arguments {
+			if !resolve(a) {
+				return false
+			}
+		}
+		return true
+
+	case *ast.IndexExpression:
+		return resolve(node.Left, node.Index)
+
+	case *ast.ArrayLiteral:
+		for _, el := range node.Elements {
+			if !resolve(el) {
+				return false
+			}
+		}
+		return true
+
+	case *ast.HashLiteral:
+		for k, v := range node.Pairs {
+			if !resolve(k, v) {
+				return false
+			}
+		}
+		return true
+	}
+
+	return false
+}
+
+// compileInlineCall compiles a call to an inlinable function as its body.
+// The arguments are stored in new slots of the caller, which the body's
+// parameters are renamed to. Calls within an inlined body are not inlined,
+// so inlining always ends. It reports false if the call was not inlined.
+func (c *Compiler) compileInlineCall(node *ast.CallExpression) (bool, error) {
+	if !c.options.Inline || c.inlining || len(node.KeywordArguments) > 0 {
+		return false, nil
+	}
+
+	ident, ok := node.Function.(*ast.Identifier)
+	if !ok {
+		return false, nil
+	}
+	symbol, ok := c.symbolTable.Resolve(ident.Value)
+	if !ok {
+		return false, nil
+	}
+	fn, ok := c.inlinable[c.inlineKey(symbol)]
+	if !ok || len(node.Arguments) != len(fn.literal.Parameters) {
+		return false, nil
+	}
+
+	for _, a := range node.Arguments {
+		err := c.Compile(a)
+		if err != nil {
+			return true, err
+		}
+	}
+
+	names := map[string]Symbol{}
+	for name, s := range fn.names {
+		names[name] = s
+	}
+
+	slots := make([]Symbol, len(node.Arguments))
+	for i, p := range fn.literal.Parameters {
+		slots[i] = c.defineTemp()
+		names[p.Value] = slots[i]
+	}
+	for i := len(slots) - 1; i >= 0; i-- {
+		c.storeSymbol(slots[i])
+	}
+
+	caller := c.symbolTable
+	c.symbolTable = newInlineSymbolTable(caller, names)
+	c.inlining = true
+	defer func() {
+		c.symbolTable = caller
+		c.inlining = false
+	}()
+
+	return true, c.compileBlockValue(fn.literal.Body)
+}
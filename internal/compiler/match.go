@@ -0,0 +1,587 @@
+package compiler
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/TheAlchemistKE/helios/internal/ast"
+	"github.com/TheAlchemistKE/helios/internal/code"
+	"github.com/TheAlchemistKE/helios/internal/object"
+)
+
+// variantInfo describes an enum case known to the compiler
+type variantInfo struct {
+	enum     string
+	name     string
+	arity    int
+	constant int // index of the case's constructor or value in the constant pool
+}
+
+func (c *Compiler) compileEnum(node *ast.EnumStatement) error {
+	names := []string{}
+
+	for _, v := range node.Variants {
+		name := v.Name.Value
+		// Patterns and constructors name variants without their enum, so a
+		// variant name is only ever defined once
+		if existing, ok := c.variants[name]; ok {
+			if existing.enum == node.Name.Value {
+				return fmt.Errorf("duplicate variant %s in enum %s", name, node.Name.Value)
+			}
+			return fmt.Errorf("variant %s of enum %s is already defined by enum %s",
+				name, node.Name.Value, existing.enum)
+		}
+
+		for i, field := range v.Fields {
+			for _, earlier := range v.Fields[:i] {
+				if earlier.Value == field.Value {
+					return fmt.Errorf("duplicate field %s in variant %s", field.Value, name)
+				}
+			}
+		}
+
+		var tag object.Object
+		if len(v.Fields) == 0 {
+			tag = &object.Variant{Enum: node.Name.Value, Name: name}
+		} else {
+			tag = &object.VariantConstructor{Enum: node.Name.Value, Name: name, Arity: len(v.Fields)}
+		}
+
+		info := &variantInfo{
+			enum:     node.Name.Value,
+			name:     name,
+			arity:    len(v.Fields),
+			constant: c.addConstant(tag),
+		}
+		c.variants[name] = info
+		names = append(names, name)
+
+		symbol := c.symbolTable.Define(name)
+		c.emit(code.OpConstant, info.constant)
+		c.storeSymbol(symbol)
+	}
+
+	c.enums[node.Name.Value] = names
+	return nil
+}
+
+// variantScope returns the variants and enums a pattern can name: the
+// current module's, or the exported ones of the imported module named by
+// module
+func (c *Compiler) variantScope(module *ast.Identifier) (map[string]*variantInfo, map[string][]string, error) {
+	if module == nil {
+		return c.variants, c.enums, nil
+	}
+
+	symbol, ok := c.symbolTable.Resolve(module.Value)
+	if !ok || symbol.Scope != ModuleScope {
+		return nil, nil, fmt.Errorf("%s is not a module", module.Value)
+	}
+
+	mod := c.modules[symbol.Index]
+	return mod.variants, mod.enums, nil
+}
+
+// compileMatch lowers a match expression to a chain of pattern tests. The
+// subject is stored in a temporary, every arm tests it and jumps to the next
+// arm on failure, and a match without a matching arm evaluates to null.
+func (c *Compiler) compileMatch(node *ast.MatchExpression) error {
+	err := c.Compile(node.Subject)
+	if err != nil {
+		return err
+	}
+
+	subject := c.defineTemp()
+	c.storeSymbol(subject)
+	load := c.tempLoader(subject)
+
+	endJumps := []int{}
+	for _, arm := range node.Arms {
+		nextArmJumps, err := c.compilePatternTest(arm.Pattern, load)
+		if err != nil {
+			return err
+		}
+
+		// The names an arm binds are in scope in its guard and body only
+		restore := c.symbolTable.shadow(c.patternNames(arm.Pattern, nil))
+
+		err = c.compilePatternBindings(arm.Pattern, load)
+		if err != nil {
+			return err
+		}
+
+		if arm.Guard != nil {
+			err = c.Compile(arm.Guard)
+			if err != nil {
+				return err
+			}
+			nextArmJumps = append(nextArmJumps, c.emit(code.OpJumpNotTruthy, 9999))
+		}
+
+		err = c.Compile(arm.Body)
+		if err != nil {
+			return err
+		}
+
+		if c.lastInstructionIs(code.OpPop) {
+			c.removeLastPop()
+		} else {
+			c.emit(code.OpNull)
+		}
+		restore()
+
+		endJumps = append(endJumps, c.emit(code.OpJump, 9999))
+
+		afterArmPos := len(c.currentInstructions())
+		for _, pos := range nextArmJumps {
+			c.changeOperand(pos, afterArmPos)
+		}
+	}
+
+	c.emit(code.OpNull)
+
+	afterMatchPos := len(c.currentInstructions())
+	for _, pos := range endJumps {
+		c.changeOperand(pos, afterMatchPos)
+	}
+
+	c.releaseTemp(subject)
+	c.checkExhaustive(node)
+	return nil
+}
+
+// compilePatternTest emits code that checks the value pushed by load against
+// pattern. It returns the positions of the jumps taken when the check fails.
+func (c *Compiler) compilePatternTest(pattern ast.Pattern, load func() error) ([]int, error) {
+	defer c.enterNode(pattern)()
+
+	switch pattern := pattern.(type) {
+	case *ast.WildcardPattern:
+		return nil, nil
+
+	case *ast.BindingPattern:
+		info, ok := c.variants[pattern.Name.Value]
+		if !ok {
+			return nil, nil
+		}
+		if info.arity != 0 {
+			return nil, fmt.Errorf("variant %s has %d fields, got=0", info.name, info.arity)
+		}
+
+		err := load()
+		if err != nil {
+			return nil, err
+		}
+		c.emit(code.OpMatchVariant, info.constant)
+		return []int{c.emit(code.OpJumpNotTruthy, 9999)}, nil
+
+	case *ast.VariantPattern:
+		variants, _, err := c.variantScope(pattern.Module)
+		if err != nil {
+			return nil, err
+		}
+		info, ok := variants[pattern.Name.Value]
+		if !ok {
+			if pattern.Module != nil {
+				return nil, fmt.Errorf("module %s has no variant %s", pattern.Module.Value, pattern.Name.Value)
+			}
+			return nil, fmt.Errorf("undefined variant %s", pattern.Name.Value)
+		}
+		if info.arity != len(pattern.Fields) {
+			return nil, fmt.Errorf("variant %s has %d fields, got=%d",
+				info.name, info.arity, len(pattern.Fields))
+		}
+
+		err = load()
+		if err != nil {
+			return nil, err
+		}
+		c.emit(code.OpMatchVariant, info.constant)
+		jumps := []int{c.emit(code.OpJumpNotTruthy, 9999)}
+
+		for i, field := range pattern.Fields {
+			fieldJumps, err := c.compilePatternTest(field, c.indexLoader(load, i))
+			if err != nil {
+				return nil, err
+			}
+			jumps = append(jumps, fieldJumps...)
+		}
+
+		return jumps, nil
+
+	case *ast.LiteralPattern:
+		err := load()
+		if err != nil {
+			return nil, err
+		}
+
+		err = c.Compile(pattern.Value)
+		if err != nil {
+			return nil, err
+		}
+
+		c.emit(code.OpEqual)
+		return []int{c.emit(code.OpJumpNotTruthy, 9999)}, nil
+
+	case *ast.ArrayPattern:
+		err := load()
+		if err != nil {
+			return nil, err
+		}
+
+		required := 0
+		for _, el := range pattern.Elements {
+			if _, ok := el.(*ast.DefaultPattern); !ok {
+				required++
+			}
+		}
+
+		hasRest := 0
+		if pattern.Rest != nil {
+			hasRest = 1
+		}
+		c.emit(code.OpMatchArray, required, len(pattern.Elements)-required, hasRest)
+		jumps := []int{c.emit(code.OpJumpNotTruthy, 9999)}
+
+		for i, el := range pattern.Elements {
+			elementJumps, err := c.compilePatternTest(el, c.indexLoader(load, i))
+			if err != nil {
+				return nil, err
+			}
+			jumps = append(jumps, elementJumps...)
+		}
+
+		return jumps, nil
+
+	case *ast.HashPattern:
+		err := load()
+		if err != nil {
+			return nil, err
+		}
+
+		required := 0
+		for _, pair := range pattern.Pairs {
+			if _, ok := pair.Value.(*ast.DefaultPattern); ok {
+				continue
+			}
+
+			err := c.Compile(pair.Key)
+			if err != nil {
+				return nil, err
+			}
+			required++
+		}
+		c.emit(code.OpMatchHash, required)
+		jumps := []int{c.emit(code.OpJumpNotTruthy, 9999)}
+
+		for _, pair := range pattern.Pairs {
+			valueJumps, err := c.compilePatternTest(pair.Value, c.keyLoader(load, pair.Key))
+			if err != nil {
+				return nil, err
+			}
+			jumps = append(jumps, valueJumps...)
+		}
+
+		return jumps, nil
+
+	case *ast.DefaultPattern:
+		// The value or its default is computed once, here, since the
+		// pattern within may load it many times
+		err := c.defaultLoader(load, pattern.Default)()
+		if err != nil {
+			return nil, err
+		}
+		temp := c.defineTemp()
+		c.storeSymbol(temp)
+		c.defaults[pattern] = temp
+
+		return c.compilePatternTest(pattern.Pattern, c.tempLoader(temp))
+	}
+
+	return nil, fmt.Errorf("unknown pattern %T", pattern)
+}
+
+// compilePatternBindings emits code that binds every name introduced by
+// pattern. It must only run once compilePatternTest's checks have passed.
+func (c *Compiler) compilePatternBindings(pattern ast.Pattern, load func() error) error {
+	switch pattern := pattern.(type) {
+	case *ast.BindingPattern:
+		if _, ok := c.variants[pattern.Name.Value]; ok {
+			return nil
+		}
+
+		symbol := c.symbolTable.Define(pattern.Name.Value)
+		err := load()
+		if err != nil {
+			return err
+		}
+		c.storeSymbol(symbol)
+		c.addBinding(pattern.Name, symbol, span{}, false)
+
+	case *ast.VariantPattern:
+		for i, field := range pattern.Fields {
+			err := c.compilePatternBindings(field, c.indexLoader(load, i))
+			if err != nil {
+				return err
+			}
+		}
+
+	case *ast.ArrayPattern:
+		for i, el := range pattern.Elements {
+			err := c.compilePatternBindings(el, c.indexLoader(load, i))
+			if err != nil {
+				return err
+			}
+		}
+
+		if pattern.Rest != nil {
+			err := c.compilePatternBindings(pattern.Rest, c.sliceLoader(load, len(pattern.Elements)))
+			if err != nil {
+				return err
+			}
+		}
+
+	case *ast.HashPattern:
+		for _, pair := range pattern.Pairs {
+			err := c.compilePatternBindings(pair.Value, c.keyLoader(load, pair.Key))
+			if err != nil {
+				return err
+			}
+		}
+
+	case *ast.DefaultPattern:
+		temp := c.defaults[pattern]
+		delete(c.defaults, pattern)
+
+		err := c.compilePatternBindings(pattern.Pattern, c.tempLoader(temp))
+		if err != nil {
+			return err
+		}
+		c.releaseTemp(temp)
+	}
+
+	return nil
+}
+
+// tempLoader returns a loader that pushes the value of temp
+func (c *Compiler) tempLoader(temp Symbol) func() error {
+	return func() error {
+		c.loadSymbol(temp)
+		return nil
+	}
+}
+
+// indexLoader returns a loader that pushes element i of the value pushed by load
+func (c *Compiler) indexLoader(load func() error, i int) func() error {
+	return func() error {
+		err := load()
+		if err != nil {
+			return err
+		}
+		c.emit(code.OpConstant, c.addConstant(&object.Integer{Value: int64(i)}))
+		c.emit(code.OpIndex)
+		return nil
+	}
+}
+
+// keyLoader returns a loader that pushes the value stored under key in the
+// hash pushed by load
+func (c *Compiler) keyLoader(load func() error, key ast.Expression) func() error {
+	return func() error {
+		err := load()
+		if err != nil {
+			return err
+		}
+		err = c.Compile(key)
+		if err != nil {
+			return err
+		}
+		c.emit(code.OpIndex)
+		return nil
+	}
+}
+
+// sliceLoader returns a loader that pushes the elements of the array pushed
+// by load from index start onward
+func (c *Compiler) sliceLoader(load func() error, start int) func() error {
+	return func() error {
+		err := load()
+		if err != nil {
+			return err
+		}
+		c.emit(code.OpSlice, start)
+		return nil
+	}
+}
+
+// defaultLoader returns a loader that pushes the value pushed by load, or
+// the value of def when that value is null
+func (c *Compiler) defaultLoader(load func() error, def ast.Expression) func() error {
+	return func() error {
+		err := load()
+		if err != nil {
+			return err
+		}
+		c.emit(code.OpNull)
+		c.emit(code.OpEqual)
+		jumpNotNullPos := c.emit(code.OpJumpNotTruthy, 9999)
+
+		err = c.Compile(def)
+		if err != nil {
+			return err
+		}
+		jumpPos := c.emit(code.OpJump, 9999)
+
+		c.changeOperand(jumpNotNullPos, len(c.currentInstructions()))
+		err = load()
+		if err != nil {
+			return err
+		}
+
+		c.changeOperand(jumpPos, len(c.currentInstructions()))
+		return nil
+	}
+}
+
+// compileLetPattern compiles a destructuring let. Unlike a match arm, a
+// value that does not fit the pattern is a runtime error.
+func (c *Compiler) compileLetPattern(node *ast.LetStatement) error {
+	err := c.Compile(node.Value)
+	if err != nil {
+		return err
+	}
+
+	value := c.defineTemp()
+	c.storeSymbol(value)
+	load := c.tempLoader(value)
+
+	failJumps, err := c.compilePatternTest(node.Pattern, load)
+	if err != nil {
+		return err
+	}
+
+	if len(failJumps) > 0 {
+		jumpPos := c.emit(code.OpJump, 9999)
+
+		failPos := len(c.currentInstructions())
+		for _, pos := range failJumps {
+			c.changeOperand(pos, failPos)
+		}
+
+		msg := &object.String{Value: fmt.Sprintf("value does not match pattern %s", node.Pattern)}
+		c.emit(code.OpFail, c.addConstant(msg))
+
+		c.changeOperand(jumpPos, len(c.currentInstructions()))
+	}
+
+	err = c.compilePatternBindings(node.Pattern, load)
+	if err != nil {
+		return err
+	}
+
+	c.releaseTemp(value)
+	return nil
+}
+
+// patternNames appends the names pattern binds to names
+func (c *Compiler) patternNames(pattern ast.Pattern, names []string) []string {
+	switch pattern := pattern.(type) {
+	case *ast.BindingPattern:
+		if _, ok := c.variants[pattern.Name.Value]; !ok {
+			names = append(names, pattern.Name.Value)
+		}
+	case *ast.VariantPattern:
+		for _, field := range pattern.Fields {
+			names = c.patternNames(field, names)
+		}
+	case *ast.ArrayPattern:
+		for _, el := range pattern.Elements {
+			names = c.patternNames(el, names)
+		}
+		if pattern.Rest != nil {
+			names = c.patternNames(pattern.Rest, names)
+		}
+	case *ast.HashPattern:
+		for _, pair := range pattern.Pairs {
+			names = c.patternNames(pair.Value, names)
+		}
+	case *ast.DefaultPattern:
+		names = c.patternNames(pattern.Pattern, names)
+	}
+	return names
+}
+
+// isIrrefutable reports whether pattern matches every value
+func (c *Compiler) isIrrefutable(pattern ast.Pattern) bool {
+	switch pattern := pattern.(type) {
+	case *ast.WildcardPattern:
+		return true
+	case *ast.BindingPattern:
+		_, isVariant := c.variants[pattern.Name.Value]
+		return !isVariant
+	}
+	return false
+}
+
+// checkExhaustive records a warning when a match over the variants of an
+// enum neither covers every variant nor has a catch-all arm
+func (c *Compiler) checkExhaustive(node *ast.MatchExpression) {
+	enum := ""
+	var cases []string
+	covered := map[string]bool{}
+
+	for _, arm := range node.Arms {
+		if arm.Guard != nil {
+			continue
+		}
+		if c.isIrrefutable(arm.Pattern) {
+			return
+		}
+
+		var info *variantInfo
+		complete := true
+
+		switch pattern := arm.Pattern.(type) {
+		case *ast.BindingPattern:
+			info = c.variants[pattern.Name.Value]
+			if info != nil && enum == "" {
+				cases = c.enums[info.enum]
+			}
+		case *ast.VariantPattern:
+			variants, enums, _ := c.variantScope(pattern.Module)
+			info = variants[pattern.Name.Value]
+			if info != nil && enum == "" {
+				cases = enums[info.enum]
+			}
+			for _, field := range pattern.Fields {
+				complete = complete && c.isIrrefutable(field)
+			}
+		}
+
+		if info == nil {
+			continue
+		}
+		if enum == "" {
+			enum = info.enum
+		}
+		if info.enum == enum && complete {
+			covered[info.name] = true
+		}
+	}
+
+	if enum == "" {
+		return
+	}
+
+	missing := []string{}
+	for _, name := range cases {
+		if !covered[name] {
+			missing = append(missing, name)
+		}
+	}
+
+	if len(missing) > 0 {
+		c.warnings = append(c.warnings, fmt.Sprintf("non-exhaustive match on %s: missing %s",
+			enum, strings.Join(missing, ", ")))
+	}
+}
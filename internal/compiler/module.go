@@ -0,0 +1,340 @@
+package compiler
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/TheAlchemistKE/helios/internal/ast"
+	"github.com/TheAlchemistKE/helios/internal/code"
+	"github.com/TheAlchemistKE/helios/internal/lexer"
+	"github.com/TheAlchemistKE/helios/internal/object"
+	"github.com/TheAlchemistKE/helios/internal/parser"
+)
+
+// SourceExtension is the file extension of Helios source files
+const SourceExtension = ".helios"
+
+// Resolver locates and loads the source of imported modules
+type Resolver interface {
+	// Resolve returns the canonical path of the module imported as path
+	// by the module at importer. importer is empty for the main program.
+	Resolve(importer, path string) (string, error)
+	// Load returns the source of the module at a canonical path
+	Load(path string) (string, error)
+	// Canonical returns the canonical path of the main program's file,
+	// given as path
+	Canonical(path string) (string, error)
+}
+
+// FileResolver loads modules from the file system. Paths starting with
+// "./" or "../" are relative to the importing file, all others to Root.
+type FileResolver struct {
+	Root string
+}
+
+func (r *FileResolver) Resolve(importer, name string) (string, error) {
+	dir := r.Root
+	if importer != "" && (strings.HasPrefix(name, "./") || strings.HasPrefix(name, "../")) {
+		dir = filepath.Dir(importer)
+	}
+
+	p := filepath.Join(dir, filepath.FromSlash(name))
+	if filepath.Ext(p) != SourceExtension {
+		p += SourceExtension
+	}
+
+	return filepath.Abs(p)
+}
+
+func (r *FileResolver) Load(path string) (string, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return string(src), nil
+}
+
+func (r *FileResolver) Canonical(path string) (string, error) {
+	return filepath.Abs(path)
+}
+
+// MapResolver serves modules from memory, keyed by import path
+type MapResolver map[string]string
+
+func (r MapResolver) Resolve(importer, name string) (string, error) {
+	if _, ok := r[name]; !ok {
+		return "", fmt.Errorf("module %q not found", name)
+	}
+	return name, nil
+}
+
+func (r MapResolver) Load(path string) (string, error) {
+	return r[path], nil
+}
+
+func (r MapResolver) Canonical(path string) (string, error) {
+	return path, nil
+}
+
+// ModuleError reports a compile error inside an imported module
+type ModuleError struct {
+	Path string
+	Err  error
+}
+
+func (e *ModuleError) Error() string { return e.Path + ": " + e.Err.Error() }
+func (e *ModuleError) Unwrap() error { return e.Err }
+
+// module is a compiled module. Its top-level code is emitted inline at the
+// first import, so it runs exactly once, before any importer uses it.
+type module struct {
+	path    string
+	exports map[string]Symbol
+
+	// the variants and enums of exported enums, for patterns in importers
+	variants map[string]*variantInfo
+	enums    map[string][]string
+}
+
+// NewWithResolver creates a compiler for the program at path that loads
+// imports through r. path may be empty if the program has no file.
+func NewWithResolver(r Resolver, path string) *Compiler {
+	return NewWithResolverOptions(r, path, Options{})
+}
+
+// NewWithResolverOptions is NewWithResolver for a compiler that applies the
+// optimisations in opts. A path that r cannot canonicalise fails the
+// compilation.
+func NewWithResolverOptions(r Resolver, path string, opts Options) *Compiler {
+	compiler := NewWithOptions(opts)
+	compiler.resolver = r
+	if path != "" {
+		canonical, err := r.Canonical(path)
+		if err != nil {
+			compiler.fail(fmt.Errorf("cannot resolve %s: %s", path, err))
+		} else {
+			path = canonical
+		}
+	}
+	// loading holds the main program even without a path, so that a
+	// module is always compiled with more than one entry in it
+	compiler.loading = []string{path}
+	compiler.path = path
+	return compiler
+}
+
+// compileProgram compiles the top level of a module. Imports are hoisted so
+// that every imported module has run before the importer's own code, and
+// exported declarations are recorded for the importer.
+func (c *Compiler) compileProgram(program *ast.Program) error {
+	// A program that imports is compiled to stack code, and so are the
+	// modules it imports
+	if c.options.Backend == RegisterBackend && len(c.loading) <= 1 {
+		if compiled, err := c.compileRegisters(program); compiled || err != nil {
+			return err
+		}
+	}
+	if c.options.SSA {
+		if compiled, err := c.compileSSA(program); compiled || err != nil {
+			return err
+		}
+	}
+
+	stmts := []ast.Statement{}
+
+	for _, s := range program.Statements {
+		switch s := s.(type) {
+		case *ast.ImportStatement:
+			err := c.compileImport(s)
+			if err != nil {
+				return err
+			}
+		case *ast.ExportStatement:
+			switch decl := s.Statement.(type) {
+			case *ast.LetStatement:
+				c.exports = append(c.exports, decl.Name.Value)
+			case *ast.FunctionStatement:
+				c.exports = append(c.exports, decl.Name.Value)
+			case *ast.EnumStatement:
+				for _, v := range decl.Variants {
+					c.exports = append(c.exports, v.Name.Value)
+				}
+			}
+			stmts = append(stmts, s.Statement)
+		default:
+			stmts = append(stmts, s)
+		}
+	}
+
+	err := c.compileStatements(stmts)
+	if err != nil {
+		return err
+	}
+	return c.err
+}
+
+func (c *Compiler) compileImport(node *ast.ImportStatement) error {
+	if c.resolver == nil {
+		return fmt.Errorf("cannot import %q: no module resolver", node.Path)
+	}
+
+	name, err := moduleName(node)
+	if err != nil {
+		return err
+	}
+
+	p, err := c.resolver.Resolve(c.path, node.Path)
+	if err != nil {
+		return fmt.Errorf("cannot import %q: %s", node.Path, err)
+	}
+
+	for i, loading := range c.loading {
+		if loading == p {
+			chain := append(append([]string{}, c.loading[i:]...), p)
+			return fmt.Errorf("circular import: %s", strings.Join(chain, " -> "))
+		}
+	}
+
+	index, ok := c.moduleIndex[p]
+	if !ok {
+		mod, err := c.compileModule(p)
+		if err != nil {
+			return err
+		}
+
+		index = len(c.modules)
+		c.modules = append(c.modules, mod)
+		c.moduleIndex[p] = index
+	}
+
+	c.symbolTable.DefineModule(index, name)
+	return nil
+}
+
+// compileModule loads, parses and compiles the module at path in its own
+// global namespace.
+func (c *Compiler) compileModule(p string) (*module, error) {
+	src, err := c.resolver.Load(p)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load module %s: %s", p, err)
+	}
+
+	l := lexer.New(src)
+	ps := parser.New(l)
+	program := ps.ParseProgram()
+	if len(ps.Errors()) != 0 {
+		return nil, fmt.Errorf("parse errors in module %s: %s", p, strings.Join(ps.Errors(), "; "))
+	}
+
+	symbolTable, importer, exports := c.symbolTable, c.path, c.exports
+	variants, enums := c.variants, c.enums
+
+	c.symbolTable = NewModuleSymbolTable(symbolTable)
+	for i, v := range object.Builtins {
+		c.symbolTable.DefineBuiltin(i, v.Name)
+	}
+	c.path = p
+	c.exports = nil
+	c.variants = map[string]*variantInfo{}
+	c.enums = map[string][]string{}
+	c.loading = append(c.loading, p)
+
+	err = c.compileProgram(program)
+
+	mod := &module{
+		path:     p,
+		exports:  map[string]Symbol{},
+		variants: map[string]*variantInfo{},
+		enums:    map[string][]string{},
+	}
+	for _, name := range c.exports {
+		mod.exports[name], _ = c.symbolTable.Resolve(name)
+		if info, ok := c.variants[name]; ok {
+			mod.variants[name] = info
+			mod.enums[info.enum] = c.enums[info.enum]
+		}
+	}
+
+	c.symbolTable, c.path, c.exports = symbolTable, importer, exports
+	c.variants, c.enums = variants, enums
+	c.loading = c.loading[:len(c.loading)-1]
+
+	if err != nil {
+		if _, ok := err.(*ModuleError); ok {
+			return nil, err
+		}
+		return nil, &ModuleError{Path: p, Err: err}
+	}
+
+	return mod, nil
+}
+
+// moduleName returns the name an import binds: either the explicit name or
+// the last element of the import path without its extension.
+func moduleName(node *ast.ImportStatement) (string, error) {
+	if node.Name != nil {
+		return node.Name.Value, nil
+	}
+
+	name := strings.TrimSuffix(path.Base(node.Path), SourceExtension)
+	for i, ch := range name {
+		isLetter := 'a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z' || ch == '_'
+		if !isLetter && (i == 0 || ch < '0' || ch > '9') {
+			return "", fmt.Errorf("cannot derive a module name from %q, use import name %q", node.Path, node.Path)
+		}
+	}
+	if name == "" {
+		return "", fmt.Errorf("cannot derive a module name from %q, use import name %q", node.Path, node.Path)
+	}
+
+	return name, nil
+}
+
+// compileMember compiles `obj.name`. Members of an imported module load the
+// exported global directly; on any other value the member is looked up as a
+// string key.
+func (c *Compiler) compileMember(node *ast.MemberExpression) error {
+	if ident, ok := node.Object.(*ast.Identifier); ok {
+		symbol, ok := c.symbolTable.Resolve(ident.Value)
+		if ok && symbol.Scope == ModuleScope {
+			export, ok := c.modules[symbol.Index].exports[node.Property.Value]
+			if !ok {
+				return fmt.Errorf("module %s has no export %s", ident.Value, node.Property.Value)
+			}
+
+			c.loadSymbol(export)
+			return nil
+		}
+	}
+
+	err := c.Compile(node.Object)
+	if err != nil {
+		return err
+	}
+
+	key := &object.String{Value: node.Property.Value}
+	c.emit(code.OpConstant, c.addConstant(key))
+	c.emit(code.OpIndex)
+	return nil
+}
+
+// compileModuleValue builds a hash of a module's exports, used when a module
+// name appears as a value rather than in a member expression.
+func (c *Compiler) compileModuleValue(mod *module) {
+	names := []string{}
+	for name := range mod.exports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		key := &object.String{Value: name}
+		c.emit(code.OpConstant, c.addConstant(key))
+		c.loadSymbol(mod.exports[name])
+	}
+	c.emit(code.OpHash, len(names)*2)
+}
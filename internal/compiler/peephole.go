@@ -0,0 +1,152 @@
+package compiler
+
+import "github.com/TheAlchemistKE/helios/internal/code"
+
+// peephole rewrites wasteful instruction sequences until none is left:
+//
+//   - a jump to an OpJump goes straight to that jump's target
+//   - an OpJump to the next instruction is removed, and an OpJumpNotTruthy
+//     to the next instruction only pops its condition
+//   - a value pushed without side effects and popped straight away is
+//     removed along with the OpPop
+//   - a constant condition of an OpJumpNotTruthy is resolved: a truthy one
+//     never jumps, so both are removed, a falsy one always does
+//   - an OpJump to an OpReturnValue returns straight away, and an OpCall
+//     or OpCallKeywords followed by an OpReturnValue becomes a tail call
+//
+// An instruction that something jumps to is never merged with the one before
+// it, as the jump would skip half of the pair. At the top level pushes and
+// pops are kept, as the last value popped is the program's result. The list
+// is rewritten in place and returned with deleted instructions removed.
+func peephole(list []editable, topLevel bool) []editable {
+	for {
+		changed := threadJumps(list)
+
+		targeted := map[int]bool{}
+		for _, e := range list {
+			if isJump(e.op) {
+				targeted[e.target] = true
+			}
+		}
+
+		deleted := make([]bool, len(list))
+		for i := 0; i < len(list); i++ {
+			e := list[i]
+			pairs := i+1 < len(list) && !targeted[i+1]
+
+			switch {
+			case e.op == code.OpJump && e.target == i+1:
+				deleted[i] = true
+
+			case e.op == code.OpJumpNotTruthy && e.target == i+1:
+				list[i] = editable{op: code.OpPop, position: e.position, hasPos: e.hasPos}
+
+			case e.op == code.OpJump && e.target < len(list) && list[e.target].op == code.OpReturnValue:
+				list[i] = editable{op: code.OpReturnValue, position: e.position, hasPos: e.hasPos}
+
+			case !topLevel && e.op == code.OpCall && i+1 < len(list) && list[i+1].op == code.OpReturnValue:
+				list[i].op = code.OpTailCall
+
+			case !topLevel && e.op == code.OpCallKeywords && i+1 < len(list) && list[i+1].op == code.OpReturnValue:
+				list[i].op = code.OpTailCallKeywords
+
+			case pairs && !topLevel && isPurePush(e.op) && list[i+1].op == code.OpPop:
+				deleted[i], deleted[i+1] = true, true
+				i++
+
+			case pairs && isConstantCondition(e.op) && list[i+1].op == code.OpJumpNotTruthy:
+				deleted[i] = true
+				if isTruthyConstant(e.op) {
+					deleted[i+1] = true
+				} else {
+					list[i+1].op = code.OpJump
+				}
+				i++
+
+			default:
+				continue
+			}
+			changed = true
+		}
+
+		if !changed {
+			return list
+		}
+		list = compact(list, deleted)
+	}
+}
+
+// threadJumps points every jump to an OpJump at that jump's final target
+func threadJumps(list []editable) bool {
+	changed := false
+
+	for i, e := range list {
+		if !isJump(e.op) {
+			continue
+		}
+
+		target := e.target
+		// A cycle of jumps is followed at most once around
+		for steps := 0; target < len(list) && list[target].op == code.OpJump && steps < len(list); steps++ {
+			target = list[target].target
+		}
+
+		if target != e.target {
+			list[i].target = target
+			changed = true
+		}
+	}
+
+	return changed
+}
+
+// compact removes deleted instructions. A jump to a deleted instruction
+// goes to the next one that is kept.
+func compact(list []editable, deleted []bool) []editable {
+	// index maps an instruction to its new index, a deleted one to the
+	// new index of the next instruction kept
+	index := make([]int, len(list)+1)
+	kept := 0
+	for i := range list {
+		index[i] = kept
+		if !deleted[i] {
+			kept++
+		}
+	}
+	index[len(list)] = kept
+
+	out := []editable{}
+	for i, e := range list {
+		if deleted[i] {
+			continue
+		}
+		if isJump(e.op) {
+			e.target = index[e.target]
+		}
+		out = append(out, e)
+	}
+
+	return out
+}
+
+// isPurePush reports whether op only pushes a value, so that a push followed
+// by OpPop can be removed
+func isPurePush(op code.Opcode) bool {
+	switch op {
+	case code.OpConstant, code.OpTrue, code.OpFalse, code.OpNull,
+		code.OpGetGlobal, code.OpGetLocal, code.OpGetFree, code.OpGetBuiltin,
+		code.OpCurrentClosure:
+		return true
+	}
+	return false
+}
+
+func isConstantCondition(op code.Opcode) bool {
+	return op == code.OpConstant || op == code.OpTrue || op == code.OpFalse || op == code.OpNull
+}
+
+// isTruthyConstant reports whether a constant condition is truthy. Constants
+// in the pool are never booleans or null, so they are always truthy.
+func isTruthyConstant(op code.Opcode) bool {
+	return op == code.OpConstant || op == code.OpTrue
+}
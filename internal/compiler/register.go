@@ -0,0 +1,523 @@
+package compiler
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"github.com/TheAlchemistKE/helios/internal/ast"
+	"github.com/TheAlchemistKE/helios/internal/code"
+	"github.com/TheAlchemistKE/helios/internal/ir"
+	"github.com/TheAlchemistKE/helios/internal/object"
+)
+
+// Backend is an instruction set the compiler generates code for
+type Backend int
+
+const (
+	// StackBackend generates code for a stack machine, see code.Opcode
+	StackBackend Backend = iota
+	// RegisterBackend generates code for a register machine, see
+	// code.RegisterOpcode
+	RegisterBackend
+)
+
+func (b Backend) String() string {
+	if b == RegisterBackend {
+		return "register"
+	}
+	return "stack"
+}
+
+// compileRegisters compiles program through the IR to register code. It
+// reports false, having emitted nothing, if the IR cannot express the
+// program or the program uses an imported module.
+func (c *Compiler) compileRegisters(program *ast.Program) (bool, error) {
+	fn, err := c.lowerProgram(program)
+	if fn == nil || err != nil {
+		return err != nil, err
+	}
+	if c.usesModules(fn) {
+		return false, nil
+	}
+
+	g := newRegisterGen(c, fn)
+	err = g.generate()
+	if err != nil {
+		return true, err
+	}
+
+	c.scopes[0].instructions = g.instructions
+	c.scopes[0].positions = g.positions
+	c.registerCode = true
+	c.mainRegisters = g.numLocals()
+	return true, c.err
+}
+
+// usesModules reports whether fn or a function nested in it refers to an
+// imported module, which the register machine cannot load
+func (c *Compiler) usesModules(fn *ir.Func) bool {
+	for _, f := range fn.Funcs() {
+		for _, b := range f.Blocks {
+			for _, v := range b.Values {
+				if v.Op != ir.OpGlobal {
+					continue
+				}
+				if symbol, ok := c.globalSymbols().Resolve(v.Name); ok && symbol.Scope == ModuleScope {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// registerGen generates the register code of one function of the IR.
+//
+// Parameters are the first registers of the frame. Integer, float and
+// string constants are RK operands, read straight from the constant pool.
+// Every other value gets a register of its own for as long as it is live,
+// see allocate. Since the IR has no loops, every edge goes forward in the
+// layout of the blocks, so a value is live from its definition to its last
+// use in that layout. Calls, arrays, hashes and closures take their
+// operands from a window of registers after the others, which values are
+// moved into just before.
+type registerGen struct {
+	c  *Compiler
+	fn *ir.Func
+
+	instructions code.Instructions
+	positions    code.PositionTable
+	position     code.Position
+
+	uses map[*ir.Value]int
+	regs map[*ir.Value]int
+	// tails are the calls returned straight away
+	tails map[*ir.Value]bool
+	// window is the first register of the window and width its size
+	window int
+	width  int
+
+	starts map[*ir.Block]int
+	// jumps maps the offset of each jump target operand to the block it
+	// jumps to
+	jumps map[int]*ir.Block
+}
+
+func newRegisterGen(c *Compiler, fn *ir.Func) *registerGen {
+	return &registerGen{
+		c:      c,
+		fn:     fn,
+		uses:   fn.Uses(),
+		regs:   map[*ir.Value]int{},
+		tails:  map[*ir.Value]bool{},
+		starts: map[*ir.Block]int{},
+		jumps:  map[int]*ir.Block{},
+	}
+}
+
+// numLocals is the number of registers a frame of the function has
+func (g *registerGen) numLocals() int {
+	return g.window + g.width
+}
+
+func (g *registerGen) generate() error {
+	g.allocate()
+	if g.numLocals() > code.RKConstant {
+		g.c.fail(fmt.Errorf("program too large: %d registers exceed the limit of %d",
+			g.numLocals(), code.RKConstant))
+		return nil
+	}
+
+	if !g.fn.Main {
+		for _, b := range g.fn.Blocks {
+			if call := g.tailCall(b); call != nil {
+				g.tails[call] = true
+			}
+		}
+	}
+
+	for i, b := range g.fn.Blocks {
+		var next *ir.Block
+		if i+1 < len(g.fn.Blocks) {
+			next = g.fn.Blocks[i+1]
+		}
+		err := g.block(b, next)
+		if err != nil {
+			return err
+		}
+	}
+
+	for offset, b := range g.jumps {
+		target := g.starts[b]
+		if target > 0xffff {
+			g.c.fail(fmt.Errorf("program too large: jump target %d exceeds the limit of %d", target, 0xffff))
+			continue
+		}
+		binary.BigEndian.PutUint16(g.instructions[offset:], uint16(target))
+	}
+	return nil
+}
+
+// tailCall returns the call at the end of b whose result is returned
+// straight away, either by b or by the block it jumps to, which does
+// nothing but return it
+func (g *registerGen) tailCall(b *ir.Block) *ir.Value {
+	if len(b.Values) == 0 {
+		return nil
+	}
+	call := b.Values[len(b.Values)-1]
+	if call.Op != ir.OpCall || g.uses[call] != 1 {
+		return nil
+	}
+
+	switch b.Kind {
+	case ir.BlockReturn:
+		if b.Control == call {
+			return call
+		}
+	case ir.BlockJump:
+		succ := b.Succs[0]
+		phi := succ.Control
+		if succ.Kind == ir.BlockReturn && len(succ.Values) == 1 && succ.Values[0] == phi &&
+			phi.Op == ir.OpPhi && moves(b)[0] == call {
+			return call
+		}
+	}
+	return nil
+}
+
+// inPool reports whether v is an RK operand, read from the constant pool
+func inPool(v *ir.Value) bool {
+	if v.Op != ir.OpConst {
+		return false
+	}
+	switch v.Const.(type) {
+	case *object.Integer, *object.Float, *object.String:
+		return true
+	}
+	return false
+}
+
+// allocate assigns registers to values by linear scan. The values and the
+// end of each block are numbered in layout order; a value is live from its
+// definition to its last use, and a phi from the end of its first
+// predecessor, where it is first assigned. Phi arguments are used at the end
+// of the predecessor that passes them. A register is reused once the value
+// in it is dead.
+func (g *registerGen) allocate() {
+	at := map[*ir.Value]int{}
+	ends := map[*ir.Block]int{}
+	n := 0
+	for _, b := range g.fn.Blocks {
+		for _, v := range b.Values {
+			at[v] = n
+			n++
+		}
+		ends[b] = n
+		n++
+	}
+
+	start := map[*ir.Value]int{}
+	end := map[*ir.Value]int{}
+	use := func(v *ir.Value, pos int) {
+		end[v] = max(end[v], pos)
+	}
+
+	values := []*ir.Value{}
+	for _, b := range g.fn.Blocks {
+		for _, v := range b.Values {
+			start[v] = at[v]
+			if v.Op == ir.OpPhi {
+				for _, p := range b.Preds {
+					start[v] = min(start[v], ends[p])
+				}
+			} else {
+				for _, arg := range v.Args {
+					use(arg, at[v])
+				}
+			}
+			use(v, start[v])
+
+			switch v.Op {
+			case ir.OpCall, ir.OpArray, ir.OpHash, ir.OpClosure:
+				g.width = max(g.width, len(v.Args))
+			}
+			if v.Op.HasValue() && v.Op != ir.OpParam && !inPool(v) {
+				values = append(values, v)
+			}
+		}
+
+		if b.Control != nil {
+			use(b.Control, ends[b])
+		}
+		for _, arg := range moves(b) {
+			use(arg, ends[b])
+		}
+	}
+
+	sort.SliceStable(values, func(i, j int) bool {
+		return start[values[i]] < start[values[j]]
+	})
+
+	next := len(g.fn.Params)
+	free := []int{}
+	active := []*ir.Value{}
+	for _, v := range values {
+		live := active[:0]
+		for _, a := range active {
+			if end[a] < start[v] {
+				free = append(free, g.regs[a])
+			} else {
+				live = append(live, a)
+			}
+		}
+		active = append(live, v)
+
+		if len(free) == 0 {
+			g.regs[v] = next
+			next++
+			continue
+		}
+		sort.Ints(free)
+		g.regs[v], free = free[0], free[1:]
+	}
+
+	g.window = next
+}
+
+func (g *registerGen) emit(op code.RegisterOpcode, operands ...int) int {
+	def, _ := code.LookupRegister(byte(op))
+	if !def.Fits(operands...) {
+		for _, o := range operands {
+			if o > 0xffff {
+				g.c.fail(fmt.Errorf("program too large: %s operand %d exceeds the limit of %d",
+					def.Name, o, 0xffff))
+				break
+			}
+		}
+		operands = make([]int, len(operands))
+	}
+
+	pos := len(g.instructions)
+	g.instructions = append(g.instructions, code.MakeRegister(op, operands...)...)
+	g.positions.Add(pos, g.position)
+	return pos
+}
+
+// jump emits a jump to the block to, whose target is its last operand
+func (g *registerGen) jump(op code.RegisterOpcode, to *ir.Block, operands ...int) {
+	pos := g.emit(op, append(operands, 0)...)
+	g.jumps[pos+1+2*len(operands)] = to
+}
+
+func (g *registerGen) setPosition(v *ir.Value) {
+	if v.Line != 0 {
+		g.position = code.Position{File: g.c.path, Line: v.Line, Column: v.Column}
+	}
+}
+
+// rk returns the RK operand that reads v
+func (g *registerGen) rk(v *ir.Value) int {
+	switch {
+	case v.Op == ir.OpParam:
+		return v.Index
+	case inPool(v):
+		index := g.c.addConstant(v.Const)
+		if index >= code.RKConstant {
+			g.c.fail(fmt.Errorf("program too large: constant %d exceeds the limit of %d",
+				index, code.RKConstant-1))
+			return 0
+		}
+		return index | code.RKConstant
+	}
+	return g.regs[v]
+}
+
+// moveInto copies v into the register dst
+func (g *registerGen) moveInto(dst int, v *ir.Value) {
+	src := g.rk(v)
+	switch {
+	case src == dst:
+	case src&code.RKConstant != 0:
+		g.emit(code.RegLoadConst, dst, src&^code.RKConstant)
+	default:
+		g.emit(code.RegMove, dst, src)
+	}
+}
+
+// fillWindow moves args into the window
+func (g *registerGen) fillWindow(args []*ir.Value) {
+	for i, arg := range args {
+		g.moveInto(g.window+i, arg)
+	}
+}
+
+func (g *registerGen) block(b *ir.Block, next *ir.Block) error {
+	g.starts[b] = len(g.instructions)
+
+	for _, v := range b.Values {
+		if v.Op == ir.OpPhi || v.Op == ir.OpParam || inPool(v) {
+			continue
+		}
+		err := g.value(v)
+		if err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case len(b.Values) > 0 && g.tails[b.Values[len(b.Values)-1]]:
+		// The tail call returns
+
+	case b.Kind == ir.BlockJump:
+		succ := b.Succs[0]
+		var phis []*ir.Value
+		for _, v := range succ.Values {
+			if v.Op == ir.OpPhi {
+				phis = append(phis, v)
+			}
+		}
+		for i, arg := range moves(b) {
+			g.moveInto(g.regs[phis[i]], arg)
+		}
+		if succ != next {
+			g.jump(code.RegJump, succ)
+		}
+
+	case b.Kind == ir.BlockIf:
+		g.jump(code.RegJumpNotTruthy, b.Succs[1], g.rk(b.Control))
+		if b.Succs[0] != next {
+			g.jump(code.RegJump, b.Succs[0])
+		}
+
+	case b.Kind == ir.BlockReturn:
+		if b.Control == nil {
+			g.emit(code.RegReturnNull)
+		} else {
+			g.emit(code.RegReturn, g.rk(b.Control))
+		}
+
+	case b.Kind == ir.BlockExit:
+		if next != nil {
+			g.jump(code.RegJump, nil)
+		}
+	}
+
+	if next == nil {
+		// The exit jumps past the last block
+		g.starts[nil] = len(g.instructions)
+	}
+	return nil
+}
+
+var registerOps = map[ir.Op]code.RegisterOpcode{
+	ir.OpAdd:         code.RegAdd,
+	ir.OpSub:         code.RegSub,
+	ir.OpMul:         code.RegMul,
+	ir.OpDiv:         code.RegDiv,
+	ir.OpGreaterThan: code.RegGreaterThan,
+	ir.OpEqual:       code.RegEqual,
+	ir.OpNotEqual:    code.RegNotEqual,
+	ir.OpMinus:       code.RegMinus,
+	ir.OpBang:        code.RegBang,
+	ir.OpIndex:       code.RegIndex,
+}
+
+// value emits v, storing its result in its register
+func (g *registerGen) value(v *ir.Value) error {
+	g.setPosition(v)
+	a := g.regs[v]
+
+	if op, ok := registerOps[v.Op]; ok {
+		operands := []int{a}
+		for _, arg := range v.Args {
+			operands = append(operands, g.rk(arg))
+		}
+		g.emit(op, operands...)
+		return nil
+	}
+
+	switch v.Op {
+	case ir.OpConst:
+		switch obj := v.Const.(type) {
+		case *object.Boolean:
+			if obj.Value {
+				g.emit(code.RegLoadTrue, a)
+			} else {
+				g.emit(code.RegLoadFalse, a)
+			}
+		case *object.Null:
+			g.emit(code.RegLoadNull, a)
+		default:
+			g.emit(code.RegLoadConst, a, g.c.addConstant(obj))
+		}
+	case ir.OpFree:
+		g.emit(code.RegGetFree, a, v.Index)
+	case ir.OpSelf:
+		g.emit(code.RegCurrentClosure, a)
+	case ir.OpGlobal:
+		symbol, _ := g.c.globalSymbols().Resolve(v.Name)
+		if symbol.Scope == BuiltinScope {
+			g.emit(code.RegGetBuiltin, a, symbol.Index)
+		} else {
+			g.emit(code.RegGetGlobal, a, symbol.Index)
+		}
+	case ir.OpCopy:
+		g.moveInto(a, v.Args[0])
+	case ir.OpArray:
+		g.fillWindow(v.Args)
+		g.emit(code.RegArray, a, g.window, len(v.Args))
+	case ir.OpHash:
+		g.fillWindow(v.Args)
+		g.emit(code.RegHash, a, g.window, len(v.Args))
+	case ir.OpCall:
+		g.fillWindow(v.Args)
+		if g.tails[v] {
+			g.emit(code.RegTailCall, g.window, len(v.Args)-1)
+		} else {
+			g.emit(code.RegCall, a, g.window, len(v.Args)-1)
+		}
+	case ir.OpClosure:
+		return g.closure(v)
+	case ir.OpDefine:
+		symbol := g.c.globalSymbols().Define(v.Name)
+		if len(v.Args) > 0 {
+			g.emit(code.RegSetGlobal, symbol.Index, g.rk(v.Args[0]))
+		}
+	case ir.OpSetGlobal:
+		symbol, _ := g.c.globalSymbols().Resolve(v.Name)
+		g.emit(code.RegSetGlobal, symbol.Index, g.rk(v.Args[0]))
+	case ir.OpPop:
+		g.emit(code.RegPop, g.rk(v.Args[0]))
+	default:
+		return fmt.Errorf("cannot generate code for %s", v.LongString())
+	}
+	return nil
+}
+
+// closure generates the function of v and emits a closure of it over v's
+// arguments
+func (g *registerGen) closure(v *ir.Value) error {
+	fn := v.Fn
+
+	inner := newRegisterGen(g.c, fn)
+	err := inner.generate()
+	if err != nil {
+		return err
+	}
+
+	compiledFn := &object.CompiledFunction{
+		Name:          fn.Name,
+		Instructions:  inner.instructions,
+		NumLocals:     inner.numLocals(),
+		NumParameters: len(fn.Params),
+		Parameters:    fn.Params,
+		Positions:     inner.positions,
+	}
+
+	g.fillWindow(v.Args)
+	g.setPosition(v)
+	g.emit(code.RegClosure, g.regs[v], g.c.addConstant(compiledFn), g.window, len(v.Args))
+	return nil
+}
@@ -0,0 +1,120 @@
+package compiler
+
+import (
+	"github.com/TheAlchemistKE/helios/internal/code"
+)
+
+// editable is a decoded instruction that can be moved, rewritten or deleted
+// without breaking the code around it. A jump's target is the index of the
+// instruction it jumps to, so it survives changes in instruction sizes;
+// len(list) means the end of the code.
+type editable struct {
+	op       code.Opcode
+	operands []int
+	target   int
+	position code.Position
+	hasPos   bool
+
+	// offset is where the instruction was in the code it was decoded from
+	offset int
+}
+
+// isJump reports whether op jumps, always or conditionally. A jump's target
+// is its last operand.
+func isJump(op code.Opcode) bool {
+	return op == code.OpJump || isConditionalJump(op)
+}
+
+func isConditionalJump(op code.Opcode) bool {
+	switch op {
+	case code.OpJumpNotTruthy, code.OpJumpNotGreater, code.OpJumpNotEqual, code.OpJumpLocalsNotGreater,
+		code.OpJumpSupplied:
+		return true
+	}
+	return false
+}
+
+// decodeEditable splits ins into editable instructions. far maps the offsets
+// of jumps whose targets did not fit their operand to those targets.
+func decodeEditable(ins code.Instructions, positions code.PositionTable, far map[int]int) []editable {
+	list := []editable{}
+	index := map[int]int{}
+
+	for i := 0; i < len(ins); {
+		op, def, prefix, _ := code.Decode(ins[i:])
+		operands, read := code.ReadOperands(def, ins[i+prefix+1:])
+
+		if target, ok := far[i]; ok {
+			operands[len(operands)-1] = target
+		}
+
+		e := editable{op: op, operands: operands, offset: i}
+		e.position, e.hasPos = positions.Lookup(i)
+
+		index[i] = len(list)
+		list = append(list, e)
+		i += prefix + 1 + read
+	}
+	index[len(ins)] = len(list)
+
+	for i, e := range list {
+		if isJump(e.op) {
+			list[i].target = index[e.operands[len(e.operands)-1]]
+		}
+	}
+
+	return list
+}
+
+// encodeEditable turns editable instructions back into code, choosing for
+// each instruction the narrowest encoding its operands fit. Widening a jump
+// moves the code after it, which can push further jumps past the narrow
+// limit, so jumps are widened until every target fits.
+func encodeEditable(list []editable) (code.Instructions, code.PositionTable) {
+	wideJump := make([]bool, len(list))
+	narrow, _ := code.Lookup(byte(code.OpJump))
+
+	var offsets []int
+	for changed := true; changed; {
+		offsets = make([]int, len(list)+1)
+		for i, e := range list {
+			// A narrow jump is sized with a dummy target, which always fits
+			offsets[i+1] = offsets[i] + len(encodeOne(e, 0, wideJump[i]))
+		}
+
+		changed = false
+		for i, e := range list {
+			if isJump(e.op) && !wideJump[i] && !narrow.Fits(offsets[e.target]) {
+				wideJump[i] = true
+				changed = true
+			}
+		}
+	}
+
+	ins := code.Instructions{}
+	positions := code.PositionTable{}
+	for i, e := range list {
+		if e.hasPos {
+			positions.Add(len(ins), e.position)
+		}
+		ins = append(ins, encodeOne(e, offsets[e.target], wideJump[i])...)
+	}
+
+	return ins, positions
+}
+
+func encodeOne(e editable, targetOffset int, wideJump bool) []byte {
+	if isJump(e.op) {
+		operands := append(append([]int{}, e.operands[:len(e.operands)-1]...), targetOffset)
+		if wideJump {
+			return code.MakeWide(e.op, operands...)
+		}
+		return code.Make(e.op, operands...)
+	}
+
+	def, _ := code.Lookup(byte(e.op))
+	if def.Fits(e.operands...) {
+		return code.Make(e.op, e.operands...)
+	}
+	return code.MakeWide(e.op, e.operands...)
+}
@@ -0,0 +1,504 @@
+package compiler
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/TheAlchemistKE/helios/internal/ast"
+	"github.com/TheAlchemistKE/helios/internal/code"
+	"github.com/TheAlchemistKE/helios/internal/ir"
+	"github.com/TheAlchemistKE/helios/internal/object"
+)
+
+// compileSSA compiles program through the IR: it is lowered, optimised by
+// the IR's passes and turned into bytecode. It reports false, having emitted
+// nothing, if the program uses something the IR cannot express.
+func (c *Compiler) compileSSA(program *ast.Program) (bool, error) {
+	fn, err := c.lowerProgram(program)
+	if fn == nil || err != nil {
+		return err != nil, err
+	}
+
+	err = newSSAGen(c, fn).generate()
+	if err != nil {
+		return true, err
+	}
+	return true, c.err
+}
+
+// lowerProgram lowers program to the IR and optimises it. It returns nil,
+// and no error, if the program uses something the IR cannot express, and
+// records a warning saying what.
+func (c *Compiler) lowerProgram(program *ast.Program) (*ir.Func, error) {
+	fn, err := ir.Lower(program)
+	if errors.Is(err, ir.ErrUnsupported) {
+		warning := fmt.Sprintf("%s, compiled without the IR", err)
+		if len(c.loading) > 1 {
+			warning = c.path + ": " + warning
+		}
+		// The register backend and SSA lower the same program
+		if !slices.Contains(c.warnings, warning) {
+			c.warnings = append(c.warnings, warning)
+		}
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Names are checked before the passes remove values nothing uses, so
+	// that an undefined variable is reported wherever it is
+	err = c.checkGlobals(fn, map[string]bool{})
+	if err != nil {
+		return nil, err
+	}
+
+	ir.Optimize(fn)
+	return fn, nil
+}
+
+// checkGlobals reports the first global fn or a function nested in it uses
+// that is not defined where it is used, in the order the compiler would
+// find it
+func (c *Compiler) checkGlobals(fn *ir.Func, defined map[string]bool) error {
+	for _, b := range fn.Blocks {
+		for _, v := range b.Values {
+			switch v.Op {
+			case ir.OpDefine:
+				defined[v.Name] = true
+			case ir.OpGlobal:
+				if _, ok := c.globalSymbols().Resolve(v.Name); !ok && !defined[v.Name] {
+					return fmt.Errorf("undefined variable %s", v.Name)
+				}
+			case ir.OpClosure:
+				err := c.checkGlobals(v.Fn, defined)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// globalSymbols returns the top-level symbol table, which the IR's globals
+// are resolved in
+func (c *Compiler) globalSymbols() *SymbolTable {
+	s := c.symbolTable
+	for s.Outer != nil {
+		s = s.Outer
+	}
+	return s
+}
+
+// ssaGen generates the bytecode of one function of the IR into the current
+// scope.
+//
+// The code is a stack machine's, so each value is computed where it is used
+// if it can be: a value used once, by a value of the same block, is emitted
+// as an operand of its user if nothing with an effect has to happen between
+// the two, see stackify. Constants, parameters, free variables and globals
+// are loaded again at each use. Every other value is stored in a slot of its
+// own. A phi whose block starts by using it is left on the stack by each
+// predecessor, as the compiler does for an if; other phis are slots the
+// predecessors store into.
+type ssaGen struct {
+	c  *Compiler
+	fn *ir.Func
+
+	uses    map[*ir.Value]int
+	pos     map[*ir.Value]int
+	inTree  map[*ir.Value]bool
+	onStack map[*ir.Value]bool
+	slots   map[*ir.Value]Symbol
+
+	starts map[*ir.Block]int
+	jumps  map[int]*ir.Block
+}
+
+func newSSAGen(c *Compiler, fn *ir.Func) *ssaGen {
+	return &ssaGen{
+		c:       c,
+		fn:      fn,
+		uses:    fn.Uses(),
+		pos:     map[*ir.Value]int{},
+		inTree:  map[*ir.Value]bool{},
+		onStack: map[*ir.Value]bool{},
+		slots:   map[*ir.Value]Symbol{},
+		starts:  map[*ir.Block]int{},
+		jumps:   map[int]*ir.Block{},
+	}
+}
+
+func (g *ssaGen) generate() error {
+	for _, b := range g.fn.Blocks {
+		g.schedule(b)
+	}
+
+	for i, b := range g.fn.Blocks {
+		var next *ir.Block
+		if i+1 < len(g.fn.Blocks) {
+			next = g.fn.Blocks[i+1]
+		}
+		err := g.block(b, next)
+		if err != nil {
+			return err
+		}
+	}
+
+	for pos, b := range g.jumps {
+		g.c.changeOperand(pos, g.starts[b])
+	}
+	return nil
+}
+
+// rematerialized reports whether v is loaded again at each use instead of
+// being computed once
+func rematerialized(v *ir.Value) bool {
+	switch v.Op {
+	case ir.OpConst, ir.OpParam, ir.OpFree, ir.OpSelf, ir.OpGlobal:
+		return true
+	}
+	return false
+}
+
+// moves returns the phi arguments b passes to its successor, which are
+// emitted at its end
+func moves(b *ir.Block) []*ir.Value {
+	if b.Kind != ir.BlockJump {
+		return nil
+	}
+	succ := b.Succs[0]
+	index := 0
+	for i, p := range succ.Preds {
+		if p == b {
+			index = i
+		}
+	}
+
+	args := []*ir.Value{}
+	for _, v := range succ.Values {
+		if v.Op == ir.OpPhi {
+			args = append(args, v.Args[index])
+		}
+	}
+	return args
+}
+
+// schedule decides which values of b are emitted as operands of their
+// user. The block's end uses its control or phi arguments.
+func (g *ssaGen) schedule(b *ir.Block) {
+	for i, v := range b.Values {
+		g.pos[v] = i
+	}
+
+	end := len(b.Values)
+	if b.Control != nil {
+		g.stackify(b, []*ir.Value{b.Control}, end)
+	}
+	g.stackify(b, moves(b), end)
+	for i := len(b.Values) - 1; i >= 0; i-- {
+		if v := b.Values[i]; !g.inTree[v] {
+			g.stackify(b, v.Args, i)
+		}
+	}
+
+	// The first value emitted in the block must be the phi for it to be
+	// left on the stack by the predecessors
+	phis := 0
+	for _, v := range b.Values {
+		if v.Op == ir.OpPhi {
+			phis++
+		}
+	}
+	if phis != 1 {
+		return
+	}
+
+	var first []*ir.Value
+	for _, v := range b.Values {
+		if !g.inTree[v] && !rematerialized(v) && v.Op != ir.OpPhi {
+			first = v.Args
+			break
+		}
+	}
+	if first == nil && b.Control != nil {
+		first = []*ir.Value{b.Control}
+	}
+	if first == nil {
+		first = moves(b)
+	}
+	for len(first) > 0 && g.inTree[first[0]] {
+		if first[0].Op == ir.OpPhi {
+			g.onStack[first[0]] = true
+			break
+		}
+		first = first[0].Args
+	}
+}
+
+// stackify marks the operands of a user at index at in b that can be
+// emitted as part of it. Operands are tried from the last one, the last
+// computed, so each candidate only has to move past the values after it
+// that are not already part of the tree.
+func (g *ssaGen) stackify(b *ir.Block, args []*ir.Value, at int) {
+	for i := len(args) - 1; i >= 0; i-- {
+		v := args[i]
+		if g.inTree[v] || !g.movable(b, v, at) {
+			continue
+		}
+		g.inTree[v] = true
+		g.stackify(b, v.Args, at)
+	}
+}
+
+func (g *ssaGen) movable(b *ir.Block, v *ir.Value, at int) bool {
+	if v.Block != b || g.uses[v] != 1 || rematerialized(v) {
+		return false
+	}
+	if v.Op == ir.OpPhi || v.Op.Pure() {
+		return true
+	}
+	for _, w := range b.Values[g.pos[v]+1 : at] {
+		if !g.inTree[w] && !w.Op.Pure() {
+			return false
+		}
+	}
+	return true
+}
+
+func (g *ssaGen) setPosition(v *ir.Value) {
+	if v.Line != 0 {
+		g.c.position = code.Position{File: g.c.path, Line: v.Line, Column: v.Column}
+	}
+}
+
+func (g *ssaGen) jump(op code.Opcode, to *ir.Block) {
+	g.jumps[g.c.emit(op, 9999)] = to
+}
+
+func (g *ssaGen) block(b *ir.Block, next *ir.Block) error {
+	g.starts[b] = len(g.c.currentInstructions())
+
+	for _, v := range b.Values {
+		if g.inTree[v] || rematerialized(v) || v.Op == ir.OpPhi {
+			continue
+		}
+		err := g.value(v)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case !v.Op.HasValue():
+		case g.uses[v] == 0:
+			g.c.emit(code.OpPop)
+		default:
+			g.slots[v] = g.c.defineTemp()
+			g.c.storeSymbol(g.slots[v])
+		}
+	}
+
+	switch b.Kind {
+	case ir.BlockJump:
+		succ := b.Succs[0]
+		var phis []*ir.Value
+		for _, v := range succ.Values {
+			if v.Op == ir.OpPhi {
+				phis = append(phis, v)
+			}
+		}
+		for i, arg := range moves(b) {
+			err := g.operand(arg)
+			if err != nil {
+				return err
+			}
+			if !g.onStack[phis[i]] {
+				g.c.storeSymbol(g.phiSlot(phis[i]))
+			}
+		}
+		if succ != next {
+			g.jump(code.OpJump, succ)
+		}
+
+	case ir.BlockIf:
+		err := g.operand(b.Control)
+		if err != nil {
+			return err
+		}
+		g.jump(code.OpJumpNotTruthy, b.Succs[1])
+		if b.Succs[0] != next {
+			g.jump(code.OpJump, b.Succs[0])
+		}
+
+	case ir.BlockReturn:
+		if b.Control == nil {
+			g.c.emit(code.OpReturn)
+			break
+		}
+		err := g.operand(b.Control)
+		if err != nil {
+			return err
+		}
+		g.c.markTailCall(g.c.scopes[g.c.scopeIndex].lastInstruction)
+		g.c.emit(code.OpReturnValue)
+
+	case ir.BlockExit:
+		if next != nil {
+			g.jumps[g.c.emit(code.OpJump, 9999)] = nil
+		}
+	}
+
+	if next == nil {
+		// The exit jumps past the last block
+		g.starts[nil] = len(g.c.currentInstructions())
+	}
+	return nil
+}
+
+func (g *ssaGen) phiSlot(phi *ir.Value) Symbol {
+	slot, ok := g.slots[phi]
+	if !ok {
+		slot = g.c.defineTemp()
+		g.slots[phi] = slot
+	}
+	return slot
+}
+
+// operand pushes the value of v where it is used
+func (g *ssaGen) operand(v *ir.Value) error {
+	switch {
+	case g.onStack[v]:
+		return nil
+	case g.inTree[v] && v.Op != ir.OpPhi:
+		return g.value(v)
+	}
+
+	g.setPosition(v)
+	switch v.Op {
+	case ir.OpConst:
+		g.constant(v.Const)
+	case ir.OpParam:
+		g.c.emit(code.OpGetLocal, v.Index)
+	case ir.OpFree:
+		g.c.emit(code.OpGetFree, v.Index)
+	case ir.OpSelf:
+		g.c.emit(code.OpCurrentClosure)
+	case ir.OpGlobal:
+		symbol, _ := g.c.globalSymbols().Resolve(v.Name)
+		if symbol.Scope == ModuleScope {
+			g.c.compileModuleValue(g.c.modules[symbol.Index])
+		} else {
+			g.c.loadSymbol(symbol)
+		}
+	case ir.OpPhi:
+		g.c.loadSymbol(g.phiSlot(v))
+	default:
+		g.c.loadSymbol(g.slots[v])
+	}
+	return nil
+}
+
+func (g *ssaGen) constant(obj object.Object) {
+	switch obj := obj.(type) {
+	case *object.Boolean:
+		if obj.Value {
+			g.c.emit(code.OpTrue)
+		} else {
+			g.c.emit(code.OpFalse)
+		}
+	case *object.Null:
+		g.c.emit(code.OpNull)
+	default:
+		g.c.emit(code.OpConstant, g.c.addConstant(obj))
+	}
+}
+
+var ssaOps = map[ir.Op]code.Opcode{
+	ir.OpAdd:         code.OpAdd,
+	ir.OpSub:         code.OpSub,
+	ir.OpMul:         code.OpMul,
+	ir.OpDiv:         code.OpDiv,
+	ir.OpGreaterThan: code.OpGreaterThan,
+	ir.OpEqual:       code.OpEqual,
+	ir.OpNotEqual:    code.OpNotEqual,
+	ir.OpMinus:       code.OpMinus,
+	ir.OpBang:        code.OpBang,
+	ir.OpIndex:       code.OpIndex,
+}
+
+// value emits the operands of v and then v itself
+func (g *ssaGen) value(v *ir.Value) error {
+	for _, arg := range v.Args {
+		err := g.operand(arg)
+		if err != nil {
+			return err
+		}
+	}
+
+	g.setPosition(v)
+	if op, ok := ssaOps[v.Op]; ok {
+		g.c.emit(op)
+		return nil
+	}
+
+	switch v.Op {
+	case ir.OpArray:
+		g.c.emit(code.OpArray, len(v.Args))
+	case ir.OpHash:
+		g.c.emit(code.OpHash, len(v.Args))
+	case ir.OpCall:
+		g.c.emit(code.OpCall, len(v.Args)-1)
+	case ir.OpClosure:
+		return g.closure(v)
+	case ir.OpDefine:
+		symbol := g.c.globalSymbols().Define(v.Name)
+		if len(v.Args) > 0 {
+			g.c.storeSymbol(symbol)
+		}
+	case ir.OpSetGlobal:
+		symbol, _ := g.c.globalSymbols().Resolve(v.Name)
+		g.c.storeSymbol(symbol)
+	case ir.OpPop:
+		g.c.emit(code.OpPop)
+	default:
+		return fmt.Errorf("cannot generate code for %s", v.LongString())
+	}
+	return nil
+}
+
+// closure compiles the function of v in a scope of its own and emits a
+// closure of it over v's arguments, which are already on the stack
+func (g *ssaGen) closure(v *ir.Value) error {
+	fn := v.Fn
+	c := g.c
+
+	c.enterScope()
+	for _, p := range fn.Params {
+		c.symbolTable.Define(p)
+	}
+
+	err := newSSAGen(c, fn).generate()
+	if err != nil {
+		return err
+	}
+
+	numLocals := c.symbolTable.numDefinitions
+	instructions, positions := c.scopeCode()
+	c.leaveScope()
+
+	compiledFn := &object.CompiledFunction{
+		Name:          fn.Name,
+		Instructions:  instructions,
+		NumLocals:     numLocals,
+		NumParameters: len(fn.Params),
+		Parameters:    fn.Params,
+		MaxStackDepth: maxStackDepth(instructions, c.constants),
+		Positions:     positions,
+	}
+
+	g.setPosition(v)
+	c.emit(code.OpClosure, c.addConstant(compiledFn), len(v.Args))
+	return nil
+}
@@ -1,5 +1,11 @@
 package compiler
 
+import (
+	"slices"
+
+	"github.com/TheAlchemistKE/helios/internal/object"
+)
+
 type SymbolScope string
 
 const (
@@ -8,12 +14,21 @@ const (
 	BuiltinScope  SymbolScope = "BUILTIN"
 	FreeScope     SymbolScope = "FREE"
 	FunctionScope SymbolScope = "FUNCTION"
+	ModuleScope   SymbolScope = "MODULE"
+
+	// A closure that reads its caller's variables refers to them in these
+	// scopes, see readsCaller
+	CallerLocalScope SymbolScope = "CALLER_LOCAL"
+	CallerFreeScope  SymbolScope = "CALLER_FREE"
 )
 
+// Symbol is a name resolved to a slot. Type is the type of the slot's
+// value if it is known at compile time, see staticType.
 type Symbol struct {
 	Name  string
 	Scope SymbolScope
 	Index int
+	Type  object.ObjectType
 }
 
 type SymbolTable struct {
@@ -22,7 +37,30 @@ type SymbolTable struct {
 	store          map[string]Symbol
 	numDefinitions int
 
+	// globals counts the global slots handed out across every module of a
+	// program. Each module has its own top-level table, and so its own
+	// namespace, but they all share this counter so their slots never clash.
+	globals *int
+
 	FreeSymbols []Symbol
+
+	// used records the indices of the local definitions that were resolved
+	used map[int]bool
+
+	// readsCaller is set for the table of a closure that never escapes the
+	// function defining it. The locals and free variables of that function
+	// are resolved in the caller scopes rather than captured. usesCaller
+	// records whether any was.
+	readsCaller bool
+	usesCaller  bool
+
+	// temps are the slots of compiler-generated variables that are no
+	// longer live, for defineTemp to reuse
+	temps []Symbol
+
+	// hidden are names defined here that cannot be resolved yet, from this
+	// table or any enclosed in it, see hide
+	hidden []string
 }
 
 func NewSymbolTable() *SymbolTable {
@@ -31,9 +69,29 @@ func NewSymbolTable() *SymbolTable {
 	return &SymbolTable{
 		store:       s,
 		FreeSymbols: free,
+		globals:     new(int),
+		used:        map[int]bool{},
 	}
 }
 
+// NewModuleSymbolTable creates the top-level table of an imported module. It
+// shares global slot allocation with program, the top-level table of the
+// importing program.
+func NewModuleSymbolTable(program *SymbolTable) *SymbolTable {
+	s := NewSymbolTable()
+	s.globals = program.globals
+	return s
+}
+
+// newInlineSymbolTable creates the table an inlined function body is
+// compiled with. It resolves exactly the given names.
+func newInlineSymbolTable(caller *SymbolTable, names map[string]Symbol) *SymbolTable {
+	s := NewSymbolTable()
+	s.globals = caller.globals
+	s.store = names
+	return s
+}
+
 func NewEnclosedSymbolTable(outer *SymbolTable) *SymbolTable {
 	s := NewSymbolTable()
 	s.Outer = outer
@@ -48,6 +106,8 @@ func (s *SymbolTable) Define(name string) Symbol {
 
 	if s.Outer == nil {
 		symbol.Scope = GlobalScope
+		symbol.Index = *s.globals
+		*s.globals++
 	} else {
 		symbol.Scope = LocalScope
 	}
@@ -57,6 +117,16 @@ func (s *SymbolTable) Define(name string) Symbol {
 	return symbol
 }
 
+// setType records the type of symbol's value, unless name has since been
+// bound to another slot
+func (s *SymbolTable) setType(symbol Symbol, t object.ObjectType) {
+	if s.store[symbol.Name] != symbol {
+		return
+	}
+	symbol.Type = t
+	s.store[symbol.Name] = symbol
+}
+
 func (s *SymbolTable) DefineBuiltin(index int, name string) Symbol {
 	symbol := Symbol{
 		Name:  name,
@@ -67,6 +137,13 @@ func (s *SymbolTable) DefineBuiltin(index int, name string) Symbol {
 	return symbol
 }
 
+// DefineModule binds name to the module at index in the compiler's module list
+func (s *SymbolTable) DefineModule(index int, name string) Symbol {
+	symbol := Symbol{Name: name, Index: index, Scope: ModuleScope}
+	s.store[name] = symbol
+	return symbol
+}
+
 func (s *SymbolTable) DefineFunctionName(name string) Symbol {
 	symbol := Symbol{Name: name, Index: 0, Scope: FunctionScope}
 	s.store[name] = symbol
@@ -74,23 +151,48 @@ func (s *SymbolTable) DefineFunctionName(name string) Symbol {
 }
 
 func (s *SymbolTable) Resolve(name string) (Symbol, bool) {
+	if slices.Contains(s.hidden, name) {
+		return Symbol{}, false
+	}
+
 	obj, ok := s.store[name]
+	if ok && obj.Scope == LocalScope {
+		s.used[obj.Index] = true
+	}
 	if !ok && s.Outer != nil {
 		obj, ok = s.Outer.Resolve(name)
 		if !ok {
 			return obj, ok
 		}
 
-		if obj.Scope == GlobalScope || obj.Scope == BuiltinScope {
+		if obj.Scope == GlobalScope || obj.Scope == BuiltinScope || obj.Scope == ModuleScope {
 			return obj, ok
 		}
 
+		if s.readsCaller && (obj.Scope == LocalScope || obj.Scope == FreeScope) {
+			return s.defineCaller(obj), true
+		}
+
 		free := s.defineFree(obj)
 		return free, true
 	}
 	return obj, ok
 }
 
+// defineCaller refers to original, a variable of the caller, in its frame
+func (s *SymbolTable) defineCaller(original Symbol) Symbol {
+	symbol := original
+	if original.Scope == LocalScope {
+		symbol.Scope = CallerLocalScope
+	} else {
+		symbol.Scope = CallerFreeScope
+	}
+
+	s.store[original.Name] = symbol
+	s.usesCaller = true
+	return symbol
+}
+
 func (s *SymbolTable) defineFree(original Symbol) Symbol {
 	s.FreeSymbols = append(s.FreeSymbols, original)
 
@@ -98,8 +200,36 @@ func (s *SymbolTable) defineFree(original Symbol) Symbol {
 		Name:  original.Name,
 		Index: len(s.FreeSymbols) - 1,
 		Scope: FreeScope,
+		Type:  original.Type,
 	}
 
 	s.store[original.Name] = symbol
 	return symbol
 }
+
+// hide makes names, which are defined in s, unresolvable until the next
+// call, rather than resolving them to an outer definition
+func (s *SymbolTable) hide(names []string) {
+	s.hidden = names
+}
+
+// shadow returns a function that restores the bindings of names to what
+// they are now, ending the scope of any definition of them made meanwhile
+func (s *SymbolTable) shadow(names []string) func() {
+	saved := make(map[string]Symbol, len(names))
+	for _, name := range names {
+		if symbol, ok := s.store[name]; ok {
+			saved[name] = symbol
+		}
+	}
+
+	return func() {
+		for _, name := range names {
+			if symbol, ok := saved[name]; ok {
+				s.store[name] = symbol
+			} else {
+				delete(s.store, name)
+			}
+		}
+	}
+}
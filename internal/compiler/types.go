@@ -0,0 +1,141 @@
+package compiler
+
+import (
+	"fmt"
+
+	"github.com/TheAlchemistKE/helios/internal/ast"
+	"github.com/TheAlchemistKE/helios/internal/code"
+	"github.com/TheAlchemistKE/helios/internal/object"
+)
+
+// integerOperators maps the operators with an Int form to it
+var integerOperators = map[code.Opcode]code.Opcode{
+	code.OpAdd:         code.OpAddInt,
+	code.OpSub:         code.OpSubInt,
+	code.OpMul:         code.OpMulInt,
+	code.OpDiv:         code.OpDivInt,
+	code.OpGreaterThan: code.OpGreaterThanInt,
+	code.OpEqual:       code.OpEqualInt,
+	code.OpNotEqual:    code.OpNotEqualInt,
+}
+
+// annotation returns the index in object.Annotations of the type t names
+func annotation(t *ast.TypeExpression) (int, error) {
+	for i, a := range object.Annotations {
+		if a.Name == t.Type {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown type %s", t.Type)
+}
+
+// staticType returns the type every value of node is known to have at
+// compile time, or "" if it is not known. Literals have their own type,
+// variables the type they were annotated with or, failing that, the type of
+// the value they were bound to, which never changes since every binding has
+// a slot of its own. Operators propagate the types of their operands the way
+// the VM computes them.
+func (c *Compiler) staticType(node ast.Expression) object.ObjectType {
+	switch node := node.(type) {
+	case *ast.IntegerLiteral:
+		return object.INTEGER_OBJ
+	case *ast.FloatLiteral:
+		return object.FLOAT_OBJ
+	case *ast.StringLiteral:
+		return object.STRING_OBJ
+	case *ast.Boolean:
+		return object.BOOLEAN_OBJ
+
+	case *ast.Identifier:
+		symbol, ok := c.symbolTable.Resolve(node.Value)
+		if ok {
+			return symbol.Type
+		}
+
+	case *ast.PrefixExpression:
+		switch right := c.staticType(node.Right); {
+		case node.Operator == "!":
+			return object.BOOLEAN_OBJ
+		case node.Operator == "-" && isNumeric(right):
+			return right
+		}
+
+	case *ast.InfixExpression:
+		switch node.Operator {
+		case "<", ">", "==", "!=":
+			return object.BOOLEAN_OBJ
+		}
+
+		left, right := c.staticType(node.Left), c.staticType(node.Right)
+		switch {
+		case left == object.INTEGER_OBJ && right == object.INTEGER_OBJ:
+			return object.INTEGER_OBJ
+		case isNumeric(left) && isNumeric(right):
+			return object.FLOAT_OBJ
+		case node.Operator == "+" && left == object.STRING_OBJ && right == object.STRING_OBJ:
+			return object.STRING_OBJ
+		}
+	}
+
+	return ""
+}
+
+func isNumeric(t object.ObjectType) bool {
+	return t == object.INTEGER_OBJ || t == object.FLOAT_OBJ
+}
+
+// integers reports whether both operands of node are known to be integers,
+// so its operator can be compiled to its Int form
+func (c *Compiler) integers(node *ast.InfixExpression) bool {
+	return c.options.SpecialiseIntegers &&
+		c.staticType(node.Left) == object.INTEGER_OBJ &&
+		c.staticType(node.Right) == object.INTEGER_OBJ
+}
+
+// emitOperator emits op, or its Int form if integers is set
+func (c *Compiler) emitOperator(op code.Opcode, integers bool) {
+	if specialised, ok := integerOperators[op]; ok && integers {
+		op = specialised
+	}
+	c.emit(op)
+}
+
+// compileLetType checks the value of an annotated let, on top of the stack,
+// against its annotation. got is the value's static type. The check is left
+// out when got is the annotated type, and any other known type is an error.
+// It returns the annotated type and whether a check was emitted.
+func (c *Compiler) compileLetType(node *ast.LetStatement, got object.ObjectType) (object.ObjectType, bool, error) {
+	index, err := annotation(node.Type)
+	if err != nil {
+		return "", false, err
+	}
+
+	want := object.Annotations[index].Type
+	switch got {
+	case want:
+		return want, false, nil
+	case "":
+		c.emit(code.OpCheckType, index)
+		return want, true, nil
+	default:
+		return "", false, fmt.Errorf("type mismatch: %s is annotated %s, got %s", node.Name.Value, node.Type.Type, got)
+	}
+}
+
+// compileParameterTypes emits the function prologue that checks the
+// arguments of annotated parameters, after defaults have been filled in
+func (c *Compiler) compileParameterTypes(node *ast.FunctionLiteral) error {
+	for i, t := range node.Types {
+		if t == nil {
+			continue
+		}
+		index, err := annotation(t)
+		if err != nil {
+			return err
+		}
+
+		symbol, _ := c.symbolTable.Resolve(node.Parameters[i].Value)
+		c.emit(code.OpCheckLocal, symbol.Index, index)
+	}
+	return nil
+}
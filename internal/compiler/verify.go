@@ -0,0 +1,833 @@
+package compiler
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/TheAlchemistKE/helios/internal/code"
+	"github.com/TheAlchemistKE/helios/internal/object"
+)
+
+// MainFunction is the Function of a VerifyError in the main program
+const MainFunction = -1
+
+// VerifyError is an invariant violated by one instruction. Function is the
+// constant index of the enclosing CompiledFunction, or MainFunction.
+type VerifyError struct {
+	Function int
+	Offset   int
+	Message  string
+}
+
+func (e VerifyError) Error() string {
+	if e.Function == MainFunction {
+		return fmt.Sprintf("main %04d: %s", e.Offset, e.Message)
+	}
+	return fmt.Sprintf("function %d %04d: %s", e.Function, e.Offset, e.Message)
+}
+
+// Verify checks the main program and every compiled function in the constant
+// pool before they are run. It reports unknown opcodes, truncated operands,
+// jumps into the middle of an instruction, constant, local, global, free
+// variable and builtin indices out of range, returns from the main program,
+// inconsistent local and parameter counts, odd hash literal counts, any
+// path on which the stack could underflow or reach a join point at two
+// different depths, and a MaxStackDepth lower than the stack can reach.
+// Register code has no stack; its register indices are checked instead,
+// along with registers read before they are set and functions that run off
+// their end. All
+// violations are returned, ordered by function and offset; nil means the
+// bytecode is safe to run.
+func Verify(b *Bytecode) []VerifyError {
+	v := &verifier{constants: b.Constants, numFree: map[int]int{}, parent: map[int]int{}}
+	if b.Backend == RegisterBackend {
+		v.verifyRegisters(b)
+		return v.sorted()
+	}
+
+	v.collectClosures(MainFunction, b.Instructions)
+	for i, c := range b.Constants {
+		if fn, ok := c.(*object.CompiledFunction); ok {
+			v.collectClosures(i, fn.Instructions)
+		}
+	}
+
+	v.verify(MainFunction, b.Instructions, 0, 0, b.MaxStackDepth)
+	for i, c := range b.Constants {
+		if fn, ok := c.(*object.CompiledFunction); ok {
+			numFree, ok := v.numFree[i]
+			if !ok {
+				numFree = -1
+			}
+			if v.checkFunction(i, fn) {
+				v.verify(i, fn.Instructions, fn.NumLocals, numFree, fn.MaxStackDepth)
+			}
+		}
+	}
+
+	return v.sorted()
+}
+
+// checkFunction checks the counts of fn's locals and parameters, and
+// returns whether its instructions can be checked against them
+func (v *verifier) checkFunction(index int, fn *object.CompiledFunction) bool {
+	switch {
+	case fn.NumLocals < 0:
+		v.errorf(index, 0, "negative number of locals %d", fn.NumLocals)
+	case fn.NumParameters < 0 || fn.NumDefaults < 0:
+		v.errorf(index, 0, "negative number of parameters %d or defaults %d", fn.NumParameters, fn.NumDefaults)
+	case fn.NumParameters > fn.NumLocals:
+		v.errorf(index, 0, "%d parameters, but only %d locals", fn.NumParameters, fn.NumLocals)
+	case fn.NumDefaults > fn.NumParameters:
+		v.errorf(index, 0, "%d defaults, but only %d parameters", fn.NumDefaults, fn.NumParameters)
+	default:
+		return true
+	}
+	return false
+}
+
+// sorted returns the errors ordered by function and offset
+func (v *verifier) sorted() []VerifyError {
+	sort.SliceStable(v.errors, func(i, j int) bool {
+		a, b := v.errors[i], v.errors[j]
+		if a.Function != b.Function {
+			return a.Function < b.Function
+		}
+		return a.Offset < b.Offset
+	})
+
+	return v.errors
+}
+
+type verifier struct {
+	constants []object.Object
+	// numFree is the number of free variables each function is closed over
+	// with, taken from the OpClosure instructions that create it, and parent
+	// the function those instructions are in
+	numFree map[int]int
+	parent  map[int]int
+	errors  []VerifyError
+}
+
+// instruction is one decoded instruction of a stream
+type instruction struct {
+	offset   int
+	op       code.Opcode
+	def      *code.Definition
+	operands []int
+}
+
+func (v *verifier) errorf(fn, offset int, format string, a ...interface{}) {
+	v.errors = append(v.errors, VerifyError{fn, offset, fmt.Sprintf(format, a...)})
+}
+
+// decode splits ins into instructions, resolving OpWide prefixes. It stops at the first byte that is not
+// a known opcode or whose operands run past the end, as nothing after it can
+// be decoded reliably, and then reports that the stream is incomplete.
+func (v *verifier) decode(fn int, ins code.Instructions) ([]instruction, bool) {
+	decoded := []instruction{}
+
+	for offset := 0; offset < len(ins); {
+		op, def, prefix, err := code.Decode(ins[offset:])
+		if err != nil {
+			if prefix == 0 {
+				v.errorf(fn, offset, "unknown opcode %d", ins[offset])
+			} else {
+				v.errorf(fn, offset, "invalid OpWide prefix: %s", err)
+			}
+			return decoded, false
+		}
+
+		width := def.Width()
+		start := offset + prefix + 1
+		if start+width > len(ins) {
+			v.errorf(fn, offset, "truncated operands for %s: want %d bytes, have %d",
+				def.Name, width, len(ins)-start)
+			return decoded, false
+		}
+
+		operands, read := code.ReadOperands(def, ins[start:])
+		decoded = append(decoded, instruction{offset, op, def, operands})
+		offset = start + read
+	}
+
+	return decoded, true
+}
+
+// collectClosures records the free variable counts of the functions created
+// in ins, reporting functions closed over with different counts.
+func (v *verifier) collectClosures(fn int, ins code.Instructions) {
+	quiet := &verifier{constants: v.constants}
+	decoded, _ := quiet.decode(fn, ins)
+	for _, in := range decoded {
+		if in.op != code.OpClosure {
+			continue
+		}
+
+		index, numFree := in.operands[0], in.operands[1]
+		previous, seen := v.numFree[index]
+		if seen && previous != numFree {
+			v.errorf(fn, in.offset, "function %d closed over %d free variables, elsewhere %d",
+				index, numFree, previous)
+			continue
+		}
+		v.numFree[index] = numFree
+		v.parent[index] = fn
+	}
+}
+
+// verify checks one instruction stream. numFree is -1 if the function is
+// never instantiated, in which case free variable indices are not checked.
+// Control flow and maxStack, the stack depth the VM reserves for the
+// stream, are only checked if the whole stream could be decoded.
+func (v *verifier) verify(fn int, ins code.Instructions, numLocals, numFree, maxStack int) {
+	decoded, complete := v.decode(fn, ins)
+
+	starts := map[int]int{}
+	for i, in := range decoded {
+		starts[in.offset] = i
+	}
+
+	for _, in := range decoded {
+		v.checkOperands(fn, in, numLocals, numFree)
+	}
+
+	if !complete {
+		return
+	}
+
+	for _, in := range decoded {
+		if !isJump(in.op) {
+			continue
+		}
+
+		target := in.operands[len(in.operands)-1]
+		if _, ok := starts[target]; !ok && target != len(ins) {
+			v.errorf(fn, in.offset, "jump target %04d is not the start of an instruction", target)
+		}
+	}
+
+	if depth := v.checkStack(fn, decoded, len(ins), starts); depth > maxStack {
+		v.errorf(fn, 0, "MaxStackDepth is %d, but the stack reaches %d", maxStack, depth)
+	}
+}
+
+func (v *verifier) checkOperands(fn int, in instruction, numLocals, numFree int) {
+	switch in.op {
+	case code.OpReturn, code.OpReturnValue, code.OpTailCall:
+		if fn == MainFunction {
+			v.errorf(fn, in.offset, "%s outside a function", in.def.Name)
+		}
+
+	case code.OpConstant:
+		v.checkConstant(fn, in, in.operands[0], "")
+
+	case code.OpLocalAddConstant, code.OpLocalSubConstant:
+		v.checkLocal(fn, in, in.operands[0], numLocals)
+		v.checkConstant(fn, in, in.operands[1], "")
+
+	case code.OpJumpSupplied:
+		if fn == MainFunction {
+			v.errorf(fn, in.offset, "%s outside a function", in.def.Name)
+		}
+		v.checkLocal(fn, in, in.operands[0], numLocals)
+
+	case code.OpGetLocalPair, code.OpJumpLocalsNotGreater:
+		v.checkLocal(fn, in, in.operands[0], numLocals)
+		v.checkLocal(fn, in, in.operands[1], numLocals)
+
+	case code.OpClosure:
+		v.checkConstant(fn, in, in.operands[0], object.COMPILED_FUNCTION_OBJ)
+
+	case code.OpCallKeywords, code.OpTailCallKeywords:
+		if in.op == code.OpTailCallKeywords && fn == MainFunction {
+			v.errorf(fn, in.offset, "%s outside a function", in.def.Name)
+		}
+		if v.checkConstant(fn, in, in.operands[1], object.ARRAY_OBJ) {
+			for _, el := range v.constants[in.operands[1]].(*object.Array).Elements {
+				if _, ok := el.(*object.String); !ok {
+					v.errorf(fn, in.offset, "keyword names must be strings, got %s", el.Type())
+					break
+				}
+			}
+		}
+
+	case code.OpFail:
+		v.checkConstant(fn, in, in.operands[0], object.STRING_OBJ)
+
+	case code.OpMatchVariant:
+		if v.checkConstant(fn, in, in.operands[0], "") {
+			switch v.constants[in.operands[0]].(type) {
+			case *object.Variant, *object.VariantConstructor:
+			default:
+				v.errorf(fn, in.offset, "%s constant %d is %s, not a variant",
+					in.def.Name, in.operands[0], v.constants[in.operands[0]].Type())
+			}
+		}
+
+	case code.OpGetLocal, code.OpSetLocal, code.OpReturnLocal:
+		if in.op == code.OpReturnLocal && fn == MainFunction {
+			v.errorf(fn, in.offset, "%s outside a function", in.def.Name)
+		}
+		v.checkLocal(fn, in, in.operands[0], numLocals)
+
+	case code.OpCheckType:
+		v.checkAnnotation(fn, in, in.operands[0])
+
+	case code.OpCheckLocal:
+		v.checkLocal(fn, in, in.operands[0], numLocals)
+		v.checkAnnotation(fn, in, in.operands[1])
+
+	case code.OpGetCallerLocal, code.OpGetCallerFree:
+		if fn == MainFunction || !v.constants[fn].(*object.CompiledFunction).ReadsCaller {
+			v.errorf(fn, in.offset, "%s in a function that does not read its caller", in.def.Name)
+			break
+		}
+		v.checkCaller(fn, in)
+
+	case code.OpSetFree:
+		// The closure is only known at runtime, so the index is checked
+		// against every closure's free variables
+		mostFree := 0
+		for _, n := range v.numFree {
+			mostFree = max(mostFree, n)
+		}
+		if in.operands[0] >= mostFree {
+			v.errorf(fn, in.offset, "free variable %d out of range, no closure has more than %d",
+				in.operands[0], mostFree)
+		}
+
+	case code.OpGetGlobal, code.OpSetGlobal:
+		v.checkGlobal(fn, in, in.operands[0])
+
+	case code.OpHash:
+		if in.operands[0]%2 != 0 {
+			v.errorf(fn, in.offset, "odd number of hash literal values %d", in.operands[0])
+		}
+
+	case code.OpGetFree:
+		if fn == MainFunction || numFree >= 0 && in.operands[0] >= numFree {
+			v.errorf(fn, in.offset, "free variable %d out of range, function has %d",
+				in.operands[0], max(numFree, 0))
+		}
+
+	case code.OpGetBuiltin:
+		if in.operands[0] >= len(object.Builtins) {
+			v.errorf(fn, in.offset, "builtin %d out of range, there are %d",
+				in.operands[0], len(object.Builtins))
+		}
+	}
+}
+
+// checkCaller checks the index of a load from the frame of the function
+// that defines fn, which is the only one that calls it
+func (v *verifier) checkCaller(fn int, in instruction) {
+	parent, ok := v.parent[fn]
+	if !ok {
+		// A function never instantiated is never called
+		return
+	}
+	if parent == MainFunction {
+		v.errorf(fn, in.offset, "%s in a function defined by the main program", in.def.Name)
+		return
+	}
+
+	caller := v.constants[parent].(*object.CompiledFunction)
+	switch in.op {
+	case code.OpGetCallerLocal:
+		if in.operands[0] >= caller.NumLocals {
+			v.errorf(fn, in.offset, "caller local slot %d out of range, caller has %d locals",
+				in.operands[0], caller.NumLocals)
+		}
+	case code.OpGetCallerFree:
+		if callerFree, ok := v.numFree[parent]; !ok || in.operands[0] >= callerFree {
+			v.errorf(fn, in.offset, "caller free variable %d out of range, caller has %d",
+				in.operands[0], max(callerFree, 0))
+		}
+	}
+}
+
+func (v *verifier) checkGlobal(fn int, in instruction, index int) {
+	if index >= GlobalsSize {
+		v.errorf(fn, in.offset, "global %d out of range, there are %d", index, GlobalsSize)
+	}
+}
+
+func (v *verifier) checkLocal(fn int, in instruction, index, numLocals int) {
+	if index >= numLocals {
+		v.errorf(fn, in.offset, "local slot %d out of range, function has %d locals", index, numLocals)
+	}
+}
+
+func (v *verifier) checkAnnotation(fn int, in instruction, index int) {
+	if index >= len(object.Annotations) {
+		v.errorf(fn, in.offset, "annotation %d out of range, there are %d", index, len(object.Annotations))
+	}
+}
+
+// checkConstant reports a constant index out of range or, when want is set,
+// a constant of the wrong type. It returns whether the constant is usable.
+func (v *verifier) checkConstant(fn int, in instruction, index int, want object.ObjectType) bool {
+	if index >= len(v.constants) {
+		v.errorf(fn, in.offset, "constant %d out of range, pool has %d", index, len(v.constants))
+		return false
+	}
+
+	if want != "" && v.constants[index].Type() != want {
+		v.errorf(fn, in.offset, "%s constant %d is %s, want %s",
+			in.def.Name, index, v.constants[index].Type(), want)
+		return false
+	}
+
+	return true
+}
+
+// stackEffect returns how many values in pops off the stack and pushes
+func (v *verifier) stackEffect(in instruction) (int, int) {
+	switch in.op {
+	case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv,
+		code.OpEqual, code.OpNotEqual, code.OpGreaterThan, code.OpIndex,
+		code.OpAddInt, code.OpSubInt, code.OpMulInt, code.OpDivInt,
+		code.OpEqualInt, code.OpNotEqualInt, code.OpGreaterThanInt:
+		return 2, 1
+	case code.OpMinus, code.OpBang, code.OpCheckType,
+		code.OpMatchVariant, code.OpMatchArray, code.OpSlice:
+		return 1, 1
+	case code.OpPop, code.OpJumpNotTruthy, code.OpSetGlobal, code.OpSetLocal, code.OpReturnValue:
+		return 1, 0
+	case code.OpJumpNotGreater, code.OpJumpNotEqual:
+		return 2, 0
+	case code.OpGetLocalPair:
+		return 0, 2
+	case code.OpArray, code.OpHash:
+		return in.operands[0], 1
+	case code.OpMatchHash:
+		return in.operands[0] + 1, 1
+	case code.OpCall, code.OpTailCall:
+		return in.operands[0] + 1, 1
+	case code.OpCallKeywords, code.OpTailCallKeywords:
+		numNames := 0
+		if in.operands[1] < len(v.constants) {
+			if names, ok := v.constants[in.operands[1]].(*object.Array); ok {
+				numNames = len(names.Elements)
+			}
+		}
+		return in.operands[0] + numNames + 1, 1
+	case code.OpClosure:
+		return in.operands[1], 1
+	case code.OpSetFree:
+		return 2, 0
+	case code.OpJump, code.OpReturn, code.OpFail, code.OpJumpLocalsNotGreater, code.OpReturnLocal,
+		code.OpCheckLocal, code.OpJumpSupplied:
+		return 0, 0
+	default:
+		// Constants, variable loads and OpCurrentClosure push one value
+		return 0, 1
+	}
+}
+
+// checkStack follows every path through the instructions, tracking the
+// stack depth relative to the function's locals. It returns the deepest the
+// stack gets on any path.
+func (v *verifier) checkStack(fn int, decoded []instruction, end int, starts map[int]int) int {
+	if len(decoded) == 0 {
+		return 0
+	}
+
+	maxDepth := 0
+
+	depths := make([]int, len(decoded))
+	for i := range depths {
+		depths[i] = -1
+	}
+
+	reported := map[int]bool{}
+	worklist := []int{0}
+	depths[0] = 0
+
+	flow := func(from instruction, target, depth int) {
+		if target == end {
+			if fn != MainFunction && !reported[from.offset] {
+				reported[from.offset] = true
+				v.errorf(fn, from.offset, "control reaches the end of the function without a return")
+			}
+			return
+		}
+
+		i, ok := starts[target]
+		if !ok {
+			// Reported as a bad jump target by verify
+			return
+		}
+
+		switch {
+		case depths[i] == -1:
+			depths[i] = depth
+			worklist = append(worklist, i)
+		case depths[i] != depth && !reported[target]:
+			reported[target] = true
+			v.errorf(fn, target, "stack depth %d on one path and %d on another", depths[i], depth)
+		}
+	}
+
+	for len(worklist) > 0 {
+		i := worklist[len(worklist)-1]
+		worklist = worklist[:len(worklist)-1]
+
+		in := decoded[i]
+		depth := depths[i]
+
+		pops, pushes := v.stackEffect(in)
+		if pops > depth {
+			v.errorf(fn, in.offset, "stack underflow: %s pops %d values, stack holds %d",
+				in.def.Name, pops, depth)
+			continue
+		}
+		depth = depth - pops + pushes
+		maxDepth = max(maxDepth, depth)
+
+		next := end
+		if i+1 < len(decoded) {
+			next = decoded[i+1].offset
+		}
+
+		switch {
+		case in.op == code.OpReturnValue, in.op == code.OpReturn, in.op == code.OpReturnLocal, in.op == code.OpFail:
+		case in.op == code.OpJump:
+			flow(in, in.operands[0], depth)
+		case isConditionalJump(in.op):
+			flow(in, in.operands[len(in.operands)-1], depth)
+			flow(in, next, depth)
+		default:
+			flow(in, next, depth)
+		}
+	}
+
+	return maxDepth
+}
+
+// maxStackDepth returns how deep the operand stack of ins can grow, not
+// counting the function's locals. constants is needed to size keyword calls.
+func maxStackDepth(ins code.Instructions, constants []object.Object) int {
+	v := &verifier{constants: constants}
+
+	decoded, _ := v.decode(MainFunction, ins)
+	starts := map[int]int{}
+	for i, in := range decoded {
+		starts[in.offset] = i
+	}
+
+	return v.checkStack(MainFunction, decoded, len(ins), starts)
+}
+
+// registerOperands describes the operands of each register opcode, one
+// letter each: r a register, k an RK operand, c a constant, g a global, b a
+// builtin, f a free variable, w the first register of a window of the size
+// that follows it, n that size and t a jump target
+var registerOperands = map[code.RegisterOpcode]string{
+	code.RegLoadConst:      "rc",
+	code.RegLoadTrue:       "r",
+	code.RegLoadFalse:      "r",
+	code.RegLoadNull:       "r",
+	code.RegMove:           "rr",
+	code.RegGetGlobal:      "rg",
+	code.RegSetGlobal:      "gk",
+	code.RegGetBuiltin:     "rb",
+	code.RegGetFree:        "rf",
+	code.RegCurrentClosure: "r",
+	code.RegAdd:            "rkk",
+	code.RegSub:            "rkk",
+	code.RegMul:            "rkk",
+	code.RegDiv:            "rkk",
+	code.RegGreaterThan:    "rkk",
+	code.RegEqual:          "rkk",
+	code.RegNotEqual:       "rkk",
+	code.RegMinus:          "rk",
+	code.RegBang:           "rk",
+	code.RegIndex:          "rkk",
+	code.RegArray:          "rwn",
+	code.RegHash:           "rwn",
+	code.RegClosure:        "rcwn",
+	code.RegCall:           "rwn",
+	code.RegTailCall:       "wn",
+	code.RegReturn:         "k",
+	code.RegReturnNull:     "",
+	code.RegJump:           "t",
+	code.RegJumpNotTruthy:  "kt",
+	code.RegPop:            "k",
+}
+
+// verifyRegisters checks register code: the main program, whose register
+// count is b's MaxStackDepth, and every compiled function in the pool
+func (v *verifier) verifyRegisters(b *Bytecode) {
+	decoded := map[int][]instruction{}
+	decoded[MainFunction] = v.decodeRegisters(MainFunction, b.Instructions)
+	for i, c := range b.Constants {
+		if fn, ok := c.(*object.CompiledFunction); ok {
+			decoded[i] = v.decodeRegisters(i, fn.Instructions)
+		}
+	}
+
+	for fn, ins := range decoded {
+		for _, in := range ins {
+			if code.RegisterOpcode(in.op) != code.RegClosure {
+				continue
+			}
+			index, numFree := in.operands[1], in.operands[3]
+			if previous, seen := v.numFree[index]; seen && previous != numFree {
+				v.errorf(fn, in.offset, "function %d closed over %d free variables, elsewhere %d",
+					index, numFree, previous)
+				continue
+			}
+			v.numFree[index] = numFree
+		}
+	}
+
+	v.checkRegisters(MainFunction, decoded[MainFunction], len(b.Instructions), b.MaxStackDepth, 0, 0)
+	for i, c := range b.Constants {
+		if fn, ok := c.(*object.CompiledFunction); ok {
+			numFree, ok := v.numFree[i]
+			if !ok {
+				numFree = -1
+			}
+			if v.checkFunction(i, fn) {
+				v.checkRegisters(i, decoded[i], len(fn.Instructions), fn.NumLocals, fn.NumParameters, numFree)
+			}
+		}
+	}
+}
+
+// decodeRegisters splits register code into instructions, stopping at the
+// first that cannot be decoded
+func (v *verifier) decodeRegisters(fn int, ins code.Instructions) []instruction {
+	decoded := []instruction{}
+
+	for offset := 0; offset < len(ins); {
+		def, err := code.LookupRegister(ins[offset])
+		if err != nil {
+			v.errorf(fn, offset, "unknown opcode %d", ins[offset])
+			return decoded
+		}
+
+		width := def.Width()
+		if offset+1+width > len(ins) {
+			v.errorf(fn, offset, "truncated operands for %s: want %d bytes, have %d",
+				def.Name, width, len(ins)-offset-1)
+			return decoded
+		}
+
+		operands, read := code.ReadOperands(def, ins[offset+1:])
+		decoded = append(decoded, instruction{offset, code.Opcode(ins[offset]), def, operands})
+		offset += 1 + read
+	}
+
+	return decoded
+}
+
+// checkRegisters checks the operands of register code, and then follows
+// its control flow. numParams registers hold the arguments on entry.
+func (v *verifier) checkRegisters(fn int, decoded []instruction, end, numRegs, numParams, numFree int) {
+	starts := map[int]bool{end: true}
+	for _, in := range decoded {
+		starts[in.offset] = true
+	}
+
+	for _, in := range decoded {
+		switch op := code.RegisterOpcode(in.op); {
+		case (op == code.RegReturn || op == code.RegReturnNull || op == code.RegTailCall) && fn == MainFunction:
+			v.errorf(fn, in.offset, "%s outside a function", in.def.Name)
+		case op == code.RegHash && in.operands[2]%2 != 0:
+			v.errorf(fn, in.offset, "odd number of hash literal values %d", in.operands[2])
+		}
+
+		kinds := registerOperands[code.RegisterOpcode(in.op)]
+		for i, o := range in.operands {
+			switch kinds[i] {
+			case 'k':
+				if o&code.RKConstant != 0 {
+					v.checkConstant(fn, in, o&^code.RKConstant, "")
+					break
+				}
+				fallthrough
+			case 'r':
+				if o >= numRegs {
+					v.errorf(fn, in.offset, "register %d out of range, function has %d", o, numRegs)
+				}
+			case 'c':
+				want := object.ObjectType("")
+				if code.RegisterOpcode(in.op) == code.RegClosure {
+					want = object.COMPILED_FUNCTION_OBJ
+				}
+				v.checkConstant(fn, in, o, want)
+			case 'g':
+				v.checkGlobal(fn, in, o)
+			case 'b':
+				if o >= len(object.Builtins) {
+					v.errorf(fn, in.offset, "builtin %d out of range, there are %d", o, len(object.Builtins))
+				}
+			case 'f':
+				if fn == MainFunction || numFree >= 0 && o >= numFree {
+					v.errorf(fn, in.offset, "free variable %d out of range, function has %d", o, max(numFree, 0))
+				}
+			case 'w':
+				size := in.operands[i+1]
+				if code.RegisterOpcode(in.op) == code.RegCall || code.RegisterOpcode(in.op) == code.RegTailCall {
+					size++
+				}
+				if o+size > numRegs {
+					v.errorf(fn, in.offset, "registers %d to %d out of range, function has %d",
+						o, o+size-1, numRegs)
+				}
+			case 't':
+				if !starts[o] {
+					v.errorf(fn, in.offset, "jump target %04d is not the start of an instruction", o)
+				}
+			}
+		}
+	}
+
+	complete := len(decoded) == 0 && end == 0
+	if len(decoded) > 0 {
+		last := decoded[len(decoded)-1]
+		complete = last.offset+1+last.def.Width() == end
+	}
+	if complete {
+		v.checkDefined(fn, decoded, end, numRegs, numParams)
+	}
+}
+
+// registerUses returns the registers in reads and the one it writes, or
+// -1 if it writes none. Reads happen before the write.
+func registerUses(in instruction) ([]int, int) {
+	op := code.RegisterOpcode(in.op)
+	kinds := registerOperands[op]
+	reads, write := []int{}, -1
+
+	for i, o := range in.operands {
+		switch kinds[i] {
+		case 'r':
+			if i == 0 {
+				write = o
+			} else {
+				reads = append(reads, o)
+			}
+		case 'k':
+			if o&code.RKConstant == 0 {
+				reads = append(reads, o)
+			}
+		case 'w':
+			size := in.operands[i+1]
+			if op == code.RegCall || op == code.RegTailCall {
+				size++
+			}
+			for r := o; r < o+size; r++ {
+				reads = append(reads, r)
+			}
+		}
+	}
+
+	return reads, write
+}
+
+// checkDefined follows every path through register code, reporting
+// registers read before they are set on some path to the read, and, in a
+// function, paths that run off the end without returning
+func (v *verifier) checkDefined(fn int, decoded []instruction, end, numRegs, numParams int) {
+	if len(decoded) == 0 {
+		if fn != MainFunction {
+			v.errorf(fn, 0, "control reaches the end of the function without a return")
+		}
+		return
+	}
+
+	index := map[int]int{}
+	for i, in := range decoded {
+		index[in.offset] = i
+	}
+
+	successors := func(i int) []int {
+		in := decoded[i]
+		next := end
+		if i+1 < len(decoded) {
+			next = decoded[i+1].offset
+		}
+
+		switch code.RegisterOpcode(in.op) {
+		case code.RegReturn, code.RegReturnNull, code.RegTailCall:
+			return nil
+		case code.RegJump:
+			return []int{in.operands[0]}
+		case code.RegJumpNotTruthy:
+			return []int{in.operands[1], next}
+		default:
+			return []int{next}
+		}
+	}
+
+	// defined[i] holds the registers set on every path to instruction i,
+	// or nil while no path to it has been followed
+	defined := make([][]bool, len(decoded))
+	defined[0] = make([]bool, numRegs)
+	for r := 0; r < min(numParams, numRegs); r++ {
+		defined[0][r] = true
+	}
+
+	worklist := []int{0}
+	for len(worklist) > 0 {
+		i := worklist[len(worklist)-1]
+		worklist = worklist[:len(worklist)-1]
+
+		out := append([]bool{}, defined[i]...)
+		if _, write := registerUses(decoded[i]); write >= 0 && write < numRegs {
+			out[write] = true
+		}
+
+		for _, target := range successors(i) {
+			j, ok := index[target]
+			if !ok {
+				// The end, or a bad jump target reported above
+				continue
+			}
+
+			if defined[j] == nil {
+				defined[j] = append([]bool{}, out...)
+				worklist = append(worklist, j)
+				continue
+			}
+			changed := false
+			for r, set := range defined[j] {
+				if set && !out[r] {
+					defined[j][r] = false
+					changed = true
+				}
+			}
+			if changed {
+				worklist = append(worklist, j)
+			}
+		}
+	}
+
+	for i, in := range decoded {
+		if defined[i] == nil {
+			// Unreachable
+			continue
+		}
+
+		reads, _ := registerUses(in)
+		for _, r := range reads {
+			if r < numRegs && !defined[i][r] {
+				v.errorf(fn, in.offset, "register %d read before it is set", r)
+				break
+			}
+		}
+
+		if fn == MainFunction {
+			continue
+		}
+		for _, target := range successors(i) {
+			if target == end {
+				v.errorf(fn, in.offset, "control reaches the end of the function without a return")
+			}
+		}
+	}
+}
@@ -0,0 +1,326 @@
+package compiler
+
+import (
+	"testing"
+
+	"github.com/TheAlchemistKE/helios/internal/code"
+	"github.com/TheAlchemistKE/helios/internal/object"
+)
+
+func TestVerify(t *testing.T) {
+	concat := func(ins ...[]byte) code.Instructions {
+		out := code.Instructions{}
+		for _, i := range ins {
+			out = append(out, i...)
+		}
+		return out
+	}
+	one := &object.Integer{Value: 1}
+	fn := func(numLocals int, ins ...[]byte) *object.CompiledFunction {
+		return &object.CompiledFunction{Instructions: concat(ins...), NumLocals: numLocals, MaxStackDepth: 1}
+	}
+
+	tests := []struct {
+		name     string
+		bytecode *Bytecode
+		expected []string
+	}{
+		{
+			name:     "unknown opcode",
+			bytecode: &Bytecode{Instructions: concat(code.Make(code.OpTrue), []byte{255})},
+			expected: []string{"main 0001: unknown opcode 255"},
+		},
+		{
+			name:     "truncated operands",
+			bytecode: &Bytecode{Instructions: code.Make(code.OpConstant, 0)[:2], Constants: []object.Object{one}},
+			expected: []string{"main 0000: truncated operands for OpConstant: want 2 bytes, have 1"},
+		},
+		{
+			name: "jump into an instruction",
+			bytecode: &Bytecode{
+				Instructions:  concat(code.Make(code.OpConstant, 0), code.Make(code.OpJump, 1)),
+				Constants:     []object.Object{one},
+				MaxStackDepth: 1,
+			},
+			expected: []string{"main 0003: jump target 0001 is not the start of an instruction"},
+		},
+		{
+			name: "constant out of range",
+			bytecode: &Bytecode{
+				Instructions:  concat(code.Make(code.OpConstant, 3), code.Make(code.OpPop)),
+				Constants:     []object.Object{one},
+				MaxStackDepth: 1,
+			},
+			expected: []string{"main 0000: constant 3 out of range, pool has 1"},
+		},
+		{
+			name: "constant of the wrong type",
+			bytecode: &Bytecode{
+				Instructions:  concat(code.Make(code.OpClosure, 0, 0), code.Make(code.OpPop)),
+				Constants:     []object.Object{one},
+				MaxStackDepth: 1,
+			},
+			expected: []string{"main 0000: OpClosure constant 0 is INTEGER, want COMPILED_FUNCTION_OBJ"},
+		},
+		{
+			name: "local slot beyond NumLocals",
+			bytecode: &Bytecode{
+				Instructions: concat(code.Make(code.OpClosure, 0, 0), code.Make(code.OpPop)),
+				Constants: []object.Object{
+					fn(1, code.Make(code.OpGetLocal, 2), code.Make(code.OpReturnValue)),
+				},
+				MaxStackDepth: 1,
+			},
+			expected: []string{"function 0 0000: local slot 2 out of range, function has 1 locals"},
+		},
+		{
+			name: "free variable beyond the closure",
+			bytecode: &Bytecode{
+				Instructions: concat(code.Make(code.OpClosure, 0, 0), code.Make(code.OpPop)),
+				Constants: []object.Object{
+					fn(0, code.Make(code.OpGetFree, 0), code.Make(code.OpReturnValue)),
+				},
+				MaxStackDepth: 1,
+			},
+			expected: []string{"function 0 0000: free variable 0 out of range, function has 0"},
+		},
+		{
+			name:     "stack underflow",
+			bytecode: &Bytecode{Instructions: concat(code.Make(code.OpTrue), code.Make(code.OpAdd)), MaxStackDepth: 1},
+			expected: []string{"main 0001: stack underflow: OpAdd pops 2 values, stack holds 1"},
+		},
+		{
+			name: "different depths at a join",
+			bytecode: &Bytecode{
+				Instructions: concat(
+					code.Make(code.OpTrue),             // 0000
+					code.Make(code.OpJumpNotTruthy, 7), // 0001
+					code.Make(code.OpConstant, 0),      // 0004
+					code.Make(code.OpNull),             // 0007
+					code.Make(code.OpPop),              // 0008
+				),
+				Constants:     []object.Object{one},
+				MaxStackDepth: 1,
+			},
+			expected: []string{"main 0007: stack depth 0 on one path and 1 on another"},
+		},
+		{
+			name: "function without a return",
+			bytecode: &Bytecode{
+				Instructions:  concat(code.Make(code.OpClosure, 0, 0), code.Make(code.OpPop)),
+				Constants:     []object.Object{fn(0, code.Make(code.OpNull))},
+				MaxStackDepth: 1,
+			},
+			expected: []string{"function 0 0000: control reaches the end of the function without a return"},
+		},
+		{
+			name: "global beyond the globals store",
+			bytecode: &Bytecode{
+				Instructions:  concat(code.MakeWide(code.OpGetGlobal, GlobalsSize), code.Make(code.OpPop)),
+				MaxStackDepth: 1,
+			},
+			expected: []string{"main 0000: global 65536 out of range, there are 65536"},
+		},
+		{
+			name: "free variable beyond every closure",
+			bytecode: &Bytecode{
+				Instructions: concat(
+					code.Make(code.OpClosure, 0, 0),
+					code.Make(code.OpNull),
+					code.Make(code.OpSetFree, 0),
+				),
+				Constants:     []object.Object{fn(0, code.Make(code.OpReturn))},
+				MaxStackDepth: 2,
+			},
+			expected: []string{"main 0005: free variable 0 out of range, no closure has more than 0"},
+		},
+		{
+			name: "caller variables beyond the caller's",
+			bytecode: &Bytecode{
+				Instructions: concat(code.Make(code.OpClosure, 0, 0), code.Make(code.OpPop)),
+				Constants: []object.Object{
+					fn(1, code.Make(code.OpClosure, 1, 0), code.Make(code.OpReturnValue)),
+					&object.CompiledFunction{
+						Instructions: concat(
+							code.Make(code.OpGetCallerLocal, 3),
+							code.Make(code.OpGetCallerFree, 0),
+							code.Make(code.OpAdd),
+							code.Make(code.OpReturnValue),
+						),
+						MaxStackDepth: 2,
+						ReadsCaller:   true,
+					},
+				},
+				MaxStackDepth: 1,
+			},
+			expected: []string{
+				"function 1 0000: caller local slot 3 out of range, caller has 1 locals",
+				"function 1 0002: caller free variable 0 out of range, caller has 0",
+			},
+		},
+		{
+			name: "odd hash count",
+			bytecode: &Bytecode{
+				Instructions:  concat(code.Make(code.OpTrue), code.Make(code.OpHash, 1), code.Make(code.OpPop)),
+				MaxStackDepth: 1,
+			},
+			expected: []string{"main 0001: odd number of hash literal values 1"},
+		},
+		{
+			name: "MaxStackDepth below the stack's depth",
+			bytecode: &Bytecode{
+				Instructions:  concat(code.Make(code.OpTrue), code.Make(code.OpTrue), code.Make(code.OpPop), code.Make(code.OpPop)),
+				MaxStackDepth: 1,
+			},
+			expected: []string{"main 0000: MaxStackDepth is 1, but the stack reaches 2"},
+		},
+		{
+			name: "every violation is reported",
+			bytecode: &Bytecode{
+				Instructions: concat(
+					code.Make(code.OpPop),         // 0000
+					code.Make(code.OpConstant, 9), // 0001
+					code.Make(code.OpClosure, 1, 0),
+					code.Make(code.OpPop),
+				),
+				Constants: []object.Object{
+					one,
+					fn(0, code.Make(code.OpGetLocal, 0), code.Make(code.OpSub), []byte{200}),
+				},
+			},
+			expected: []string{
+				"main 0000: stack underflow: OpPop pops 1 values, stack holds 0",
+				"main 0001: constant 9 out of range, pool has 2",
+				"function 1 0000: local slot 0 out of range, function has 0 locals",
+				"function 1 0003: unknown opcode 200",
+			},
+		},
+		{
+			name: "return from the main program",
+			bytecode: &Bytecode{
+				Instructions:  concat(code.Make(code.OpTrue), code.Make(code.OpReturnValue)),
+				MaxStackDepth: 1,
+			},
+			expected: []string{"main 0001: OpReturnValue outside a function"},
+		},
+		{
+			name: "inconsistent counts",
+			bytecode: &Bytecode{
+				Constants: []object.Object{
+					&object.CompiledFunction{Instructions: code.Make(code.OpReturn), NumLocals: -1},
+					&object.CompiledFunction{Instructions: code.Make(code.OpReturn), NumParameters: -1},
+					&object.CompiledFunction{Instructions: code.Make(code.OpReturn), NumLocals: 1, NumParameters: 2},
+					&object.CompiledFunction{Instructions: code.Make(code.OpReturn), NumLocals: 1, NumParameters: 1, NumDefaults: 2},
+				},
+			},
+			expected: []string{
+				"function 0 0000: negative number of locals -1",
+				"function 1 0000: negative number of parameters -1 or defaults 0",
+				"function 2 0000: 2 parameters, but only 1 locals",
+				"function 3 0000: 2 defaults, but only 1 parameters",
+			},
+		},
+		{
+			name: "register code",
+			bytecode: &Bytecode{
+				Instructions: concat(
+					code.MakeRegister(code.RegAdd, 0, 1, code.RKConstant|4), // 0000
+					code.MakeRegister(code.RegCall, 0, 1, 1),                // 0007
+					code.MakeRegister(code.RegJump, 2),                      // 0014
+				),
+				Constants:     []object.Object{one},
+				MaxStackDepth: 2,
+				Backend:       RegisterBackend,
+			},
+			expected: []string{
+				"main 0000: constant 4 out of range, pool has 1",
+				"main 0000: register 1 read before it is set",
+				"main 0007: registers 1 to 2 out of range, function has 2",
+				"main 0007: register 1 read before it is set",
+				"main 0014: jump target 0002 is not the start of an instruction",
+			},
+		},
+		{
+			name: "register hash and return",
+			bytecode: &Bytecode{
+				Instructions: concat(
+					code.MakeRegister(code.RegLoadNull, 1),   // 0000
+					code.MakeRegister(code.RegHash, 0, 1, 1), // 0003
+					code.MakeRegister(code.RegReturn, 0),     // 0010
+				),
+				MaxStackDepth: 2,
+				Backend:       RegisterBackend,
+			},
+			expected: []string{
+				"main 0003: odd number of hash literal values 1",
+				"main 0010: RegReturn outside a function",
+			},
+		},
+		{
+			name: "register definedness",
+			bytecode: &Bytecode{
+				Constants: []object.Object{
+					// if (p0) { r1 = true }; return r1, with r1 unset on
+					// one path, then code that runs off the end
+					&object.CompiledFunction{
+						Instructions: concat(
+							code.MakeRegister(code.RegJumpNotTruthy, 0, 8), // 0000
+							code.MakeRegister(code.RegLoadTrue, 1),         // 0005
+							code.MakeRegister(code.RegReturn, 1),           // 0008
+						),
+						NumLocals:     2,
+						NumParameters: 1,
+					},
+					&object.CompiledFunction{
+						Instructions: code.MakeRegister(code.RegAdd, 0, 0, 0),
+						NumLocals:    1,
+					},
+				},
+				Backend: RegisterBackend,
+			},
+			expected: []string{
+				"function 0 0008: register 1 read before it is set",
+				"function 1 0000: register 0 read before it is set",
+				"function 1 0000: control reaches the end of the function without a return",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		violations := Verify(tt.bytecode)
+
+		if len(violations) != len(tt.expected) {
+			t.Errorf("%s: wrong number of violations. want=%q, got=%v",
+				tt.name, tt.expected, violations)
+			continue
+		}
+
+		for i, want := range tt.expected {
+			if violations[i].Error() != want {
+				t.Errorf("%s: wrong violation. want=%q, got=%q", tt.name, want, violations[i])
+			}
+		}
+	}
+}
+
+func TestVerifyCompiledPrograms(t *testing.T) {
+	inputs := []string{
+		"if (1 > 2) { 10 } else { 20 }; 3333;",
+		"let f = fn(a, b = 2, ...rest) { if (a) { b } }; f(1, b: 3)",
+		"fn fib(n) { if (n < 2) { n } else { fib(n - 1) + fib(n - 2) } } fib(10)",
+		`enum T { A(x), B } match A([1, {"k": 2}]) { A([a, {"k": b}]) if a > 0 => b, A(_) => 0, B => 1 }`,
+		"let [a, [b, ..rest], {c: d = 3}] = [1, [2, 3], {}]; a + b + d",
+	}
+
+	for _, input := range inputs {
+		compiler := New()
+		err := compiler.Compile(parse(input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		for _, violation := range Verify(compiler.Bytecode()) {
+			t.Errorf("%s: %s", input, violation)
+		}
+	}
+}
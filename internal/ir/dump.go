@@ -0,0 +1,114 @@
+package ir
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/TheAlchemistKE/helios/internal/object"
+)
+
+// String dumps f and the functions nested in it as text, one line per value:
+//
+//	fn 1 add(a, b):
+//	  b0:
+//	    v0 = param a
+//	    v1 = param b
+//	    v2 = add v0 v1
+//	    return v2
+//
+// Functions are numbered in the order they were lowered, after the main
+// program. A block entered from more than one place lists where
+// from, in the order of its phis' arguments.
+func (f *Func) String() string {
+	var out bytes.Buffer
+	for i, fn := range f.Funcs() {
+		if i > 0 {
+			out.WriteString("\n")
+		}
+		fn.dump(&out)
+	}
+	return out.String()
+}
+
+func (f *Func) dump(out *bytes.Buffer) {
+	if f.Main {
+		out.WriteString("main")
+	} else {
+		fmt.Fprintf(out, "fn %d", f.ID)
+		if f.Name != "" {
+			fmt.Fprintf(out, " %s", f.Name)
+		}
+		fmt.Fprintf(out, "(%s)", strings.Join(f.Params, ", "))
+	}
+	if len(f.FreeNames) > 0 {
+		fmt.Fprintf(out, " free(%s)", strings.Join(f.FreeNames, ", "))
+	}
+	out.WriteString(":\n")
+
+	for _, b := range f.Blocks {
+		fmt.Fprintf(out, "  b%d:", b.ID)
+		if len(b.Preds) > 1 {
+			out.WriteString(" <-")
+			for _, p := range b.Preds {
+				fmt.Fprintf(out, " b%d", p.ID)
+			}
+		}
+		out.WriteString("\n")
+
+		for _, v := range b.Values {
+			fmt.Fprintf(out, "    %s\n", v.LongString())
+		}
+		fmt.Fprintf(out, "    %s\n", b.controlString())
+	}
+}
+
+func (v *Value) String() string {
+	return fmt.Sprintf("v%d", v.ID)
+}
+
+// LongString formats the definition of v as it appears in a dump
+func (v *Value) LongString() string {
+	parts := []string{v.Op.String()}
+
+	switch v.Op {
+	case OpConst:
+		parts = append(parts, constString(v.Const))
+	case OpParam, OpFree, OpGlobal, OpCopy, OpDefine, OpSetGlobal:
+		parts = append(parts, v.Name)
+	case OpClosure:
+		parts = append(parts, fmt.Sprintf("fn%d", v.Fn.ID))
+	}
+	for _, arg := range v.Args {
+		parts = append(parts, arg.String())
+	}
+
+	s := strings.Join(parts, " ")
+	if v.Op.HasValue() {
+		s = v.String() + " = " + s
+	}
+	return s
+}
+
+func constString(obj object.Object) string {
+	if s, ok := obj.(*object.String); ok {
+		return strconv.Quote(s.Value)
+	}
+	return obj.Inspect()
+}
+
+func (b *Block) controlString() string {
+	switch b.Kind {
+	case BlockJump:
+		return fmt.Sprintf("jump b%d", b.Succs[0].ID)
+	case BlockIf:
+		return fmt.Sprintf("if %s b%d b%d", b.Control, b.Succs[0].ID, b.Succs[1].ID)
+	case BlockReturn:
+		if b.Control == nil {
+			return "return"
+		}
+		return fmt.Sprintf("return %s", b.Control)
+	}
+	return "exit"
+}
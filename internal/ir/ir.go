@@ -0,0 +1,223 @@
+// Package ir holds an intermediate representation of Helios programs between
+// the AST and bytecode: functions made of basic blocks of SSA values, each
+// defined exactly once. Lower builds it from a program, Optimize runs the
+// passes over it and Func.String dumps it as text.
+package ir
+
+import (
+	"github.com/TheAlchemistKE/helios/internal/object"
+)
+
+type Op int
+
+const (
+	// OpConst is the constant in Const
+	OpConst Op = iota
+	// OpParam is the parameter numbered Index
+	OpParam
+	// OpFree is the free variable numbered Index
+	OpFree
+	// OpSelf is the closure being executed
+	OpSelf
+	// OpGlobal is the global or builtin called Name
+	OpGlobal
+	// OpCopy is its argument, bound to the local variable called Name
+	OpCopy
+	// OpPhi is the argument for the predecessor its block was entered from
+	OpPhi
+	// OpClosure is a closure of Fn over its arguments
+	OpClosure
+
+	OpAdd
+	OpSub
+	OpMul
+	OpDiv
+	OpGreaterThan
+	OpEqual
+	OpNotEqual
+	OpMinus
+	OpBang
+
+	OpArray
+	// OpHash is a hash of its arguments, taken as key and value pairs
+	OpHash
+	OpIndex
+	// OpCall calls its first argument with the others
+	OpCall
+
+	// OpDefine declares the global called Name and binds it to its
+	// argument, if it has one. A let declares its global once its value is
+	// computed, so the value refers to any earlier global of the name.
+	// Adjacent function declarations declare all of theirs first, with no
+	// argument, so that they can refer to each other.
+	OpDefine
+	// OpSetGlobal binds the global called Name to its argument
+	OpSetGlobal
+	// OpPop discards the value of a top-level expression statement, which
+	// becomes the program's result if it is the last one
+	OpPop
+)
+
+var opNames = map[Op]string{
+	OpConst:       "const",
+	OpParam:       "param",
+	OpFree:        "free",
+	OpSelf:        "self",
+	OpGlobal:      "global",
+	OpCopy:        "copy",
+	OpPhi:         "phi",
+	OpClosure:     "closure",
+	OpAdd:         "add",
+	OpSub:         "sub",
+	OpMul:         "mul",
+	OpDiv:         "div",
+	OpGreaterThan: "gt",
+	OpEqual:       "eq",
+	OpNotEqual:    "ne",
+	OpMinus:       "minus",
+	OpBang:        "not",
+	OpArray:       "array",
+	OpHash:        "hash",
+	OpIndex:       "index",
+	OpCall:        "call",
+	OpDefine:      "define",
+	OpSetGlobal:   "setglobal",
+	OpPop:         "pop",
+}
+
+func (op Op) String() string { return opNames[op] }
+
+// Pure reports whether a value of this op has no effect and cannot fail, so
+// it can be removed when unused and computed earlier or later than written
+func (op Op) Pure() bool {
+	switch op {
+	case OpConst, OpParam, OpFree, OpSelf, OpGlobal, OpCopy, OpPhi, OpClosure,
+		OpEqual, OpNotEqual, OpBang, OpArray:
+		return true
+	}
+	return false
+}
+
+// HasValue reports whether a value of this op produces a result
+func (op Op) HasValue() bool {
+	return op != OpDefine && op != OpSetGlobal && op != OpPop
+}
+
+// Value is an SSA value: the result of one operation on other values
+type Value struct {
+	ID    int
+	Op    Op
+	Args  []*Value
+	Block *Block
+
+	Const object.Object
+	Index int
+	Name  string
+	Fn    *Func
+
+	// Line and Column are the source position the value was lowered from
+	Line, Column int
+}
+
+type BlockKind int
+
+const (
+	// BlockJump continues with its only successor
+	BlockJump BlockKind = iota
+	// BlockIf continues with its first successor if Control is truthy and
+	// with its second otherwise
+	BlockIf
+	// BlockReturn returns Control, or null if it is nil, from the function
+	BlockReturn
+	// BlockExit ends the program
+	BlockExit
+)
+
+// Block is a basic block: values executed in order, then a transfer of
+// control decided by its kind
+type Block struct {
+	ID      int
+	Kind    BlockKind
+	Values  []*Value
+	Control *Value
+	Succs   []*Block
+	// Preds are the blocks that continue with this one, in the order of the
+	// arguments of its phis
+	Preds []*Block
+}
+
+// Func is a function, or the main program, as a graph of blocks. The first
+// block is the entry and the others follow in the order code is laid out.
+type Func struct {
+	ID        int
+	Name      string
+	Params    []string
+	FreeNames []string
+	Main      bool
+	Blocks    []*Block
+
+	nextValue int
+}
+
+// newBlock creates a block that is not laid out yet
+func (f *Func) newBlock() *Block {
+	return &Block{}
+}
+
+func (f *Func) newValue(b *Block, op Op, args ...*Value) *Value {
+	v := &Value{ID: f.nextValue, Op: op, Args: args, Block: b}
+	f.nextValue++
+	return v
+}
+
+func (b *Block) addSucc(succ *Block) {
+	b.Succs = append(b.Succs, succ)
+	succ.Preds = append(succ.Preds, b)
+}
+
+// removePred removes the edge from pred, along with its phi arguments
+func (b *Block) removePred(pred *Block) {
+	for i, p := range b.Preds {
+		if p != pred {
+			continue
+		}
+		b.Preds = append(b.Preds[:i:i], b.Preds[i+1:]...)
+		for _, v := range b.Values {
+			if v.Op == OpPhi {
+				v.Args = append(v.Args[:i:i], v.Args[i+1:]...)
+			}
+		}
+		return
+	}
+}
+
+// Funcs returns f and every function nested in it, in the order they were
+// lowered
+func (f *Func) Funcs() []*Func {
+	funcs := []*Func{f}
+	for _, b := range f.Blocks {
+		for _, v := range b.Values {
+			if v.Op == OpClosure {
+				funcs = append(funcs, v.Fn.Funcs()...)
+			}
+		}
+	}
+	return funcs
+}
+
+// Uses counts the uses of each value of f by other values, block controls
+// and phis
+func (f *Func) Uses() map[*Value]int {
+	uses := map[*Value]int{}
+	for _, b := range f.Blocks {
+		for _, v := range b.Values {
+			for _, arg := range v.Args {
+				uses[arg]++
+			}
+		}
+		if b.Control != nil {
+			uses[b.Control]++
+		}
+	}
+	return uses
+}
@@ -0,0 +1,113 @@
+package ir
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/TheAlchemistKE/helios/internal/ast"
+	"github.com/TheAlchemistKE/helios/internal/lexer"
+	"github.com/TheAlchemistKE/helios/internal/parser"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// TestGolden lowers each testdata/*.helios program and compares the dump of
+// its IR, before and after optimisation, with the .golden file next to it.
+// Run the tests with -update to rewrite the golden files.
+func TestGolden(t *testing.T) {
+	inputs, err := filepath.Glob(filepath.Join("testdata", "*.helios"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, input := range inputs {
+		name := strings.TrimSuffix(filepath.Base(input), ".helios")
+		t.Run(name, func(t *testing.T) {
+			source, err := os.ReadFile(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			fn, err := Lower(parse(t, string(source)))
+			if err != nil {
+				t.Fatalf("lower error: %s", err)
+			}
+			lowered := fn.String()
+			Optimize(fn)
+			actual := "# lowered\n" + lowered + "\n# optimized\n" + fn.String()
+
+			golden := strings.TrimSuffix(input, ".helios") + ".golden"
+			if *update {
+				err := os.WriteFile(golden, []byte(actual), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			expected, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if actual != string(expected) {
+				t.Errorf("dump does not match %s.\nwant=\n%s\ngot=\n%s", golden, expected, actual)
+			}
+		})
+	}
+}
+
+func TestLowerUnsupported(t *testing.T) {
+	tests := []string{
+		`match (1) { _ => 2 }`,
+		`let [a, b] = [1, 2];`,
+		`fn(a, b = 1) { a }`,
+		`fn(...xs) { xs }`,
+		`fn(a) { a }(a: 1)`,
+		`fn() { let f = fn() { g() }; let g = fn() { f() }; f }`,
+		`fn(c) { if (c) { let x = 1; } x }`,
+		`return 1;`,
+		`import "m"; 1`,
+		`export let x = 1;`,
+		`enum E { A }`,
+		`m.x`,
+		`let x: int = 1;`,
+		`fn(a: int) { a }`,
+	}
+
+	for _, input := range tests {
+		_, err := Lower(parse(t, input))
+		if !errors.Is(err, ErrUnsupported) {
+			t.Errorf("Lower(%q): expected ErrUnsupported, got %v", input, err)
+		}
+	}
+}
+
+func TestOptimizeRemovesBranch(t *testing.T) {
+	fn, err := Lower(parse(t, `fn(x) { if (1 > 2) { x } else { 3 } }`))
+	if err != nil {
+		t.Fatalf("lower error: %s", err)
+	}
+	Optimize(fn)
+
+	f := fn.Funcs()[1]
+	if len(f.Blocks) != 1 {
+		t.Fatalf("expected a single block, got\n%s", fn)
+	}
+	ret := f.Blocks[0]
+	if ret.Kind != BlockReturn || ret.Control.Op != OpConst || ret.Control.Const.Inspect() != "3" {
+		t.Errorf("expected the function to return 3, got\n%s", fn)
+	}
+}
+
+func parse(t *testing.T, input string) *ast.Program {
+	t.Helper()
+	p := parser.New(lexer.New(input))
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		t.Fatalf("parser errors: %v", p.Errors())
+	}
+	return program
+}
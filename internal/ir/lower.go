@@ -0,0 +1,559 @@
+package ir
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/TheAlchemistKE/helios/internal/ast"
+	"github.com/TheAlchemistKE/helios/internal/object"
+)
+
+// ErrUnsupported is returned by Lower for programs that use something the
+// IR cannot express yet: imports and exports, enums, match expressions,
+// member expressions, destructuring lets, type annotations, default and
+// variadic parameters, keyword arguments, mutually recursive local
+// functions, a variable bound in only one branch of an if, and a return at
+// the top level. The compiler compiles those straight from the AST, with a
+// warning naming what the IR lacks.
+var ErrUnsupported = errors.New("not supported by the IR")
+
+func unsupported(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrUnsupported, fmt.Sprintf(format, args...))
+}
+
+// lowerer builds one function. Top-level variables are globals, so only
+// functions bind variables to values.
+type lowerer struct {
+	fn     *Func
+	parent *lowerer
+	block  *Block
+
+	// vars maps the variables in scope to their values. A variable bound in
+	// only one branch of an if maps to nil: using it after the if reads a
+	// slot the direct compiler may never have set, which the IR cannot
+	// express.
+	vars map[string]*Value
+	// free maps the variables captured from enclosing functions to their
+	// OpFree values, and captured holds the enclosing function's values
+	// for them, in the same order
+	free     map[string]*Value
+	captured []*Value
+	self     *Value
+
+	// entries counts the values emitEntry added
+	entries int
+
+	funcs *int
+}
+
+// Lower builds the IR of a program. Unreachable blocks are removed, but no
+// other pass is run.
+func Lower(program *ast.Program) (*Func, error) {
+	l := &lowerer{fn: &Func{Main: true}, vars: map[string]*Value{}, funcs: new(int)}
+	l.start(l.fn.newBlock())
+
+	_, err := l.statements(program.Statements, false)
+	if err != nil {
+		return nil, err
+	}
+	l.block.Kind = BlockExit
+
+	removeUnreachable(l.fn)
+	return l.fn, nil
+}
+
+// start makes b the block values are added to. Blocks are laid out in the
+// order they are started, which follows the source.
+func (l *lowerer) start(b *Block) {
+	b.ID = len(l.fn.Blocks)
+	l.fn.Blocks = append(l.fn.Blocks, b)
+	l.block = b
+}
+
+func (l *lowerer) emit(op Op, node ast.Node, args ...*Value) *Value {
+	v := l.fn.newValue(l.block, op, args...)
+	if node != nil {
+		tok := ast.TokenOf(node)
+		v.Line, v.Column = tok.Line, tok.Column
+	}
+	l.block.Values = append(l.block.Values, v)
+	return v
+}
+
+// emitEntry adds a value at the start of the entry block, after the others
+// it added, where it is available to every block of the function
+func (l *lowerer) emitEntry(op Op) *Value {
+	entry := l.fn.Blocks[0]
+	v := l.fn.newValue(entry, op)
+	values := append([]*Value{}, entry.Values[:l.entries]...)
+	values = append(values, v)
+	entry.Values = append(values, entry.Values[l.entries:]...)
+	l.entries++
+	return v
+}
+
+func (l *lowerer) constant(obj object.Object, node ast.Node) *Value {
+	v := l.emit(OpConst, node)
+	v.Const = obj
+	return v
+}
+
+// statements lowers stmts and returns the value of the last one if valued
+// is set and it is an expression statement, or nil. Expression statements
+// of the main program whose value is not used are popped.
+func (l *lowerer) statements(stmts []ast.Statement, valued bool) (*Value, error) {
+	var result *Value
+
+	for i := 0; i < len(stmts); {
+		result = nil
+
+		if group := functionGroup(stmts[i:]); len(group) > 1 {
+			err := l.group(group)
+			if err != nil {
+				return nil, err
+			}
+			i += len(group)
+			continue
+		}
+
+		switch s := stmts[i].(type) {
+		case *ast.ExpressionStatement:
+			v, err := l.expr(s.Expression)
+			if err != nil {
+				return nil, err
+			}
+			if valued && i == len(stmts)-1 {
+				result = v
+			} else if l.fn.Main {
+				l.emit(OpPop, s, v)
+			}
+
+		case *ast.LetStatement:
+			if s.Pattern != nil {
+				return nil, unsupported("destructuring let")
+			}
+			if s.Type != nil {
+				return nil, unsupported("type annotations")
+			}
+			err := l.bind(s.Name.Value, s.Value, s, false)
+			if err != nil {
+				return nil, err
+			}
+
+		case *ast.FunctionStatement:
+			err := l.bind(s.Name.Value, s.Function, s, false)
+			if err != nil {
+				return nil, err
+			}
+
+		case *ast.ReturnStatement:
+			if l.fn.Main {
+				return nil, unsupported("return at the top level")
+			}
+			v, err := l.expr(s.ReturnValue)
+			if err != nil {
+				return nil, err
+			}
+			l.ret(v)
+
+		default:
+			return nil, unsupported("%s", nodeKind(s))
+		}
+		i++
+	}
+
+	return result, nil
+}
+
+// functionGroup returns the run of function declarations stmts starts with
+func functionGroup(stmts []ast.Statement) []ast.Statement {
+	for i, s := range stmts {
+		switch s := s.(type) {
+		case *ast.FunctionStatement:
+			continue
+		case *ast.LetStatement:
+			if _, ok := s.Value.(*ast.FunctionLiteral); ok && s.Pattern == nil && s.Type == nil {
+				continue
+			}
+		}
+		return stmts[:i]
+	}
+	return stmts
+}
+
+// group lowers adjacent function declarations, which can refer to each
+// other. At the top level they are globals, declared before any of the
+// functions is created.
+func (l *lowerer) group(stmts []ast.Statement) error {
+	if !l.fn.Main {
+		return unsupported("mutually recursive local functions")
+	}
+
+	for _, s := range stmts {
+		name, _ := declaredFunction(s)
+		v := l.emit(OpDefine, s)
+		v.Name = name
+	}
+
+	for _, s := range stmts {
+		name, fn := declaredFunction(s)
+		err := l.bind(name, fn, s, true)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func declaredFunction(s ast.Statement) (string, *ast.FunctionLiteral) {
+	if s, ok := s.(*ast.FunctionStatement); ok {
+		return s.Name.Value, s.Function
+	}
+	let := s.(*ast.LetStatement)
+	return let.Name.Value, let.Value.(*ast.FunctionLiteral)
+}
+
+// bind binds name to the value of expr: a global at the top level and a
+// copy of the value, named for the variable, in a function. Like the
+// compiler, a global is declared once its value is computed, unless
+// declared is set because it already was.
+func (l *lowerer) bind(name string, expr ast.Expression, node ast.Node, declared bool) error {
+	value, err := l.expr(expr)
+	if err != nil {
+		return err
+	}
+
+	if l.fn.Main {
+		op := OpSetGlobal
+		if !declared {
+			op = OpDefine
+		}
+		v := l.emit(op, node, value)
+		v.Name = name
+		return nil
+	}
+
+	v := l.emit(OpCopy, node, value)
+	v.Name = name
+	l.vars[name] = v
+	return nil
+}
+
+// ret ends the current block by returning v. Anything lowered after it goes
+// to a new block that nothing reaches.
+func (l *lowerer) ret(v *Value) {
+	l.block.Kind = BlockReturn
+	l.block.Control = v
+	l.start(l.fn.newBlock())
+}
+
+func (l *lowerer) jump(to *Block) {
+	l.block.Kind = BlockJump
+	l.block.addSucc(to)
+}
+
+var infixOps = map[string]Op{
+	"+":  OpAdd,
+	"-":  OpSub,
+	"*":  OpMul,
+	"/":  OpDiv,
+	">":  OpGreaterThan,
+	"==": OpEqual,
+	"!=": OpNotEqual,
+}
+
+func (l *lowerer) expr(node ast.Expression) (*Value, error) {
+	switch node := node.(type) {
+	case *ast.IntegerLiteral:
+		return l.constant(&object.Integer{Value: node.Value}, node), nil
+
+	case *ast.FloatLiteral:
+		return l.constant(&object.Float{Value: node.Value}, node), nil
+
+	case *ast.StringLiteral:
+		return l.constant(&object.String{Value: node.Value}, node), nil
+
+	case *ast.Boolean:
+		return l.constant(&object.Boolean{Value: node.Value}, node), nil
+
+	case *ast.NullLiteral:
+		return l.constant(object.NULL, node), nil
+
+	case *ast.Identifier:
+		return l.lookup(node)
+
+	case *ast.PrefixExpression:
+		right, err := l.expr(node.Right)
+		if err != nil {
+			return nil, err
+		}
+		switch node.Operator {
+		case "!":
+			return l.emit(OpBang, node, right), nil
+		case "-":
+			return l.emit(OpMinus, node, right), nil
+		}
+		return nil, unsupported("operator %s", node.Operator)
+
+	case *ast.InfixExpression:
+		// a < b is b > a, evaluated in that order as the compiler does
+		if node.Operator == "<" {
+			right, err := l.expr(node.Right)
+			if err != nil {
+				return nil, err
+			}
+			left, err := l.expr(node.Left)
+			if err != nil {
+				return nil, err
+			}
+			return l.emit(OpGreaterThan, node, right, left), nil
+		}
+
+		op, ok := infixOps[node.Operator]
+		if !ok {
+			return nil, unsupported("operator %s", node.Operator)
+		}
+		left, err := l.expr(node.Left)
+		if err != nil {
+			return nil, err
+		}
+		right, err := l.expr(node.Right)
+		if err != nil {
+			return nil, err
+		}
+		return l.emit(op, node, left, right), nil
+
+	case *ast.IfExpression:
+		return l.ifExpression(node)
+
+	case *ast.FunctionLiteral:
+		return l.function(node)
+
+	case *ast.CallExpression:
+		if len(node.KeywordArguments) > 0 {
+			return nil, unsupported("keyword arguments")
+		}
+		args, err := l.exprs(append([]ast.Expression{node.Function}, node.Arguments...))
+		if err != nil {
+			return nil, err
+		}
+		return l.emit(OpCall, node, args...), nil
+
+	case *ast.ArrayLiteral:
+		elements, err := l.exprs(node.Elements)
+		if err != nil {
+			return nil, err
+		}
+		return l.emit(OpArray, node, elements...), nil
+
+	case *ast.HashLiteral:
+		keys := []ast.Expression{}
+		for k := range node.Pairs {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i].String() < keys[j].String()
+		})
+
+		pairs := []ast.Expression{}
+		for _, k := range keys {
+			pairs = append(pairs, k, node.Pairs[k])
+		}
+		args, err := l.exprs(pairs)
+		if err != nil {
+			return nil, err
+		}
+		return l.emit(OpHash, node, args...), nil
+
+	case *ast.IndexExpression:
+		args, err := l.exprs([]ast.Expression{node.Left, node.Index})
+		if err != nil {
+			return nil, err
+		}
+		return l.emit(OpIndex, node, args...), nil
+	}
+
+	return nil, unsupported("%s", nodeKind(node))
+}
+
+// nodeKind names the type of an AST node for unsupported, such as
+// MatchExpression
+func nodeKind(node ast.Node) string {
+	return strings.TrimPrefix(fmt.Sprintf("%T", node), "*ast.")
+}
+
+func (l *lowerer) exprs(nodes []ast.Expression) ([]*Value, error) {
+	values := []*Value{}
+	for _, n := range nodes {
+		v, err := l.expr(n)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+// lookup returns the value of a variable, loading it as a global if no
+// function binds it
+func (l *lowerer) lookup(node *ast.Identifier) (*Value, error) {
+	v, ok, err := l.local(node.Value)
+	if err != nil || ok {
+		return v, err
+	}
+
+	v = l.emit(OpGlobal, node)
+	v.Name = node.Value
+	return v, nil
+}
+
+// local resolves name to a value of the current function: a variable, a
+// parameter, the function itself, or a variable of an enclosing function,
+// which becomes a free variable
+func (l *lowerer) local(name string) (*Value, bool, error) {
+	if v, ok := l.vars[name]; ok {
+		if v == nil {
+			return nil, false, unsupported("%s is bound in only one branch of an if", name)
+		}
+		return v, true, nil
+	}
+
+	if name == l.fn.Name && !l.fn.Main {
+		if l.self == nil {
+			l.self = l.emitEntry(OpSelf)
+		}
+		return l.self, true, nil
+	}
+
+	if v, ok := l.free[name]; ok {
+		return v, true, nil
+	}
+	if l.parent == nil {
+		return nil, false, nil
+	}
+
+	outer, ok, err := l.parent.local(name)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+
+	v := l.emitEntry(OpFree)
+	v.Index = len(l.fn.FreeNames)
+	v.Name = name
+	l.fn.FreeNames = append(l.fn.FreeNames, name)
+	l.free[name] = v
+	l.captured = append(l.captured, outer)
+	return v, true, nil
+}
+
+// ifExpression lowers an if into a block for each branch and a join block,
+// where a phi selects the value of the branch taken
+func (l *lowerer) ifExpression(node *ast.IfExpression) (*Value, error) {
+	cond, err := l.expr(node.Condition)
+	if err != nil {
+		return nil, err
+	}
+
+	then, otherwise, join := l.fn.newBlock(), l.fn.newBlock(), l.fn.newBlock()
+	l.block.Kind = BlockIf
+	l.block.Control = cond
+	l.block.addSucc(then)
+	l.block.addSucc(otherwise)
+
+	outer := l.vars
+
+	l.vars = copyVars(outer)
+	l.start(then)
+	thenValue, err := l.blockValue(node.Consequence, node)
+	if err != nil {
+		return nil, err
+	}
+	l.jump(join)
+	thenVars := l.vars
+
+	l.vars = copyVars(outer)
+	l.start(otherwise)
+	var elseValue *Value
+	if node.Alternative == nil {
+		elseValue = l.constant(object.NULL, node)
+	} else {
+		elseValue, err = l.blockValue(node.Alternative, node)
+		if err != nil {
+			return nil, err
+		}
+	}
+	l.jump(join)
+	elseVars := l.vars
+
+	l.vars = outer
+	for _, branch := range []map[string]*Value{thenVars, elseVars} {
+		for name, v := range branch {
+			if outer[name] != v {
+				outer[name] = nil
+			}
+		}
+	}
+
+	l.start(join)
+	return l.emit(OpPhi, node, thenValue, elseValue), nil
+}
+
+// blockValue lowers a branch of an if, whose value is its last expression
+// or null
+func (l *lowerer) blockValue(block *ast.BlockStatement, node ast.Node) (*Value, error) {
+	v, err := l.statements(block.Statements, true)
+	if err != nil || v != nil {
+		return v, err
+	}
+	return l.constant(object.NULL, node), nil
+}
+
+func copyVars(vars map[string]*Value) map[string]*Value {
+	c := make(map[string]*Value, len(vars))
+	for k, v := range vars {
+		c[k] = v
+	}
+	return c
+}
+
+// function lowers a function literal into a new Func and returns a closure
+// over the variables it captures
+func (l *lowerer) function(node *ast.FunctionLiteral) (*Value, error) {
+	if node.Variadic != nil {
+		return nil, unsupported("variadic functions")
+	}
+	for _, def := range node.Defaults {
+		if def != nil {
+			return nil, unsupported("default parameters")
+		}
+	}
+	if node.Types != nil {
+		return nil, unsupported("type annotations")
+	}
+
+	*l.funcs++
+	fn := &Func{ID: *l.funcs, Name: node.Name}
+	child := &lowerer{fn: fn, parent: l, vars: map[string]*Value{}, free: map[string]*Value{}, funcs: l.funcs}
+	child.start(fn.newBlock())
+
+	for i, p := range node.Parameters {
+		fn.Params = append(fn.Params, p.Value)
+		v := child.emit(OpParam, p)
+		v.Index = i
+		v.Name = p.Value
+		child.vars[p.Value] = v
+	}
+
+	result, err := child.statements(node.Body.Statements, true)
+	if err != nil {
+		return nil, err
+	}
+	child.ret(result)
+	removeUnreachable(fn)
+
+	v := l.emit(OpClosure, node, child.captured...)
+	v.Fn = fn
+	return v, nil
+}
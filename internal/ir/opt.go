@@ -0,0 +1,364 @@
+package ir
+
+import (
+	"github.com/TheAlchemistKE/helios/internal/object"
+)
+
+// Optimize runs constant propagation, copy propagation and dead code
+// elimination over f and every function nested in it, merging the blocks
+// that no longer branch, until none of the passes changes anything
+func Optimize(f *Func) {
+	for _, fn := range f.Funcs() {
+		for changed := true; changed; {
+			changed = propagateConstants(fn)
+			changed = propagateCopies(fn) || changed
+			changed = removeUnreachable(fn) || changed
+			changed = mergeBlocks(fn) || changed
+			changed = removeDeadValues(fn) || changed
+		}
+	}
+}
+
+// propagateConstants replaces operations on constants by their result and
+// turns an if on a constant into a jump to the branch it takes. Like the
+// compiler's constant folding, it computes exactly what the VM would and
+// leaves anything that fails at run time in place.
+func propagateConstants(f *Func) bool {
+	changed := false
+
+	for _, b := range f.Blocks {
+		for _, v := range b.Values {
+			if result, ok := fold(v); ok {
+				v.Op, v.Args, v.Const = OpConst, nil, result
+				changed = true
+			}
+		}
+
+		if b.Kind != BlockIf || b.Control.Op != OpConst {
+			continue
+		}
+		taken, skipped := b.Succs[0], b.Succs[1]
+		if !truthy(b.Control.Const) {
+			taken, skipped = skipped, taken
+		}
+		skipped.removePred(b)
+		b.Kind, b.Control, b.Succs = BlockJump, nil, []*Block{taken}
+		changed = true
+	}
+
+	return changed
+}
+
+func fold(v *Value) (object.Object, bool) {
+	for _, arg := range v.Args {
+		if arg.Op != OpConst {
+			return nil, false
+		}
+	}
+
+	switch v.Op {
+	case OpBang:
+		return boolean(!truthy(v.Args[0].Const)), true
+
+	case OpMinus:
+		switch right := v.Args[0].Const.(type) {
+		case *object.Integer:
+			return &object.Integer{Value: -right.Value}, true
+		case *object.Float:
+			return &object.Float{Value: -right.Value}, true
+		}
+
+	case OpAdd, OpSub, OpMul, OpDiv, OpGreaterThan, OpEqual, OpNotEqual:
+		return foldBinary(v.Op, v.Args[0].Const, v.Args[1].Const)
+	}
+
+	return nil, false
+}
+
+func foldBinary(op Op, left, right object.Object) (object.Object, bool) {
+	switch l := left.(type) {
+	case *object.Integer:
+		switch r := right.(type) {
+		case *object.Integer:
+			return foldIntegers(op, l.Value, r.Value)
+		case *object.Float:
+			return foldFloats(op, float64(l.Value), r.Value)
+		}
+
+	case *object.Float:
+		switch r := right.(type) {
+		case *object.Integer:
+			return foldFloats(op, l.Value, float64(r.Value))
+		case *object.Float:
+			return foldFloats(op, l.Value, r.Value)
+		}
+
+	case *object.String:
+		if r, ok := right.(*object.String); ok {
+			return foldStrings(op, l.Value, r.Value)
+		}
+
+	case *object.Boolean:
+		if r, ok := right.(*object.Boolean); ok {
+			return foldEquality(op, l.Value == r.Value)
+		}
+
+	case *object.Null:
+		if _, ok := right.(*object.Null); ok {
+			return foldEquality(op, true)
+		}
+	}
+
+	return nil, false
+}
+
+func foldIntegers(op Op, l, r int64) (object.Object, bool) {
+	switch op {
+	case OpAdd:
+		return &object.Integer{Value: l + r}, true
+	case OpSub:
+		return &object.Integer{Value: l - r}, true
+	case OpMul:
+		return &object.Integer{Value: l * r}, true
+	case OpDiv:
+		if r == 0 {
+			return nil, false
+		}
+		return &object.Integer{Value: l / r}, true
+	case OpGreaterThan:
+		return boolean(l > r), true
+	}
+	return foldEquality(op, l == r)
+}
+
+func foldFloats(op Op, l, r float64) (object.Object, bool) {
+	switch op {
+	case OpAdd:
+		return &object.Float{Value: l + r}, true
+	case OpSub:
+		return &object.Float{Value: l - r}, true
+	case OpMul:
+		return &object.Float{Value: l * r}, true
+	case OpDiv:
+		if r == 0 {
+			return nil, false
+		}
+		return &object.Float{Value: l / r}, true
+	case OpGreaterThan:
+		return boolean(l > r), true
+	}
+	return foldEquality(op, l == r)
+}
+
+func foldStrings(op Op, l, r string) (object.Object, bool) {
+	switch op {
+	case OpAdd:
+		return &object.String{Value: l + r}, true
+	case OpGreaterThan:
+		return boolean(l > r), true
+	}
+	return foldEquality(op, l == r)
+}
+
+func foldEquality(op Op, equal bool) (object.Object, bool) {
+	switch op {
+	case OpEqual:
+		return boolean(equal), true
+	case OpNotEqual:
+		return boolean(!equal), true
+	}
+	return nil, false
+}
+
+func boolean(value bool) object.Object {
+	return &object.Boolean{Value: value}
+}
+
+// truthy follows the VM: only false and null are falsy
+func truthy(obj object.Object) bool {
+	switch obj := obj.(type) {
+	case *object.Boolean:
+		return obj.Value
+	case *object.Null:
+		return false
+	}
+	return true
+}
+
+// propagateCopies makes every use of a copy, or of a phi whose arguments
+// are all the same value, use that value directly. The copies themselves
+// are left to removeDeadValues.
+func propagateCopies(f *Func) bool {
+	changed := false
+
+	for _, b := range f.Blocks {
+		for _, v := range b.Values {
+			if v.Op != OpPhi {
+				continue
+			}
+			if same := samePhiArg(v); same != nil {
+				v.Op, v.Args = OpCopy, []*Value{same}
+				changed = true
+			}
+		}
+	}
+
+	for _, b := range f.Blocks {
+		for _, v := range b.Values {
+			for i, arg := range v.Args {
+				if source := copySource(arg); source != arg {
+					v.Args[i] = source
+					changed = true
+				}
+			}
+		}
+		if b.Control != nil {
+			if source := copySource(b.Control); source != b.Control {
+				b.Control = source
+				changed = true
+			}
+		}
+	}
+
+	return changed
+}
+
+// samePhiArg returns the value every argument of phi other than phi itself
+// is, or nil if there is more than one
+func samePhiArg(phi *Value) *Value {
+	var same *Value
+	for _, arg := range phi.Args {
+		if arg == phi || arg == same {
+			continue
+		}
+		if same != nil {
+			return nil
+		}
+		same = arg
+	}
+	return same
+}
+
+func copySource(v *Value) *Value {
+	for v.Op == OpCopy {
+		v = v.Args[0]
+	}
+	return v
+}
+
+// removeUnreachable removes the blocks of f no path from the entry reaches,
+// and their edges into the blocks that remain
+func removeUnreachable(f *Func) bool {
+	reachable := map[*Block]bool{}
+	work := []*Block{f.Blocks[0]}
+	for len(work) > 0 {
+		b := work[len(work)-1]
+		work = work[:len(work)-1]
+		if reachable[b] {
+			continue
+		}
+		reachable[b] = true
+		work = append(work, b.Succs...)
+	}
+
+	if len(reachable) == len(f.Blocks) {
+		return false
+	}
+
+	blocks := []*Block{}
+	for _, b := range f.Blocks {
+		if !reachable[b] {
+			for _, succ := range b.Succs {
+				if reachable[succ] {
+					succ.removePred(b)
+				}
+			}
+			continue
+		}
+		blocks = append(blocks, b)
+	}
+	f.Blocks = blocks
+	return true
+}
+
+// mergeBlocks appends each block that is only entered from a jump to the
+// block that jumps to it
+func mergeBlocks(f *Func) bool {
+	changed := false
+
+	for i := 0; i < len(f.Blocks); i++ {
+		b := f.Blocks[i]
+		for b.Kind == BlockJump && len(b.Succs[0].Preds) == 1 {
+			succ := b.Succs[0]
+			for _, v := range succ.Values {
+				if v.Op == OpPhi {
+					v.Op = OpCopy
+				}
+				v.Block = b
+			}
+			b.Values = append(b.Values, succ.Values...)
+			b.Kind, b.Control, b.Succs = succ.Kind, succ.Control, succ.Succs
+			for _, s := range succ.Succs {
+				for j, p := range s.Preds {
+					if p == succ {
+						s.Preds[j] = b
+					}
+				}
+			}
+
+			for j, other := range f.Blocks {
+				if other == succ {
+					f.Blocks = append(f.Blocks[:j:j], f.Blocks[j+1:]...)
+					if j < i {
+						i--
+					}
+					break
+				}
+			}
+			changed = true
+		}
+	}
+
+	return changed
+}
+
+// removeDeadValues removes the pure values nothing uses, directly or
+// through other values, from f
+func removeDeadValues(f *Func) bool {
+	live := map[*Value]bool{}
+	work := []*Value{}
+	for _, b := range f.Blocks {
+		for _, v := range b.Values {
+			if !v.Op.Pure() {
+				work = append(work, v)
+			}
+		}
+		if b.Control != nil {
+			work = append(work, b.Control)
+		}
+	}
+
+	for len(work) > 0 {
+		v := work[len(work)-1]
+		work = work[:len(work)-1]
+		if live[v] {
+			continue
+		}
+		live[v] = true
+		work = append(work, v.Args...)
+	}
+
+	changed := false
+	for _, b := range f.Blocks {
+		values := b.Values[:0]
+		for _, v := range b.Values {
+			if live[v] {
+				values = append(values, v)
+			} else {
+				changed = true
+			}
+		}
+		b.Values = values
+	}
+	return changed
+}
@@ -8,19 +8,25 @@ type Lexer struct {
 	position     int  // current position in input (points to current char)
 	readPosition int  // current reading position in input (after current char)
 	ch           byte // current char under examination
-	line         int  // current line number
-	column       int  // current column number
+	line         int  // line of the current char
+	column       int  // column of the current char
 }
 
 // New creates a new Lexer
 func New(input string) *Lexer {
-	l := &Lexer{input: input, line: 1, column: 1}
+	l := &Lexer{input: input, line: 1}
 	l.readChar()
 	return l
 }
 
 // readChar reads the next character and advances our position in the input string
 func (l *Lexer) readChar() {
+	// Move to the start of the next line after leaving a newline
+	if l.ch == '\n' {
+		l.line++
+		l.column = 0
+	}
+
 	if l.readPosition >= len(l.input) {
 		l.ch = 0
 	} else {
@@ -28,14 +34,7 @@ func (l *Lexer) readChar() {
 	}
 	l.position = l.readPosition
 	l.readPosition++
-
-	// Increment column or reset to 1 if a newline is encountered
-	if l.ch == '\n' {
-		l.line++
-		l.column = 1
-	} else {
-		l.column++
-	}
+	l.column++
 }
 
 // peekChar returns the next character without advancing our position
@@ -52,12 +51,18 @@ func (l *Lexer) NextToken() token.Token {
 
 	l.skipWhitespace()
 
+	line, column := l.line, l.column
+
 	switch l.ch {
 	case '=':
 		if l.peekChar() == '=' {
 			ch := l.ch
 			l.readChar()
 			tok = token.Token{Type: token.EQ, Literal: string(ch) + string(l.ch)}
+		} else if l.peekChar() == '>' {
+			ch := l.ch
+			l.readChar()
+			tok = token.Token{Type: token.ARROW, Literal: string(ch) + string(l.ch)}
 		} else {
 			tok = newToken(token.ASSIGN, l.ch)
 		}
@@ -93,6 +98,18 @@ func (l *Lexer) NextToken() token.Token {
 		} else {
 			tok = newToken(token.GT, l.ch)
 		}
+	case '.':
+		if l.peekChar() == '.' {
+			l.readChar()
+			if l.peekChar() == '.' {
+				l.readChar()
+				tok = token.Token{Type: token.ELLIPSIS, Literal: "..."}
+			} else {
+				tok = token.Token{Type: token.DOTDOT, Literal: ".."}
+			}
+		} else {
+			tok = newToken(token.DOT, l.ch)
+		}
 	case ';':
 		tok = newToken(token.SEMICOLON, l.ch)
 	case ':':
@@ -114,20 +131,6 @@ func (l *Lexer) NextToken() token.Token {
 	case '"':
 		tok.Type = token.STRING
 		tok.Literal = l.readString()
-	case 'n':
-		if l.peekChar() == 'u' &&
-			l.input[l.readPosition+1] == 'l' &&
-			l.input[l.readPosition+2] == 'l' {
-			// Read the full "null" token
-			l.readChar()
-			l.readChar()
-			l.readChar()
-			tok = token.Token{Type: token.NULL, Literal: "null"}
-		} else {
-			// If not "null", treat as an identifier
-			tok.Literal = l.readIdentifier()
-			tok.Type = token.LookupIdent(tok.Literal)
-		}
 	case 0:
 		tok.Literal = ""
 		tok.Type = token.EOF
@@ -135,7 +138,7 @@ func (l *Lexer) NextToken() token.Token {
 		if isLetter(l.ch) {
 			literal := l.readIdentifier()
 			tokenType := token.LookupIdent(literal)
-			tok = token.Token{Type: tokenType, Literal: literal}
+			tok = token.Token{Type: tokenType, Literal: literal, Line: line, Column: column}
 			return tok
 		} else if isDigit(l.ch) {
 			literal := l.readNumber() // `readNumber` now returns a string
@@ -146,15 +149,15 @@ func (l *Lexer) NextToken() token.Token {
 				tokenType = token.FLOAT
 			}
 
-			tok = token.Token{Type: token.TokenType(tokenType), Literal: literal}
+			tok = token.Token{Type: token.TokenType(tokenType), Literal: literal, Line: line, Column: column}
 			return tok
 		} else {
 			tok = token.Token{Type: token.ILLEGAL, Literal: string(l.ch)}
 		}
 	}
 
-	tok.Line = l.line
-	tok.Column = l.column
+	tok.Line = line
+	tok.Column = column
 	l.readChar()
 	return tok
 }
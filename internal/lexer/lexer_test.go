@@ -159,49 +159,128 @@ let float = 123.456;
 	}
 }
 
-//func TestLineAndColumnTracking(t *testing.T) {
-//	input := `let x = 5;
-//let y = 10;
-//`
-//
-//	tests := []struct {
-//		expectedType    token.TokenType
-//		expectedLiteral string
-//		expectedLine    int
-//		expectedColumn  int
-//	}{
-//		{token.LET, "let", 1, 1},
-//		{token.IDENT, "x", 1, 5},
-//		{token.ASSIGN, "=", 1, 7},
-//		{token.INT, "5", 1, 9},
-//		{token.SEMICOLON, ";", 1, 10},
-//		{token.LET, "let", 2, 1},
-//		{token.IDENT, "y", 2, 5},
-//		{token.ASSIGN, "=", 2, 7},
-//		{token.INT, "10", 2, 9},
-//		{token.SEMICOLON, ";", 2, 11},
-//		{token.EOF, "", 3, 1},
-//	}
-//
-//	l := New(input)
-//
-//	for i, tt := range tests {
-//		tok := l.NextToken()
-//
-//		if tok.Type != tt.expectedType {
-//			t.Fatalf("tests[%d] - token type wrong. expected=%q, got=%q", i, tt.expectedType, tok.Type)
-//		}
-//
-//		if tok.Literal != tt.expectedLiteral {
-//			t.Fatalf("tests[%d] - literal wrong. expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
-//		}
-//
-//		if tok.Line != tt.expectedLine {
-//			t.Fatalf("tests[%d] - line wrong. expected=%d, got=%d", i, tt.expectedLine, tok.Line)
-//		}
-//
-//		if tok.Column != tt.expectedColumn {
-//			t.Fatalf("tests[%d] - column wrong. expected=%d, got=%d", i, tt.expectedColumn, tok.Column)
-//		}
-//	}
-//}
+func TestNextTokenPatterns(t *testing.T) {
+	input := `match xs { [head, ..tail] => head, null => 0 }`
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.MATCH, "match"},
+		{token.IDENT, "xs"},
+		{token.LBRACE, "{"},
+		{token.LBRACKET, "["},
+		{token.IDENT, "head"},
+		{token.COMMA, ","},
+		{token.DOTDOT, ".."},
+		{token.IDENT, "tail"},
+		{token.RBRACKET, "]"},
+		{token.ARROW, "=>"},
+		{token.IDENT, "head"},
+		{token.COMMA, ","},
+		{token.NULL, "null"},
+		{token.ARROW, "=>"},
+		{token.INT, "0"},
+		{token.RBRACE, "}"},
+		{token.EOF, ""},
+	}
+
+	l := New(input)
+
+	for i, tt := range tests {
+		tok := l.NextToken()
+
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - token type wrong. expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - literal wrong. expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+// TestIdentifiersStartingWithN covers identifiers that start with "n" or
+// "null", which the lexer once cut short, dropping the character after them
+func TestIdentifiersStartingWithN(t *testing.T) {
+	input := `let n=next(nullable); nu;null`
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.LET, "let"},
+		{token.IDENT, "n"},
+		{token.ASSIGN, "="},
+		{token.IDENT, "next"},
+		{token.LPAREN, "("},
+		{token.IDENT, "nullable"},
+		{token.RPAREN, ")"},
+		{token.SEMICOLON, ";"},
+		{token.IDENT, "nu"},
+		{token.SEMICOLON, ";"},
+		{token.NULL, "null"},
+		{token.EOF, ""},
+	}
+
+	l := New(input)
+
+	for i, tt := range tests {
+		tok := l.NextToken()
+
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - token type wrong. expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - literal wrong. expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+func TestLineAndColumnTracking(t *testing.T) {
+	input := `let x = 5;
+let y = 10;
+`
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+		expectedLine    int
+		expectedColumn  int
+	}{
+		{token.LET, "let", 1, 1},
+		{token.IDENT, "x", 1, 5},
+		{token.ASSIGN, "=", 1, 7},
+		{token.INT, "5", 1, 9},
+		{token.SEMICOLON, ";", 1, 10},
+		{token.LET, "let", 2, 1},
+		{token.IDENT, "y", 2, 5},
+		{token.ASSIGN, "=", 2, 7},
+		{token.INT, "10", 2, 9},
+		{token.SEMICOLON, ";", 2, 11},
+		{token.EOF, "", 3, 1},
+	}
+
+	l := New(input)
+
+	for i, tt := range tests {
+		tok := l.NextToken()
+
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - token type wrong. expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - literal wrong. expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+
+		if tok.Line != tt.expectedLine {
+			t.Fatalf("tests[%d] - line wrong. expected=%d, got=%d", i, tt.expectedLine, tok.Line)
+		}
+
+		if tok.Column != tt.expectedColumn {
+			t.Fatalf("tests[%d] - column wrong. expected=%d, got=%d", i, tt.expectedColumn, tok.Column)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/TheAlchemistKE/helios/internal/ast"
 	"github.com/TheAlchemistKE/helios/internal/code"
+	"hash/fnv"
 	"strings"
 )
 
@@ -26,8 +27,22 @@ const (
 	MACRO_OBJ             = "MACRO"
 	COMPILED_FUNCTION_OBJ = "COMPILED_FUNCTION_OBJ"
 	CLOSURE_OBJ           = "CLOSURE"
+	VARIANT_OBJ           = "VARIANT"
+	VARIANT_CTOR_OBJ      = "VARIANT_CONSTRUCTOR"
 )
 
+// Annotations are the types a parameter or let can be annotated with, such
+// as `n: int`. Bytecode refers to an annotation by its index.
+var Annotations = []struct {
+	Name string
+	Type ObjectType
+}{
+	{"int", INTEGER_OBJ},
+	{"float", FLOAT_OBJ},
+	{"string", STRING_OBJ},
+	{"bool", BOOLEAN_OBJ},
+}
+
 var NULL = &Null{}
 
 type Object interface {
@@ -41,6 +56,9 @@ type Integer struct {
 
 func (i *Integer) Type() ObjectType { return INTEGER_OBJ }
 func (i *Integer) Inspect() string  { return fmt.Sprintf("%d", i.Value) }
+func (i *Integer) HashKey() HashKey {
+	return HashKey{Type: i.Type(), Value: uint64(i.Value)}
+}
 
 type Float struct {
 	Value float64
@@ -55,6 +73,13 @@ type Boolean struct {
 
 func (b *Boolean) Type() ObjectType { return BOOLEAN_OBJ }
 func (b *Boolean) Inspect() string  { return fmt.Sprintf("%t", b.Value) }
+func (b *Boolean) HashKey() HashKey {
+	var value uint64
+	if b.Value {
+		value = 1
+	}
+	return HashKey{Type: b.Type(), Value: value}
+}
 
 type Null struct{}
 
@@ -68,19 +93,101 @@ type ReturnValue struct {
 func (rv *ReturnValue) Type() ObjectType { return RETURN_VALUE_OBJ }
 func (rv *ReturnValue) Inspect() string  { return rv.Value.Inspect() }
 
+// Error is an error raised at runtime. Stack holds the calls that were
+// running when the VM raised it, innermost first; it is empty until then.
+// Cause is the Go error the VM raised it from, if any.
 type Error struct {
 	Message string
+	Stack   []StackFrame
+	Cause   error
 }
 
 func (e *Error) Type() ObjectType { return ERROR_OBJ }
 func (e *Error) Inspect() string  { return "ERROR: " + e.Message }
 
+// Error makes runtime errors Go errors, whose text is just the message
+func (e *Error) Error() string { return e.Message }
+func (e *Error) Unwrap() error { return e.Cause }
+
+// StackFrame is a call on the stack of a runtime error: the function
+// running, empty for the main program, and the position it had reached.
+// Position has no line if the instruction has no source position.
+type StackFrame struct {
+	Function string
+	Position code.Position
+}
+
+func (f StackFrame) String() string {
+	function := f.Function
+	if function == "" {
+		function = "<main>"
+	}
+	if f.Position.Line == 0 {
+		return "at unknown position in " + function
+	}
+	return "at " + f.Position.String() + " in " + function
+}
+
+// Trace renders the error like a Python traceback: the stack outermost
+// call first, then the message. A frame repeated by recursion is collapsed
+// into a count after its first few copies.
+func (e *Error) Trace() string {
+	const shown = 3
+
+	var out bytes.Buffer
+	out.WriteString("Traceback (most recent call last):\n")
+
+	for i := len(e.Stack) - 1; i >= 0; {
+		frame := e.Stack[i]
+		run := 1
+		for i-run >= 0 && e.Stack[i-run] == frame {
+			run++
+		}
+
+		for j := 0; j < run && j < shown; j++ {
+			out.WriteString("  " + frame.String() + "\n")
+		}
+		if run > shown {
+			fmt.Fprintf(&out, "  [previous frame repeated %d more times]\n", run-shown)
+		}
+		i -= run
+	}
+
+	out.WriteString("error: " + e.Message)
+	return out.String()
+}
+
 type String struct {
 	Value string
+
+	// hash is the precomputed hash of an interned string
+	hash     uint64
+	interned bool
+}
+
+// Intern returns a String whose hash key is computed once, up front. The
+// compiler interns string constants, so equal literals share one String and
+// can be compared and looked up without rehashing.
+func Intern(value string) *String {
+	s := &String{Value: value, interned: true}
+	s.hash = hashString(value)
+	return s
 }
 
 func (s *String) Type() ObjectType { return STRING_OBJ }
 func (s *String) Inspect() string  { return s.Value }
+func (s *String) HashKey() HashKey {
+	if s.interned {
+		return HashKey{Type: s.Type(), Value: s.hash}
+	}
+	return HashKey{Type: s.Type(), Value: hashString(s.Value)}
+}
+
+func hashString(value string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(value))
+	return h.Sum64()
+}
 
 type BuiltinFunction func(args ...Object) Object
 
@@ -146,10 +253,28 @@ func (h *Hash) Inspect() string {
 	return out.String()
 }
 
+// CompiledFunction is a function body compiled to bytecode. Name is the
+// name it was declared or bound with, empty if anonymous. Parameters
+// names its NumParameters positional parameters, the last NumDefaults of
+// which may be omitted by callers. A Variadic function collects surplus
+// positional arguments into an array in the local after its parameters.
+// MaxStackDepth is the most operand stack space the body uses on top of
+// its locals, and Positions maps its instructions back to source. A
+// function that ReadsCaller is a closure that never escapes the function
+// defining it, which only ever calls it directly; it reads that function's
+// variables from the frame below its own, so calls to it are never tail
+// calls.
 type CompiledFunction struct {
+	Name          string
 	Instructions  code.Instructions
 	NumLocals     int
 	NumParameters int
+	NumDefaults   int
+	Variadic      bool
+	Parameters    []string
+	MaxStackDepth int
+	Positions     code.PositionTable
+	ReadsCaller   bool
 }
 
 func (cf *CompiledFunction) Type() ObjectType { return COMPILED_FUNCTION_OBJ }
@@ -167,6 +292,52 @@ func (c *Closure) Inspect() string {
 	return fmt.Sprintf("Closure[%p]", c)
 }
 
+// Variant is a value of one case of an enum, carrying that case's fields
+type Variant struct {
+	Enum   string
+	Name   string
+	Fields []Object
+}
+
+func (v *Variant) Type() ObjectType { return VARIANT_OBJ }
+func (v *Variant) Inspect() string {
+	if len(v.Fields) == 0 {
+		return v.Enum + "." + v.Name
+	}
+
+	fields := []string{}
+	for _, f := range v.Fields {
+		fields = append(fields, f.Inspect())
+	}
+
+	return v.Enum + "." + v.Name + "(" + strings.Join(fields, ", ") + ")"
+}
+
+// Is reports whether v is the enum case described by tag, which is either a
+// VariantConstructor or a Variant without fields.
+func (v *Variant) Is(tag Object) bool {
+	switch tag := tag.(type) {
+	case *VariantConstructor:
+		return v.Enum == tag.Enum && v.Name == tag.Name
+	case *Variant:
+		return v.Enum == tag.Enum && v.Name == tag.Name
+	}
+	return false
+}
+
+// VariantConstructor is the callable bound to an enum case with fields.
+// Calling it with Arity arguments builds a Variant.
+type VariantConstructor struct {
+	Enum  string
+	Name  string
+	Arity int
+}
+
+func (vc *VariantConstructor) Type() ObjectType { return VARIANT_CTOR_OBJ }
+func (vc *VariantConstructor) Inspect() string {
+	return fmt.Sprintf("%s.%s/%d", vc.Enum, vc.Name, vc.Arity)
+}
+
 // Add to object/object.go
 
 type Environment struct {
@@ -46,6 +46,7 @@ func New(l *lexer.Lexer) *Parser {
 	p.registerPrefix(token.LBRACE, p.parseHashLiteral)
 	p.registerPrefix(token.FOR, p.parseForExpression)
 	p.registerPrefix(token.NULL, p.parseNullLiteral)
+	p.registerPrefix(token.MATCH, p.parseMatchExpression)
 
 	p.infixParseFns = make(map[token.TokenType]infixParseFn)
 	p.registerInfix(token.PLUS, p.parseInfixExpression)
@@ -60,6 +61,7 @@ func New(l *lexer.Lexer) *Parser {
 	p.registerInfix(token.GTE, p.parseInfixExpression)
 	p.registerInfix(token.LPAREN, p.parseCallExpression)
 	p.registerInfix(token.LBRACKET, p.parseIndexExpression)
+	p.registerInfix(token.DOT, p.parseMemberExpression)
 	p.registerInfix(token.ASSIGN, p.parseAssignmentExpression)
 
 	// Read two tokens, so curToken and peekToken are both set
@@ -94,6 +96,17 @@ func (p *Parser) parseStatement() ast.Statement {
 		return p.parseLetStatement()
 	case token.RETURN:
 		return p.parseReturnStatement()
+	case token.ENUM:
+		return p.parseEnumStatement()
+	case token.IMPORT:
+		return p.parseImportStatement()
+	case token.EXPORT:
+		return p.parseExportStatement()
+	case token.FUNCTION:
+		if p.peekTokenIs(token.IDENT) {
+			return p.parseFunctionStatement()
+		}
+		return p.parseExpressionStatement()
 	default:
 		return p.parseExpressionStatement()
 	}
@@ -102,18 +115,170 @@ func (p *Parser) parseStatement() ast.Statement {
 func (p *Parser) parseLetStatement() *ast.LetStatement {
 	stmt := &ast.LetStatement{Token: p.curToken}
 
+	if p.peekTokenIs(token.LBRACKET) || p.peekTokenIs(token.LBRACE) {
+		p.nextToken()
+		stmt.Pattern = p.parsePattern()
+		if stmt.Pattern == nil {
+			return nil
+		}
+	} else {
+		if !p.expectPeek(token.IDENT) {
+			return nil
+		}
+
+		stmt.Name = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+
+		if p.peekTokenIs(token.COLON) {
+			stmt.Type = p.parseTypeAnnotation()
+			if stmt.Type == nil {
+				return nil
+			}
+		}
+	}
+
+	if !p.expectPeek(token.ASSIGN) {
+		return nil
+	}
+
+	p.nextToken()
+	stmt.Value = p.parseExpression(LOWEST)
+
+	if fn, ok := stmt.Value.(*ast.FunctionLiteral); ok && stmt.Name != nil {
+		fn.Name = stmt.Name.Value
+	}
+
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+
+	return stmt
+}
+
+// parseFunctionStatement parses a named function declaration
+func (p *Parser) parseFunctionStatement() *ast.FunctionStatement {
+	stmt := &ast.FunctionStatement{Token: p.curToken}
+
+	p.nextToken()
+	stmt.Name = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+
+	lit := &ast.FunctionLiteral{Token: stmt.Token, Name: stmt.Name.Value}
+	if !p.expectPeek(token.LPAREN) {
+		return nil
+	}
+
+	if !p.parseParameterList(lit) {
+		return nil
+	}
+
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+
+	lit.Body = p.parseBlockStatement()
+	stmt.Function = lit
+
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+
+	return stmt
+}
+
+// parseImportStatement parses `import "path"` or `import name "path"`
+func (p *Parser) parseImportStatement() *ast.ImportStatement {
+	stmt := &ast.ImportStatement{Token: p.curToken}
+
+	if p.peekTokenIs(token.IDENT) {
+		p.nextToken()
+		stmt.Name = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+	}
+
+	if !p.expectPeek(token.STRING) {
+		return nil
+	}
+
+	stmt.Path = p.curToken.Literal
+
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+
+	return stmt
+}
+
+// parseExportStatement parses an exported let, fn or enum declaration
+func (p *Parser) parseExportStatement() *ast.ExportStatement {
+	stmt := &ast.ExportStatement{Token: p.curToken}
+
+	p.nextToken()
+	switch {
+	case p.curTokenIs(token.LET):
+		let := p.parseLetStatement()
+		if let == nil {
+			return nil
+		}
+		if let.Pattern != nil {
+			p.errors = append(p.errors, "cannot export a destructuring let statement")
+			return nil
+		}
+		stmt.Statement = let
+	case p.curTokenIs(token.FUNCTION) && p.peekTokenIs(token.IDENT):
+		fn := p.parseFunctionStatement()
+		if fn == nil {
+			return nil
+		}
+		stmt.Statement = fn
+	case p.curTokenIs(token.ENUM):
+		enum := p.parseEnumStatement()
+		if enum == nil {
+			return nil
+		}
+		stmt.Statement = enum
+	default:
+		msg := fmt.Sprintf("only let, fn and enum declarations can be exported, got %s", p.curToken.Type)
+		p.errors = append(p.errors, msg)
+		return nil
+	}
+
+	return stmt
+}
+
+// parseEnumStatement parses an enum declaration
+func (p *Parser) parseEnumStatement() *ast.EnumStatement {
+	stmt := &ast.EnumStatement{Token: p.curToken}
+
 	if !p.expectPeek(token.IDENT) {
 		return nil
 	}
 
 	stmt.Name = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
 
-	if !p.expectPeek(token.ASSIGN) {
+	if !p.expectPeek(token.LBRACE) {
 		return nil
 	}
 
+	for !p.peekTokenIs(token.RBRACE) {
+		if !p.expectPeek(token.IDENT) {
+			return nil
+		}
+
+		variant := &ast.EnumVariant{
+			Name: &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal},
+		}
+
+		if p.peekTokenIs(token.LPAREN) {
+			p.nextToken()
+			variant.Fields = p.parseFunctionParameters()
+		}
+
+		stmt.Variants = append(stmt.Variants, variant)
+
+		if !p.peekTokenIs(token.RBRACE) && !p.expectPeek(token.COMMA) {
+			return nil
+		}
+	}
+
 	p.nextToken()
-	stmt.Value = p.parseExpression(LOWEST)
 
 	if p.peekTokenIs(token.SEMICOLON) {
 		p.nextToken()
@@ -275,7 +440,9 @@ func (p *Parser) parseFunctionLiteral() ast.Expression {
 		return nil
 	}
 
-	lit.Parameters = p.parseFunctionParameters()
+	if !p.parseParameterList(lit) {
+		return nil
+	}
 
 	if !p.expectPeek(token.LBRACE) {
 		return nil
@@ -387,6 +554,7 @@ var precedences = map[token.TokenType]int{
 	token.ASTERISK: PRODUCT,
 	token.LPAREN:   CALL,
 	token.LBRACKET: INDEX,
+	token.DOT:      INDEX,
 }
 
 // parseIfExpression parses an if expression
@@ -424,10 +592,57 @@ func (p *Parser) parseIfExpression() ast.Expression {
 // parseCallExpression parses a function call expression
 func (p *Parser) parseCallExpression(function ast.Expression) ast.Expression {
 	exp := &ast.CallExpression{Token: p.curToken, Function: function}
-	exp.Arguments = p.parseExpressionList(token.RPAREN)
+	if !p.parseCallArguments(exp) {
+		return nil
+	}
 	return exp
 }
 
+// parseCallArguments parses the arguments of a call. Positional arguments
+// come first and are followed by any `name: value` keyword arguments.
+func (p *Parser) parseCallArguments(exp *ast.CallExpression) bool {
+	exp.Arguments = []ast.Expression{}
+
+	if p.peekTokenIs(token.RPAREN) {
+		p.nextToken()
+		return true
+	}
+
+	seen := map[string]bool{}
+	for {
+		p.nextToken()
+
+		if p.curTokenIs(token.IDENT) && p.peekTokenIs(token.COLON) {
+			name := &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+			if seen[name.Value] {
+				msg := fmt.Sprintf("keyword argument %s repeated", name.Value)
+				p.errors = append(p.errors, msg)
+				return false
+			}
+			seen[name.Value] = true
+
+			p.nextToken()
+			p.nextToken()
+			arg := &ast.KeywordArgument{Name: name, Value: p.parseExpression(LOWEST)}
+			exp.KeywordArguments = append(exp.KeywordArguments, arg)
+		} else {
+			if len(exp.KeywordArguments) > 0 {
+				msg := "positional argument follows keyword argument"
+				p.errors = append(p.errors, msg)
+				return false
+			}
+			exp.Arguments = append(exp.Arguments, p.parseExpression(LOWEST))
+		}
+
+		if !p.peekTokenIs(token.COMMA) {
+			break
+		}
+		p.nextToken()
+	}
+
+	return p.expectPeek(token.RPAREN)
+}
+
 // parseIndexExpression parses an index expression
 func (p *Parser) parseIndexExpression(left ast.Expression) ast.Expression {
 	exp := &ast.IndexExpression{Token: p.curToken, Left: left}
@@ -442,6 +657,19 @@ func (p *Parser) parseIndexExpression(left ast.Expression) ast.Expression {
 	return exp
 }
 
+// parseMemberExpression parses a member access such as `math.add`
+func (p *Parser) parseMemberExpression(left ast.Expression) ast.Expression {
+	exp := &ast.MemberExpression{Token: p.curToken, Object: left}
+
+	if !p.expectPeek(token.IDENT) {
+		return nil
+	}
+
+	exp.Property = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+
+	return exp
+}
+
 // nextToken advances the parser to the next token
 func (p *Parser) nextToken() {
 	p.curToken = p.peekToken
@@ -490,6 +718,87 @@ func (p *Parser) parseFunctionParameters() []*ast.Identifier {
 	return identifiers
 }
 
+// parseParameterList parses a function literal's parameters. Parameters may
+// have `= default` values, which must come after all required parameters,
+// and the list may end with a variadic `...name` parameter.
+func (p *Parser) parseParameterList(lit *ast.FunctionLiteral) bool {
+	lit.Parameters = []*ast.Identifier{}
+
+	if p.peekTokenIs(token.RPAREN) {
+		p.nextToken()
+		return true
+	}
+
+	hasDefaults, hasTypes := false, false
+	for {
+		p.nextToken()
+
+		if p.curTokenIs(token.ELLIPSIS) {
+			if !p.expectPeek(token.IDENT) {
+				return false
+			}
+			lit.Variadic = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+			break
+		}
+
+		if !p.curTokenIs(token.IDENT) {
+			msg := fmt.Sprintf("expected parameter name, got %s", p.curToken.Type)
+			p.errors = append(p.errors, msg)
+			return false
+		}
+
+		ident := &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+		var typ *ast.TypeExpression
+		var def ast.Expression
+
+		if p.peekTokenIs(token.COLON) {
+			typ = p.parseTypeAnnotation()
+			if typ == nil {
+				return false
+			}
+			hasTypes = true
+		}
+
+		if p.peekTokenIs(token.ASSIGN) {
+			p.nextToken()
+			p.nextToken()
+			def = p.parseExpression(LOWEST)
+			hasDefaults = true
+		} else if hasDefaults {
+			msg := fmt.Sprintf("parameter %s without default follows a parameter with a default", ident.Value)
+			p.errors = append(p.errors, msg)
+			return false
+		}
+
+		lit.Parameters = append(lit.Parameters, ident)
+		lit.Types = append(lit.Types, typ)
+		lit.Defaults = append(lit.Defaults, def)
+
+		if !p.peekTokenIs(token.COMMA) {
+			break
+		}
+		p.nextToken()
+	}
+
+	if !hasDefaults {
+		lit.Defaults = nil
+	}
+	if !hasTypes {
+		lit.Types = nil
+	}
+
+	return p.expectPeek(token.RPAREN)
+}
+
+// parseTypeAnnotation parses the `: type` after a parameter or let name
+func (p *Parser) parseTypeAnnotation() *ast.TypeExpression {
+	p.nextToken()
+	if !p.expectPeek(token.IDENT) {
+		return nil
+	}
+	return &ast.TypeExpression{Token: p.curToken, Type: p.curToken.Literal}
+}
+
 // parseBlockStatement parses a block statement
 func (p *Parser) parseBlockStatement() *ast.BlockStatement {
 	block := &ast.BlockStatement{Token: p.curToken}
@@ -556,3 +865,267 @@ func (p *Parser) peekError(t token.TokenType) {
 	msg := fmt.Sprintf("expected next token to be %s, got %s instead", t, p.peekToken.Type)
 	p.errors = append(p.errors, msg)
 }
+
+// parseMatchExpression parses a match expression. Arm bodies are either a
+// single expression or a braced block of statements.
+func (p *Parser) parseMatchExpression() ast.Expression {
+	expression := &ast.MatchExpression{Token: p.curToken}
+
+	p.nextToken()
+	expression.Subject = p.parseExpression(LOWEST)
+
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+
+	for !p.peekTokenIs(token.RBRACE) && !p.peekTokenIs(token.EOF) {
+		p.nextToken()
+
+		arm := p.parseMatchArm()
+		if arm == nil {
+			return nil
+		}
+		expression.Arms = append(expression.Arms, arm)
+
+		if p.peekTokenIs(token.COMMA) {
+			p.nextToken()
+		}
+	}
+
+	if !p.expectPeek(token.RBRACE) {
+		return nil
+	}
+
+	return expression
+}
+
+// parseMatchArm parses a single `pattern => body` arm
+func (p *Parser) parseMatchArm() *ast.MatchArm {
+	pattern := p.parsePattern()
+	if pattern == nil {
+		return nil
+	}
+
+	var guard ast.Expression
+	if p.peekTokenIs(token.IF) {
+		p.nextToken()
+		p.nextToken()
+		guard = p.parseExpression(LOWEST)
+	}
+
+	if !p.expectPeek(token.ARROW) {
+		return nil
+	}
+
+	arm := &ast.MatchArm{Token: p.curToken, Pattern: pattern, Guard: guard}
+
+	p.nextToken()
+
+	if p.curTokenIs(token.LBRACE) {
+		arm.Body = p.parseBlockStatement()
+	} else {
+		stmt := &ast.ExpressionStatement{Token: p.curToken}
+		stmt.Expression = p.parseExpression(LOWEST)
+		arm.Body = &ast.BlockStatement{Token: arm.Token, Statements: []ast.Statement{stmt}}
+	}
+
+	return arm
+}
+
+// parsePattern parses a pattern in a match arm
+func (p *Parser) parsePattern() ast.Pattern {
+	switch p.curToken.Type {
+	case token.IDENT:
+		if p.curToken.Literal == "_" {
+			return &ast.WildcardPattern{Token: p.curToken}
+		}
+
+		name := &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+		pattern := &ast.VariantPattern{Token: name.Token, Name: name}
+
+		// A variant of an imported enum is named through its module, with
+		// or without fields: `shapes.Circle(r)`, `shapes.Empty`
+		if p.peekTokenIs(token.DOT) {
+			p.nextToken()
+			if !p.expectPeek(token.IDENT) {
+				return nil
+			}
+			pattern.Module = name
+			pattern.Name = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+			if !p.peekTokenIs(token.LPAREN) {
+				return pattern
+			}
+		} else if !p.peekTokenIs(token.LPAREN) {
+			return &ast.BindingPattern{Token: p.curToken, Name: name}
+		}
+
+		p.nextToken()
+		pattern.Fields = p.parsePatternList(token.RPAREN)
+		if pattern.Fields == nil {
+			return nil
+		}
+
+		return pattern
+	case token.INT, token.FLOAT, token.STRING, token.TRUE, token.FALSE, token.NULL, token.MINUS:
+		return &ast.LiteralPattern{Token: p.curToken, Value: p.parseExpression(PREFIX)}
+	case token.LBRACKET:
+		return p.parseArrayPattern()
+	case token.LBRACE:
+		return p.parseHashPattern()
+	default:
+		msg := fmt.Sprintf("no pattern parse function for %s found", p.curToken.Type)
+		p.errors = append(p.errors, msg)
+		return nil
+	}
+}
+
+// parseArrayPattern parses an array pattern such as `[head, ..tail]`
+func (p *Parser) parseArrayPattern() ast.Pattern {
+	pattern := &ast.ArrayPattern{Token: p.curToken}
+
+	for !p.peekTokenIs(token.RBRACKET) {
+		p.nextToken()
+
+		if p.curTokenIs(token.DOTDOT) {
+			pattern.Rest = &ast.WildcardPattern{Token: p.curToken}
+			if p.peekTokenIs(token.IDENT) {
+				p.nextToken()
+				pattern.Rest = p.parsePattern()
+			}
+
+			if !p.expectPeek(token.RBRACKET) {
+				return nil
+			}
+			return pattern
+		}
+
+		element := p.parseOptionalDefault(p.parsePattern())
+		if element == nil {
+			return nil
+		}
+
+		_, hasDefault := element.(*ast.DefaultPattern)
+		if !hasDefault && len(pattern.Elements) > 0 {
+			if _, ok := pattern.Elements[len(pattern.Elements)-1].(*ast.DefaultPattern); ok {
+				msg := fmt.Sprintf("element %s without default follows an element with a default", element)
+				p.errors = append(p.errors, msg)
+				return nil
+			}
+		}
+
+		pattern.Elements = append(pattern.Elements, element)
+
+		if !p.peekTokenIs(token.RBRACKET) && !p.expectPeek(token.COMMA) {
+			return nil
+		}
+	}
+
+	p.nextToken()
+	return pattern
+}
+
+// parseOptionalDefault wraps pattern in a DefaultPattern when it is
+// followed by `= default`
+func (p *Parser) parseOptionalDefault(pattern ast.Pattern) ast.Pattern {
+	if pattern == nil || !p.peekTokenIs(token.ASSIGN) {
+		return pattern
+	}
+
+	p.nextToken()
+	dp := &ast.DefaultPattern{Token: p.curToken, Pattern: pattern}
+
+	p.nextToken()
+	dp.Default = p.parseExpression(LOWEST)
+	if dp.Default == nil {
+		return nil
+	}
+
+	return dp
+}
+
+// parseHashPattern parses a hash pattern such as `{"name": n, age}`. A bare
+// identifier key names a string key, and on its own binds that key's value
+// to a variable of the same name.
+func (p *Parser) parseHashPattern() ast.Pattern {
+	pattern := &ast.HashPattern{Token: p.curToken}
+
+	for !p.peekTokenIs(token.RBRACE) {
+		p.nextToken()
+
+		pair := &ast.HashPatternPair{}
+
+		switch p.curToken.Type {
+		case token.IDENT:
+			pair.Key = &ast.StringLiteral{Token: p.curToken, Value: p.curToken.Literal}
+			if !p.peekTokenIs(token.COLON) {
+				pair.Value = &ast.BindingPattern{
+					Token: p.curToken,
+					Name:  &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal},
+				}
+			}
+		case token.STRING, token.INT, token.TRUE, token.FALSE:
+			pair.Key = p.parseExpression(PREFIX)
+		default:
+			msg := fmt.Sprintf("invalid hash pattern key %s", p.curToken.Type)
+			p.errors = append(p.errors, msg)
+			return nil
+		}
+
+		if pair.Value == nil {
+			if !p.expectPeek(token.COLON) {
+				return nil
+			}
+
+			p.nextToken()
+			pair.Value = p.parsePattern()
+		}
+
+		pair.Value = p.parseOptionalDefault(pair.Value)
+		if pair.Value == nil {
+			return nil
+		}
+
+		pattern.Pairs = append(pattern.Pairs, pair)
+
+		if !p.peekTokenIs(token.RBRACE) && !p.expectPeek(token.COMMA) {
+			return nil
+		}
+	}
+
+	p.nextToken()
+	return pattern
+}
+
+// parsePatternList parses a comma-separated list of patterns
+func (p *Parser) parsePatternList(end token.TokenType) []ast.Pattern {
+	list := []ast.Pattern{}
+
+	if p.peekTokenIs(end) {
+		p.nextToken()
+		return list
+	}
+
+	p.nextToken()
+	pattern := p.parsePattern()
+	if pattern == nil {
+		return nil
+	}
+	list = append(list, pattern)
+
+	for p.peekTokenIs(token.COMMA) {
+		p.nextToken()
+		p.nextToken()
+
+		pattern := p.parsePattern()
+		if pattern == nil {
+			return nil
+		}
+		list = append(list, pattern)
+	}
+
+	if !p.expectPeek(end) {
+		return nil
+	}
+
+	return list
+}
@@ -255,3 +255,295 @@ func TestParsePrefixExpression(t *testing.T) {
 		}
 	}
 }
+
+func TestParseEnumStatement(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{
+			input:    "enum Shape { Circle(r), Rect(w, h) }",
+			expected: "enum Shape { Circle(r), Rect(w, h) }",
+		},
+		{
+			input:    "enum Option { Some(value), None, };",
+			expected: "enum Option { Some(value), None }",
+		},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+
+		if len(p.Errors()) != 0 {
+			t.Fatalf("parser errors: %v", p.Errors())
+		}
+
+		actual := program.String()
+		if actual != tt.expected {
+			t.Errorf("expected %q, got %q", tt.expected, actual)
+		}
+	}
+}
+
+func TestParseMatchExpression(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{
+			input:    "match s { Circle(r) => r * r, Rect(w, _) => w, _ => 0 }",
+			expected: "match s { Circle(r) => (r * r), Rect(w, _) => w, _ => 0 }",
+		},
+		{
+			input:    "match s { None => { let x = 1; x } Some(v) => v }",
+			expected: "match s { None => let x = 1;x, Some(v) => v }",
+		},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+
+		if len(p.Errors()) != 0 {
+			t.Fatalf("parser errors: %v", p.Errors())
+		}
+
+		actual := program.String()
+		if actual != tt.expected {
+			t.Errorf("expected %q, got %q", tt.expected, actual)
+		}
+	}
+}
+
+func TestParseMatchPatterns(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{
+			input:    `match x { 1 => "one", -1 => "minus one", "s" => 2, true => 3, null => 4 }`,
+			expected: `match x { 1 => one, (-1) => minus one, s => 2, true => 3, null => 4 }`,
+		},
+		{
+			input:    "match xs { [] => 0, [head, ..tail] => head, [a, ..] => a }",
+			expected: "match xs { [] => 0, [head, ..tail] => head, [a, ..] => a }",
+		},
+		{
+			input:    `match p { {"name": n, age} => n, {1: [x]} => x }`,
+			expected: "match p { {name: n, age: age} => n, {1: [x]} => x }",
+		},
+		{
+			input:    "match n { x if x > 10 => x, _ => 0 }",
+			expected: "match n { x if (x > 10) => x, _ => 0 }",
+		},
+		{
+			input:    "match s { shapes.Circle(r) => r, shapes.Empty => 0, Empty => 1 }",
+			expected: "match s { shapes.Circle(r) => r, shapes.Empty => 0, Empty => 1 }",
+		},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+
+		if len(p.Errors()) != 0 {
+			t.Fatalf("parser errors: %v", p.Errors())
+		}
+
+		actual := program.String()
+		if actual != tt.expected {
+			t.Errorf("expected %q, got %q", tt.expected, actual)
+		}
+	}
+}
+
+func TestParseDestructuringLet(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{
+			input:    "let [a, b, ..rest] = xs;",
+			expected: "let [a, b, ..rest] = xs;",
+		},
+		{
+			input:    "let {name, age = 0} = person;",
+			expected: "let {name: name, age: age = 0} = person;",
+		},
+		{
+			input:    `let [x, {"y": y}, z = 1 + 2] = point;`,
+			expected: "let [x, {y: y}, z = (1 + 2)] = point;",
+		},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+
+		if len(p.Errors()) != 0 {
+			t.Fatalf("parser errors: %v", p.Errors())
+		}
+
+		actual := program.String()
+		if actual != tt.expected {
+			t.Errorf("expected %q, got %q", tt.expected, actual)
+		}
+	}
+}
+
+func TestParseDestructuringErrors(t *testing.T) {
+	l := lexer.New("let [a = 1, b] = xs;")
+	p := New(l)
+	p.ParseProgram()
+
+	expected := "element b without default follows an element with a default"
+	if len(p.Errors()) == 0 || p.Errors()[0] != expected {
+		t.Errorf("expected error %q, got %v", expected, p.Errors())
+	}
+}
+
+func TestParseFunctionParameters(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{
+			input:    "fn(a, b = 2, ...rest) { a }",
+			expected: "fn(a, b = 2, ...rest) {a}",
+		},
+		{
+			input:    "fn(...args) { args }",
+			expected: "fn(...args) {args}",
+		},
+		{
+			input:    "fn(n: int, s, x: float = 1.5) { n }",
+			expected: "fn(n: int, s, x: float = 1.5) {n}",
+		},
+		{
+			input:    "let n: int = 1;",
+			expected: "let n: int = 1;",
+		},
+		{
+			input:    "greet(name, greeting: \"hi\", times: 1 + 2)",
+			expected: "greet(name, greeting: hi, times: (1 + 2))",
+		},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+
+		if len(p.Errors()) != 0 {
+			t.Fatalf("parser errors: %v", p.Errors())
+		}
+
+		actual := program.String()
+		if actual != tt.expected {
+			t.Errorf("expected %q, got %q", tt.expected, actual)
+		}
+	}
+}
+
+func TestParseFunctionParameterErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"fn(a = 1, b) { a }", "parameter b without default follows a parameter with a default"},
+		{"fn(...rest, a) { a }", "expected next token to be ), got , instead"},
+		{"f(a: 1, 2)", "positional argument follows keyword argument"},
+		{"f(a: 1, a: 2)", "keyword argument a repeated"},
+		{"fn(a: 1) { a }", "expected next token to be IDENT, got INT instead"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		p.ParseProgram()
+
+		if len(p.Errors()) == 0 || p.Errors()[0] != tt.expected {
+			t.Errorf("expected error %q, got %v", tt.expected, p.Errors())
+		}
+	}
+}
+
+func TestParseFunctionStatement(t *testing.T) {
+	input := "fn add(a, b = 1) { a + b } let sub = fn(a, b) { a - b };"
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+
+	if len(p.Errors()) != 0 {
+		t.Fatalf("parser errors: %v", p.Errors())
+	}
+
+	if len(program.Statements) != 2 {
+		t.Fatalf("expected 2 statements, got %d", len(program.Statements))
+	}
+
+	stmt, ok := program.Statements[0].(*ast.FunctionStatement)
+	if !ok {
+		t.Fatalf("expected *ast.FunctionStatement, got %T", program.Statements[0])
+	}
+
+	if stmt.String() != "fn add(a, b = 1) {(a + b)}" {
+		t.Errorf("wrong string, got %q", stmt.String())
+	}
+
+	if stmt.Function.Name != "add" {
+		t.Errorf("expected function name add, got %q", stmt.Function.Name)
+	}
+
+	let := program.Statements[1].(*ast.LetStatement)
+	fn, ok := let.Value.(*ast.FunctionLiteral)
+	if !ok {
+		t.Fatalf("expected *ast.FunctionLiteral, got %T", let.Value)
+	}
+
+	if fn.Name != "sub" {
+		t.Errorf("expected function name sub, got %q", fn.Name)
+	}
+}
+
+func TestParseModules(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`import "lib/math";`, `import "lib/math"`},
+		{`import m "lib/math"`, `import m "lib/math"`},
+		{`export let pi = 3;`, `export let pi = 3;`},
+		{`export fn add(a, b) { a + b }`, `export fn add(a, b) {(a + b)}`},
+		{`export enum Shape { Circle(r), Empty }`, `export enum Shape { Circle(r), Empty }`},
+		{`math.add(1, 2)`, `math.add(1, 2)`},
+		{`a.b.c[0]`, `(a.b.c[0])`},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+
+		if len(p.Errors()) != 0 {
+			t.Fatalf("parser errors: %v", p.Errors())
+		}
+
+		actual := program.String()
+		if actual != tt.expected {
+			t.Errorf("expected %q, got %q", tt.expected, actual)
+		}
+	}
+
+	p := New(lexer.New("export 1 + 2"))
+	p.ParseProgram()
+	if len(p.Errors()) == 0 || p.Errors()[0] != "only let, fn and enum declarations can be exported, got INT" {
+		t.Errorf("unexpected errors: %v", p.Errors())
+	}
+}
@@ -49,6 +49,10 @@ const (
 	RBRACE    = "}"
 	LBRACKET  = "["
 	RBRACKET  = "]"
+	ARROW     = "=>"
+	DOT       = "."
+	DOTDOT    = ".."
+	ELLIPSIS  = "..."
 
 	// Keywords
 	FUNCTION = "FUNCTION"
@@ -60,6 +64,10 @@ const (
 	RETURN   = "RETURN"
 	FOR      = "FOR"
 	IN       = "IN"
+	ENUM     = "ENUM"
+	MATCH    = "MATCH"
+	IMPORT   = "IMPORT"
+	EXPORT   = "EXPORT"
 )
 
 // Keywords map for quick lookup
@@ -73,6 +81,11 @@ var keywords = map[string]TokenType{
 	"return": RETURN,
 	"for":    FOR,
 	"in":     IN,
+	"null":   NULL,
+	"enum":   ENUM,
+	"match":  MATCH,
+	"import": IMPORT,
+	"export": EXPORT,
 }
 
 // LookupIdent checks whether the given identifier is a keyword
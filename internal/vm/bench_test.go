@@ -0,0 +1,150 @@
+package vm
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/TheAlchemistKE/helios/internal/compiler"
+)
+
+// workloads are numeric benchmarks. The parameters of the integer ones are
+// annotated, so their arithmetic can be specialised; the other benchmarks
+// run them with the annotations stripped, see plain.
+var workloads = []struct {
+	name    string
+	input   string
+	integer bool
+}{
+	{"fib", `
+let fib = fn(n: int) { if (n < 2) { n } else { fib(n - 1) + fib(n - 2) } };
+fib(20)`, true},
+	{"sum", `
+let sum = fn(n: int, acc: int) { if (n == 0) { acc } else { sum(n - 1, acc + n) } };
+sum(20000, 0)`, true},
+	{"collatz", `
+let steps = fn(n: int, count: int) {
+	if (n == 1) { count }
+	else { if (n - n / 2 * 2 == 0) { steps(n / 2, count + 1) } else { steps(3 * n + 1, count + 1) } }
+};
+let total = fn(n: int, acc: int) { if (n == 0) { acc } else { total(n - 1, acc + steps(n, 0)) } };
+total(300, 0)`, true},
+	{"newton", `
+let abs = fn(x) { if (x < 0) { -x } else { x } };
+let root = fn(x, guess) {
+	if (abs(guess * guess - x) < 0.000001) { guess } else { root(x, (guess + x / guess) / 2) }
+};
+let roots = fn(n, acc) { if (n == 0) { acc } else { roots(n - 1, acc + root(n * 1.0, 1.0)) } };
+roots(2000, 0.0)`, false},
+}
+
+// plain strips the type annotations of a workload
+func plain(input string) string {
+	return strings.ReplaceAll(input, ": int", "")
+}
+
+// variant is one way of compiling a benchmark
+type variant struct {
+	name    string
+	options compiler.Options
+}
+
+// benchmarkVariants compiles input once per variant, outside the timed
+// loop, and checks that every variant computes the same result before
+// timing each as a sub-benchmark. Each run gets a fresh machine, created
+// with the timer stopped, so only running the program is measured.
+func benchmarkVariants(b *testing.B, name, input string, variants []variant) {
+	program := parse(input)
+	results := []string{}
+
+	for _, v := range variants {
+		comp := compiler.NewWithOptions(v.options)
+		err := comp.Compile(program)
+		if err != nil {
+			b.Fatalf("%s: compiler error: %s", name, err)
+		}
+		bytecode := comp.Bytecode()
+		if bytecode.Backend != v.options.Backend {
+			b.Fatalf("%s: compiled for the %s backend, want %s", name, bytecode.Backend, v.options.Backend)
+		}
+
+		machine := New(bytecode)
+		err = machine.Run()
+		if err != nil {
+			b.Fatalf("%s: vm error: %s", name, err)
+		}
+		results = append(results, machine.LastPoppedStackElem().Inspect())
+		if results[0] != results[len(results)-1] {
+			b.Fatalf("%s: %s and %s disagree: %s, %s", name, variants[0].name, v.name,
+				results[0], results[len(results)-1])
+		}
+
+		b.Run(name+"/"+v.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				machine := New(bytecode)
+				b.StartTimer()
+
+				err := machine.Run()
+				if err != nil {
+					b.Fatalf("vm error: %s", err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkBackends runs each workload on the stack and the register
+// machine. Both compile through the IR, so they start from the same
+// optimised program and differ only in the instruction set.
+func BenchmarkBackends(b *testing.B) {
+	for _, w := range workloads {
+		benchmarkVariants(b, w.name, plain(w.input), []variant{
+			{compiler.StackBackend.String(), compiler.Options{SSA: true}},
+			{compiler.RegisterBackend.String(), compiler.Options{SSA: true, Backend: compiler.RegisterBackend}},
+		})
+	}
+}
+
+// BenchmarkSuperinstructions runs each workload on the stack machine with
+// and without superinstructions
+func BenchmarkSuperinstructions(b *testing.B) {
+	for _, w := range workloads {
+		benchmarkVariants(b, w.name, plain(w.input), []variant{
+			{"plain", compiler.Options{Peephole: true}},
+			{"fused", compiler.Options{Peephole: true, Superinstructions: true}},
+		})
+	}
+}
+
+// BenchmarkSpecialiseIntegers runs each integer workload with generic and
+// with Int operators
+func BenchmarkSpecialiseIntegers(b *testing.B) {
+	for _, w := range workloads {
+		if !w.integer {
+			continue
+		}
+		benchmarkVariants(b, w.name, w.input, []variant{
+			{"generic", compiler.Options{Peephole: true}},
+			{"int", compiler.Options{Peephole: true, SpecialiseIntegers: true}},
+		})
+	}
+}
+
+// BenchmarkEscapeAnalysis runs a workload that calls short-lived closures
+// over its arguments, with and without escape analysis
+func BenchmarkEscapeAnalysis(b *testing.B) {
+	input := `
+let step = fn(n, k) {
+	let scale = fn(x) { x * k };
+	let shift = fn(x) { x + k + n };
+	shift(scale(n))
+};
+let total = fn(n, acc) { if (n == 0) { acc } else { total(n - 1, acc + step(n, 3)) } };
+total(20000, 0)`
+
+	benchmarkVariants(b, "closures", input, []variant{
+		{"captured", compiler.Options{}},
+		{"caller", compiler.Options{EscapeAnalysis: true}},
+	})
+}
@@ -0,0 +1,37 @@
+package vm
+
+import (
+	"github.com/TheAlchemistKE/helios/internal/code"
+	"github.com/TheAlchemistKE/helios/internal/object"
+)
+
+// Frame holds the execution state of a single function call
+type Frame struct {
+	cl          *object.Closure
+	ip          int
+	basePointer int
+
+	// omitted marks the parameters whose arguments were not passed, so
+	// their defaults are used; nil if every argument was
+	omitted []bool
+}
+
+// NewFrame creates a frame for the given closure whose locals start at basePointer
+func NewFrame(cl *object.Closure, basePointer int) *Frame {
+	return &Frame{
+		cl:          cl,
+		ip:          -1,
+		basePointer: basePointer,
+	}
+}
+
+// Instructions returns the bytecode of the function executing in this frame
+func (f *Frame) Instructions() code.Instructions {
+	return f.cl.Fn.Instructions
+}
+
+// supplied reports whether the argument of the parameter in local slot i was
+// passed to the call
+func (f *Frame) supplied(i int) bool {
+	return i >= len(f.omitted) || !f.omitted[i]
+}
@@ -0,0 +1,106 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// checkInterval is the most instructions run between checks of the limits
+// of a run, which bounds how late a cancelled context is noticed
+const checkInterval = 1024
+
+// Limits bounds the resources a run may use. Zero fields are unlimited.
+// Instructions is the most instructions executed, counting a
+// superinstruction once, and CallDepth the most calls in progress at once,
+// not counting the main program or calls replaced by tail calls.
+type Limits struct {
+	Instructions int64
+	CallDepth    int
+}
+
+// The limits a run can exceed. Every run is bounded by the size of the
+// stack, the others only by RunContext.
+var (
+	ErrStackOverflow    = errors.New("stack overflow")
+	ErrInstructionLimit = errors.New("instruction limit exceeded")
+	ErrCallDepthLimit   = errors.New("call depth limit exceeded")
+)
+
+// ErrInternal is wrapped by the error of a run the VM failed, rather than
+// the program it ran
+var ErrInternal = errors.New("internal error")
+
+// LimitError is the error a run stopped by a limit fails with. Err is
+// ErrStackOverflow, ErrInstructionLimit, ErrCallDepthLimit or the error of
+// the run's context, so errors.Is tells them apart.
+type LimitError struct {
+	Err error
+}
+
+func (e *LimitError) Error() string { return "execution stopped: " + e.Err.Error() }
+func (e *LimitError) Unwrap() error { return e.Err }
+
+// InternalError is the error of a run the VM panicked in, holding the value
+// it panicked with
+type InternalError struct {
+	Value any
+}
+
+func (e *InternalError) Error() string { return fmt.Sprintf("%s: %v", ErrInternal, e.Value) }
+func (e *InternalError) Unwrap() error { return ErrInternal }
+
+// errStackOverflow is the error of a push or call beyond the stack
+var errStackOverflow = &LimitError{Err: ErrStackOverflow}
+
+// RunContext executes the bytecode like Run, but stops with a *LimitError
+// once ctx is done or the run exceeds limits. The error reaches the caller
+// inside the *object.Error holding the stack it stopped at. A panic in the
+// VM is returned as an *InternalError, so untrusted code cannot bring down
+// the host. A stopped VM's globals keep the values assigned so far.
+func (vm *VM) RunContext(ctx context.Context, limits Limits) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &InternalError{Value: r}
+		}
+	}()
+
+	vm.ctx, vm.limits, vm.remaining = ctx, limits, limits.Instructions
+	return vm.execute()
+}
+
+// grant returns how many instructions may run before the limits are
+// checked again
+func (vm *VM) grant() int64 {
+	n := int64(checkInterval)
+	if vm.limits.Instructions > 0 {
+		n = min(n, vm.remaining)
+		vm.remaining -= n
+	}
+	return n
+}
+
+// checkLimits is called when the instructions granted have run, and fails
+// if the run has to stop
+func (vm *VM) checkLimits() error {
+	if vm.ctx != nil {
+		select {
+		case <-vm.ctx.Done():
+			return &LimitError{Err: vm.ctx.Err()}
+		default:
+		}
+	}
+	if vm.limits.Instructions > 0 && vm.remaining == 0 {
+		return &LimitError{Err: ErrInstructionLimit}
+	}
+	return nil
+}
+
+// checkCallDepth fails if a call from depth calls in would exceed the
+// call depth limit
+func (vm *VM) checkCallDepth(depth int) error {
+	if vm.limits.CallDepth > 0 && depth >= vm.limits.CallDepth {
+		return &LimitError{Err: ErrCallDepthLimit}
+	}
+	return nil
+}
@@ -0,0 +1,318 @@
+package vm
+
+import (
+	"fmt"
+
+	"github.com/TheAlchemistKE/helios/internal/code"
+	"github.com/TheAlchemistKE/helios/internal/object"
+)
+
+// registerFrame is the execution state of a call on the register machine.
+// Its registers are the stack slots from basePointer, and the closure
+// called is in the slot below them. ret is the caller's register the
+// result is stored in.
+type registerFrame struct {
+	cl          *object.Closure
+	ip          int
+	basePointer int
+	ret         int
+}
+
+// stackOps maps the register operations computed by the same helpers as a
+// stack operation to that operation
+var stackOps = [...]code.Opcode{
+	code.RegAdd:         code.OpAdd,
+	code.RegSub:         code.OpSub,
+	code.RegMul:         code.OpMul,
+	code.RegDiv:         code.OpDiv,
+	code.RegGreaterThan: code.OpGreaterThan,
+	code.RegEqual:       code.OpEqual,
+	code.RegNotEqual:    code.OpNotEqual,
+}
+
+// rk reads an RK operand: a register, or a constant if code.RKConstant is
+// set
+func rk(regs, constants []object.Object, operand int) object.Object {
+	if operand&code.RKConstant != 0 {
+		return constants[operand&^code.RKConstant]
+	}
+	return regs[operand]
+}
+
+// runRegisters executes register code. The state of the running frame is
+// kept in locals, and saved in frames while it calls another.
+func (vm *VM) runRegisters() error {
+	main := vm.frames[0].cl
+	if main.Fn.MaxStackDepth > RegisterStackSize {
+		return registerError(errStackOverflow, nil, registerFrame{cl: main}, 0)
+	}
+
+	constants := vm.constants
+	frames := []registerFrame{}
+	frame := registerFrame{cl: main}
+
+	ins := main.Fn.Instructions
+	ip := 0
+	regs := vm.stack
+	var steps int64
+
+	for ip < len(ins) {
+		pc := ip
+		if steps == 0 {
+			if err := vm.checkLimits(); err != nil {
+				return registerError(err, frames, frame, pc)
+			}
+			steps = vm.grant()
+		}
+		steps--
+
+		op := code.RegisterOpcode(ins[ip])
+
+		switch op {
+		case code.RegLoadConst:
+			a, k := code.ReadUint16(ins[ip+1:]), code.ReadUint16(ins[ip+3:])
+			regs[a] = constants[k]
+			ip += 5
+
+		case code.RegLoadTrue, code.RegLoadFalse, code.RegLoadNull:
+			a := code.ReadUint16(ins[ip+1:])
+			switch op {
+			case code.RegLoadTrue:
+				regs[a] = True
+			case code.RegLoadFalse:
+				regs[a] = False
+			default:
+				regs[a] = Null
+			}
+			ip += 3
+
+		case code.RegMove:
+			a, b := code.ReadUint16(ins[ip+1:]), code.ReadUint16(ins[ip+3:])
+			regs[a] = regs[b]
+			ip += 5
+
+		case code.RegGetGlobal:
+			a, g := code.ReadUint16(ins[ip+1:]), code.ReadUint16(ins[ip+3:])
+			global, err := vm.global(int(g))
+			if err != nil {
+				return registerError(err, frames, frame, pc)
+			}
+			regs[a] = global
+			ip += 5
+
+		case code.RegSetGlobal:
+			g, b := code.ReadUint16(ins[ip+1:]), code.ReadUint16(ins[ip+3:])
+			vm.globals[g] = rk(regs, constants, int(b))
+			ip += 5
+
+		case code.RegGetBuiltin:
+			a, i := code.ReadUint16(ins[ip+1:]), code.ReadUint16(ins[ip+3:])
+			regs[a] = object.Builtins[i].Builtin
+			ip += 5
+
+		case code.RegGetFree:
+			a, i := code.ReadUint16(ins[ip+1:]), code.ReadUint16(ins[ip+3:])
+			regs[a] = frame.cl.Free[i]
+			ip += 5
+
+		case code.RegCurrentClosure:
+			regs[code.ReadUint16(ins[ip+1:])] = frame.cl
+			ip += 3
+
+		case code.RegAdd, code.RegSub, code.RegMul, code.RegDiv:
+			a, b, c := code.ReadUint16(ins[ip+1:]), code.ReadUint16(ins[ip+3:]), code.ReadUint16(ins[ip+5:])
+			result, err := binaryOperation(stackOps[op], rk(regs, constants, int(b)), rk(regs, constants, int(c)))
+			if err != nil {
+				return registerError(err, frames, frame, pc)
+			}
+			regs[a] = result
+			ip += 7
+
+		case code.RegGreaterThan, code.RegEqual, code.RegNotEqual:
+			a, b, c := code.ReadUint16(ins[ip+1:]), code.ReadUint16(ins[ip+3:]), code.ReadUint16(ins[ip+5:])
+			result, err := comparison(stackOps[op], rk(regs, constants, int(b)), rk(regs, constants, int(c)))
+			if err != nil {
+				return registerError(err, frames, frame, pc)
+			}
+			regs[a] = result
+			ip += 7
+
+		case code.RegMinus:
+			a, b := code.ReadUint16(ins[ip+1:]), code.ReadUint16(ins[ip+3:])
+			result, err := negate(rk(regs, constants, int(b)))
+			if err != nil {
+				return registerError(err, frames, frame, pc)
+			}
+			regs[a] = result
+			ip += 5
+
+		case code.RegBang:
+			a, b := code.ReadUint16(ins[ip+1:]), code.ReadUint16(ins[ip+3:])
+			regs[a] = nativeBoolToBooleanObject(!isTruthy(rk(regs, constants, int(b))))
+			ip += 5
+
+		case code.RegIndex:
+			a, b, c := code.ReadUint16(ins[ip+1:]), code.ReadUint16(ins[ip+3:]), code.ReadUint16(ins[ip+5:])
+			result, err := indexValue(rk(regs, constants, int(b)), rk(regs, constants, int(c)))
+			if err != nil {
+				return registerError(err, frames, frame, pc)
+			}
+			regs[a] = result
+			ip += 7
+
+		case code.RegArray:
+			a, b, n := code.ReadUint16(ins[ip+1:]), code.ReadUint16(ins[ip+3:]), code.ReadUint16(ins[ip+5:])
+			regs[a] = newArray(regs[b : b+n])
+			ip += 7
+
+		case code.RegHash:
+			a, b, n := code.ReadUint16(ins[ip+1:]), code.ReadUint16(ins[ip+3:]), code.ReadUint16(ins[ip+5:])
+			hash, err := newHash(regs[b : b+n])
+			if err != nil {
+				return registerError(err, frames, frame, pc)
+			}
+			regs[a] = hash
+			ip += 7
+
+		case code.RegClosure:
+			a, k := code.ReadUint16(ins[ip+1:]), code.ReadUint16(ins[ip+3:])
+			b, n := code.ReadUint16(ins[ip+5:]), code.ReadUint16(ins[ip+7:])
+			fn, ok := constants[k].(*object.CompiledFunction)
+			if !ok {
+				return registerError(fmt.Errorf("not a function: %+v", constants[k]), frames, frame, pc)
+			}
+			free := make([]object.Object, n)
+			copy(free, regs[b:b+n])
+			regs[a] = &object.Closure{Fn: fn, Free: free}
+			ip += 9
+
+		case code.RegCall:
+			a, b, n := code.ReadUint16(ins[ip+1:]), code.ReadUint16(ins[ip+3:]), code.ReadUint16(ins[ip+5:])
+			ip += 7
+
+			cl, ok := regs[b].(*object.Closure)
+			if !ok {
+				result, err := callNative(regs[b], regs[b+1:b+1+n])
+				if err != nil {
+					return registerError(err, frames, frame, pc)
+				}
+				regs[a] = result
+				continue
+			}
+
+			if int(n) != cl.Fn.NumParameters {
+				return registerError(wrongArgumentCount(cl.Fn, int(n)), frames, frame, pc)
+			}
+			if err := vm.checkCallDepth(len(frames)); err != nil {
+				return registerError(err, frames, frame, pc)
+			}
+			bp := frame.basePointer + int(b) + 1
+			if len(frames)+1 >= MaxFrames || bp+cl.Fn.NumLocals > RegisterStackSize {
+				return registerError(errStackOverflow, frames, frame, pc)
+			}
+
+			frame.ip = ip
+			frames = append(frames, frame)
+			frame = registerFrame{cl: cl, basePointer: bp, ret: int(a)}
+			ins, ip, regs = cl.Fn.Instructions, 0, vm.stack[bp:]
+
+		case code.RegTailCall:
+			b, n := code.ReadUint16(ins[ip+1:]), code.ReadUint16(ins[ip+3:])
+
+			cl, ok := regs[b].(*object.Closure)
+			if !ok {
+				result, err := callNative(regs[b], regs[b+1:b+1+n])
+				if err != nil {
+					return registerError(err, frames, frame, pc)
+				}
+				frame, ins, ip, regs = vm.returnRegisters(&frames, frame, result)
+				continue
+			}
+
+			if int(n) != cl.Fn.NumParameters {
+				return registerError(wrongArgumentCount(cl.Fn, int(n)), frames, frame, pc)
+			}
+			if frame.basePointer+cl.Fn.NumLocals > RegisterStackSize {
+				return registerError(errStackOverflow, frames, frame, pc)
+			}
+
+			// The callee and its arguments replace the caller's
+			copy(vm.stack[frame.basePointer-1:], regs[b:b+1+n])
+			frame.cl = cl
+			ins, ip = cl.Fn.Instructions, 0
+
+		case code.RegReturn:
+			result := rk(regs, constants, int(code.ReadUint16(ins[ip+1:])))
+			frame, ins, ip, regs = vm.returnRegisters(&frames, frame, result)
+
+		case code.RegReturnNull:
+			frame, ins, ip, regs = vm.returnRegisters(&frames, frame, Null)
+
+		case code.RegJump:
+			ip = int(code.ReadUint16(ins[ip+1:]))
+
+		case code.RegJumpNotTruthy:
+			b := code.ReadUint16(ins[ip+1:])
+			if isTruthy(rk(regs, constants, int(b))) {
+				ip += 5
+			} else {
+				ip = int(code.ReadUint16(ins[ip+3:]))
+			}
+
+		case code.RegPop:
+			vm.result = rk(regs, constants, int(code.ReadUint16(ins[ip+1:])))
+			ip += 3
+
+		default:
+			return registerError(fmt.Errorf("unknown register opcode %d", op), frames, frame, pc)
+		}
+	}
+
+	return nil
+}
+
+// returnRegisters returns result from frame to its caller, and returns the
+// caller's state to resume it with
+func (vm *VM) returnRegisters(frames *[]registerFrame, frame registerFrame, result object.Object) (
+	registerFrame, code.Instructions, int, []object.Object) {
+	if len(*frames) == 0 {
+		// Only the main program has no caller, and it does not return
+		vm.result = result
+		return frame, nil, 0, nil
+	}
+
+	caller := (*frames)[len(*frames)-1]
+	*frames = (*frames)[:len(*frames)-1]
+
+	regs := vm.stack[caller.basePointer:]
+	regs[frame.ret] = result
+	return caller, caller.cl.Fn.Instructions, caller.ip, regs
+}
+
+// callNative calls a builtin or a variant constructor, which run to
+// completion without a frame of their own. An error a builtin returns
+// is raised.
+func callNative(callee object.Object, args []object.Object) (object.Object, error) {
+	switch callee := callee.(type) {
+	case *object.Builtin:
+		result := callee.Fn(args...)
+		if err, ok := result.(*object.Error); ok {
+			return nil, err
+		}
+		if result == nil {
+			return Null, nil
+		}
+		return result, nil
+
+	case *object.VariantConstructor:
+		if len(args) != callee.Arity {
+			return nil, fmt.Errorf("wrong number of fields for %s.%s: want=%d, got=%d",
+				callee.Enum, callee.Name, callee.Arity, len(args))
+		}
+		fields := make([]object.Object, len(args))
+		copy(fields, args)
+		return &object.Variant{Enum: callee.Enum, Name: callee.Name, Fields: fields}, nil
+	}
+
+	return nil, fmt.Errorf("calling non-function")
+}
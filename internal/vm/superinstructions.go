@@ -0,0 +1,64 @@
+package vm
+
+import (
+	"github.com/TheAlchemistKE/helios/internal/code"
+	"github.com/TheAlchemistKE/helios/internal/object"
+)
+
+// The superinstructions share the helpers of the instructions they fuse, so
+// they compute the same results and fail with the same errors.
+
+// fusedOperator returns the operator a superinstruction applies
+func fusedOperator(op code.Opcode) code.Opcode {
+	switch op {
+	case code.OpLocalAddConstant:
+		return code.OpAdd
+	case code.OpLocalSubConstant:
+		return code.OpSub
+	case code.OpJumpNotEqual:
+		return code.OpEqual
+	default:
+		return code.OpGreaterThan
+	}
+}
+
+func (vm *VM) pushLocalPair(first, second int) error {
+	basePointer := vm.currentFrame().basePointer
+	err := vm.push(vm.stack[basePointer+first])
+	if err != nil {
+		return err
+	}
+	return vm.push(vm.stack[basePointer+second])
+}
+
+// executeLocalConstant pushes a local combined with a constant by the
+// operator op fuses
+func (vm *VM) executeLocalConstant(op code.Opcode, localIndex, constIndex int) error {
+	left := vm.stack[vm.currentFrame().basePointer+localIndex]
+	result, err := binaryOperation(fusedOperator(op), left, vm.constants[constIndex])
+	if err != nil {
+		return err
+	}
+	return vm.push(result)
+}
+
+// jumpUnlessCompared compares left and right with the operator op fuses and
+// jumps to pos unless the comparison holds
+func (vm *VM) jumpUnlessCompared(op code.Opcode, left, right object.Object, pos int) error {
+	result, err := comparison(fusedOperator(op), left, right)
+	if err != nil {
+		return err
+	}
+	if !isTruthy(result) {
+		vm.currentFrame().ip = pos - 1
+	}
+	return nil
+}
+
+func (vm *VM) returnLocal(localIndex int) error {
+	frame := vm.popFrame()
+	returnValue := vm.stack[frame.basePointer+localIndex]
+	vm.sp = frame.basePointer - 1
+
+	return vm.push(returnValue)
+}
@@ -0,0 +1,41 @@
+package vm
+
+import "github.com/TheAlchemistKE/helios/internal/object"
+
+// raise turns err into a runtime error raised with stack, innermost call
+// first. An error that is not already a runtime error is kept as its Cause.
+func raise(err error, stack []object.StackFrame) *object.Error {
+	if runtimeErr, ok := err.(*object.Error); ok {
+		return &object.Error{Message: runtimeErr.Message, Stack: stack}
+	}
+	return &object.Error{Message: err.Error(), Stack: stack, Cause: err}
+}
+
+// stackFrame describes a call to fn that has reached the instruction at ip
+func stackFrame(fn *object.CompiledFunction, ip int) object.StackFrame {
+	pos, _ := fn.Positions.Lookup(ip)
+	return object.StackFrame{Function: fn.Name, Position: pos}
+}
+
+// stackTrace returns the calls on the stack machine's stack, innermost
+// first. A frame's ip is within the instruction it is executing, which for
+// a caller is the call.
+func (vm *VM) stackTrace() []object.StackFrame {
+	stack := make([]object.StackFrame, 0, vm.framesIndex)
+	for i := vm.framesIndex - 1; i >= 0; i-- {
+		f := vm.frames[i]
+		stack = append(stack, stackFrame(f.cl.Fn, f.ip))
+	}
+	return stack
+}
+
+// registerError raises err in frame at the instruction at ip, with frames
+// the calls below it. A saved frame's ip is just past its call.
+func registerError(err error, frames []registerFrame, frame registerFrame, ip int) error {
+	stack := make([]object.StackFrame, 0, len(frames)+1)
+	stack = append(stack, stackFrame(frame.cl.Fn, ip))
+	for i := len(frames) - 1; i >= 0; i-- {
+		stack = append(stack, stackFrame(frames[i].cl.Fn, frames[i].ip-1))
+	}
+	return raise(err, stack)
+}
@@ -0,0 +1,80 @@
+package vm
+
+import (
+	"fmt"
+
+	"github.com/TheAlchemistKE/helios/internal/code"
+	"github.com/TheAlchemistKE/helios/internal/object"
+)
+
+// genericOperators maps each Int operator to the operator it specialises
+var genericOperators = map[code.Opcode]code.Opcode{
+	code.OpAddInt:         code.OpAdd,
+	code.OpSubInt:         code.OpSub,
+	code.OpMulInt:         code.OpMul,
+	code.OpDivInt:         code.OpDiv,
+	code.OpGreaterThanInt: code.OpGreaterThan,
+	code.OpEqualInt:       code.OpEqual,
+	code.OpNotEqualInt:    code.OpNotEqual,
+}
+
+// executeIntegerOperation applies an Int operator to the two values on top
+// of the stack. The compiler only emits these for operands it has proven to
+// be integers, but bytecode loaded from a file may not keep that promise, so
+// other operands fall back to the generic operator and its errors.
+func (vm *VM) executeIntegerOperation(op code.Opcode) error {
+	l, lok := vm.stack[vm.sp-2].(*object.Integer)
+	r, rok := vm.stack[vm.sp-1].(*object.Integer)
+	if !lok || !rok {
+		generic := genericOperators[op]
+		if generic == code.OpAdd || generic == code.OpSub || generic == code.OpMul || generic == code.OpDiv {
+			return vm.executeBinaryOperation(generic)
+		}
+		return vm.executeComparison(generic)
+	}
+	left, right := l.Value, r.Value
+
+	var result object.Object
+	switch op {
+	case code.OpAddInt:
+		result = &object.Integer{Value: left + right}
+	case code.OpSubInt:
+		result = &object.Integer{Value: left - right}
+	case code.OpMulInt:
+		result = &object.Integer{Value: left * right}
+	case code.OpDivInt:
+		if right == 0 {
+			return fmt.Errorf("division by zero")
+		}
+		result = &object.Integer{Value: left / right}
+	case code.OpGreaterThanInt:
+		result = nativeBoolToBooleanObject(left > right)
+	case code.OpEqualInt:
+		result = nativeBoolToBooleanObject(left == right)
+	case code.OpNotEqualInt:
+		result = nativeBoolToBooleanObject(left != right)
+	}
+
+	vm.sp--
+	vm.stack[vm.sp-1] = result
+	return nil
+}
+
+// checkType fails unless value has the type of the annotation at index
+func checkType(value object.Object, index int) error {
+	annotation := object.Annotations[index]
+	if value.Type() != annotation.Type {
+		return fmt.Errorf("type mismatch: want %s, got %s", annotation.Name, value.Type())
+	}
+	return nil
+}
+
+// checkParameter checks the argument of an annotated parameter
+func (vm *VM) checkParameter(localIndex, index int) error {
+	frame := vm.currentFrame()
+	err := checkType(vm.stack[frame.basePointer+localIndex], index)
+	if err != nil && localIndex < len(frame.cl.Fn.Parameters) {
+		return fmt.Errorf("parameter %s: %w", frame.cl.Fn.Parameters[localIndex], err)
+	}
+	return err
+}
@@ -0,0 +1,1304 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/TheAlchemistKE/helios/internal/code"
+	"github.com/TheAlchemistKE/helios/internal/compiler"
+	"github.com/TheAlchemistKE/helios/internal/object"
+)
+
+const StackSize = 2048
+
+// RegisterStackSize is the size of the stack of register code. A function
+// compiled to register code takes a register for each value it computes,
+// where stack code reuses the slots of its operand stack, so its frames are
+// larger, and its stack is sized to hold about as many calls.
+const RegisterStackSize = 4 * StackSize
+
+const GlobalsSize = compiler.GlobalsSize
+const MaxFrames = 1024
+
+var True = &object.Boolean{Value: true}
+var False = &object.Boolean{Value: false}
+var Null = object.NULL
+
+// VM executes compiled Helios bytecode on an operand stack
+type VM struct {
+	constants []object.Object
+
+	stack []object.Object
+	sp    int // Always points to the next free slot. Top of stack is stack[sp-1]
+
+	globals []object.Object
+
+	frames      []*Frame
+	framesIndex int
+
+	// backend is the instruction set of the bytecode. Register code keeps
+	// the result of the last expression statement in result.
+	backend compiler.Backend
+	result  object.Object
+
+	// ctx and limits bound the current run, with remaining the instructions
+	// it has left beyond those already granted, see RunContext
+	ctx       context.Context
+	limits    Limits
+	remaining int64
+}
+
+func New(bytecode *compiler.Bytecode) *VM {
+	mainFn := &object.CompiledFunction{
+		Instructions:  bytecode.Instructions,
+		MaxStackDepth: bytecode.MaxStackDepth,
+		Positions:     bytecode.Positions,
+	}
+	mainClosure := &object.Closure{Fn: mainFn}
+	mainFrame := NewFrame(mainClosure, 0)
+
+	stackSize := StackSize
+	if bytecode.Backend == compiler.RegisterBackend {
+		stackSize = RegisterStackSize
+	}
+
+	frames := make([]*Frame, MaxFrames)
+	frames[0] = mainFrame
+
+	return &VM{
+		constants: bytecode.Constants,
+
+		stack: make([]object.Object, stackSize),
+		sp:    0,
+
+		globals: make([]object.Object, GlobalsSize),
+
+		frames:      frames,
+		framesIndex: 1,
+
+		backend: bytecode.Backend,
+	}
+}
+
+func NewWithGlobalsStore(bytecode *compiler.Bytecode, s []object.Object) *VM {
+	vm := New(bytecode)
+	vm.globals = s
+	return vm
+}
+
+// LastPoppedStackElem returns the value most recently popped off the stack,
+// which is the result of the last expression statement
+func (vm *VM) LastPoppedStackElem() object.Object {
+	if vm.backend == compiler.RegisterBackend {
+		return vm.result
+	}
+	return vm.stack[vm.sp]
+}
+
+// Run executes the bytecode. A runtime error is returned as an *object.Error
+// holding the stack of calls that raised it.
+func (vm *VM) Run() error {
+	vm.ctx, vm.limits, vm.remaining = nil, Limits{}, 0
+	return vm.execute()
+}
+
+// execute runs the bytecode on the interpreter loop of its backend
+func (vm *VM) execute() error {
+	if vm.backend == compiler.RegisterBackend {
+		return vm.runRegisters()
+	}
+
+	err := vm.run()
+	if err != nil {
+		return raise(err, vm.stackTrace())
+	}
+	return nil
+}
+
+// run is the interpreter loop of stack code
+func (vm *VM) run() error {
+	var ip int
+	var ins code.Instructions
+	var op code.Opcode
+	var steps int64
+
+	if vm.currentFrame().cl.Fn.MaxStackDepth > StackSize {
+		return errStackOverflow
+	}
+
+	for vm.currentFrame().ip < len(vm.currentFrame().Instructions())-1 {
+		if steps == 0 {
+			if err := vm.checkLimits(); err != nil {
+				return err
+			}
+			steps = vm.grant()
+		}
+		steps--
+
+		vm.currentFrame().ip++
+
+		ip = vm.currentFrame().ip
+		ins = vm.currentFrame().Instructions()
+		op = code.Opcode(ins[ip])
+
+		switch op {
+		case code.OpConstant:
+			constIndex := code.ReadUint16(ins[ip+1:])
+			vm.currentFrame().ip += 2
+
+			err := vm.push(vm.constants[constIndex])
+			if err != nil {
+				return err
+			}
+
+		case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv:
+			err := vm.executeBinaryOperation(op)
+			if err != nil {
+				return err
+			}
+
+		case code.OpEqual, code.OpNotEqual, code.OpGreaterThan:
+			err := vm.executeComparison(op)
+			if err != nil {
+				return err
+			}
+
+		case code.OpBang:
+			err := vm.executeBangOperator()
+			if err != nil {
+				return err
+			}
+
+		case code.OpMinus:
+			err := vm.executeMinusOperator()
+			if err != nil {
+				return err
+			}
+
+		case code.OpTrue:
+			err := vm.push(True)
+			if err != nil {
+				return err
+			}
+
+		case code.OpFalse:
+			err := vm.push(False)
+			if err != nil {
+				return err
+			}
+
+		case code.OpNull:
+			err := vm.push(Null)
+			if err != nil {
+				return err
+			}
+
+		case code.OpPop:
+			vm.pop()
+
+		case code.OpJump:
+			pos := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip = pos - 1
+
+		case code.OpJumpNotTruthy:
+			pos := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			condition := vm.pop()
+			if !isTruthy(condition) {
+				vm.currentFrame().ip = pos - 1
+			}
+
+		case code.OpJumpSupplied:
+			localIndex := code.ReadUint8(ins[ip+1:])
+			pos := int(code.ReadUint16(ins[ip+2:]))
+			vm.currentFrame().ip += 3
+
+			if vm.currentFrame().supplied(int(localIndex)) {
+				vm.currentFrame().ip = pos - 1
+			}
+
+		case code.OpSetGlobal:
+			globalIndex := code.ReadUint16(ins[ip+1:])
+			vm.currentFrame().ip += 2
+
+			vm.globals[globalIndex] = vm.pop()
+
+		case code.OpGetGlobal:
+			globalIndex := code.ReadUint16(ins[ip+1:])
+			vm.currentFrame().ip += 2
+
+			global, err := vm.global(int(globalIndex))
+			if err != nil {
+				return err
+			}
+			err = vm.push(global)
+			if err != nil {
+				return err
+			}
+
+		case code.OpSetLocal:
+			localIndex := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			frame := vm.currentFrame()
+			vm.stack[frame.basePointer+int(localIndex)] = vm.pop()
+
+		case code.OpGetLocal:
+			localIndex := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			frame := vm.currentFrame()
+			err := vm.push(vm.stack[frame.basePointer+int(localIndex)])
+			if err != nil {
+				return err
+			}
+
+		case code.OpGetBuiltin:
+			builtinIndex := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			definition := object.Builtins[builtinIndex]
+			err := vm.push(definition.Builtin)
+			if err != nil {
+				return err
+			}
+
+		case code.OpGetFree:
+			freeIndex := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			currentClosure := vm.currentFrame().cl
+			err := vm.push(currentClosure.Free[freeIndex])
+			if err != nil {
+				return err
+			}
+
+		case code.OpArray:
+			numElements := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			err := vm.pushArray(numElements)
+			if err != nil {
+				return err
+			}
+
+		case code.OpHash:
+			numElements := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			err := vm.pushHash(numElements)
+			if err != nil {
+				return err
+			}
+
+		case code.OpIndex:
+			index := vm.pop()
+			left := vm.pop()
+
+			err := vm.executeIndexExpression(left, index)
+			if err != nil {
+				return err
+			}
+
+		case code.OpCall:
+			numArgs := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			err := vm.executeCall(int(numArgs))
+			if err != nil {
+				return err
+			}
+
+		case code.OpTailCall:
+			numArgs := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			err := vm.executeTailCall(int(numArgs))
+			if err != nil {
+				return err
+			}
+
+		case code.OpCallKeywords:
+			numArgs := code.ReadUint8(ins[ip+1:])
+			namesIndex := code.ReadUint16(ins[ip+2:])
+			vm.currentFrame().ip += 3
+
+			names := vm.constants[namesIndex].(*object.Array)
+			err := vm.executeKeywordCall(int(numArgs), names)
+			if err != nil {
+				return err
+			}
+
+		case code.OpTailCallKeywords:
+			numArgs := code.ReadUint8(ins[ip+1:])
+			namesIndex := code.ReadUint16(ins[ip+2:])
+			vm.currentFrame().ip += 3
+
+			names := vm.constants[namesIndex].(*object.Array)
+			err := vm.executeTailKeywordCall(int(numArgs), names)
+			if err != nil {
+				return err
+			}
+
+		case code.OpReturnValue:
+			returnValue := vm.pop()
+
+			frame := vm.popFrame()
+			vm.sp = frame.basePointer - 1
+
+			err := vm.push(returnValue)
+			if err != nil {
+				return err
+			}
+
+		case code.OpReturn:
+			frame := vm.popFrame()
+			vm.sp = frame.basePointer - 1
+
+			err := vm.push(Null)
+			if err != nil {
+				return err
+			}
+
+		case code.OpClosure:
+			constIndex := code.ReadUint16(ins[ip+1:])
+			numFree := code.ReadUint8(ins[ip+3:])
+			vm.currentFrame().ip += 3
+
+			err := vm.pushClosure(int(constIndex), int(numFree))
+			if err != nil {
+				return err
+			}
+
+		case code.OpSetFree:
+			freeIndex := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			err := vm.setFree(int(freeIndex))
+			if err != nil {
+				return err
+			}
+
+		case code.OpCurrentClosure:
+			currentClosure := vm.currentFrame().cl
+			err := vm.push(currentClosure)
+			if err != nil {
+				return err
+			}
+
+		case code.OpMatchVariant:
+			constIndex := code.ReadUint16(ins[ip+1:])
+			vm.currentFrame().ip += 2
+
+			err := vm.matchVariant(int(constIndex))
+			if err != nil {
+				return err
+			}
+
+		case code.OpMatchArray:
+			required := int(code.ReadUint16(ins[ip+1:]))
+			optional := int(code.ReadUint16(ins[ip+3:]))
+			hasRest := code.ReadUint8(ins[ip+5:]) == 1
+			vm.currentFrame().ip += 5
+
+			err := vm.matchArray(required, optional, hasRest)
+			if err != nil {
+				return err
+			}
+
+		case code.OpMatchHash:
+			numKeys := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			err := vm.matchHash(numKeys)
+			if err != nil {
+				return err
+			}
+
+		case code.OpSlice:
+			start := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			err := vm.slice(start)
+			if err != nil {
+				return err
+			}
+
+		case code.OpFail:
+			constIndex := code.ReadUint16(ins[ip+1:])
+			vm.currentFrame().ip += 2
+
+			return fmt.Errorf("%s", vm.constants[constIndex].Inspect())
+
+		case code.OpWide:
+			err := vm.executeWide(ins, ip)
+			if err != nil {
+				return err
+			}
+
+		case code.OpGetLocalPair:
+			first := code.ReadUint8(ins[ip+1:])
+			second := code.ReadUint8(ins[ip+2:])
+			vm.currentFrame().ip += 2
+
+			err := vm.pushLocalPair(int(first), int(second))
+			if err != nil {
+				return err
+			}
+
+		case code.OpLocalAddConstant, code.OpLocalSubConstant:
+			localIndex := code.ReadUint8(ins[ip+1:])
+			constIndex := code.ReadUint16(ins[ip+2:])
+			vm.currentFrame().ip += 3
+
+			err := vm.executeLocalConstant(op, int(localIndex), int(constIndex))
+			if err != nil {
+				return err
+			}
+
+		case code.OpJumpNotGreater, code.OpJumpNotEqual:
+			pos := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			right := vm.pop()
+			left := vm.pop()
+			err := vm.jumpUnlessCompared(op, left, right, pos)
+			if err != nil {
+				return err
+			}
+
+		case code.OpJumpLocalsNotGreater:
+			first := code.ReadUint8(ins[ip+1:])
+			second := code.ReadUint8(ins[ip+2:])
+			pos := int(code.ReadUint16(ins[ip+3:]))
+			vm.currentFrame().ip += 4
+
+			basePointer := vm.currentFrame().basePointer
+			left := vm.stack[basePointer+int(first)]
+			right := vm.stack[basePointer+int(second)]
+			err := vm.jumpUnlessCompared(op, left, right, pos)
+			if err != nil {
+				return err
+			}
+
+		case code.OpReturnLocal:
+			localIndex := code.ReadUint8(ins[ip+1:])
+
+			err := vm.returnLocal(int(localIndex))
+			if err != nil {
+				return err
+			}
+
+		case code.OpAddInt, code.OpSubInt, code.OpMulInt, code.OpDivInt,
+			code.OpGreaterThanInt, code.OpEqualInt, code.OpNotEqualInt:
+			err := vm.executeIntegerOperation(op)
+			if err != nil {
+				return err
+			}
+
+		case code.OpCheckType:
+			index := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			err := checkType(vm.stack[vm.sp-1], int(index))
+			if err != nil {
+				return err
+			}
+
+		case code.OpGetCallerLocal:
+			localIndex := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			err := vm.push(vm.stack[vm.callerFrame().basePointer+int(localIndex)])
+			if err != nil {
+				return err
+			}
+
+		case code.OpGetCallerFree:
+			freeIndex := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			err := vm.push(vm.callerFrame().cl.Free[freeIndex])
+			if err != nil {
+				return err
+			}
+
+		case code.OpCheckLocal:
+			localIndex := code.ReadUint8(ins[ip+1:])
+			index := code.ReadUint8(ins[ip+2:])
+			vm.currentFrame().ip += 2
+
+			err := vm.checkParameter(int(localIndex), int(index))
+			if err != nil {
+				return err
+			}
+
+		default:
+			def, err := code.Lookup(byte(op))
+			if err != nil {
+				return err
+			}
+			return fmt.Errorf("unsupported opcode %s", def.Name)
+		}
+	}
+
+	return nil
+}
+
+func (vm *VM) currentFrame() *Frame {
+	return vm.frames[vm.framesIndex-1]
+}
+
+// callerFrame returns the frame below the current one, that of the function
+// that called it
+func (vm *VM) callerFrame() *Frame {
+	return vm.frames[vm.framesIndex-2]
+}
+
+func (vm *VM) pushFrame(f *Frame) {
+	vm.frames[vm.framesIndex] = f
+	vm.framesIndex++
+}
+
+func (vm *VM) popFrame() *Frame {
+	vm.framesIndex--
+	return vm.frames[vm.framesIndex]
+}
+
+// global returns the global at index, failing if nothing was stored there,
+// which loaded bytecode can ask for but the compiler never does
+func (vm *VM) global(index int) (object.Object, error) {
+	if vm.globals[index] == nil {
+		return nil, fmt.Errorf("global %d read before it is set", index)
+	}
+	return vm.globals[index], nil
+}
+
+func (vm *VM) push(o object.Object) error {
+	if vm.sp >= StackSize {
+		return errStackOverflow
+	}
+
+	vm.stack[vm.sp] = o
+	vm.sp++
+
+	return nil
+}
+
+func (vm *VM) pop() object.Object {
+	o := vm.stack[vm.sp-1]
+	vm.sp--
+	return o
+}
+
+func (vm *VM) executeBinaryOperation(op code.Opcode) error {
+	right := vm.pop()
+	left := vm.pop()
+
+	result, err := binaryOperation(op, left, right)
+	if err != nil {
+		return err
+	}
+	return vm.push(result)
+}
+
+// binaryOperation computes an arithmetic operator. The register machine
+// shares it, and the other operator helpers below, with the stack machine.
+func binaryOperation(op code.Opcode, left, right object.Object) (object.Object, error) {
+	leftType := left.Type()
+	rightType := right.Type()
+
+	switch {
+	case leftType == object.INTEGER_OBJ && rightType == object.INTEGER_OBJ:
+		return binaryIntegerOperation(op, left, right)
+	case isNumber(left) && isNumber(right):
+		return binaryFloatOperation(op, left, right)
+	case leftType == object.STRING_OBJ && rightType == object.STRING_OBJ:
+		return binaryStringOperation(op, left, right)
+	default:
+		return nil, fmt.Errorf("unsupported types for binary operation: %s %s", leftType, rightType)
+	}
+}
+
+func binaryIntegerOperation(op code.Opcode, left, right object.Object) (object.Object, error) {
+	leftValue := left.(*object.Integer).Value
+	rightValue := right.(*object.Integer).Value
+
+	var result int64
+
+	switch op {
+	case code.OpAdd:
+		result = leftValue + rightValue
+	case code.OpSub:
+		result = leftValue - rightValue
+	case code.OpMul:
+		result = leftValue * rightValue
+	case code.OpDiv:
+		if rightValue == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		result = leftValue / rightValue
+	default:
+		return nil, fmt.Errorf("unknown integer operator: %d", op)
+	}
+
+	return &object.Integer{Value: result}, nil
+}
+
+func binaryFloatOperation(op code.Opcode, left, right object.Object) (object.Object, error) {
+	leftValue := toFloat(left)
+	rightValue := toFloat(right)
+
+	var result float64
+
+	switch op {
+	case code.OpAdd:
+		result = leftValue + rightValue
+	case code.OpSub:
+		result = leftValue - rightValue
+	case code.OpMul:
+		result = leftValue * rightValue
+	case code.OpDiv:
+		if rightValue == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		result = leftValue / rightValue
+	default:
+		return nil, fmt.Errorf("unknown float operator: %d", op)
+	}
+
+	return &object.Float{Value: result}, nil
+}
+
+func binaryStringOperation(op code.Opcode, left, right object.Object) (object.Object, error) {
+	if op != code.OpAdd {
+		return nil, fmt.Errorf("unknown string operator: %d", op)
+	}
+
+	leftValue := left.(*object.String).Value
+	rightValue := right.(*object.String).Value
+
+	return &object.String{Value: leftValue + rightValue}, nil
+}
+
+func (vm *VM) executeComparison(op code.Opcode) error {
+	right := vm.pop()
+	left := vm.pop()
+
+	result, err := comparison(op, left, right)
+	if err != nil {
+		return err
+	}
+	return vm.push(result)
+}
+
+func comparison(op code.Opcode, left, right object.Object) (object.Object, error) {
+	switch {
+	case left.Type() == object.INTEGER_OBJ && right.Type() == object.INTEGER_OBJ:
+		return integerComparison(op, left, right)
+	case isNumber(left) && isNumber(right):
+		return floatComparison(op, left, right)
+	case left.Type() == object.STRING_OBJ && right.Type() == object.STRING_OBJ:
+		return stringComparison(op, left, right)
+	case left.Type() == object.VARIANT_OBJ && right.Type() == object.VARIANT_OBJ && op != code.OpGreaterThan:
+		equal, err := variantsEqual(left.(*object.Variant), right.(*object.Variant))
+		if err != nil {
+			return nil, err
+		}
+		return nativeBoolToBooleanObject(equal == (op == code.OpEqual)), nil
+	}
+
+	switch op {
+	case code.OpEqual:
+		return nativeBoolToBooleanObject(right == left), nil
+	case code.OpNotEqual:
+		return nativeBoolToBooleanObject(right != left), nil
+	default:
+		return nil, fmt.Errorf("unknown operator: %d (%s %s)", op, left.Type(), right.Type())
+	}
+}
+
+// variantsEqual compares variants by value: they are equal if they are the
+// same case of the same enum and their fields are pairwise ==
+func variantsEqual(left, right *object.Variant) (bool, error) {
+	if left.Enum != right.Enum || left.Name != right.Name || len(left.Fields) != len(right.Fields) {
+		return false, nil
+	}
+
+	for i := range left.Fields {
+		result, err := comparison(code.OpEqual, left.Fields[i], right.Fields[i])
+		if err != nil {
+			return false, err
+		}
+		if result != True {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func integerComparison(op code.Opcode, left, right object.Object) (object.Object, error) {
+	leftValue := left.(*object.Integer).Value
+	rightValue := right.(*object.Integer).Value
+
+	switch op {
+	case code.OpEqual:
+		return nativeBoolToBooleanObject(rightValue == leftValue), nil
+	case code.OpNotEqual:
+		return nativeBoolToBooleanObject(rightValue != leftValue), nil
+	case code.OpGreaterThan:
+		return nativeBoolToBooleanObject(leftValue > rightValue), nil
+	default:
+		return nil, fmt.Errorf("unknown operator: %d", op)
+	}
+}
+
+func floatComparison(op code.Opcode, left, right object.Object) (object.Object, error) {
+	leftValue := toFloat(left)
+	rightValue := toFloat(right)
+
+	switch op {
+	case code.OpEqual:
+		return nativeBoolToBooleanObject(rightValue == leftValue), nil
+	case code.OpNotEqual:
+		return nativeBoolToBooleanObject(rightValue != leftValue), nil
+	case code.OpGreaterThan:
+		return nativeBoolToBooleanObject(leftValue > rightValue), nil
+	default:
+		return nil, fmt.Errorf("unknown operator: %d", op)
+	}
+}
+
+func stringComparison(op code.Opcode, left, right object.Object) (object.Object, error) {
+	if left == right && op != code.OpGreaterThan {
+		// Interned strings are the same object, no need to compare contents
+		return nativeBoolToBooleanObject(op == code.OpEqual), nil
+	}
+
+	leftValue := left.(*object.String).Value
+	rightValue := right.(*object.String).Value
+
+	switch op {
+	case code.OpEqual:
+		return nativeBoolToBooleanObject(rightValue == leftValue), nil
+	case code.OpNotEqual:
+		return nativeBoolToBooleanObject(rightValue != leftValue), nil
+	case code.OpGreaterThan:
+		return nativeBoolToBooleanObject(leftValue > rightValue), nil
+	default:
+		return nil, fmt.Errorf("unknown operator: %d", op)
+	}
+}
+
+func (vm *VM) executeBangOperator() error {
+	operand := vm.pop()
+	return vm.push(nativeBoolToBooleanObject(!isTruthy(operand)))
+}
+
+func (vm *VM) executeMinusOperator() error {
+	result, err := negate(vm.pop())
+	if err != nil {
+		return err
+	}
+	return vm.push(result)
+}
+
+func negate(operand object.Object) (object.Object, error) {
+	switch operand := operand.(type) {
+	case *object.Integer:
+		return &object.Integer{Value: -operand.Value}, nil
+	case *object.Float:
+		return &object.Float{Value: -operand.Value}, nil
+	default:
+		return nil, fmt.Errorf("unsupported type for negation: %s", operand.Type())
+	}
+}
+
+func (vm *VM) pushArray(numElements int) error {
+	array := vm.buildArray(vm.sp-numElements, vm.sp)
+	vm.sp = vm.sp - numElements
+
+	return vm.push(array)
+}
+
+func (vm *VM) pushHash(numElements int) error {
+	hash, err := vm.buildHash(vm.sp-numElements, vm.sp)
+	if err != nil {
+		return err
+	}
+	vm.sp = vm.sp - numElements
+
+	return vm.push(hash)
+}
+
+func (vm *VM) buildArray(startIndex, endIndex int) object.Object {
+	return newArray(vm.stack[startIndex:endIndex])
+}
+
+func (vm *VM) buildHash(startIndex, endIndex int) (object.Object, error) {
+	return newHash(vm.stack[startIndex:endIndex])
+}
+
+// newArray creates an array of a copy of elements
+func newArray(elements []object.Object) object.Object {
+	copied := make([]object.Object, len(elements))
+	copy(copied, elements)
+	return &object.Array{Elements: copied}
+}
+
+// newHash creates a hash of elements, taken as key and value pairs
+func newHash(elements []object.Object) (object.Object, error) {
+	hashedPairs := make(map[object.HashKey]object.HashPair)
+
+	for i := 0; i < len(elements); i += 2 {
+		key := elements[i]
+		value := elements[i+1]
+
+		pair := object.HashPair{Key: key, Value: value}
+
+		hashKey, ok := key.(object.Hashable)
+		if !ok {
+			return nil, fmt.Errorf("unusable as hash key: %s", key.Type())
+		}
+
+		hashedPairs[hashKey.HashKey()] = pair
+	}
+
+	return &object.Hash{Pairs: hashedPairs}, nil
+}
+
+// matchVariant replaces the value on top of the stack with whether it is
+// a value of the variant tagged by the constant at constIndex
+func (vm *VM) matchVariant(constIndex int) error {
+	variant, ok := vm.pop().(*object.Variant)
+	matched := ok && variant.Is(vm.constants[constIndex])
+
+	return vm.push(nativeBoolToBooleanObject(matched))
+}
+
+func (vm *VM) matchArray(required, optional int, hasRest bool) error {
+	array, ok := vm.pop().(*object.Array)
+	matched := ok && len(array.Elements) >= required &&
+		(hasRest || len(array.Elements) <= required+optional)
+
+	return vm.push(nativeBoolToBooleanObject(matched))
+}
+
+func (vm *VM) matchHash(numKeys int) error {
+	matched, err := vm.matchHashKeys(vm.sp-numKeys, vm.sp)
+	if err != nil {
+		return err
+	}
+	vm.sp = vm.sp - numKeys - 1
+
+	return vm.push(nativeBoolToBooleanObject(matched))
+}
+
+func (vm *VM) slice(start int) error {
+	array, ok := vm.pop().(*object.Array)
+	if !ok || start > len(array.Elements) {
+		return fmt.Errorf("cannot slice from %d", start)
+	}
+
+	elements := make([]object.Object, len(array.Elements)-start)
+	copy(elements, array.Elements[start:])
+
+	return vm.push(&object.Array{Elements: elements})
+}
+
+// matchHashKeys reports whether the value below the keys in
+// stack[startIndex:endIndex] is a hash containing every one of those keys
+func (vm *VM) matchHashKeys(startIndex, endIndex int) (bool, error) {
+	hash, ok := vm.stack[startIndex-1].(*object.Hash)
+	if !ok {
+		return false, nil
+	}
+
+	for i := startIndex; i < endIndex; i++ {
+		key, ok := vm.stack[i].(object.Hashable)
+		if !ok {
+			return false, fmt.Errorf("unusable as hash key: %s", vm.stack[i].Type())
+		}
+
+		if _, ok := hash.Pairs[key.HashKey()]; !ok {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+func (vm *VM) executeIndexExpression(left, index object.Object) error {
+	result, err := indexValue(left, index)
+	if err != nil {
+		return err
+	}
+	return vm.push(result)
+}
+
+func indexValue(left, index object.Object) (object.Object, error) {
+	switch {
+	case left.Type() == object.ARRAY_OBJ && index.Type() == object.INTEGER_OBJ:
+		return arrayIndex(left, index), nil
+	case left.Type() == object.HASH_OBJ:
+		return hashIndex(left, index)
+	case left.Type() == object.VARIANT_OBJ && index.Type() == object.INTEGER_OBJ:
+		return variantIndex(left, index)
+	default:
+		return nil, fmt.Errorf("index operator not supported: %s", left.Type())
+	}
+}
+
+func arrayIndex(array, index object.Object) object.Object {
+	arrayObject := array.(*object.Array)
+	i := index.(*object.Integer).Value
+	max := int64(len(arrayObject.Elements) - 1)
+
+	if i < 0 || i > max {
+		return Null
+	}
+
+	return arrayObject.Elements[i]
+}
+
+func hashIndex(hash, index object.Object) (object.Object, error) {
+	hashObject := hash.(*object.Hash)
+
+	key, ok := index.(object.Hashable)
+	if !ok {
+		return nil, fmt.Errorf("unusable as hash key: %s", index.Type())
+	}
+
+	pair, ok := hashObject.Pairs[key.HashKey()]
+	if !ok {
+		return Null, nil
+	}
+
+	return pair.Value, nil
+}
+
+func variantIndex(variant, index object.Object) (object.Object, error) {
+	variantObject := variant.(*object.Variant)
+	i := index.(*object.Integer).Value
+
+	if i < 0 || i >= int64(len(variantObject.Fields)) {
+		return nil, fmt.Errorf("variant %s has no field %d", variantObject.Name, i)
+	}
+
+	return variantObject.Fields[i], nil
+}
+
+func (vm *VM) executeCall(numArgs int) error {
+	callee := vm.stack[vm.sp-1-numArgs]
+	switch callee := callee.(type) {
+	case *object.Closure:
+		return vm.callClosure(callee, numArgs)
+	case *object.Builtin:
+		return vm.callBuiltin(callee, numArgs)
+	case *object.VariantConstructor:
+		return vm.callVariantConstructor(callee, numArgs)
+	default:
+		return fmt.Errorf("calling non-function")
+	}
+}
+
+// executeTailCall calls a closure in the caller's frame: the callee and its
+// arguments replace the caller's, so its result is returned to the caller's
+// caller. Builtins and constructors return to the caller as usual, which
+// returns their result with the OpReturnValue after the call.
+func (vm *VM) executeTailCall(numArgs int) error {
+	if !vm.leaveFrame(numArgs) {
+		return vm.executeCall(numArgs)
+	}
+	return vm.callClosure(vm.stack[vm.sp-1-numArgs].(*object.Closure), numArgs)
+}
+
+// executeTailKeywordCall is executeKeywordCall in the caller's frame, see
+// executeTailCall
+func (vm *VM) executeTailKeywordCall(numArgs int, names *object.Array) error {
+	vm.leaveFrame(numArgs + len(names.Elements))
+	return vm.executeKeywordCall(numArgs, names)
+}
+
+// leaveFrame pops the current frame for a tail call of the closure below
+// numArgs arguments, moving the closure and its arguments down to where the
+// frame's own callee was. It reports whether it did, which it does not at
+// the top level or for a callee that is not a closure or that reads its
+// caller's variables, as that needs the caller's frame.
+func (vm *VM) leaveFrame(numArgs int) bool {
+	cl, ok := vm.stack[vm.sp-1-numArgs].(*object.Closure)
+	if !ok || vm.framesIndex == 1 || cl.Fn.ReadsCaller {
+		return false
+	}
+
+	frame := vm.popFrame()
+	calleeSlot := frame.basePointer - 1
+	copy(vm.stack[calleeSlot:], vm.stack[vm.sp-1-numArgs:vm.sp])
+	vm.sp = calleeSlot + 1 + numArgs
+
+	return true
+}
+
+func (vm *VM) callClosure(cl *object.Closure, numArgs int) error {
+	fn := cl.Fn
+
+	var omitted []bool
+	if numArgs != fn.NumParameters || fn.Variadic {
+		args := make([]object.Object, numArgs)
+		copy(args, vm.stack[vm.sp-numArgs:vm.sp])
+
+		var slots []object.Object
+		var err error
+		slots, omitted, err = bindArguments(fn, args, nil, nil)
+		if err != nil {
+			return err
+		}
+
+		vm.sp = vm.sp - numArgs
+		for _, slot := range slots {
+			if err := vm.push(slot); err != nil {
+				return err
+			}
+		}
+		numArgs = len(slots)
+	}
+
+	return vm.enterFrame(cl, vm.sp-numArgs, omitted)
+}
+
+// executeKeywordCall calls the closure below numArgs positional arguments
+// and one value for each keyword in names
+func (vm *VM) executeKeywordCall(numArgs int, names *object.Array) error {
+	numKeywords := len(names.Elements)
+	total := numArgs + numKeywords
+
+	cl, ok := vm.stack[vm.sp-1-total].(*object.Closure)
+	if !ok {
+		return fmt.Errorf("keyword arguments not supported by %s",
+			vm.stack[vm.sp-1-total].Type())
+	}
+
+	args := make([]object.Object, numArgs)
+	copy(args, vm.stack[vm.sp-total:vm.sp-numKeywords])
+
+	keywords := make([]string, numKeywords)
+	for i, name := range names.Elements {
+		keywords[i] = name.(*object.String).Value
+	}
+	values := make([]object.Object, numKeywords)
+	copy(values, vm.stack[vm.sp-numKeywords:vm.sp])
+
+	slots, omitted, err := bindArguments(cl.Fn, args, keywords, values)
+	if err != nil {
+		return err
+	}
+
+	vm.sp = vm.sp - total
+	for _, slot := range slots {
+		if err := vm.push(slot); err != nil {
+			return err
+		}
+	}
+
+	return vm.enterFrame(cl, vm.sp-len(slots), omitted)
+}
+
+// enterFrame starts executing cl with its locals at basePointer, omitted
+// marking the parameters whose arguments were not passed. The space
+// for the callee's locals and its deepest operand stack is reserved here, so
+// a call that could overflow the stack fails before it starts.
+func (vm *VM) enterFrame(cl *object.Closure, basePointer int, omitted []bool) error {
+	if err := vm.checkCallDepth(vm.framesIndex - 1); err != nil {
+		return err
+	}
+	if vm.framesIndex >= MaxFrames ||
+		basePointer+cl.Fn.NumLocals+cl.Fn.MaxStackDepth > StackSize {
+		return errStackOverflow
+	}
+
+	frame := NewFrame(cl, basePointer)
+	frame.omitted = omitted
+	vm.pushFrame(frame)
+	vm.sp = basePointer + cl.Fn.NumLocals
+
+	return nil
+}
+
+// bindArguments assigns positional and keyword arguments to fn's parameter
+// slots. Omitted parameters with defaults are set to null and marked in
+// omitted, which OpJumpSupplied tests for the function's prologue to fill
+// them in, and surplus positional arguments of a variadic
+// function are collected into an array in the final slot.
+func bindArguments(
+	fn *object.CompiledFunction,
+	args []object.Object,
+	keywords []string,
+	values []object.Object,
+) (slots []object.Object, omitted []bool, err error) {
+	required := fn.NumParameters - fn.NumDefaults
+
+	if len(args) > fn.NumParameters && !fn.Variadic {
+		if fn.NumDefaults == 0 {
+			return nil, nil, fmt.Errorf("wrong number of arguments: want=%d, got=%d",
+				fn.NumParameters, len(args))
+		}
+		return nil, nil, fmt.Errorf("wrong number of arguments: want at most %d, got=%d",
+			fn.NumParameters, len(args))
+	}
+
+	numSlots := fn.NumParameters
+	if fn.Variadic {
+		numSlots++
+	}
+	slots = make([]object.Object, numSlots)
+
+	for i := 0; i < len(args) && i < fn.NumParameters; i++ {
+		slots[i] = args[i]
+	}
+
+	for i, keyword := range keywords {
+		index := -1
+		for j, param := range fn.Parameters {
+			if param == keyword {
+				index = j
+				break
+			}
+		}
+
+		if index == -1 {
+			return nil, nil, fmt.Errorf("unexpected keyword argument %s", keyword)
+		}
+		if slots[index] != nil {
+			return nil, nil, fmt.Errorf("multiple values for argument %s", keyword)
+		}
+		slots[index] = values[i]
+	}
+
+	for i := 0; i < fn.NumParameters; i++ {
+		if slots[i] != nil {
+			continue
+		}
+		if i < required {
+			if len(keywords) == 0 {
+				return nil, nil, wrongArgumentCount(fn, len(args))
+			}
+			return nil, nil, fmt.Errorf("missing argument %s", fn.Parameters[i])
+		}
+		slots[i] = Null
+		if omitted == nil {
+			omitted = make([]bool, fn.NumParameters)
+		}
+		omitted[i] = true
+	}
+
+	if fn.Variadic {
+		rest := []object.Object{}
+		if len(args) > fn.NumParameters {
+			rest = append(rest, args[fn.NumParameters:]...)
+		}
+		slots[fn.NumParameters] = &object.Array{Elements: rest}
+	}
+
+	return slots, omitted, nil
+}
+
+func wrongArgumentCount(fn *object.CompiledFunction, got int) error {
+	required := fn.NumParameters - fn.NumDefaults
+	if fn.NumDefaults == 0 && !fn.Variadic {
+		return fmt.Errorf("wrong number of arguments: want=%d, got=%d", required, got)
+	}
+	return fmt.Errorf("wrong number of arguments: want at least %d, got=%d", required, got)
+}
+
+// callBuiltin calls builtin with the numArgs values on top of the stack. An
+// error it returns is raised rather than pushed.
+func (vm *VM) callBuiltin(builtin *object.Builtin, numArgs int) error {
+	args := vm.stack[vm.sp-numArgs : vm.sp]
+
+	result := builtin.Fn(args...)
+	if err, ok := result.(*object.Error); ok {
+		return err
+	}
+	vm.sp = vm.sp - numArgs - 1
+
+	if result != nil {
+		return vm.push(result)
+	}
+	return vm.push(Null)
+}
+
+func (vm *VM) callVariantConstructor(ctor *object.VariantConstructor, numArgs int) error {
+	if numArgs != ctor.Arity {
+		return fmt.Errorf("wrong number of fields for %s.%s: want=%d, got=%d",
+			ctor.Enum, ctor.Name, ctor.Arity, numArgs)
+	}
+
+	fields := make([]object.Object, numArgs)
+	copy(fields, vm.stack[vm.sp-numArgs:vm.sp])
+	vm.sp = vm.sp - numArgs - 1
+
+	return vm.push(&object.Variant{Enum: ctor.Enum, Name: ctor.Name, Fields: fields})
+}
+
+func (vm *VM) setFree(freeIndex int) error {
+	value := vm.pop()
+	closure, ok := vm.pop().(*object.Closure)
+	if !ok {
+		return fmt.Errorf("cannot set free variable of non-closure")
+	}
+	if freeIndex >= len(closure.Free) {
+		return fmt.Errorf("free variable %d out of range, closure has %d", freeIndex, len(closure.Free))
+	}
+	closure.Free[freeIndex] = value
+	return nil
+}
+
+func (vm *VM) pushClosure(constIndex int, numFree int) error {
+	constant := vm.constants[constIndex]
+	function, ok := constant.(*object.CompiledFunction)
+	if !ok {
+		return fmt.Errorf("not a function: %+v", constant)
+	}
+
+	free := make([]object.Object, numFree)
+	for i := 0; i < numFree; i++ {
+		free[i] = vm.stack[vm.sp-numFree+i]
+	}
+	vm.sp = vm.sp - numFree
+
+	closure := &object.Closure{Fn: function, Free: free}
+	return vm.push(closure)
+}
+
+func nativeBoolToBooleanObject(input bool) *object.Boolean {
+	if input {
+		return True
+	}
+	return False
+}
+
+func isTruthy(obj object.Object) bool {
+	switch obj := obj.(type) {
+	case *object.Boolean:
+		return obj.Value
+	case *object.Null:
+		return false
+	default:
+		return true
+	}
+}
+
+func isNumber(obj object.Object) bool {
+	return obj.Type() == object.INTEGER_OBJ || obj.Type() == object.FLOAT_OBJ
+}
+
+func toFloat(obj object.Object) float64 {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		return float64(obj.Value)
+	case *object.Float:
+		return obj.Value
+	}
+	return 0
+}
@@ -0,0 +1,1287 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TheAlchemistKE/helios/internal/ast"
+	"github.com/TheAlchemistKE/helios/internal/code"
+	"github.com/TheAlchemistKE/helios/internal/compiler"
+	"github.com/TheAlchemistKE/helios/internal/lexer"
+	"github.com/TheAlchemistKE/helios/internal/object"
+	"github.com/TheAlchemistKE/helios/internal/parser"
+)
+
+type vmTestCase struct {
+	input    string
+	expected interface{}
+}
+
+func TestIntegerArithmetic(t *testing.T) {
+	tests := []vmTestCase{
+		{"1", 1},
+		{"1 + 2", 3},
+		{"50 / 2 * 2 + 10 - 5", 55},
+		{"5 * (2 + 10)", 60},
+		{"-50 + 100 + -50", 0},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestBooleanExpressions(t *testing.T) {
+	tests := []vmTestCase{
+		{"true", true},
+		{"1 < 2", true},
+		{"1 > 2", false},
+		{"1 == 1", true},
+		{"1 != 1", false},
+		{"(1 < 2) == true", true},
+		{"!true", false},
+		{"!!5", true},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestConditionals(t *testing.T) {
+	tests := []vmTestCase{
+		{"if (true) { 10 }", 10},
+		{"if (1 > 2) { 10 } else { 20 }", 20},
+		{"if (1 > 2) { 10 }", Null},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestGlobalLetStatements(t *testing.T) {
+	tests := []vmTestCase{
+		{"let one = 1; one", 1},
+		{"let one = 1; let two = one + one; one + two", 3},
+		{"let x = 1; let x = x + 1; x", 2},
+		{"let f = fn(x) { let x = x * 2; x }; f(3)", 6},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestStringExpressions(t *testing.T) {
+	tests := []vmTestCase{
+		{`"mon" + "key"`, "monkey"},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestArrayAndHashLiterals(t *testing.T) {
+	tests := []vmTestCase{
+		{"[1, 2 + 3][1]", 5},
+		{"[1, 2, 3][99]", Null},
+		{"{1: 1, 2: 2}[2]", 2},
+		{`{"a": 5}["a"]`, 5},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestCallingFunctions(t *testing.T) {
+	tests := []vmTestCase{
+		{"let fivePlusTen = fn() { 5 + 10; }; fivePlusTen();", 15},
+		{"let sum = fn(a, b) { a + b; }; sum(1, 2);", 3},
+		{"let noReturn = fn() { }; noReturn();", Null},
+		{"let early = fn() { return 99; 100; }; early();", 99},
+		{`len([1, 2, 3])`, 3},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestFunctionParameters(t *testing.T) {
+	tests := []vmTestCase{
+		{"let f = fn(a, b = 10) { a + b }; f(1)", 11},
+		{"let f = fn(a, b = 10) { a + b }; f(1, 2)", 3},
+		{"let f = fn(a, b = a * 2) { a + b }; f(3)", 9},
+		// An explicit null is an argument like any other
+		{"let f = fn(a, b = 10) { b }; f(1, null)", Null},
+		{"let f = fn(a, b = 10) { b }; f(1, b: null)", Null},
+		{"let f = fn(a, b = 2, c = 3) { if (c == null) { b } else { 0 } }; f(1, c: null)", 2},
+		{"let f = fn(...args) { len(args) }; f()", 0},
+		{"let f = fn(...args) { len(args) }; f(1, 2, 3)", 3},
+		{"let f = fn(a, ...rest) { rest }; f(1, 2, 3)[1]", 3},
+		{"let f = fn(a, b = 5, ...rest) { b + len(rest) }; f(1)", 5},
+		{"let f = fn(a, b) { a - b }; f(b: 1, a: 10)", 9},
+		{"let f = fn(a, b = 2, c = 3) { a * 100 + b * 10 + c }; f(1, c: 9)", 129},
+		{"let f = fn(a, ...rest) { a + len(rest) }; f(4, 5, 6)", 6},
+		{
+			input: `
+let outer = fn(k) {
+    let add = fn(x, y = k) { x + y };
+    add(1) + add(1, 1)
+};
+outer(5);
+`,
+			expected: 8,
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestFunctionArityErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"fn(a, b) { a }(1)", "wrong number of arguments: want=2, got=1"},
+		{"fn(a) { a }(1, 2)", "wrong number of arguments: want=1, got=2"},
+		{"fn(a, b = 1) { a }()", "wrong number of arguments: want at least 1, got=0"},
+		{"fn(a, b = 1) { a }(1, 2, 3)", "wrong number of arguments: want at most 2, got=3"},
+		{"fn(a, ...rest) { a }()", "wrong number of arguments: want at least 1, got=0"},
+		{"fn(a, b) { a }(1, c: 2)", "unexpected keyword argument c"},
+		{"fn(a, b) { a }(1, a: 2)", "multiple values for argument a"},
+		{"fn(a, b) { a }(b: 2)", "missing argument a"},
+		{"len(x: [])", "keyword arguments not supported by BUILTIN"},
+		{"let f = fn(a) { a }; fn() { f() }()", "wrong number of arguments: want=1, got=0"},
+		{"fn() { 1() }()", "calling non-function"},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+		err = vm.Run()
+		if err == nil {
+			t.Fatalf("expected VM error but resulted in none.")
+		}
+
+		if err.Error() != tt.expected {
+			t.Errorf("wrong VM error: want=%q, got=%q", tt.expected, err)
+		}
+	}
+}
+
+func TestStackOverflow(t *testing.T) {
+	inputs := []string{
+		"let f = fn(n) { f(n + 1) + 1 }; f(0)",
+		"let f = fn(n, m = 1) { f(n: n + m) + 1 }; f(0)",
+		"let g = fn(n, qa = 1, qaa = 1) { if (n == 0) { 0 } else { 1 + g(n - 1) } }; g(100000)",
+		"let g = fn(n, ...rest) { if (n == 0) { 0 } else { 1 + g(n - 1, n, n) } }; g(100000)",
+	}
+
+	for _, input := range inputs {
+		comp := compiler.New()
+		err := comp.Compile(parse(input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+		err = vm.Run()
+		var limitErr *LimitError
+		if !errors.As(err, &limitErr) || !errors.Is(err, ErrStackOverflow) {
+			t.Errorf("%q: expected stack overflow, got %v", input, err)
+		}
+	}
+}
+
+func TestStackTraces(t *testing.T) {
+	input := `let g = fn(xs) {
+  first(xs)
+};
+let f = fn(x) {
+  g(x) + 1
+};
+f(5);`
+
+	expected := []object.StackFrame{
+		{Function: "g", Position: code.Position{Line: 2, Column: 8}},
+		{Function: "f", Position: code.Position{Line: 5, Column: 4}},
+		{Function: "", Position: code.Position{Line: 7, Column: 2}},
+	}
+
+	for _, opts := range []compiler.Options{
+		{},
+		{FoldConstants: true, Peephole: true, EliminateDeadCode: true, Superinstructions: true},
+		{Backend: compiler.RegisterBackend},
+	} {
+		comp := compiler.NewWithOptions(opts)
+		err := comp.Compile(parse(input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+		err = vm.Run()
+
+		runtimeErr, ok := err.(*object.Error)
+		if !ok {
+			t.Fatalf("%+v: expected *object.Error, got %T (%v)", opts, err, err)
+		}
+		if runtimeErr.Message != "argument to `first` must be ARRAY, got INTEGER" {
+			t.Errorf("%+v: wrong message: %q", opts, runtimeErr.Message)
+		}
+		if !reflect.DeepEqual(runtimeErr.Stack, expected) {
+			t.Errorf("%+v: wrong stack:\n%s", opts, runtimeErr.Trace())
+		}
+	}
+}
+
+func TestStackTraceRecursion(t *testing.T) {
+	comp := compiler.New()
+	err := comp.Compile(parse("let f = fn(n) { if (n == 0) { first(n) } else { f(n - 1) + 1 } }; f(10)"))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(comp.Bytecode())
+	err = vm.Run()
+
+	runtimeErr, ok := err.(*object.Error)
+	if !ok {
+		t.Fatalf("expected *object.Error, got %T (%v)", err, err)
+	}
+
+	expected := `Traceback (most recent call last):
+  at 1:68 in <main>
+  at 1:50 in f
+  at 1:50 in f
+  at 1:50 in f
+  [previous frame repeated 7 more times]
+  at 1:36 in f
+error: argument to ` + "`first` must be ARRAY, got INTEGER"
+	if trace := runtimeErr.Trace(); trace != expected {
+		t.Errorf("wrong trace:\n%s\nwant:\n%s", trace, expected)
+	}
+}
+
+func TestRunContext(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		input    string
+		ctx      context.Context
+		limits   Limits
+		expected error
+	}{
+		{"let f = fn() { f() }; f()", context.Background(), Limits{Instructions: 10000}, ErrInstructionLimit},
+		{"let f = fn(n) { f(n + 1) + 1 }; f(0)", context.Background(), Limits{CallDepth: 100}, ErrCallDepthLimit},
+		{"let f = fn() { f() }; f()", cancelled, Limits{}, context.Canceled},
+		{"1 + 2", cancelled, Limits{}, context.Canceled},
+	}
+
+	for _, opts := range []compiler.Options{{}, {Backend: compiler.RegisterBackend}} {
+		for _, tt := range tests {
+			comp := compiler.NewWithOptions(opts)
+			err := comp.Compile(parse(tt.input))
+			if err != nil {
+				t.Fatalf("compiler error: %s", err)
+			}
+
+			vm := New(comp.Bytecode())
+			err = vm.RunContext(tt.ctx, tt.limits)
+
+			var limitErr *LimitError
+			if !errors.As(err, &limitErr) || !errors.Is(err, tt.expected) {
+				t.Errorf("%+v: %q: expected %v, got %v", opts, tt.input, tt.expected, err)
+			}
+		}
+	}
+}
+
+func TestRunContextTimeout(t *testing.T) {
+	comp := compiler.New()
+	err := comp.Compile(parse("let f = fn(n) { f(n + 1) }; f(0)"))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	vm := New(comp.Bytecode())
+	err = vm.RunContext(ctx, Limits{})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestRunContextInternalError(t *testing.T) {
+	// The constant is out of range, which Run would panic on
+	bytecode := &compiler.Bytecode{
+		Instructions:  append(code.Make(code.OpConstant, 5), code.Make(code.OpPop)...),
+		MaxStackDepth: 1,
+	}
+
+	vm := New(bytecode)
+	err := vm.RunContext(context.Background(), Limits{})
+
+	var internalErr *InternalError
+	if !errors.As(err, &internalErr) || !errors.Is(err, ErrInternal) {
+		t.Fatalf("expected an internal error, got %v", err)
+	}
+}
+
+func TestIntegerOperationTypes(t *testing.T) {
+	// Bytecode that was not compiled may apply an Int operator to
+	// anything, so it gets the errors of the generic operator
+	tests := []struct {
+		op       code.Opcode
+		expected string
+	}{
+		{code.OpAddInt, "unsupported types for binary operation: BOOLEAN BOOLEAN"},
+		{code.OpGreaterThanInt, "unknown operator: 10 (BOOLEAN BOOLEAN)"},
+	}
+
+	for _, tt := range tests {
+		var ins code.Instructions
+		ins = append(ins, code.Make(code.OpTrue)...)
+		ins = append(ins, code.Make(code.OpTrue)...)
+		ins = append(ins, code.Make(tt.op)...)
+		ins = append(ins, code.Make(code.OpPop)...)
+		bytecode := &compiler.Bytecode{Instructions: ins, MaxStackDepth: 2}
+		if errs := compiler.Verify(bytecode); len(errs) != 0 {
+			t.Fatalf("verify errors: %v", errs)
+		}
+
+		vm := New(bytecode)
+		err := vm.Run()
+		if err == nil || !strings.Contains(err.Error(), tt.expected) {
+			t.Errorf("expected error %q, got %v", tt.expected, err)
+		}
+	}
+}
+
+func TestUnsetGlobal(t *testing.T) {
+	stack := &compiler.Bytecode{
+		Instructions:  append(code.Make(code.OpGetGlobal, 5), code.Make(code.OpPop)...),
+		MaxStackDepth: 1,
+	}
+	register := &compiler.Bytecode{
+		Instructions:  append(code.MakeRegister(code.RegGetGlobal, 0, 5), code.MakeRegister(code.RegReturnNull)...),
+		MaxStackDepth: 1,
+		Backend:       compiler.RegisterBackend,
+	}
+
+	for _, bytecode := range []*compiler.Bytecode{stack, register} {
+		vm := New(bytecode)
+		err := vm.Run()
+		if err == nil || !strings.Contains(err.Error(), "global 5 read before it is set") {
+			t.Errorf("expected an unset global error, got %v", err)
+		}
+	}
+}
+
+func TestRunContextLimits(t *testing.T) {
+	tests := []struct {
+		input  string
+		limits Limits
+	}{
+		// OpConstant, OpConstant, OpAdd and OpPop
+		{"1 + 2", Limits{Instructions: 4}},
+		{"let f = fn(n) { if (n == 0) { 0 } else { f(n - 1) + 1 } }; f(10)", Limits{CallDepth: 11}},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+		err = vm.RunContext(context.Background(), tt.limits)
+		if err != nil {
+			t.Errorf("%q: within %+v, got %v", tt.input, tt.limits, err)
+		}
+
+		over := tt.limits
+		if over.Instructions > 0 {
+			over.Instructions--
+		}
+		if over.CallDepth > 0 {
+			over.CallDepth--
+		}
+
+		vm = New(comp.Bytecode())
+		err = vm.RunContext(context.Background(), over)
+		var limitErr *LimitError
+		if !errors.As(err, &limitErr) {
+			t.Errorf("%q: expected a LimitError over %+v, got %v", tt.input, over, err)
+		}
+	}
+}
+
+func TestWideOperands(t *testing.T) {
+	// table returns an array of rows arrays of 1000 distinct integers, which
+	// is too many constants for narrow operands but never deep on the stack
+	table := func(rows int) string {
+		items := []string{}
+		for r := 0; r < rows; r++ {
+			row := make([]string, 1000)
+			for i := range row {
+				row[i] = fmt.Sprint(r*1000 + i)
+			}
+			items = append(items, "["+strings.Join(row, ", ")+"]")
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	}
+
+	args := strings.TrimSuffix(strings.Repeat("0, ", 300), ", ")
+
+	locals := []string{}
+	for i := 0; i < 300; i++ {
+		locals = append(locals, fmt.Sprintf("let v%s = %d;", letters(i), i))
+	}
+
+	tests := []vmTestCase{
+		{"let a = " + table(70) + "; a[69][999]", 69999},
+		{"fn() { " + strings.Join(locals, " ") + " v" + letters(299) + " + v" + letters(3) + " }()", 302},
+		{"let f = fn(...args) { len(args) }; f(" + args + ")", 300},
+		{"let x = if (len([]) == 0) { " + table(25) + " } else { [1] }; x[24][999]", 24999},
+		{"let x = if (len([1]) == 0) { " + table(25) + " } else { [1] }; x[0]", 1},
+		{globals(GlobalsSize) + "ga + g" + letters(GlobalsSize-1), GlobalsSize - 1},
+	}
+
+	runVmTests(t, tests)
+
+	comp := compiler.New()
+	err := comp.Compile(parse(globals(GlobalsSize + 1)))
+	expected := fmt.Sprintf("program too large: %d globals exceed the limit of %d", GlobalsSize+1, GlobalsSize)
+	if err == nil || err.Error() != expected {
+		t.Errorf("expected %q, got %v", expected, err)
+	}
+}
+
+// globals returns a program that defines n globals, ga holding 0 and so on
+func globals(n int) string {
+	var out strings.Builder
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&out, "let g%s = %d; ", letters(i), i)
+	}
+	return out.String()
+}
+
+// TestOptimisations runs each input with the plain compiler and with each of
+// the option sets it is listed under, which must all give the same result
+func TestOptimisations(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []compiler.Options
+		inputs  []string
+	}{
+		{
+			name: "constant folding",
+			options: []compiler.Options{
+				{FoldConstants: true},
+			},
+			inputs: []string{
+				"2 * 60 * 60",
+				"-(1 + 2.5) * 2",
+				`"a" + "b" == "ab"`,
+				"7 / 2 + 7.0 / 2",
+				"1 < 2 == !(3 > 4)",
+				"let x = 4; (x - 1 * 1) * 1 / 1",
+				"if (1 > 2) { 10 } else { 20 }",
+				"if (null) { 10 }",
+				"if (0) { let y = 1; }",
+				"1 / 0",
+				"1.5 / 0",
+				`"a" * 1`,
+				`let s = "a"; s * 1`,
+				"-true",
+			},
+		},
+		{
+			name: "peephole",
+			options: []compiler.Options{
+				{Peephole: true},
+				{Peephole: true, FoldConstants: true},
+			},
+			inputs: []string{
+				"if (true) { 10 }; 3333",
+				"if (false) { 10 }",
+				"let f = fn(x) { if (x) { if (x) { 1 } else { 2 } } else { 3 } }; [f(true), f(false), f(null)]",
+				"let f = fn() { 1; 2; true; f }; f() == f",
+				"let f = fn(x) { if (x > 1) { x } }; [f(1), f(2)]",
+				"let f = fn(n) { if (n == 0) { 0 } else { n + f(n - 1) } }; f(10)",
+				"let x = 5; if (x > 1) { if (x > 2) { if (x > 3) { x } } }",
+				"let f = fn() { if (0) { 1 } else { 2 } }; f()",
+				"let f = fn() { if (null) { 1 } }; f()",
+				"if (1 > 2) { 10 } else { 20 }",
+			},
+		},
+		{
+			name: "dead code",
+			options: []compiler.Options{
+				{EliminateDeadCode: true},
+				{EliminateDeadCode: true, Peephole: true, FoldConstants: true},
+			},
+			inputs: []string{
+				"let f = fn(x) { let a = 1; let b = fn() { x }; let c = x + 1; 5; x; return a; 99 }; f(2)",
+				"let f = fn(x) { if (x) { return 1 } else { return 2 }; x }; [f(true), f(false)]",
+				"let f = fn(x) { if (x) { return 1; 5 } }; [f(true), f(false)]",
+				"let f = fn(x) { let y = x + 1; return 0 }; f(true)",
+				"let f = fn(x) { -x; 1 }; f(true)",
+				"let f = fn() { let g = fn(n) { if (n == 0) { return 0 }; n + g(n - 1) }; g(5) }; f()",
+				"let f = fn(x) { match (x) { 1 => { return 10 }, _ => 20 } }; [f(1), f(2)]",
+				"if (true) { 10 }; 3333",
+			},
+		},
+		{
+			name: "inlining",
+			options: []compiler.Options{
+				{Inline: true},
+				{Inline: true, FoldConstants: true, Peephole: true, EliminateDeadCode: true},
+			},
+			inputs: []string{
+				"let sq = fn(x) { x * x }; sq(3) + sq(4)",
+				"let g = 10; let f = fn(x, y) { x - y + g }; let h = fn() { let g = 1; f(2, g) }; h()",
+				"let g = 1; let f = fn() { g }; let g = 2; [f(), g]",
+				"let f = fn(x) { if (x > 1) { x * 2 } }; [f(1), f(2)]",
+				"let f = fn(xs) { len(xs) + first(xs) }; f([5, 6])",
+				"let f = fn(x) { [x, {x: x}] }; f(1)[1][1]",
+				"let f = fn(a, b) { a / b }; f(1, 0)",
+				"let f = fn(x) { x }; f(1, 2)",
+				"let f = fn(x) { x }; let g = fn(x) { f(x) + f(x) }; g(g(2))",
+				"let f = fn() { }; f()",
+				"let run = fn(n) { let twice = fn(x) { x * 2 }; let k = fn() { twice(n) }; twice(n) + k() }; run(4)",
+				"let sum = fn(n, acc) { let add = fn(a, b) { a + b }; if (n == 0) { return acc; } sum(n - 1, add(acc, n)) }; sum(10, 0)",
+			},
+		},
+		{
+			name: "superinstructions",
+			options: []compiler.Options{
+				{Superinstructions: true},
+				{Superinstructions: true, Peephole: true, EliminateDeadCode: true, FoldConstants: true},
+				{Superinstructions: true, SSA: true},
+			},
+			inputs: []string{
+				"let f = fn(a, b) { if (a > b) { a + 1 } else { b - 1 } }; [f(1, 2), f(2, 1), f(1.5, 1), f(2, 2)]",
+				"let f = fn(a, b) { if (a > b) { 1 } else { 2 } }; f(\"b\", \"a\")",
+				"let f = fn(a, b) { if (a > b) { 1 } else { 2 } }; f(true, 1)",
+				"let f = fn(a) { a + 1 }; f(\"x\")",
+				"let f = fn(a) { a - 1 }; [f(1), f(0.5)]",
+				"let f = fn(a) { a + \"!\" }; f(\"hi\")",
+				"let f = fn(n) { if (n == 0) { n } else { 2 } }; [f(0), f(1), f(null), f([])]",
+				"let f = fn(a, b) { if (a == b) { 1 } else { 2 } }; [f(true, true), f(null, false), f(\"a\", \"a\")]",
+				"let f = fn(a, b) { if (a + 0 > b - 0) { 1 } }; [f(3, 2), f(2, 3)]",
+				"let f = fn(a, b) { [a, b, b, a] }; f(1, 2)",
+				"let f = fn(a) { a }; f(5)",
+				"let f = fn(a, b) { (if (a) { a } else { b }) + 1 }; [f(1, 2), f(false, 2)]",
+				"let fib = fn(n) { if (n < 2) { n } else { fib(n - 1) + fib(n - 2) } }; fib(15)",
+				"let sum = fn(n, acc) { if (n == 0) { acc } else { sum(n - 1, acc + n) } }; sum(10000, 0)",
+				"let count = fn(lo, hi) { if (hi > lo) { 1 + count(lo + 1, hi) } else { 0 } }; count(0, 100)",
+			},
+		},
+		{
+			name: "escape analysis",
+			options: []compiler.Options{
+				{EscapeAnalysis: true},
+				{EscapeAnalysis: true, FoldConstants: true, Peephole: true, EliminateDeadCode: true, Inline: true, Superinstructions: true},
+			},
+			inputs: []string{
+				"let f = fn(k) { let add = fn(x) { x + k }; add(1) + add(2) }; f(10)",
+				// A tail call to a closure that reads its caller is a plain call
+				"let f = fn(k) { let add = fn(x) { x + k }; add(1) }; f(10)",
+				"let f = fn(k) { let add = fn(x) { x + k }; if (k > 5) { add(1) } else { add(-1) } }; [f(10), f(1)]",
+				"let f = fn(k) { let add = fn(x) { x + k }; add }; f(10)(5)",
+				// The closure reads a free variable of its caller
+				"let make = fn(k) { fn(n) { let scale = fn(x) { x * k }; scale(n) + scale(1) } }; make(3)(4)",
+				// Closures within a closure that reads its caller
+				"let f = fn(k) { let g = fn(x) { let h = fn(y) { x + y + k }; h(1) + [fn() { k }][0]() }; g(2) }; f(10)",
+				"let f = fn(k) { let g = fn(x) { x + k }; let k = 100; g(1) + k }; f(10)",
+				"let f = fn(k) { fn inc(x) { x + k } fn dec(x) { x - k } inc(dec(5)) + inc(x: 1) }; f(2)",
+				"let f = fn(k) { let add = fn(x, y = k) { x + y }; [add(1), add(1, 2)] }; f(10)",
+				"let f = fn(k) { let add = fn(x) { x + k }; add(1, 2) }; f(10)",
+				"let f = fn(k) { let g = fn(x) { if (x == 0) { k } else { 0 } }; g(0) + g(1) }; f(7)",
+				"let f = fn(n) { let go = fn(x) { x + n }; if (n == 0) { 0 } else { go(f(n - 1)) } }; f(50)",
+				"let f = fn(n, acc) { let add = fn(x) { acc + x }; if (n == 0) { acc } else { f(n - 1, add(n)) } }; f(2000, 0)",
+			},
+		},
+		{
+			name: "SSA",
+			options: []compiler.Options{
+				{SSA: true},
+				{SSA: true, FoldConstants: true, Peephole: true, EliminateDeadCode: true, Inline: true},
+			},
+			inputs: []string{
+				"1 + 2 * 3; 4",
+				"let x = 2 * 3; let y = x - 1; [x, y, -y, !y]",
+				`"a" + "b" == "ab"`,
+				"1 / 0",
+				"-true",
+				"if (1 < 2) { 10 } else { 20 }",
+				"if (false) { 10 }",
+				"let f = fn(x) { if (x > 1) { x * 2 } }; [f(1), f(2)]",
+				"let abs = fn(n) { if (n < 0) { -n } else { n } }; abs(-3) + abs(3)",
+				"let f = fn(a, b) { let t = a; let u = b; [u, t] }; f(1, 2)",
+				"let f = fn() { let a = first([1]); let b = len([2]); [b, a] }; f()",
+				"let order = fn() { let a = [1]; let b = push(a, 2); let c = push(b, 3); [c, b, a] }; order()",
+				"let fact = fn(n) { if (n == 0) { return 1; } n * fact(n - 1) }; fact(10)",
+				"let sum = fn(n, acc) { if (n == 0) { acc } else { sum(n - 1, acc + n) } }; sum(100000, 0)",
+				"fn even(n) { if (n == 0) { true } else { odd(n - 1) } } fn odd(n) { if (n == 0) { false } else { even(n - 1) } } [even(10), odd(7)]",
+				"let counter = fn(start) { let step = 2; fn(n) { start + n * step } }; counter(10)(3)",
+				"let outer = fn(a) { fn(b) { fn(c) { a + b + c } } }; outer(1)(2)(3)",
+				"let f = fn(c) { let x = if (c) { 1 } else { 2 }; let y = if (!c) { 3 } else { 4 }; x * 10 + y }; [f(true), f(false)]",
+				"let f = fn(a, b) { if (a) { if (b) { 1 } else { 2 } } else { 3 } }; [f(true, true), f(true, false), f(false, true)]",
+				"let f = fn(x) { if (if (x) { false } else { true }) { 1 } else { 2 } }; [f(true), f(false)]",
+				`{"b": 2, "a": 1}["a"] + [1, 2, 3][2]`,
+				"let g = 1; let f = fn() { g }; let g = 2; [f(), g]",
+				"let x = 1; let x = x + 1; x",
+				"let y = 1; let f = fn() { let y = y + 1; y }; f()",
+				"let f = fn() { let y = y + 1; y }; f()",
+				"let f = fn(x) { x }; f(1, 2)",
+				"let f = fn() { }; f()",
+				"let f = fn() { let x = 1; 2; x }; f()",
+				"let f = fn() { if (true) { return 1; } 2 }; f()",
+				"match (1) { 1 => 2, _ => 3 }",
+			},
+		},
+		{
+			name: "register backend",
+			options: []compiler.Options{
+				{Backend: compiler.RegisterBackend},
+			},
+			inputs: []string{
+				"1 + 2 * 3; 4",
+				"let x = 2 * 3; let y = x - 1; [x, y, -y, !y]",
+				`"a" + "b" == "ab"`,
+				"1 / 0",
+				"1.5 * 2 > 2",
+				"-true",
+				`"a" - "b"`,
+				"if (1 < 2) { 10 } else { 20 }",
+				"if (false) { 10 }",
+				"[true == true, null != false, [] == []]",
+				"let f = fn(x) { if (x > 1) { x * 2 } }; [f(1), f(2)]",
+				"let f = fn(a, b) { let t = a; let u = b; [u, t] }; f(1, 2)",
+				"let f = fn() { let a = first([1]); let b = len([2]); [b, a] }; f()",
+				"let fact = fn(n) { if (n == 0) { return 1; } n * fact(n - 1) }; fact(10)",
+				"let fib = fn(n) { if (n < 2) { n } else { fib(n - 1) + fib(n - 2) } }; fib(15)",
+				"let sum = fn(n, acc) { if (n == 0) { acc } else { sum(n - 1, acc + n) } }; sum(100000, 0)",
+				"let deep = fn(n) { if (n == 0) { 0 } else { 1 + deep(n - 1) } }; deep(100000)",
+				"let deep = fn(n) { if (n == 0) { 0 } else { 1 + deep(n - 1) } }; deep(500)",
+				"fn even(n) { if (n == 0) { true } else { odd(n - 1) } } fn odd(n) { if (n == 0) { false } else { even(n - 1) } } [even(10), odd(7)]",
+				"let outer = fn(a) { fn(b) { fn(c) { a + b + c } } }; outer(1)(2)(3)",
+				"let f = fn(c) { let x = if (c) { 1 } else { 2 }; let y = if (!c) { 3 } else { 4 }; x * 10 + y }; [f(true), f(false)]",
+				"let f = fn(a, b) { if (a) { if (b) { 1 } else { 2 } } else { 3 } }; [f(true, true), f(true, false), f(false, true)]",
+				`{"b": 2, "a": 1}["a"] + [1, 2, 3][2]`,
+				`{[1]: 2}`,
+				"[1, 2][5]",
+				"let g = 1; let f = fn() { g }; let g = 2; [f(), g]",
+				"let x = 1; let x = x + 1; x",
+				"let y = 1; let f = fn() { let y = y + 1; y }; f()",
+				"let f = fn() { let y = y + 1; y }; f()",
+				"let f = fn(x) { x }; f(1, 2)",
+				"let f = fn(x) { len(x) }; f([1, 2, 3])",
+				"let f = fn() { }; f()",
+				"1(2)",
+				"let f = fn() { if (true) { return 1; } 2 }; f()",
+				"match (1) { 1 => 2, _ => 3 }",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		for _, input := range tt.inputs {
+			plain := runWithOptions(t, input, compiler.Options{})
+			for _, opts := range tt.options {
+				got := runWithOptions(t, input, opts)
+				if plain != got {
+					t.Errorf("%s: %q: %+v changed the result. want=%s, got=%s", tt.name, input, opts, plain, got)
+				}
+			}
+		}
+	}
+}
+
+func TestSpecialiseIntegers(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"let f = fn(a: int, b: int) { a + b }; f(1, 2)", "3"},
+		{`let f = fn(a: int, b: int) { a + b }; f(1, "x")`, "error: parameter b: type mismatch: want int, got STRING"},
+		{"let f = fn(a: int, b: int) { a + b }; f(1.5, 2)", "error: parameter a: type mismatch: want int, got FLOAT"},
+		{"let f = fn(a: int, b: int = 10) { a * b }; [f(2), f(2, 3)]", "[20, 6]"},
+		{"let f = fn(a: int = 1.5) { a }; f()", "error: parameter a: type mismatch: want int, got FLOAT"},
+		{"let f = fn(a: int, b: int) { a - b }; f(b: 1, a: 5)", "4"},
+		{"let f = fn(a: int) { 10 / a }; f(0)", "error: division by zero"},
+		{
+			"let f = fn(a: int, b: int) { [a / b, a - b, a * b, a == b, a != b, a > b, a < b] }; [f(7, -2), f(-3, -3)]",
+			"[[-3, 9, -14, false, true, true, false], [1, 0, 9, true, false, false, false]]",
+		},
+		{"let f = fn(x) { let n: int = x; n + 1 }; f(1)", "2"},
+		{"let f = fn(x) { let n: int = x; n + 1 }; f(true)", "error: type mismatch: want int, got BOOLEAN"},
+		{"let f = fn(x) { let n: int = x; 1 }; f(\"s\")", "error: type mismatch: want int, got STRING"},
+		{"let f: int = fn() { 1 }; f", "error: type mismatch: want int, got CLOSURE"},
+		{"let f = fn(x: float) { x * 2.0 }; [f(1.5), f(2)]", "error: parameter x: type mismatch: want float, got INTEGER"},
+		{`let b: bool = 1 < 2; let s: string = "a" + "b"; [b, s]`, "[true, ab]"},
+		{"let x = 5; let y = x * x - 1; let z = -x + y; [y / x, z > y, z, y == 24]", "[4, false, 19, true]"},
+		{"let make = fn(n: int) { fn(m: int) { n * m } }; make(6)(7)", "42"},
+		{"let sum = fn(n: int, acc: int) { if (n == 0) { acc } else { sum(n - 1, acc + n) } }; sum(10000, 0)", "50005000"},
+		{"let fib = fn(n: int) { if (n < 2) { n } else { fib(n - 1) + fib(n - 2) } }; fib(15)", "610"},
+		{"let count = fn(lo: int, hi: int) { if (hi > lo) { 1 + count(lo + 1, hi) } else { 0 } }; count(0, 100)", "100"},
+	}
+
+	for _, tt := range tests {
+		for _, opts := range []compiler.Options{
+			{},
+			{SpecialiseIntegers: true},
+			{SpecialiseIntegers: true, FoldConstants: true, Peephole: true, EliminateDeadCode: true, Inline: true, Superinstructions: true},
+			{SpecialiseIntegers: true, SSA: true},
+			{SpecialiseIntegers: true, Backend: compiler.RegisterBackend},
+		} {
+			got := runWithOptions(t, tt.input, opts)
+			if got != tt.expected {
+				t.Errorf("%q with %+v: want=%s, got=%s", tt.input, opts, tt.expected, got)
+			}
+		}
+	}
+}
+
+func TestRegisterBackend(t *testing.T) {
+	comp := compiler.NewWithOptions(compiler.Options{Backend: compiler.RegisterBackend})
+	err := comp.Compile(parse("let f = fn(x) { x * 2 }; f(21)"))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	if backend := comp.Bytecode().Backend; backend != compiler.RegisterBackend {
+		t.Errorf("wrong backend. want=%s, got=%s", compiler.RegisterBackend, backend)
+	}
+}
+
+// runWithOptions compiles and runs input, returning its result or the error
+// compiling or running it as a string
+func runWithOptions(t *testing.T, input string, opts compiler.Options) string {
+	t.Helper()
+
+	comp := compiler.NewWithOptions(opts)
+	err := comp.Compile(parse(input))
+	if err != nil {
+		return "compiler error: " + err.Error()
+	}
+
+	for _, violation := range compiler.Verify(comp.Bytecode()) {
+		t.Errorf("verifier: %s\n%s", violation, input)
+	}
+
+	vm := New(comp.Bytecode())
+	err = vm.Run()
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	return vm.LastPoppedStackElem().Inspect()
+}
+
+func TestClosures(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			input: `
+let newAdder = fn(a, b) {
+    fn(c) { a + b + c };
+};
+let adder = newAdder(1, 2);
+adder(8);
+`,
+			expected: 11,
+		},
+		{
+			input: `
+let fibonacci = fn(x) {
+    if (x == 0) { return 0; }
+    if (x == 1) { return 1; }
+    fibonacci(x - 1) + fibonacci(x - 2);
+};
+fibonacci(15);
+`,
+			expected: 610,
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestRecursiveFunctions(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			input: `
+fn fact(n) { if (n < 2) { 1 } else { n * fact(n - 1) } }
+fact(5);
+`,
+			expected: 120,
+		},
+		{
+			input: `
+let wrapper = fn() {
+    let countDown = fn(x) { if (x == 0) { return 0; } countDown(x - 1) };
+    countDown(3);
+};
+wrapper();
+`,
+			expected: 0,
+		},
+		{
+			input: `
+let parity = fn(x) {
+    fn even(n) { if (n == 0) { true } else { odd(n - 1) } }
+    fn odd(n) { if (n == 0) { false } else { even(n - 1) } }
+    [even(x), odd(x)]
+};
+parity(7);
+`,
+			expected: []interface{}{false, true},
+		},
+		{
+			input: `
+let isEven = fn(n) { if (n == 0) { true } else { isOdd(n - 1) } };
+let isOdd = fn(n) { if (n == 0) { false } else { isEven(n - 1) } };
+isEven(10);
+`,
+			expected: true,
+		},
+		{
+			input: `
+let outer = fn(step) {
+    let down = fn(n) { if (n < 1) { 0 } else { 1 + up(n - step) } };
+    let up = fn(n) { fn() { down(n) }() };
+    down(10)
+};
+outer(2);
+`,
+			expected: 5,
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestTailCalls(t *testing.T) {
+	// Each of these recurses far deeper than MaxFrames
+	tests := []vmTestCase{
+		{
+			input: `
+let sum = fn(n, acc) { if (n == 0) { return acc; } sum(n - 1, acc + n) };
+sum(100000, 0);
+`,
+			expected: 5000050000,
+		},
+		{
+			input: `
+let counter = fn(step) {
+    let count = fn(n, acc) { if (n == 0) { acc } else { count(n - 1, acc + step) } };
+    count
+};
+counter(3)(50000, 0);
+`,
+			expected: 150000,
+		},
+		{
+			input: `
+fn even(n) { if (n == 0) { return true; } odd(n - 1) }
+fn odd(n) { if (n == 0) { return false; } even(n - 1) }
+[even(20001), odd(20001)];
+`,
+			expected: []interface{}{false, true},
+		},
+		{
+			input: `
+let total = fn(xs, acc) { if (len(xs) == 0) { return acc; } total(rest(xs), acc + first(xs)) };
+total([1, 2, 3, 4], 0);
+`,
+			expected: 10,
+		},
+		{
+			input: `
+let spread = fn(n, ...rest) { if (n == 0) { return len(rest); } spread(n - 1, n, n) };
+spread(5000);
+`,
+			expected: 2,
+		},
+		{
+			input:    "let count = fn(n) { if (n > 0) { count(n - 1) } else { n } }; count(100000)",
+			expected: 0,
+		},
+		{
+			input:    "let count = fn(n) { match (n) { 0 => n, _ => count(n - 1) } }; count(100000)",
+			expected: 0,
+		},
+		{
+			input:    "let count = fn(n, acc = 0) { if (n == 0) { return acc; } count(n - 1, acc: acc + 1) }; count(100000)",
+			expected: 100000,
+		},
+		{
+			input:    "let size = fn(xs) { len(xs) }; size([1, 2]) + 1",
+			expected: 3,
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestImports(t *testing.T) {
+	modules := compiler.MapResolver{
+		"lib/math": `
+let x = 1;
+export let pi = 3;
+export fn square(n) { n * n }
+export fn area(r) { pi * square(r) }
+`,
+		"geometry": `
+import "lib/math";
+let x = 2;
+export fn circle(r) { math.area(r) + x }
+`,
+		"shapes": `
+export enum Shape { Circle(r), Rect(w, h), Empty }
+export fn area(s) { match s { Circle(r) => 3 * r * r, Rect(w, h) => w * h, Empty => 0 } }
+`,
+	}
+
+	tests := []vmTestCase{
+		{`import "lib/math"; math.square(4)`, 16},
+		{`import "lib/math"; math.area(2)`, 12},
+		{`let x = 10; import "lib/math"; x + math.pi`, 13},
+		{`import "geometry"; import "lib/math"; geometry.circle(1) + math.pi`, 8},
+		{`import g "geometry"; let f = fn() { g.circle(2) }; f()`, 14},
+		{`import "lib/math"; let ns = math; ns["pi"]`, 3},
+		{`let point = {"x": 4}; point.x`, 4},
+		{`import "shapes"; match shapes.Rect(2, 3) { shapes.Circle(r) => r, shapes.Rect(w, h) => w * h, shapes.Empty => 0 }`, 6},
+		{`import "shapes"; match shapes.Empty { shapes.Circle(r) => r, shapes.Empty => -1 }`, -1},
+		{`import s "shapes"; let f = fn(x) { match x { s.Circle(r) => r, _ => 0 } }; f(s.Circle(5)) + s.area(s.Circle(1))`, 8},
+	}
+
+	for _, opts := range []compiler.Options{{}, {Peephole: true, Inline: true, Superinstructions: true}} {
+		for _, tt := range tests {
+			comp := compiler.NewWithResolverOptions(modules, "main", opts)
+			err := comp.Compile(parse(tt.input))
+			if err != nil {
+				t.Fatalf("%+v: compiler error: %s", opts, err)
+			}
+
+			vm := New(comp.Bytecode())
+			err = vm.Run()
+			if err != nil {
+				t.Fatalf("%+v: vm error: %s", opts, err)
+			}
+
+			testExpectedObject(t, tt.expected, vm.LastPoppedStackElem())
+		}
+	}
+}
+
+func TestDecodedBytecode(t *testing.T) {
+	tests := []vmTestCase{
+		{"let f = fn(a, b = 2) { a * b }; f(21)", 42},
+		{`enum T { A(x), B } match A(1.5) { A(x) => x > 1.0, B => false }`, true},
+		{`let g = fn(...xs) { len(xs) }; g(1, 2, 3)`, 3},
+		{`let h = fn(a, b) { a + b }; h(b: "y", a: "x")`, "xy"},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		data, err := comp.Bytecode().MarshalBinary()
+		if err != nil {
+			t.Fatalf("encode error: %s", err)
+		}
+
+		bytecode := &compiler.Bytecode{}
+		err = bytecode.UnmarshalBinary(data)
+		if err != nil {
+			t.Fatalf("decode error: %s", err)
+		}
+
+		vm := New(bytecode)
+		err = vm.Run()
+		if err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+
+		testExpectedObject(t, tt.expected, vm.LastPoppedStackElem())
+	}
+}
+
+func TestEnums(t *testing.T) {
+	shape := `
+enum Shape { Circle(r), Rect(w, h), Empty }
+let area = fn(s) {
+    match s {
+        Circle(r) => 3 * r * r,
+        Rect(w, h) => w * h,
+        Empty => 0,
+    }
+};
+`
+
+	tests := []vmTestCase{
+		{shape + "area(Circle(2))", 12},
+		{shape + "area(Rect(3, 4))", 12},
+		{shape + "area(Empty)", 0},
+		{shape + "match Rect(1, 2) { Circle(r) => r }", Null},
+		{shape + "match Rect(1, 2) { Rect(_, h) => h }", 2},
+		{shape + "match Circle(Rect(5, 6)) { Circle(Rect(w, h)) => w + h, _ => 0 }", 11},
+		{shape + "match Circle(Empty) { Circle(Rect(w, h)) => w + h, _ => 0 }", 0},
+		{shape + "match 5 { Circle(r) => r, other => other }", 5},
+		// Variants compare by value, fields as == compares them
+		{shape + "Rect(1, 2) == Rect(1, 2)", true},
+		{shape + "Rect(1, 2) != Rect(1, 2.0)", false},
+		{shape + "Rect(1, 2) == Rect(2, 1)", false},
+		{shape + "Circle(Empty) == Circle(Empty)", true},
+		{shape + "Circle(Rect(1, 2)) != Circle(Rect(1, 3))", true},
+		{shape + "Circle(1) == Rect(1, 1)", false},
+		{shape + "Circle([1]) == Circle([1])", false},
+		{shape + "let a = [1]; Circle(a) == Circle(a)", true},
+		{shape + "Circle(1) == 1", false},
+		{shape + "match [Circle(2)] { [x] if x == Circle(2) => 1, _ => 0 }", 1},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestMatchPatterns(t *testing.T) {
+	tests := []vmTestCase{
+		{`match 2 { 1 => "one", 2 => "two", _ => "many" }`, "two"},
+		{`match 7 { 1 => "one", 2 => "two", _ => "many" }`, "many"},
+		{`match "b" { "a" => 1, "b" => 2 }`, 2},
+		{`match null { null => 1, _ => 2 }`, 1},
+		{`match -3 { -3 => true, _ => false }`, true},
+		{`match 2.5 { 2.5 => 1, _ => 0 }`, 1},
+		{"match [] { [] => 0, [x, ..rest] => x }", 0},
+		{"match [4, 5, 6] { [] => 0, [x, ..rest] => len(rest) }", 2},
+		{"match [4, 5] { [a, b, c] => 3, [a, b] => a + b }", 9},
+		{"match [4, 5] { [a] => a, [a, ..] => a * 10 }", 40},
+		{"match [[1, 2], 3] { [[a, b], c] => a + b + c }", 6},
+		{"match 5 { [x] => x }", Null},
+		{`match {"name": "ada", "age": 36} { {"name": n, age} => age }`, 36},
+		{`match {"name": "ada"} { {name, age} => age, {name} => name }`, "ada"},
+		{`match {1: [7]} { {1: [x]} => x }`, 7},
+		{`match [1, 2] { {a} => a, _ => 0 }`, 0},
+		{"match 15 { x if x > 10 => x * 2, x => x }", 30},
+		{"match 5 { x if x > 10 => x * 2, x => x }", 5},
+		{"let x = 1; match 5 { x => x }; x", 1},
+		{"let f = fn(x) { let y = match 5 { x => x * 2 }; x + y }; f(1)", 11},
+		{"match [1] { [x] => x }; let x = 2; x", 2},
+		{
+			input: `
+let sum = fn(xs) {
+    match xs {
+        [] => 0,
+        [head, ..tail] => head + sum(tail),
+    }
+};
+sum([1, 2, 3, 4]);
+`,
+			expected: 10,
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestDestructuringLet(t *testing.T) {
+	tests := []vmTestCase{
+		{"let [a, b] = [1, 2]; a + b", 3},
+		{"let [a, b, ..rest] = [1, 2, 3, 4]; len(rest)", 2},
+		{"let [a, b = 10] = [1]; a + b", 11},
+		{"let [a, b = 10] = [1, 2]; a + b", 3},
+		{`let {name, age} = {"name": "ada", "age": 36}; name`, "ada"},
+		{`let {name, age = 30} = {"name": "ada"}; age`, 30},
+		{"let [[b, c] = [5, 6]] = []; b + c", 11},
+		{`let {p: {x, y} = {"x": 1, "y": 2}} = {}; x + y`, 3},
+		{"match [] { [[b, c] = [5, 6]] => b * c }", 30},
+		{`let {"n": n, tags: [first, ..]} = {"n": 1, "tags": [7, 8]}; n + first`, 8},
+		{
+			input: `
+let f = fn(pair) {
+    let [x, y] = pair;
+    x * y
+};
+f([6, 7]);
+`,
+			expected: 42,
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestDestructuringErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"let [a, b] = [1];", "value does not match pattern [a, b]"},
+		{"let [a] = 5;", "value does not match pattern [a]"},
+		{`let {name} = {"age": 1};`, "value does not match pattern {name: name}"},
+		{"let [a, 2] = [1, 3];", "value does not match pattern [a, 2]"},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+		err = vm.Run()
+		if err == nil {
+			t.Fatalf("expected VM error but resulted in none.")
+		}
+
+		if err.Error() != tt.expected {
+			t.Errorf("wrong VM error: want=%q, got=%q", tt.expected, err)
+		}
+	}
+}
+
+func TestVariantConstructorArity(t *testing.T) {
+	program := parse("enum Shape { Rect(w, h) } Rect(1)")
+
+	comp := compiler.New()
+	err := comp.Compile(program)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(comp.Bytecode())
+	err = vm.Run()
+	if err == nil {
+		t.Fatalf("expected VM error but resulted in none.")
+	}
+
+	expected := "wrong number of fields for Shape.Rect: want=2, got=1"
+	if err.Error() != expected {
+		t.Fatalf("wrong VM error: want=%q, got=%q", expected, err)
+	}
+}
+
+func runVmTests(t *testing.T, tests []vmTestCase) {
+	t.Helper()
+
+	for _, tt := range tests {
+		program := parse(tt.input)
+
+		comp := compiler.New()
+		err := comp.Compile(program)
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		for _, violation := range compiler.Verify(comp.Bytecode()) {
+			t.Errorf("verifier: %s\n%s", violation, tt.input)
+		}
+
+		vm := New(comp.Bytecode())
+		err = vm.Run()
+		if err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+
+		stackElem := vm.LastPoppedStackElem()
+
+		testExpectedObject(t, tt.expected, stackElem)
+	}
+}
+
+// letters spells i in base 26 with the letters a to z, to name variables
+func letters(i int) string {
+	name := string(rune('a' + i%26))
+	if i >= 26 {
+		name = letters(i/26-1) + name
+	}
+	return name
+}
+
+func parse(input string) *ast.Program {
+	l := lexer.New(input)
+	p := parser.New(l)
+	return p.ParseProgram()
+}
+
+func testExpectedObject(
+	t *testing.T,
+	expected interface{},
+	actual object.Object,
+) {
+	t.Helper()
+
+	switch expected := expected.(type) {
+	case int:
+		err := testIntegerObject(int64(expected), actual)
+		if err != nil {
+			t.Errorf("testIntegerObject failed: %s", err)
+		}
+
+	case bool:
+		err := testBooleanObject(expected, actual)
+		if err != nil {
+			t.Errorf("testBooleanObject failed: %s", err)
+		}
+
+	case string:
+		err := testStringObject(expected, actual)
+		if err != nil {
+			t.Errorf("testStringObject failed: %s", err)
+		}
+
+	case *object.Null:
+		if actual != Null {
+			t.Errorf("object is not Null: %T (%+v)", actual, actual)
+		}
+	}
+}
+
+func testIntegerObject(expected int64, actual object.Object) error {
+	result, ok := actual.(*object.Integer)
+	if !ok {
+		return fmt.Errorf("object is not Integer. got=%T (%+v)", actual, actual)
+	}
+
+	if result.Value != expected {
+		return fmt.Errorf("object has wrong value. got=%d, want=%d", result.Value, expected)
+	}
+
+	return nil
+}
+
+func testBooleanObject(expected bool, actual object.Object) error {
+	result, ok := actual.(*object.Boolean)
+	if !ok {
+		return fmt.Errorf("object is not Boolean. got=%T (%+v)", actual, actual)
+	}
+
+	if result.Value != expected {
+		return fmt.Errorf("object has wrong value. got=%t, want=%t", result.Value, expected)
+	}
+
+	return nil
+}
+
+func testStringObject(expected string, actual object.Object) error {
+	result, ok := actual.(*object.String)
+	if !ok {
+		return fmt.Errorf("object is not String. got=%T (%+v)", actual, actual)
+	}
+
+	if result.Value != expected {
+		return fmt.Errorf("object has wrong value. got=%q, want=%q", result.Value, expected)
+	}
+
+	return nil
+}
@@ -0,0 +1,141 @@
+package vm
+
+import (
+	"fmt"
+
+	"github.com/TheAlchemistKE/helios/internal/code"
+	"github.com/TheAlchemistKE/helios/internal/object"
+)
+
+// executeWide executes the instruction prefixed by the OpWide at ip, whose
+// operands are twice their usual width. The compiler only widens the rare
+// instructions whose operands overflow, so these share a slower, generic
+// decode rather than a case each in Run.
+func (vm *VM) executeWide(ins code.Instructions, ip int) error {
+	def, err := code.LookupWide(ins[ip+1])
+	if err != nil {
+		return err
+	}
+
+	op := code.Opcode(ins[ip+1])
+	operands, read := code.ReadOperands(def, ins[ip+2:])
+	vm.currentFrame().ip += 1 + read
+
+	switch op {
+	case code.OpConstant:
+		return vm.push(vm.constants[operands[0]])
+
+	case code.OpJump:
+		vm.currentFrame().ip = operands[0] - 1
+
+	case code.OpJumpNotTruthy:
+		if !isTruthy(vm.pop()) {
+			vm.currentFrame().ip = operands[0] - 1
+		}
+
+	case code.OpJumpSupplied:
+		if vm.currentFrame().supplied(operands[0]) {
+			vm.currentFrame().ip = operands[1] - 1
+		}
+
+	case code.OpSetGlobal:
+		vm.globals[operands[0]] = vm.pop()
+
+	case code.OpGetGlobal:
+		global, err := vm.global(operands[0])
+		if err != nil {
+			return err
+		}
+		return vm.push(global)
+
+	case code.OpSetLocal:
+		vm.stack[vm.currentFrame().basePointer+operands[0]] = vm.pop()
+
+	case code.OpGetLocal:
+		return vm.push(vm.stack[vm.currentFrame().basePointer+operands[0]])
+
+	case code.OpGetBuiltin:
+		return vm.push(object.Builtins[operands[0]].Builtin)
+
+	case code.OpGetFree:
+		return vm.push(vm.currentFrame().cl.Free[operands[0]])
+
+	case code.OpSetFree:
+		return vm.setFree(operands[0])
+
+	case code.OpArray:
+		return vm.pushArray(operands[0])
+
+	case code.OpHash:
+		return vm.pushHash(operands[0])
+
+	case code.OpCall:
+		return vm.executeCall(operands[0])
+
+	case code.OpTailCall:
+		return vm.executeTailCall(operands[0])
+
+	case code.OpCallKeywords:
+		names := vm.constants[operands[1]].(*object.Array)
+		return vm.executeKeywordCall(operands[0], names)
+
+	case code.OpTailCallKeywords:
+		names := vm.constants[operands[1]].(*object.Array)
+		return vm.executeTailKeywordCall(operands[0], names)
+
+	case code.OpClosure:
+		return vm.pushClosure(operands[0], operands[1])
+
+	case code.OpMatchVariant:
+		return vm.matchVariant(operands[0])
+
+	case code.OpMatchArray:
+		return vm.matchArray(operands[0], operands[1], operands[2] == 1)
+
+	case code.OpMatchHash:
+		return vm.matchHash(operands[0])
+
+	case code.OpSlice:
+		return vm.slice(operands[0])
+
+	case code.OpFail:
+		return fmt.Errorf("%s", vm.constants[operands[0]].Inspect())
+
+	case code.OpGetLocalPair:
+		return vm.pushLocalPair(operands[0], operands[1])
+
+	case code.OpLocalAddConstant, code.OpLocalSubConstant:
+		return vm.executeLocalConstant(op, operands[0], operands[1])
+
+	case code.OpJumpNotGreater, code.OpJumpNotEqual:
+		right := vm.pop()
+		left := vm.pop()
+		return vm.jumpUnlessCompared(op, left, right, operands[0])
+
+	case code.OpJumpLocalsNotGreater:
+		basePointer := vm.currentFrame().basePointer
+		left := vm.stack[basePointer+operands[0]]
+		right := vm.stack[basePointer+operands[1]]
+		return vm.jumpUnlessCompared(op, left, right, operands[2])
+
+	case code.OpReturnLocal:
+		return vm.returnLocal(operands[0])
+
+	case code.OpGetCallerLocal:
+		return vm.push(vm.stack[vm.callerFrame().basePointer+operands[0]])
+
+	case code.OpGetCallerFree:
+		return vm.push(vm.callerFrame().cl.Free[operands[0]])
+
+	case code.OpCheckType:
+		return checkType(vm.stack[vm.sp-1], operands[0])
+
+	case code.OpCheckLocal:
+		return vm.checkParameter(operands[0], operands[1])
+
+	default:
+		return fmt.Errorf("unsupported opcode %s", def.Name)
+	}
+
+	return nil
+}